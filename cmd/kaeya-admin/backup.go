@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+)
+
+const defaultServer = "http://localhost:6666"
+
+// runBackup asks a running server for a backup, either into a directory on the
+// server or as a tar stream into a local file.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	target := fs.String("target", "", "missing or empty directory below the backup root of the server to write the backup into")
+	out := fs.String("out", "", "local tar file to stream the backup into, - for stdout")
+	since := fs.String("since", "", "directory of a previous backup below the backup root of the server, only newer files are backed up")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if (*target == "") == (*out == "") {
+		return fmt.Errorf("exactly one of -target and -out is required: %w", errUsage)
+	}
+
+	if *target != "" {
+		return backupToServerDir(*server, *target, *since)
+	}
+
+	return backupToTar(*server, *out, *since)
+}
+
+func backupToServerDir(server, target, since string) error {
+	body, err := json.Marshal(map[string]string{"target": target, "since": since})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(strings.TrimRight(server, "/")+"/admin/backup", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Code    int          `json:"code"`
+		Message string       `json:"message"`
+		Data    *backup.Meta `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("read response error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || res.Data == nil {
+		return fmt.Errorf("server: %s", res.Message)
+	}
+
+	printBackupMeta(os.Stdout, target, res.Data)
+
+	return nil
+}
+
+func backupToTar(server, out, since string) error {
+	u := strings.TrimRight(server, "/") + "/admin/backup"
+	if since != "" {
+		u += "?since=" + url.QueryEscape(since)
+	}
+
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server: %s %s", resp.Status, msg)
+	}
+
+	w := io.Writer(os.Stdout)
+	if out != "-" {
+		f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return fmt.Errorf("stream backup error: %w", err)
+	}
+
+	return nil
+}
+
+func printBackupMeta(w io.Writer, dir string, meta *backup.Meta) {
+	var size, copied int64
+	files := 0
+	for _, f := range meta.Files {
+		size += f.Size
+		if !f.InBase {
+			copied += f.Size
+			files++
+		}
+	}
+
+	fmt.Fprintf(w, "backup %s created %s\n", dir, meta.Created.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "  files: %d, size: %d bytes, written: %d files, %d bytes\n", len(meta.Files), size, files, copied)
+	if meta.Base != "" {
+		fmt.Fprintf(w, "  base: %s\n", meta.Base)
+	}
+}
+
+// runRestore installs a backup directory or tar file into an empty data directory,
+// then checks the restored storages with the codec settings of the config.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := fs.String("from", "", "backup directory or tar file, - for a tar on stdin")
+	to := fs.String("to", "", "missing or empty directory to restore into, the storage path of the config by default")
+	base := fs.String("base", "", "directory of the base backup of an incremental tar file")
+	check := fs.Bool("check", true, "check the restored storages like fsck")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *from == "" {
+		return fmt.Errorf("-from is required: %w", errUsage)
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if *to == "" {
+		*to = conf.Storage.Path
+	}
+
+	var meta *backup.Meta
+	switch info, statErr := os.Stat(*from); {
+	case *from == "-":
+		meta, err = backup.RestoreTar(os.Stdin, *to, *base)
+	case statErr != nil:
+		return statErr
+	case info.IsDir():
+		meta, err = backup.Restore(*from, *to)
+	default:
+		var f *os.File
+		f, err = os.Open(*from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		meta, err = backup.RestoreTar(f, *to, *base)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %d files into %s\n", len(meta.Files), *to)
+
+	if !*check {
+		return nil
+	}
+
+	root := conf.Storage
+	root.Path = *to
+
+	namespaces, err := application.OfflineNamespaces(root)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, ns := range namespaces {
+		report, err := storage.Check(ns.Storage, false)
+		if err != nil {
+			return fmt.Errorf("check namespace %s error: %w", ns.Name, err)
+		}
+
+		fmt.Printf("namespace %s: %d files, %d records, %d live keys\n", ns.Name, report.Files, report.Records, report.LiveKeys)
+		for _, p := range report.Problems {
+			fmt.Printf("  problem: %s\n", p)
+		}
+
+		failed = failed || !report.OK()
+	}
+
+	if failed {
+		return errCheckFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
+)
+
+const clusterUsage = "cluster [status | add ID RAFT_ADDR | remove ID | snapshot]"
+
+// runCluster shows or changes the members of the raft cluster of a running server,
+// add and remove go to the leader.
+func runCluster(args []string) error {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	nonVoter := fs.Bool("nonvoter", false, "add the member without a vote in elections")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	action := fs.Arg(0)
+	switch {
+	case action == "" || action == "status":
+		var status cluster.Status
+		err = adminRequest(http.MethodGet, *server, "/admin/cluster", nil, &status)
+		if err != nil {
+			return err
+		}
+
+		printClusterStatus(&status)
+		return nil
+	case action == "add" && fs.NArg() == 3:
+		body, _ := json.Marshal(map[string]interface{}{"id": fs.Arg(1), "address": fs.Arg(2), "voter": !*nonVoter})
+		return adminRequest(http.MethodPost, *server, "/admin/cluster/members", body, nil)
+	case action == "remove" && fs.NArg() == 2:
+		return adminRequest(http.MethodDelete, *server, "/admin/cluster/members/"+fs.Arg(1), nil, nil)
+	case action == "snapshot":
+		return adminRequest(http.MethodPost, *server, "/admin/cluster/snapshot", nil, nil)
+	default:
+		return errors.New("usage: " + clusterUsage)
+	}
+}
+
+func adminRequest(method, server, path string, body []byte, data interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(server, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res := struct {
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}{Data: data}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("read response error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server: %s", res.Message)
+	}
+
+	return nil
+}
+
+func printClusterStatus(status *cluster.Status) {
+	fmt.Printf("node: %s\nstate: %s\nleader: %s\nterm: %d\nlast index: %d\napplied index: %d\n",
+		status.ID, status.State, status.Leader, status.Term, status.LastIndex, status.AppliedIndex)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tVOTER\tLEADER")
+	for _, m := range status.Members {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", m.ID, m.Address, m.Voter, m.Leader)
+	}
+	w.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
+)
+
+const dynamoUsage = "dynamo [status | sync]"
+
+// runDynamo shows the leaderless replication of a running server, or runs an anti-entropy sync on it.
+func runDynamo(args []string) error {
+	fs := flag.NewFlagSet("dynamo", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var status dynamo.Status
+	switch fs.Arg(0) {
+	case "", "status":
+		err = adminRequest(http.MethodGet, *server, "/admin/dynamo", nil, &status)
+	case "sync":
+		err = adminRequest(http.MethodPost, *server, "/admin/dynamo/sync", nil, &status)
+	default:
+		return errors.New("usage: " + dynamoUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("self: %s\nreplicas: %d\nread quorum: %d\nwrite quorum: %d\nread repairs: %d\nsynced: %d\n",
+		status.Self, status.Replicas, status.ReadQuorum, status.WriteQuorum, status.ReadRepairs, status.Synced)
+	if !status.LastSync.IsZero() {
+		fmt.Printf("last sync: %s\n", status.LastSync.Format(time.RFC3339))
+	}
+	if status.Error != "" {
+		fmt.Printf("error: %s\n", status.Error)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL")
+	for _, m := range status.Members {
+		fmt.Fprintf(w, "%s\t%s\n", m.Name, m.URL)
+	}
+	w.Flush()
+
+	return nil
+}
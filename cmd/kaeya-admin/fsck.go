@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+)
+
+var errCheckFailed = errors.New("problems found")
+
+// runFsck checks the storage of every namespace, the server must be stopped.
+func runFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "truncate torn tails, quarantine unreadable segments and rewrite the segment set")
+	namespace := fs.String("ns", "", "check only this namespace")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	namespaces, err := application.OfflineNamespaces(conf.Storage)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, ns := range namespaces {
+		if *namespace != "" && ns.Name != *namespace {
+			continue
+		}
+
+		fmt.Printf("namespace %s (%s) %s\n", ns.Name, ns.Storage.System, ns.Storage.Path)
+
+		report, err := storage.Check(ns.Storage, *repair)
+		if err != nil {
+			fmt.Printf("  error: %v\n", err)
+			failed = true
+			continue
+		}
+
+		fmt.Printf("  files: %d, records: %d, live keys: %d, garbage: %.1f%%\n",
+			report.Files, report.Records, report.LiveKeys, report.GarbageRatio()*100)
+
+		for _, r := range report.Repairs {
+			fmt.Printf("  repaired: %s\n", r)
+		}
+
+		for _, p := range report.Problems {
+			fmt.Printf("  problem: %s\n", p)
+		}
+
+		failed = failed || !report.OK()
+	}
+
+	if failed {
+		return errCheckFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+)
+
+// runBuild writes JSON lines or CSV into a segment file sorted by key, with the codec,
+// compression and encryption of the namespace, ready for ingest.
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace whose storage settings are used")
+	format := fs.String("format", "", "jsonl or csv, by the file extension by default")
+	in := fs.String("in", "-", "file to read from, - for stdin")
+	out := fs.String("out", "", "segment file to write")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return fmt.Errorf("-out is required: %w", errUsage)
+	}
+
+	f, err := transfer.ParseFormat(inputFormat(*format, *in))
+	if err != nil {
+		return err
+	}
+
+	conf, err := offlineStorage(*namespace)
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+	}
+
+	kvs, err := transfer.NewReader(f, r)
+	if err != nil {
+		return err
+	}
+
+	n, err := storage.BuildSegment(conf, *out, kvs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "built %s with %d keys\n", *out, n)
+
+	return nil
+}
+
+// inputFormat is format, or the format of the file extension of in if format is empty.
+func inputFormat(format, in string) string {
+	if format != "" {
+		return format
+	}
+
+	if strings.EqualFold(filepath.Ext(in), ".csv") {
+		return string(transfer.FormatCSV)
+	}
+
+	return string(transfer.FormatJSONL)
+}
+
+// runIngest asks a running server to ingest segment files built by build.
+// The files are named relative to the ingest root of the server.
+func runIngest(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	precedence := fs.String("precedence", "", "newest to win over the existing data, oldest to lose, the configured one by default")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: ingest [flags] <segment file below the ingest root>...: %w", errUsage)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"namespace":  *namespace,
+		"files":      fs.Args(),
+		"precedence": *precedence,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(strings.TrimRight(*server, "/")+"/admin/ingest", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Message string `json:"message"`
+		Data    *struct {
+			Records int `json:"records"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("read response error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || res.Data == nil {
+		return fmt.Errorf("server: %s", res.Message)
+	}
+
+	fmt.Printf("ingested %d files with %d records\n", fs.NArg(), res.Data.Records)
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+)
+
+var errUsage = errors.New("wrong arguments")
+
+// record is a dumped record, values which are not valid utf8 are base64 encoded.
+type record struct {
+	transfer.Record
+	// the value is a pointer into the value log
+	ValueLog bool `json:"value_log,omitempty"`
+}
+
+func newRecord(kv domain.KV) record {
+	return record{
+		Record:   transfer.NewRecord(kv),
+		ValueLog: mananger.InValueLog(kv),
+	}
+}
+
+// offlineStorage returns the storage config of a namespace of the stopped server.
+func offlineStorage(namespace string) (config.StorageConfig, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return config.StorageConfig{}, err
+	}
+
+	namespaces, err := application.OfflineNamespaces(conf.Storage)
+	if err != nil {
+		return config.StorageConfig{}, err
+	}
+
+	for _, ns := range namespaces {
+		if ns.Name == namespace {
+			return ns.Storage, nil
+		}
+	}
+
+	return config.StorageConfig{}, fmt.Errorf("namespace %s: %w", namespace, application.ErrNamespaceNotFound)
+}
+
+func openInspector(namespace string) (*mananger.Inspector, error) {
+	conf, err := offlineStorage(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.InspectSegments(conf)
+}
+
+// runLs lists the segments of a namespace in the search order of reads.
+func runLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	inspector, err := openInspector(*namespace)
+	if err != nil {
+		return err
+	}
+	defer inspector.Close()
+
+	segments, err := inspector.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILE\tVERSION\tSIZE\tRECORDS\tMIN KEY\tMAX KEY\tCOMPRESSION\tKEY ID")
+	for _, s := range segments {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%q\t%q\t%s\t%d\n",
+			s.ID, s.File, s.Version, s.Size, s.Records, s.MinKey, s.MaxKey, s.Compression, s.KeyID)
+	}
+
+	return w.Flush()
+}
+
+// runDump writes the records of a segment as JSON lines from the newest.
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: dump [-ns namespace] <segment id or file>: %w", errUsage)
+	}
+
+	inspector, err := openInspector(*namespace)
+	if err != nil {
+		return err
+	}
+	defer inspector.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+
+	return inspector.Dump(fs.Arg(0), func(kv domain.KV) error {
+		return enc.Encode(newRecord(kv))
+	})
+}
+
+// runLocate prints the segment holding the winning version of a key.
+func runLocate(args []string) error {
+	fs := flag.NewFlagSet("locate", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: locate [-ns namespace] <key>: %w", errUsage)
+	}
+
+	inspector, err := openInspector(*namespace)
+	if err != nil {
+		return err
+	}
+	defer inspector.Close()
+
+	info, kv, err := inspector.Locate(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(struct {
+		Segment mananger.SegmentInfo `json:"segment"`
+		Record  record               `json:"record"`
+	}{info, newRecord(kv)})
+}
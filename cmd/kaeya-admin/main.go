@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "upgrade",
+		usage: "rewrite legacy segment files of every storage into the current format",
+		run:   runUpgrade,
+	},
+	{
+		name:  "fsck",
+		usage: "check the data files of every storage offline, -repair fixes what can be fixed",
+		run:   runFsck,
+	},
+	{
+		name:  "ls",
+		usage: "list the segments of a namespace with sizes, record counts and key ranges",
+		run:   runLs,
+	},
+	{
+		name:  "dump",
+		usage: "write the records of a segment as JSON lines",
+		run:   runDump,
+	},
+	{
+		name:  "locate",
+		usage: "find the segment holding the winning version of a key",
+		run:   runLocate,
+	},
+	{
+		name:  "export",
+		usage: "write every key of a namespace as JSON lines or CSV",
+		run:   runExport,
+	},
+	{
+		name:  "import",
+		usage: "bulk load JSON lines or CSV into a namespace",
+		run:   runImport,
+	},
+	{
+		name:  "build",
+		usage: "build a segment file sorted by key from JSON lines or CSV, for ingest",
+		run:   runBuild,
+	},
+	{
+		name:  "ingest",
+		usage: "add segment files built by build to a namespace of a running server",
+		run:   runIngest,
+	},
+	{
+		name:  "backup",
+		usage: "take a backup of a running server into a directory on the server or a local tar file",
+		run:   runBackup,
+	},
+	{
+		name:  "restore",
+		usage: "install a backup directory or tar file into an empty data directory",
+		run:   runRestore,
+	},
+	{
+		name:  "replication",
+		usage: "show the role of a running server and the replication lag of a follower",
+		run:   runReplication,
+	},
+	{
+		name:  "promote",
+		usage: "make a follower stop replicating its leader and accept writes",
+		run:   runPromote,
+	},
+	{
+		name:  "cluster",
+		usage: clusterUsage + ": show or change the members of the raft cluster of a running server",
+		run:   runCluster,
+	},
+	{
+		name:  "shards",
+		usage: shardsUsage + ": show the shard topology of a running server or rebalance to a new one",
+		run:   runShards,
+	},
+	{
+		name:  "dynamo",
+		usage: dynamoUsage + ": show the leaderless replication of a running server or repair its replicas now",
+		run:   runDynamo,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+
+		err := cmd.run(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: kaeya-admin <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// loadConfig reads the configuration from the config directory like kaeya-server.
+func loadConfig() (config.KaeyaConfig, error) {
+	conf, err := config.ProvideConfig()
+	if err != nil {
+		return conf, err
+	}
+
+	err = logger.InitZerolog(conf.Log.Level)
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+)
+
+// runReplication prints the role of a running server and the lag of every replicated namespace.
+func runReplication(args []string) error {
+	fs := flag.NewFlagSet("replication", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	status, err := replicationRequest(http.MethodGet, *server, "/admin/replication")
+	if err != nil {
+		return err
+	}
+
+	printReplicationStatus(status)
+
+	return nil
+}
+
+// runPromote makes a follower stop replicating and accept writes.
+func runPromote(args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the follower")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	status, err := replicationRequest(http.MethodPost, *server, "/admin/promote")
+	if err != nil {
+		return err
+	}
+
+	printReplicationStatus(status)
+
+	return nil
+}
+
+func replicationRequest(method, server, path string) (*application.ReplicationStatus, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(server, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Code    int                            `json:"code"`
+		Message string                         `json:"message"`
+		Data    *application.ReplicationStatus `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("read response error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || res.Data == nil {
+		return nil, fmt.Errorf("server: %s", res.Message)
+	}
+
+	return res.Data, nil
+}
+
+func printReplicationStatus(status *application.ReplicationStatus) {
+	fmt.Printf("role: %s\n", status.Role)
+	if status.Leader != "" {
+		fmt.Printf("leader: %s\n", status.Leader)
+	}
+
+	if len(status.Streams) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tCONNECTED\tAPPLIED\tLEADER\tLAG\tLAST CONTACT\tERROR")
+	for _, s := range status.Streams {
+		contact := "-"
+		if !s.LastContact.IsZero() {
+			contact = time.Since(s.LastContact).Round(time.Millisecond).String() + " ago"
+		}
+
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\t%s\t%s\n",
+			s.Namespace, s.Connected, s.Applied, s.LeaderSequence, s.Lag, contact, s.Error)
+	}
+	w.Flush()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+)
+
+const shardsUsage = "shards [status | owner KEY | topology FILE]"
+
+// runShards shows the shard topology of a running server, or sends it a new topology
+// from a json file like {"version": 2, "members": [{"name": "a", "url": "http://..."}]}.
+func runShards(args []string) error {
+	fs := flag.NewFlagSet("shards", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "address of the running server")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	action := fs.Arg(0)
+	switch {
+	case action == "" || action == "status":
+		var status sharding.Status
+		err = adminRequest(http.MethodGet, *server, "/admin/shards", nil, &status)
+		if err != nil {
+			return err
+		}
+
+		printShardStatus(&status)
+		return nil
+	case action == "owner" && fs.NArg() == 2:
+		var owner sharding.Member
+		err = adminRequest(http.MethodGet, *server, "/admin/shards/owner?key="+url.QueryEscape(fs.Arg(1)), nil, &owner)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s %s\n", owner.Name, owner.URL)
+		return nil
+	case action == "topology" && fs.NArg() == 2:
+		body, err := os.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+
+		var status sharding.Status
+		err = adminRequest(http.MethodPost, *server, "/admin/shards/topology", body, &status)
+		if err != nil {
+			return err
+		}
+
+		printShardStatus(&status)
+		return nil
+	default:
+		return errors.New("usage: " + shardsUsage)
+	}
+}
+
+func printShardStatus(status *sharding.Status) {
+	fmt.Printf("self: %s\nversion: %d\nrebalancing: %t\nmoved: %d\n",
+		status.Self, status.Topology.Version, status.Rebalancing, status.Moved)
+	if len(status.Pending) > 0 {
+		fmt.Printf("pending: %s\n", strings.Join(status.Pending, ", "))
+	}
+	if status.Error != "" {
+		fmt.Printf("error: %s\n", status.Error)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL")
+	for _, m := range status.Topology.Members {
+		fmt.Fprintf(w, "%s\t%s\n", m.Name, m.URL)
+	}
+	w.Flush()
+}
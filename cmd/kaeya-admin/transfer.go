@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+)
+
+// runExport writes every kv of a namespace as JSON lines or CSV, from the storage of the
+// stopped server or from a running one with -server.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	prefix := fs.String("prefix", "", "export only the keys starting with prefix")
+	format := fs.String("format", string(transfer.FormatJSONL), "jsonl or csv")
+	out := fs.String("out", "-", "file to write into, - for stdout")
+	server := fs.String("server", "", "address of a running server to export from")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	f, err := transfer.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		file, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		w = file
+	}
+
+	if *server != "" {
+		query := url.Values{"format": {string(f)}, "prefix": {*prefix}}
+
+		resp, err := http.Get(transferURL(*server, *namespace, "export") + "?" + query.Encode())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("server: %s %s", resp.Status, msg)
+		}
+
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+
+	conf, err := offlineStorage(*namespace)
+	if err != nil {
+		return err
+	}
+
+	repo, err := storage.NewStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	// the service skips deleted keys
+	db := service.NewDefaultDBService(repo)
+	defer db.Close(context.Background())
+
+	n, err := transfer.Export(f, w, func(fn func(kv domain.KV) error) error {
+		return db.Scan(context.Background(), *prefix, fn)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", n)
+
+	return nil
+}
+
+// runImport bulk loads JSON lines or CSV into a namespace, of the stopped server or of a
+// running one with -server. With another storage system than the source, this migrates data.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	namespace := fs.String("ns", application.DefaultNamespace, "namespace")
+	format := fs.String("format", "", "jsonl or csv, by the file extension by default")
+	in := fs.String("in", "-", "file to read from, - for stdin")
+	server := fs.String("server", "", "address of a running server to import into")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	f, err := transfer.ParseFormat(inputFormat(*format, *in))
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+	}
+
+	if *server != "" {
+		return importToServer(*server, *namespace, f, r)
+	}
+
+	conf, err := offlineStorage(*namespace)
+	if err != nil {
+		return err
+	}
+
+	repo, err := storage.NewStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	kvs, err := transfer.NewReader(f, r)
+	if err != nil {
+		repo.Close(context.Background())
+		return err
+	}
+
+	n, err := repo.Import(context.Background(), kvs)
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", n)
+
+	closeErr := repo.Close(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func importToServer(server, namespace string, format transfer.Format, r io.Reader) error {
+	resp, err := http.Post(transferURL(server, namespace, "import"), format.ContentType(), r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Message string `json:"message"`
+		Data    *struct {
+			Imported int `json:"imported"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("read response error: %w", err)
+	}
+
+	if res.Data != nil {
+		fmt.Fprintf(os.Stderr, "imported %d keys\n", res.Data.Imported)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server: %s", res.Message)
+	}
+
+	return nil
+}
+
+func transferURL(server, namespace, op string) string {
+	u := strings.TrimRight(server, "/")
+	if namespace != application.DefaultNamespace {
+		u += "/ns/" + url.PathEscape(namespace)
+	}
+
+	return u + "/" + op
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+)
+
+// runUpgrade opens every storage with legacy upgrade enabled, the server must be stopped.
+func runUpgrade(args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	conf.Storage.Segment.UpgradeLegacy = true
+	for name, ns := range conf.Namespaces {
+		ns.Segment.UpgradeLegacy = true
+		conf.Namespaces[name] = ns
+	}
+
+	app, err := application.NewApplication(conf)
+	if err != nil {
+		return err
+	}
+
+	err = app.Close(context.Background())
+	if err != nil {
+		return err
+	}
+
+	logger.Logger.Info().Msg("upgrade finished")
+
+	return nil
+}
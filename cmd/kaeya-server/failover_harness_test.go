@@ -0,0 +1,213 @@
+//go:build harness
+
+// The failover harness runs kaeya-server processes on local ports:
+//
+//	go test -tags harness -run TestFailover -v ./cmd/kaeya-server/
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/stretchr/testify/assert"
+)
+
+const waitTimeout = 15 * time.Second
+
+type process struct {
+	name string
+	url  string
+	cmd  *exec.Cmd
+}
+
+func buildServer(t *testing.T) string {
+	bin := path.Join(t.TempDir(), "kaeya-server")
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build kaeya-server: %s %s", err, out)
+	}
+
+	return bin
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// start runs the server in dir, following leader if it is not empty.
+func start(t *testing.T, bin, dir, name, leader string) *process {
+	addr := freeAddr(t)
+
+	conf := fmt.Sprintf(`log:
+  level: info
+server:
+  addr: %s
+storage:
+  system: segment
+  segment:
+    refresh_interval: 100ms
+`, addr)
+	if leader != "" {
+		conf += fmt.Sprintf("replication:\n  leader: %s\n  retry_interval: 100ms\n", leader)
+	}
+
+	root := path.Join(dir, name)
+	assert.NoError(t, os.MkdirAll(path.Join(root, "config"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(root, "config", "config.yaml"), []byte(conf), 0644))
+
+	logFile, err := os.OpenFile(path.Join(root, "server.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+
+	cmd := exec.Command(bin)
+	cmd.Dir = root
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	assert.NoError(t, cmd.Start())
+
+	p := &process{name: name, url: "http://" + addr, cmd: cmd}
+	t.Cleanup(func() {
+		p.kill()
+		logFile.Close()
+	})
+
+	eventually(t, func() bool {
+		_, err := p.replication()
+		return err == nil
+	}, name+" started")
+
+	return p
+}
+
+func (p *process) kill() {
+	if p.cmd.ProcessState == nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	}
+}
+
+func (p *process) do(method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, p.url+path, strings.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func (p *process) get(key string) (int, string) {
+	return p.do(http.MethodGet, "/kv/"+key+"?raw=1", "")
+}
+
+func (p *process) replication() (application.ReplicationStatus, error) {
+	var res struct {
+		Data application.ReplicationStatus `json:"data"`
+	}
+
+	code, body := p.do(http.MethodGet, "/admin/replication", "")
+	if code != http.StatusOK {
+		return res.Data, fmt.Errorf("%d %s", code, body)
+	}
+
+	err := json.Unmarshal([]byte(body), &res)
+	return res.Data, err
+}
+
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for: %s", msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	bin := buildServer(t)
+	dir := t.TempDir()
+
+	leader := start(t, bin, dir, "node-a", "")
+	for i := 0; i < 20; i++ {
+		code, body := leader.do(http.MethodPut, fmt.Sprintf("/kv/key-%d", i), fmt.Sprint(i))
+		assert.Equal(t, http.StatusOK, code, body)
+	}
+
+	follower := start(t, bin, dir, "node-b", leader.url)
+	eventually(t, func() bool {
+		code, value := follower.get("key-19")
+		return code == http.StatusOK && value == "19"
+	}, "initial copy")
+
+	code, _ := follower.do(http.MethodPut, "/kv/key-0", "x")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// the stream after the copy
+	code, _ = leader.do(http.MethodPut, "/kv/key-20", "20")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = leader.do(http.MethodDelete, "/kv/key-0", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	eventually(t, func() bool {
+		code, _ := follower.get("key-0")
+		return code == http.StatusNotFound
+	}, "stream applied")
+
+	code, value := follower.get("key-20")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "20", value)
+
+	status, err := follower.replication()
+	assert.NoError(t, err)
+	assert.Equal(t, application.RoleFollower, status.Role)
+	assert.Equal(t, uint64(0), status.Streams[0].Lag)
+
+	// the leader fails, the follower takes over
+	leader.kill()
+	eventually(t, func() bool {
+		status, err := follower.replication()
+		return err == nil && !status.Streams[0].Connected
+	}, "follower disconnected")
+
+	code, body := follower.do(http.MethodPost, "/admin/promote", "")
+	assert.Equal(t, http.StatusOK, code, body)
+
+	code, _ = follower.do(http.MethodPut, "/kv/key-21", "21")
+	assert.Equal(t, http.StatusOK, code)
+
+	status, err = follower.replication()
+	assert.NoError(t, err)
+	assert.Equal(t, application.RoleLeader, status.Role)
+
+	// the old leader comes back as a follower of the new one
+	old := start(t, bin, dir, "node-a", follower.url)
+	eventually(t, func() bool {
+		code, value := old.get("key-21")
+		return code == http.StatusOK && value == "21"
+	}, "old leader caught up")
+
+	code, _ = old.get("key-0")
+	assert.Equal(t, http.StatusNotFound, code)
+}
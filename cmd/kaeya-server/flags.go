@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+)
+
+// configFlags are the command line flags of the common settings, a flag which is set
+// wins over the config file and the KAEYA_* environment variables.
+var configFlags = []struct {
+	name  string
+	key   string
+	usage string
+}{
+	{"addr", "server.addr", "address of the rest api, like :6666"},
+	{"data", "storage.path", "directory of the data files"},
+	{"system", "storage.system", "storage system, fs or segment"},
+	{"log-level", "log.level", "log level, debug, info, warn or error"},
+}
+
+// parseConfigFlags returns the options to load the config with from the command line args.
+func parseConfigFlags(name string, args []string) ([]config.Option, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	file := fs.String("config", "", "config file, the config directory or "+config.FileEnv+" by default")
+	for _, f := range configFlags {
+		fs.String(f.name, "", f.usage)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %s", fs.Arg(0))
+	}
+
+	overrides := make(map[string]string)
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range configFlags {
+			if f.name == fl.Name {
+				overrides[f.key] = fl.Value.String()
+			}
+		}
+	})
+
+	options := []config.Option{config.WithOverrides(overrides)}
+	if *file != "" {
+		options = append(options, config.WithFile(*file))
+	}
+
+	return options, nil
+}
+
+// runConfig is the config subcommand, "config print" writes the effective config
+// merged from the defaults, the file, the environment and the flags.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: kaeya-server config print [flags]")
+	}
+
+	options, err := parseConfigFlags("config print", args[1:])
+	if err != nil {
+		return err
+	}
+
+	conf, err := config.ProvideConfig(options...)
+	if err != nil {
+		return err
+	}
+
+	out, err := config.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+
+	return err
+}
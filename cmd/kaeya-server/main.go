@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,28 +14,65 @@ import (
 	"github.com/ForeverSRC/kaeya/pkg/application"
 	"github.com/ForeverSRC/kaeya/pkg/config"
 	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
 )
 
 func main() {
-	conf := initGlobalDependency()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	app, err := application.NewApplication(conf)
+	options, err := parseConfigFlags("kaeya-server", os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	conf := initGlobalDependency(options)
+
+	shutdownTracing, err := tracing.Setup(conf.Tracing)
 	if err != nil {
 		panic(err)
 	}
 
-	server := rest.CreateHttpServer(app)
+	server, err := rest.CreateHttpServer(conf.Server)
+	if err != nil {
+		panic(err)
+	}
 
+	// the probes are answered while the storage loads
 	go func() {
-		if err = server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Logger.Error().Err(err).Msg("http server serve error")
 		}
 	}()
 
+	app, err := application.NewApplication(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(app)
+	logger.Logger.Info().Str("addr", conf.Server.Addr).Msg("application ready")
+
+	err = config.WatchConfig(func(conf config.KaeyaConfig, err error) {
+		reload(app, conf, err)
+	}, options...)
+	if err != nil {
+		logger.Logger.Warn().Err(err).Msg("watch config file error, reload by SIGHUP only")
+	}
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-sig
+	for s := <-sig; s == syscall.SIGHUP; s = <-sig {
+		conf, err := config.ProvideConfig(options...)
+		reload(app, conf, err)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -47,12 +85,30 @@ func main() {
 		logger.Logger.Error().Err(err).Msg("application shutdown error")
 	}
 
+	if err = shutdownTracing(ctx); err != nil {
+		logger.Logger.Error().Err(err).Msg("tracing shutdown error")
+	}
+
 	logger.Logger.Info().Msg("application closed")
 
 }
 
-func initGlobalDependency() config.KaeyaConfig {
-	conf, err := config.ProvideConfig()
+// reload applies the config loaded again while serving, see application.Reload.
+func reload(app *application.Application, conf config.KaeyaConfig, err error) {
+	if err == nil {
+		err = app.Reload(conf)
+	}
+
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("config reload rejected")
+		return
+	}
+
+	logger.Logger.Info().Msg("config reloaded")
+}
+
+func initGlobalDependency(options []config.Option) config.KaeyaConfig {
+	conf, err := config.ProvideConfig(options...)
 	if err != nil {
 		panic(err)
 	}
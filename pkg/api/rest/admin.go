@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
+	"github.com/gin-gonic/gin"
+)
+
+// Status reports the storage engines: their segments, write buffers, last background jobs and the uptime.
+func Status(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, NewSuccessResponse("", app.Status()))
+	}
+}
+
+// RunJob runs a storage job of the namespace in ?ns= now and reports its outcome,
+// a merge with ?full=1 compacts all segments into one.
+func RunJob(app *application.Application, job string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		j := job
+		if j == metrics.JobMerge && isFull(c) {
+			j = metrics.JobCompact
+		}
+
+		status, err := app.RunJob(c.DefaultQuery("ns", application.DefaultNamespace), j)
+		switch {
+		case err == nil:
+		case status.Error != "":
+			// the job ran and failed, its duration is reported too
+			c.JSON(http.StatusInternalServerError, Response{Code: CodeInternalError, Message: err.Error(), Data: status})
+			return
+		default:
+			respondJobError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", status))
+	}
+}
+
+// PauseMerges stops or restarts the background merges of the namespace in ?ns=,
+// merges run by RunJob are not affected.
+func PauseMerges(app *application.Application, paused bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := app.PauseMerges(c.DefaultQuery("ns", application.DefaultNamespace), paused)
+		if err != nil {
+			respondJobError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	}
+}
+
+func isFull(c *gin.Context) bool {
+	switch c.Query("full") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+func respondJobError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, application.ErrNamespaceNotFound):
+		c.JSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+	case errors.Is(err, storage.ErrJobsUnsupported), errors.Is(err, segment.ErrUnknownJob):
+		c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+	}
+}
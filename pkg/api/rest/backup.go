@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+	"github.com/gin-gonic/gin"
+)
+
+const tarContentType = "application/x-tar"
+
+// Backup writes a backup into a directory below the backup root of the server and returns its meta.
+func Backup(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BackupRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		meta, err := app.Backup(c.Request.Context(), req.Target, req.Since)
+		if err != nil {
+			switch {
+			case errors.Is(err, backup.ErrNotEmpty):
+				c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			case errors.Is(err, backup.ErrBackupFormat), errors.Is(err, application.ErrBackupPath):
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			default:
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", meta))
+	}
+}
+
+// BackupTar streams a backup as a tar archive, ?since= names a backup directory below the backup root.
+func BackupTar(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Disposition", `attachment; filename="kaeya-backup.tar"`)
+		c.Header("Content-Type", tarContentType)
+
+		_, err := app.BackupTar(c.Request.Context(), c.Writer, c.Query("since"))
+		if err == nil {
+			return
+		}
+
+		// once the stream has started, a failure can only cut it
+		if c.Writer.Written() {
+			logger.Logger.Error().Err(err).Msg("stream backup error")
+			c.Abort()
+			return
+		}
+
+		c.Header("Content-Disposition", "")
+		c.Header("Content-Type", "")
+		if errors.Is(err, backup.ErrBackupFormat) || errors.Is(err, application.ErrBackupPath) {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+		} else {
+			c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+		}
+	}
+}
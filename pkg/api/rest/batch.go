@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/gin-gonic/gin"
+)
+
+// Batch applies puts and deletes in order, without other writes in between.
+func Batch() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		ops := make([]service.Op, 0, len(req.Ops))
+		for i, op := range req.Ops {
+			version, err := domain.ParseVersion(op.Version)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, fmt.Sprintf("op %d: %s", i, err.Error())))
+				return
+			}
+
+			if op.Op == string(service.EventDelete) {
+				ops = append(ops, service.Op{Type: service.EventDelete, KV: domain.KV{Key: op.Key, Version: version}})
+				continue
+			}
+
+			kv, err := decodeKV(op.Key, op.Value, op.Encoding, op.ContentType, op.Flags)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, fmt.Sprintf("op %d: %s", i, err.Error())))
+				return
+			}
+			kv.Version = version
+			ops = append(ops, service.Op{Type: service.EventPut, KV: kv})
+		}
+
+		err := dbFromContext(c).Batch(c.Request.Context(), ops)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	}
+}
@@ -0,0 +1,81 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
+	"github.com/gin-gonic/gin"
+)
+
+// withCluster runs fn with the raft member of the application, 409 if it runs alone.
+func withCluster(app *application.Application, fn func(c *gin.Context, node *cluster.Node)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		node, err := app.Cluster()
+		if err != nil {
+			c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			return
+		}
+
+		fn(c, node)
+	}
+}
+
+// ClusterStatus reports the raft state of this member and the members of the cluster.
+func ClusterStatus(app *application.Application) gin.HandlerFunc {
+	return withCluster(app, func(c *gin.Context, node *cluster.Node) {
+		status, err := node.Status()
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", status))
+	})
+}
+
+// AddMember adds a member to the cluster, only on the leader.
+func AddMember(app *application.Application) gin.HandlerFunc {
+	return withCluster(app, func(c *gin.Context, node *cluster.Node) {
+		var req AddMemberRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		err := node.AddMember(req.ID, req.Address, req.Voter)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	})
+}
+
+// RemoveMember removes :id from the cluster, only on the leader.
+func RemoveMember(app *application.Application) gin.HandlerFunc {
+	return withCluster(app, func(c *gin.Context, node *cluster.Node) {
+		err := node.RemoveMember(c.Param("id"))
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	})
+}
+
+// ClusterSnapshot takes a raft snapshot on this member.
+func ClusterSnapshot(app *application.Application) gin.HandlerFunc {
+	return withCluster(app, func(c *gin.Context, node *cluster.Node) {
+		err := node.Snapshot()
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	})
+}
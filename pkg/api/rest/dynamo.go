@@ -0,0 +1,166 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
+	"github.com/gin-gonic/gin"
+)
+
+// Quorum sets the read and write quorums of the request from ?r= and ?w=, the configured
+// ones are used for the missing ones. They only apply in leaderless replication mode.
+func Quorum() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, err := parseQuorum(c.Query("r"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "r: "+err.Error()))
+			return
+		}
+
+		w, err := parseQuorum(c.Query("w"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "w: "+err.Error()))
+			return
+		}
+
+		if r != 0 || w != 0 {
+			c.Request = c.Request.WithContext(dynamo.WithQuorum(c.Request.Context(), r, w))
+		}
+	}
+}
+
+func parseQuorum(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	q, err := strconv.Atoi(s)
+	if err != nil || q < 1 {
+		return 0, errors.New("invalid quorum " + s)
+	}
+
+	return q, nil
+}
+
+// withDynamo runs fn with the leaderless replica set of the application, 409 if it runs alone.
+func withDynamo(app *application.Application, fn func(c *gin.Context, node *dynamo.Node)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		node, err := app.Dynamo()
+		if err != nil {
+			c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			return
+		}
+
+		fn(c, node)
+	}
+}
+
+// DynamoStatus reports the quorums, the members and the repairs of this member.
+func DynamoStatus(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		c.JSON(http.StatusOK, NewSuccessResponse("", node.Status()))
+	})
+}
+
+// DynamoSync runs an anti-entropy sync with every other member now.
+func DynamoSync(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		err := node.Sync(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusBadGateway, Response{Code: CodeInternalError, Message: err.Error(), Data: node.Status()})
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", node.Status()))
+	})
+}
+
+// Coordinate applies a write sent by a member which does not replicate its key.
+func Coordinate(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		var req dynamo.Write
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		err := node.Coordinate(c.Request.Context(), req)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	})
+}
+
+// Replica returns the replica of ?key= stored here, with its siblings and version.
+func Replica(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		kv, err := node.Replica(c.Request.Context(), c.Query("key"))
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", kv))
+	})
+}
+
+// StoreReplicas merges the replicas sent by a member into the ones stored here.
+func StoreReplicas(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		n, err := node.Store(c.Request.Context(), dynamo.NewReader(c.Request.Body))
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", ImportResponse{Imported: n}))
+	})
+}
+
+// ReplicaTree returns the merkle tree of the replicas shared with ?peer=.
+func ReplicaTree(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		tree, err := node.Tree(c.Request.Context(), c.Query("peer"))
+		if err != nil {
+			respondDynamoError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", tree))
+	})
+}
+
+// ReplicaBuckets returns the replicas shared with ?peer= in the tree ?buckets=, comma separated.
+func ReplicaBuckets(app *application.Application) gin.HandlerFunc {
+	return withDynamo(app, func(c *gin.Context, node *dynamo.Node) {
+		buckets, err := dynamo.ParseBuckets(c.Query("buckets"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		kvs, err := node.Buckets(c.Request.Context(), c.Query("peer"), buckets)
+		if err != nil {
+			respondDynamoError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", kvs))
+	})
+}
+
+func respondDynamoError(c *gin.Context, err error) {
+	if errors.Is(err, dynamo.ErrMember) {
+		c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+		return
+	}
+
+	respondDBError(c, err)
+}
@@ -1,14 +1,46 @@
 package rest
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
 	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
 	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
 	"github.com/gin-gonic/gin"
 )
 
-func Set(db service.DBService) gin.HandlerFunc {
+const (
+	dbContextKey      = "kaeya.db"
+	releaseContextKey = "kaeya.db.release"
+
+	defaultRawContentType = "application/octet-stream"
+	flagsHeader           = "X-Kaeya-Flags"
+	versionHeader         = "X-Kaeya-Version"
+
+	maxRawBodySize = 64 << 20
+)
+
+// WithDB makes every handler in the chain operate on db.
+func WithDB(db service.DBService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(dbContextKey, db)
+	}
+}
+
+func dbFromContext(c *gin.Context) service.DBService {
+	return c.MustGet(dbContextKey).(service.DBService)
+}
+
+func Set() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req SetKVRequest
 
@@ -17,37 +49,253 @@ func Set(db service.DBService) gin.HandlerFunc {
 			return
 		}
 
+		kv, err := decodeKV(req.Key, req.Value, req.Encoding, req.ContentType, req.Flags)
+		if err == nil {
+			kv.Version, err = domain.ParseVersion(req.Version)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		err = dbFromContext(c).Set(c.Request.Context(), kv)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+
+	}
+}
+
+// Put stores the raw request body as the value of :key, keeping its Content-Type.
+// User flags can be given by the X-Kaeya-Flags header, the version read by the X-Kaeya-Version one.
+func Put() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if key == "" {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "empty key"))
+			return
+		}
+
+		flags, err := parseFlags(c.GetHeader(flagsHeader))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		version, err := domain.ParseVersion(c.GetHeader(versionHeader))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		body, err := readRawBody(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
 		kv := domain.KV{
-			Key:   req.Key,
-			Value: req.Value,
+			Key:         key,
+			Value:       body,
+			ContentType: c.GetHeader("Content-Type"),
+			Flags:       flags,
+			Version:     version,
 		}
 
-		err := db.Set(c.Request.Context(), kv)
+		err = dbFromContext(c).Set(c.Request.Context(), kv)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			respondDBError(c, err)
 			return
 		}
 
 		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	}
+}
+
+// Get returns the kv as json, or the raw value with its Content-Type if ?raw=1. A raw
+// read of concurrent values answers 300 with them as json.
+func Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if key == "" {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "empty key"))
+			return
+		}
+
+		kv, err := dbFromContext(c).Get(c.Request.Context(), key)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+
+		if kv.Version != nil {
+			c.Header(versionHeader, kv.Version.String())
+		}
+
+		if isRaw(c) && len(kv.Siblings) > 0 {
+			c.JSON(http.StatusMultipleChoices, NewSuccessResponse("", NewKVResponse(kv)))
+			return
+		}
+
+		if isRaw(c) {
+			contentType := kv.ContentType
+			if contentType == "" {
+				contentType = defaultRawContentType
+			}
+
+			if kv.Flags != 0 {
+				c.Header(flagsHeader, strconv.FormatUint(uint64(kv.Flags), 10))
+			}
+
+			c.Data(http.StatusOK, contentType, kv.Value)
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", NewKVResponse(kv)))
 
 	}
 }
 
-func Get(db service.DBService) gin.HandlerFunc {
+// Head reports whether :key exists without returning the value.
+func Head() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := dbFromContext(c).Get(c.Request.Context(), c.Param("key"))
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.Status(http.StatusNotFound)
+			} else if errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, dynamo.ErrQuorum) {
+				c.Status(http.StatusServiceUnavailable)
+			} else {
+				c.Status(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+// Delete removes :key, deleting a missing key succeeds as well. Storages with the csv
+// codec cannot hold deletes. In leaderless replication mode the X-Kaeya-Version header
+// limits the delete to the values of the version read.
+func Delete() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key := c.Param("key")
 		if key == "" {
-			c.JSON(http.StatusOK, NewErrorResponse(CodeBadRequest, "empty key"))
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "empty key"))
+			return
+		}
+
+		version, err := domain.ParseVersion(c.GetHeader(versionHeader))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
 			return
 		}
 
-		kv, err := db.Get(c.Request.Context(), key)
+		ctx := c.Request.Context()
+		if version != nil {
+			ctx = dynamo.WithVersion(ctx, version)
+		}
+
+		err = dbFromContext(c).Delete(ctx, key)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			respondDBError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, NewSuccessResponse("", kv))
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	}
+}
+
+func isRaw(c *gin.Context) bool {
+	switch c.Query("raw") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeKV builds the kv of a json request, value is base64 encoded if encoding says so.
+func decodeKV(key, value, encoding, contentType string, flags uint32) (domain.KV, error) {
+	kv := domain.KV{
+		Key:         key,
+		Value:       []byte(value),
+		ContentType: contentType,
+		Flags:       flags,
+	}
+
+	if encoding == EncodingBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return domain.KV{}, err
+		}
+		kv.Value = decoded
+	}
+
+	if kv.Flags&domain.FlagsReserved != 0 {
+		return domain.KV{}, errors.New("reserved flags set")
+	}
 
+	return kv, nil
+}
+
+func respondDBError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		c.JSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+	case errors.Is(err, codec.ErrUnsupported), errors.Is(err, service.ErrUnknownOp), errors.Is(err, dynamo.ErrInvalidQuorum):
+		c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+	case errors.Is(err, cluster.ErrNotLeader):
+		// the message names the leader to retry on
+		c.JSON(http.StatusServiceUnavailable, NewErrorResponse(CodeNotLeader, err.Error()))
+	case errors.Is(err, dynamo.ErrQuorum):
+		c.JSON(http.StatusServiceUnavailable, NewErrorResponse(CodeQuorum, err.Error()))
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, NewErrorResponse(CodeTimeout, err.Error()))
+	case errors.Is(err, context.Canceled):
+		c.JSON(StatusClientClosedRequest, NewErrorResponse(CodeCanceled, err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
 	}
 }
+
+// readRawBody reads the whole body into a single buffer sized by Content-Length.
+func readRawBody(c *gin.Context) ([]byte, error) {
+	size := c.Request.ContentLength
+	if size > maxRawBodySize {
+		return nil, fmt.Errorf("body larger than %d bytes", maxRawBodySize)
+	}
+
+	if size < 0 {
+		size = bytes.MinRead
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, size+1))
+	_, err := buffer.ReadFrom(http.MaxBytesReader(c.Writer, c.Request.Body, maxRawBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func parseFlags(header string) (uint32, error) {
+	if header == "" {
+		return 0, nil
+	}
+
+	flags, err := strconv.ParseUint(header, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid flags: %w", err)
+	}
+
+	if uint32(flags)&domain.FlagsReserved != 0 {
+		return 0, errors.New("reserved flags set")
+	}
+
+	return uint32(flags), nil
+}
@@ -0,0 +1,50 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
+	"github.com/gin-gonic/gin"
+)
+
+type IngestResponse struct {
+	Records int `json:"records"`
+}
+
+// Ingest adds segment files below the ingest root of the server, built by kaeya-admin build,
+// to a namespace.
+func Ingest(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req IngestRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		if req.Namespace == "" {
+			req.Namespace = application.DefaultNamespace
+		}
+
+		n, err := app.Ingest(c.Request.Context(), req.Namespace, req.Files, req.Precedence)
+		if err != nil {
+			switch {
+			case errors.Is(err, application.ErrNamespaceNotFound):
+				c.JSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+			case errors.Is(err, storage.ErrIngestUnsupported),
+				errors.Is(err, application.ErrIngestPath),
+				errors.Is(err, mananger.ErrPrecedence),
+				errors.Is(err, mananger.ErrIngest):
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			default:
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", IngestResponse{Records: n}))
+	}
+}
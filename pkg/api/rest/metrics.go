@@ -0,0 +1,32 @@
+package rest
+
+import (
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRoute labels the requests of no route, not to create a series per path
+const unmatchedRoute = "unmatched"
+
+// Metrics records the count and the latency of the requests by route.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		metrics.ObserveRequest(route, c.Request.Method, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// MetricsHandler serves the metrics in the prometheus text format.
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(metrics.Handler())
+}
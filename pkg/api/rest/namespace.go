@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/gin-gonic/gin"
+)
+
+// WithNamespace resolves the :ns path parameter to the DBService of that namespace,
+// a drop waits until the chain is done with it, see releaseDB.
+func WithNamespace(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, release, err := app.Namespace(c.Param("ns"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+			return
+		}
+
+		once := &sync.Once{}
+		c.Set(dbContextKey, db)
+		c.Set(releaseContextKey, func() {
+			once.Do(release)
+		})
+		defer releaseDB(c)
+
+		c.Next()
+	}
+}
+
+// releaseDB tells that the handler no longer uses the DBService of its namespace.
+func releaseDB(c *gin.Context) {
+	if release, ok := c.Get(releaseContextKey); ok {
+		release.(func())()
+	}
+}
+
+func ListNamespaces(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, NewSuccessResponse("", app.ListNamespaces()))
+	}
+}
+
+func CreateNamespace(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateNamespaceRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		ns, err := app.CreateNamespace(req.Name, req.Storage)
+		if err != nil {
+			switch {
+			case errors.Is(err, application.ErrNamespaceExists), errors.Is(err, application.ErrClustered),
+				errors.Is(err, application.ErrLeaderless):
+				c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			case errors.Is(err, application.ErrInvalidNamespace):
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			default:
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", ns))
+	}
+}
+
+func DropNamespace(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := app.DropNamespace(c.Request.Context(), c.Param("ns"))
+		if err != nil {
+			if errors.Is(err, application.ErrNamespaceNotFound) {
+				c.JSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+			} else {
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	}
+}
@@ -0,0 +1,42 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/gin-gonic/gin"
+)
+
+// Writable rejects the request while the application is a read-only follower.
+func Writable(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.ReadOnly() {
+			c.AbortWithStatusJSON(http.StatusForbidden, NewErrorResponse(CodeReadOnly, application.ErrReadOnly.Error()))
+		}
+	}
+}
+
+// ReplicationStatus reports the role and, on a follower, the lag of every namespace.
+func ReplicationStatus(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, NewSuccessResponse("", app.ReplicationStatus()))
+	}
+}
+
+// Promote turns a follower into a leader, the final replication status is returned.
+func Promote(app *application.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := app.Promote()
+		if err != nil {
+			if errors.Is(err, application.ErrNotFollower) {
+				c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			} else {
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", status))
+	}
+}
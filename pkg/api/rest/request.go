@@ -1,6 +1,71 @@
 package rest
 
+import "github.com/ForeverSRC/kaeya/pkg/config"
+
+const (
+	EncodingBase64 = "base64"
+)
+
 type SetKVRequest struct {
 	Key   string `json:"key" binding:"required"`
 	Value string `json:"value" binding:"required"`
+	// Encoding of Value, empty for plain text or "base64" for binary values.
+	Encoding    string `json:"encoding" binding:"omitempty,oneof=base64"`
+	ContentType string `json:"content_type"`
+	Flags       uint32 `json:"flags"`
+	// Version is the version read with the key in leaderless replication mode, a write
+	// without it is kept next to the current values.
+	Version string `json:"version"`
+}
+
+// BatchRequest applies every op or none.
+type BatchRequest struct {
+	Ops []BatchOpRequest `json:"ops" binding:"required,min=1,dive"`
+}
+
+type BatchOpRequest struct {
+	Op    string `json:"op" binding:"required,oneof=put delete"`
+	Key   string `json:"key" binding:"required"`
+	Value string `json:"value" binding:"required_if=Op put"`
+	// Encoding, ContentType, Flags and Version of a put, see SetKVRequest. A delete
+	// with a Version only removes the values of that version.
+	Encoding    string `json:"encoding" binding:"omitempty,oneof=base64"`
+	ContentType string `json:"content_type"`
+	Flags       uint32 `json:"flags"`
+	Version     string `json:"version"`
+}
+
+type AddMemberRequest struct {
+	ID string `json:"id" binding:"required"`
+	// Address is the raft address of the new member.
+	Address string `json:"address" binding:"required"`
+	Voter   bool   `json:"voter"`
+}
+
+type ShardDoneRequest struct {
+	From    string `json:"from" binding:"required"`
+	Version uint64 `json:"version" binding:"required"`
+}
+
+type CreateNamespaceRequest struct {
+	Name    string               `json:"name" binding:"required"`
+	Storage config.StorageConfig `json:"storage"`
+}
+
+type BackupRequest struct {
+	// Target is a missing or empty directory below the backup root of the server.
+	Target string `json:"target" binding:"required"`
+	// Since is the directory of a previous backup below the backup root for an incremental backup.
+	Since string `json:"since"`
+}
+
+type IngestRequest struct {
+	// Namespace to ingest into, the default one if empty.
+	Namespace string `json:"namespace"`
+	// Files are segment files relative to the ingest root of the server, a later one
+	// wins over an earlier one.
+	Files []string `json:"files" binding:"required,min=1"`
+	// Precedence is "newest" or "oldest", empty for the configured one. Deleted keys are
+	// only sure to stay deleted by an "oldest" ingest if that is the configured one.
+	Precedence string `json:"precedence" binding:"omitempty,oneof=newest oldest"`
 }
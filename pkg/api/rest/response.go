@@ -1,17 +1,96 @@
 package rest
 
+import (
+	"encoding/base64"
+	"unicode/utf8"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+)
+
 const (
 	CodeSuccess       = 0
 	CodeInternalError = 5000
 	CodeBadRequest    = 5001
+	CodeNotFound      = 5002
+	CodeConflict      = 5003
+	CodeGone          = 5004
+	CodeReadOnly      = 5005
+	CodeNotLeader     = 5006
+	CodeQuorum        = 5007
+	CodeTimeout       = 5008
+	CodeNotReady      = 5009
+	CodeCanceled      = 5010
 )
 
+// StatusClientClosedRequest is the non-standard status of a request the client canceled,
+// nobody reads the response, it is only for the logs and metrics.
+const StatusClientClosedRequest = 499
+
 type Response struct {
 	Code    int         `json:"code"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data"`
 }
 
+type KVResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Encoding is "base64" if Value is not valid utf-8 and has been encoded.
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Flags       uint32 `json:"flags,omitempty"`
+	// Version is the version vector to send back with the next write of the key in leaderless
+	// replication mode, Siblings are the concurrent values the write replaces.
+	Version  string       `json:"version,omitempty"`
+	Siblings []KVResponse `json:"siblings,omitempty"`
+}
+
+func NewKVResponse(kv domain.KV) KVResponse {
+	res := KVResponse{
+		Key:         kv.Key,
+		ContentType: kv.ContentType,
+		Flags:       kv.Flags,
+		Version:     kv.Version.String(),
+	}
+
+	for _, s := range kv.Siblings {
+		res.Siblings = append(res.Siblings, NewKVResponse(s))
+	}
+
+	if utf8.Valid(kv.Value) {
+		res.Value = string(kv.Value)
+	} else {
+		res.Value = base64.StdEncoding.EncodeToString(kv.Value)
+		res.Encoding = EncodingBase64
+	}
+
+	return res
+}
+
+// EventResponse is the data of a watch event, KV is missing for a delete.
+type EventResponse struct {
+	Sequence uint64      `json:"sequence"`
+	Type     string      `json:"type"`
+	Key      string      `json:"key"`
+	KV       *KVResponse `json:"kv,omitempty"`
+}
+
+func NewEventResponse(e service.Event) EventResponse {
+	res := EventResponse{
+		Sequence: e.Sequence,
+		Type:     string(e.Type),
+		Key:      e.KV.Key,
+	}
+
+	if e.Type == service.EventPut {
+		kv := NewKVResponse(e.KV)
+		res.KV = &kv
+	}
+
+	return res
+}
+
 func NewSuccessResponse(msg string, data interface{}) Response {
 	return Response{
 		Code:    CodeSuccess,
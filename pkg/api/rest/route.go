@@ -1,15 +1,109 @@
 package rest
 
 import (
+	"time"
+
 	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
 	"github.com/gin-gonic/gin"
 )
 
-func Route(app *application.Application) *gin.Engine {
+type routeOptions struct {
+	requestTimeout time.Duration
+	scanTimeout    time.Duration
+}
+
+type Option func(*routeOptions)
+
+// WithRequestTimeout bounds the kv reads and writes.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *routeOptions) {
+		o.requestTimeout = d
+	}
+}
+
+// WithScanTimeout bounds the exports and imports.
+func WithScanTimeout(d time.Duration) Option {
+	return func(o *routeOptions) {
+		o.scanTimeout = d
+	}
+}
+
+func Route(app *application.Application, options ...Option) *gin.Engine {
+	var opts routeOptions
+	for _, op := range options {
+		op(&opts)
+	}
+
 	router := gin.New()
+	router.Use(Metrics(), Tracing())
+	router.GET("/metrics", MetricsHandler())
+
+	writable := Writable(app)
+	shard := Shard(app)
 
-	router.POST("/kv", Set(app.DB))
-	router.GET("/kv/:key", Get(app.DB))
+	requestTimeout, scanTimeout := Timeout(opts.requestTimeout), Timeout(opts.scanTimeout)
+
+	kv := router.Group("/kv", requestTimeout, WithDB(app.DB), Quorum())
+	kvRoutes(kv, writable, shard)
+
+	ns := router.Group("/ns/:ns/kv", requestTimeout, WithNamespace(app))
+	kvRoutes(ns, writable, shard)
+
+	transferRoutes(router.Group("", scanTimeout, WithDB(app.DB)), writable)
+	transferRoutes(router.Group("/ns/:ns", scanTimeout, WithNamespace(app)), writable)
+
+	router.GET("/watch", WithDB(app.DB), Watch())
+	router.GET("/ns/:ns/watch", WithNamespace(app), Watch())
+
+	admin := router.Group("/admin")
+	admin.GET("/status", Status(app))
+	admin.POST("/refresh", RunJob(app, metrics.JobRefresh))
+	admin.POST("/flush", RunJob(app, metrics.JobFlush))
+	admin.POST("/merge", RunJob(app, metrics.JobMerge))
+	admin.POST("/merge/pause", PauseMerges(app, true))
+	admin.POST("/merge/resume", PauseMerges(app, false))
+	admin.GET("/ns", ListNamespaces(app))
+	admin.POST("/ns", writable, CreateNamespace(app))
+	admin.DELETE("/ns/:ns", writable, DropNamespace(app))
+	admin.POST("/backup", Backup(app))
+	admin.GET("/backup", BackupTar(app))
+	admin.POST("/ingest", writable, Ingest(app))
+	admin.GET("/replication", ReplicationStatus(app))
+	admin.POST("/promote", Promote(app))
+	admin.GET("/cluster", ClusterStatus(app))
+	admin.POST("/cluster/members", AddMember(app))
+	admin.DELETE("/cluster/members/:id", RemoveMember(app))
+	admin.POST("/cluster/snapshot", ClusterSnapshot(app))
+	admin.GET("/shards", ShardStatus(app))
+	admin.GET("/shards/owner", ShardOwner(app))
+	admin.POST("/shards/topology", UpdateTopology(app))
+	admin.POST("/shards/receive", ReceiveShard(app))
+	admin.POST("/shards/done", ShardDone(app))
+	admin.GET("/dynamo", DynamoStatus(app))
+	admin.POST("/dynamo/sync", DynamoSync(app))
+	admin.POST("/dynamo/coordinate", Coordinate(app))
+	admin.GET("/dynamo/replicas", Replica(app))
+	admin.POST("/dynamo/replicas", StoreReplicas(app))
+	admin.GET("/dynamo/tree", ReplicaTree(app))
+	admin.GET("/dynamo/buckets", ReplicaBuckets(app))
 
 	return router
 }
+
+// writable guards the routes changing data, see Writable. shard routes the keys
+// of other shards, see Shard.
+func kvRoutes(group *gin.RouterGroup, writable, shard gin.HandlerFunc) {
+	group.POST("", writable, shard, Set())
+	group.POST("/_batch", writable, shard, Batch())
+	group.PUT("/:key", writable, shard, Put())
+	group.GET("/:key", shard, Get())
+	group.HEAD("/:key", shard, Head())
+	group.DELETE("/:key", writable, shard, Delete())
+}
+
+// transferRoutes only cover the keys of this member if sharded.
+func transferRoutes(group *gin.RouterGroup, writable gin.HandlerFunc) {
+	group.GET("/export", Export())
+	group.POST("/import", writable, Import())
+}
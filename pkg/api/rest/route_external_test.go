@@ -0,0 +1,380 @@
+package rest_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/api/rest"
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(t *testing.T, conf config.KaeyaConfig) (*application.Application, *httptest.Server) {
+	app, err := application.NewApplication(conf)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(rest.Route(app))
+	t.Cleanup(func() {
+		server.Close()
+		app.Close(context.Background())
+	})
+
+	return app, server
+}
+
+func storageConfig() config.StorageConfig {
+	return config.StorageConfig{
+		Path:   path.Join("testdata", "dynamic", utils.ID()),
+		System: "fs",
+		Codec:  "binary",
+	}
+}
+
+func do(t *testing.T, method, url, contentType, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	return resp, data
+}
+
+func decode(t *testing.T, data []byte) rest.Response {
+	var res rest.Response
+	assert.NoError(t, json.Unmarshal(data, &res))
+
+	return res
+}
+
+func TestReadiness(t *testing.T) {
+	s, err := rest.CreateHttpServer(config.ServerConfig{ShutdownDelay: "500ms"})
+	assert.NoError(t, err)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	status := func(path string) int {
+		resp, _ := do(t, http.MethodGet, server.URL+path, "", "")
+		return resp.StatusCode
+	}
+
+	// loading: alive but neither ready nor serving
+	assert.Equal(t, http.StatusOK, status(rest.HealthPath))
+	resp, data := do(t, http.MethodGet, server.URL+rest.ReadyPath, "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, rest.CodeNotReady, decode(t, data).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, status("/kv/a"))
+
+	app, err := application.NewApplication(config.KaeyaConfig{Storage: storageConfig()})
+	assert.NoError(t, err)
+	defer app.Close(context.Background())
+
+	s.Serve(app)
+	assert.Equal(t, http.StatusOK, status(rest.HealthPath))
+	assert.Equal(t, http.StatusOK, status(rest.ReadyPath))
+	assert.Equal(t, http.StatusNotFound, status("/kv/a"))
+
+	// draining: not ready, the requests are still served until the shutdown delay is over
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	assert.Eventually(t, func() bool {
+		return status(rest.ReadyPath) == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, status(rest.HealthPath))
+	assert.Equal(t, http.StatusNotFound, status("/kv/a"))
+
+	assert.NoError(t, <-shutdown)
+}
+
+func TestNamespaces(t *testing.T) {
+	app, server := newServer(t, config.KaeyaConfig{Storage: storageConfig()})
+
+	resp, _ := do(t, http.MethodPost, server.URL+"/admin/ns", "application/json", `{"name":"orders"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, data := do(t, http.MethodPost, server.URL+"/admin/ns", "application/json", `{"name":"orders"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, rest.CodeConflict, decode(t, data).Code)
+
+	resp, _ = do(t, http.MethodPost, server.URL+"/admin/ns", "application/json", `{"name":"a/b"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	names := make([]string, 0)
+	for _, ns := range app.ListNamespaces() {
+		names = append(names, ns.Name)
+	}
+	assert.Equal(t, []string{application.DefaultNamespace, "orders"}, names)
+
+	// the same key lives apart in every namespace
+	resp, _ = do(t, http.MethodPut, server.URL+"/ns/orders/kv/a", "text/plain", "in orders")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, http.MethodPut, server.URL+"/kv/a", "text/plain", "in default")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, data = do(t, http.MethodGet, server.URL+"/ns/orders/kv/a", "", "")
+	assert.Equal(t, "in orders", decode(t, data).Data.(map[string]interface{})["value"])
+	_, data = do(t, http.MethodGet, server.URL+"/ns/default/kv/a", "", "")
+	assert.Equal(t, "in default", decode(t, data).Data.(map[string]interface{})["value"])
+
+	resp, _ = do(t, http.MethodGet, server.URL+"/ns/missing/kv/a", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodDelete, server.URL+"/admin/ns/orders", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, utils.PathExists(path.Join(app.ListNamespaces()[0].Storage.Path, "namespaces", "orders")))
+
+	resp, _ = do(t, http.MethodGet, server.URL+"/ns/orders/kv/a", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, http.MethodDelete, server.URL+"/admin/ns/orders", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Len(t, app.ListNamespaces(), 1)
+}
+
+func TestDropNamespaceInUse(t *testing.T) {
+	app, server := newServer(t, config.KaeyaConfig{Storage: storageConfig()})
+
+	_, err := app.CreateNamespace("orders", config.StorageConfig{})
+	assert.NoError(t, err)
+
+	db, release, err := app.Namespace("orders")
+	assert.NoError(t, err)
+
+	// a watch does not hold the namespace, it ends with the drop
+	resp, err := http.Get(server.URL + "/ns/orders/watch")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the drop waits for the user, no new one gets the namespace meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, app.DropNamespace(ctx, "orders"), context.DeadlineExceeded)
+
+	_, _, err = app.Namespace("orders")
+	assert.ErrorIs(t, err, application.ErrNamespaceNotFound)
+	resp2, _ := do(t, http.MethodGet, server.URL+"/ns/orders/kv/a", "", "")
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+	assert.Len(t, app.ListNamespaces(), 1)
+
+	assert.NoError(t, db.Set(context.Background(), domain.KV{Key: "a", Value: []byte("1")}))
+	release()
+
+	assert.NoError(t, app.DropNamespace(context.Background(), "orders"))
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+}
+
+func TestKV(t *testing.T) {
+	_, server := newServer(t, config.KaeyaConfig{Storage: storageConfig()})
+
+	resp, data := do(t, http.MethodGet, server.URL+"/kv/missing", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, rest.CodeNotFound, decode(t, data).Code)
+
+	resp, _ = do(t, http.MethodHead, server.URL+"/kv/missing", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body := "line1\nline2\x00\xff"
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/kv/blob", strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-test")
+	req.Header.Set("X-Kaeya-Flags", "7")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodHead, server.URL+"/kv/blob", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the raw body comes back byte for byte, with its content type and flags
+	resp, data = do(t, http.MethodGet, server.URL+"/kv/blob?raw=1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, body, string(data))
+	assert.Equal(t, "application/x-test", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "7", resp.Header.Get("X-Kaeya-Flags"))
+
+	_, data = do(t, http.MethodGet, server.URL+"/kv/blob", "", "")
+	value := decode(t, data).Data.(map[string]interface{})
+	assert.Equal(t, rest.EncodingBase64, value["encoding"])
+
+	resp, _ = do(t, http.MethodDelete, server.URL+"/kv/blob", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, http.MethodGet, server.URL+"/kv/blob?raw=1", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, http.MethodHead, server.URL+"/kv/blob", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	app, err := application.NewApplication(config.KaeyaConfig{Storage: storageConfig()})
+	assert.NoError(t, err)
+	defer app.Close(context.Background())
+
+	// a missing key is searched through the whole data file, which checks the request context
+	for i := 0; i < 2*common.CancelCheckInterval; i++ {
+		assert.NoError(t, app.DB.Set(context.Background(), domain.KV{Key: fmt.Sprintf("k%d", i), Value: []byte("v")}))
+	}
+
+	router := rest.Route(app, rest.WithRequestTimeout(time.Nanosecond))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, data := do(t, http.MethodGet, server.URL+"/kv/missing", "", "")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, rest.CodeTimeout, decode(t, data).Code)
+
+	// the client went away before the timeout, nothing timed out
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/kv/missing", nil).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	rest.Route(app, rest.WithRequestTimeout(time.Minute)).ServeHTTP(recorder, req)
+	assert.Equal(t, rest.StatusClientClosedRequest, recorder.Code)
+	assert.Equal(t, rest.CodeCanceled, decode(t, recorder.Body.Bytes()).Code)
+}
+
+func TestBackup(t *testing.T) {
+	conf := config.KaeyaConfig{Storage: storageConfig()}
+	_, server := newServer(t, conf)
+
+	// without a backup root only the tar stream works
+	resp, data := do(t, http.MethodPost, server.URL+"/admin/backup", "application/json", `{"target":"full"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, rest.CodeBadRequest, decode(t, data).Code)
+
+	resp, _ = do(t, http.MethodGet, server.URL+"/admin/backup", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conf = config.KaeyaConfig{Storage: storageConfig(), Backup: config.BackupConfig{Root: path.Join("testdata", "dynamic", utils.ID())}}
+	_, server = newServer(t, conf)
+
+	resp, _ = do(t, http.MethodPut, server.URL+"/kv/a", "text/plain", "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, target := range []string{"/tmp/outside", "../outside", "a/../../outside", "."} {
+		resp, _ = do(t, http.MethodPost, server.URL+"/admin/backup", "application/json", `{"target":"`+target+`"}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, target)
+	}
+
+	resp, _ = do(t, http.MethodPost, server.URL+"/admin/backup", "application/json", `{"target":"full"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.FileExists(t, path.Join(conf.Backup.Root, "full", backup.MetaFileName))
+
+	resp, _ = do(t, http.MethodPost, server.URL+"/admin/backup", "application/json", `{"target":"incr","since":"/tmp"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, data = do(t, http.MethodPost, server.URL+"/admin/backup", "application/json", `{"target":"incr","since":"full"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+	assert.Equal(t, "../full", decode(t, data).Data.(map[string]interface{})["base"])
+}
+
+func TestIngest(t *testing.T) {
+	conf := config.KaeyaConfig{Storage: storageConfig(), Ingest: config.IngestConfig{Root: path.Join("testdata", "dynamic", utils.ID())}}
+	conf.Storage.System = "segment"
+	_, server := newServer(t, conf)
+
+	outside := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, os.MkdirAll(conf.Ingest.Root, 0754))
+	assert.NoError(t, os.MkdirAll(outside, 0754))
+
+	build := func(file string) {
+		_, err := mananger.BuildSegment(file, codec.NewBinaryCodec(), common.NewSliceReader([]domain.KV{{Key: "a", Value: []byte("1")}}))
+		assert.NoError(t, err)
+	}
+	build(path.Join(conf.Ingest.Root, "a.sgk"))
+	build(path.Join(outside, "a.sgk"))
+
+	abs, err := filepath.Abs(path.Join(outside, "a.sgk"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Symlink(abs, path.Join(conf.Ingest.Root, "link.sgk")))
+
+	for _, file := range []string{abs, "../" + path.Base(outside) + "/a.sgk", "link.sgk", "missing.sgk"} {
+		resp, _ := do(t, http.MethodPost, server.URL+"/admin/ingest", "application/json", `{"files":["`+file+`"]}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, file)
+	}
+
+	resp, data := do(t, http.MethodPost, server.URL+"/admin/ingest", "application/json", `{"files":["a.sgk"]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+
+	resp, data = do(t, http.MethodGet, server.URL+"/kv/a?raw=1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", string(data))
+}
+
+func TestWatchResume(t *testing.T) {
+	_, server := newServer(t, config.KaeyaConfig{Storage: storageConfig()})
+
+	resp, _ := do(t, http.MethodPut, server.URL+"/kv/a", "text/plain", "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	watch := func(lastEventID string) (*http.Response, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/watch?from=1", nil)
+		assert.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		return resp, cancel
+	}
+
+	// the event id holds the change log
+	resp, cancel := watch("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	changeLog := resp.Header.Get("X-Kaeya-Change-Log")
+	assert.NotEmpty(t, changeLog)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "id: "+changeLog+":1\n", line)
+	cancel()
+	resp.Body.Close()
+
+	// a sequence of another change log, like the one before a restart, cannot be resumed
+	resp, cancel = watch("other:1")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	cancel()
+	resp.Body.Close()
+
+	resp, cancel = watch("1")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	cancel()
+	resp.Body.Close()
+
+	resp, cancel = watch(changeLog + ":1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	cancel()
+	resp.Body.Close()
+}
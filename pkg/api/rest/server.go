@@ -1,17 +1,130 @@
 package rest
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
 )
 
-func CreateHttpServer(app *application.Application) *http.Server {
-	e := Route(app)
-	server := &http.Server{
-		Addr:    ":6666",
-		Handler: e,
+const (
+	HealthPath = "/healthz"
+	ReadyPath  = "/readyz"
+)
+
+// states of a Server
+const (
+	stateLoading int32 = iota
+	stateReady
+	stateDraining
+)
+
+// Server answers the probes as soon as it listens and the api once Serve hands it the
+// application, it is ready in between Serve and Shutdown.
+type Server struct {
+	*http.Server
+
+	options       []Option
+	shutdownDelay time.Duration
+
+	state atomic.Int32
+	api   atomic.Value
+}
+
+func CreateHttpServer(conf config.ServerConfig) (*Server, error) {
+	s := &Server{}
+
+	for _, t := range []struct {
+		value  string
+		option func(time.Duration) Option
+	}{
+		{conf.RequestTimeout, WithRequestTimeout},
+		{conf.ScanTimeout, WithScanTimeout},
+	} {
+		if t.value == "" {
+			continue
+		}
+
+		d, err := utils.ParseDuration(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("parse server timeout %q: %w", t.value, err)
+		}
+		s.options = append(s.options, t.option(d))
+	}
+
+	if conf.ShutdownDelay != "" {
+		d, err := utils.ParseDuration(conf.ShutdownDelay)
+		if err != nil {
+			return nil, fmt.Errorf("parse shutdown delay %q: %w", conf.ShutdownDelay, err)
+		}
+		s.shutdownDelay = d
 	}
 
-	return server
+	s.Server = &http.Server{
+		Addr:    conf.Addr,
+		Handler: s,
+	}
+
+	// watch streams never end by themselves, Shutdown must close them
+	stop := make(chan struct{})
+	s.BaseContext = func(net.Listener) context.Context {
+		return withStreamsStop(context.Background(), stop)
+	}
+	s.RegisterOnShutdown(func() {
+		close(stop)
+	})
+
+	return s, nil
+}
+
+// Serve routes the api to app, which has been loaded, and reports the server ready.
+func (s *Server) Serve(app *application.Application) {
+	s.api.Store(http.Handler(Route(app, s.options...)))
+	s.state.Store(stateReady)
+}
+
+// Shutdown reports the server not ready, waits for the shutdown delay to let the
+// orchestrator route the traffic elsewhere, then stops it gracefully.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.Store(stateDraining)
+
+	if s.shutdownDelay > 0 {
+		select {
+		case <-time.After(s.shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	return s.Server.Shutdown(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := s.state.Load()
+
+	switch {
+	case r.URL.Path == HealthPath:
+		writeJSON(w, http.StatusOK, NewSuccessResponse("ok", nil))
+	case r.URL.Path == ReadyPath && state == stateReady:
+		writeJSON(w, http.StatusOK, NewSuccessResponse("ready", nil))
+	case state == stateLoading:
+		writeJSON(w, http.StatusServiceUnavailable, NewErrorResponse(CodeNotReady, "loading"))
+	case r.URL.Path == ReadyPath:
+		writeJSON(w, http.StatusServiceUnavailable, NewErrorResponse(CodeNotReady, "shutting down"))
+	default:
+		// the requests keep being served while draining
+		s.api.Load().(http.Handler).ServeHTTP(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, res Response) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
 }
@@ -0,0 +1,267 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+	"github.com/gin-gonic/gin"
+)
+
+// Shard serves the requests for keys of this member and forwards or redirects the others
+// to their owner. Requests forwarded by a member are always served here. Reads of missing
+// keys are looked up on the former owner while it moves its keys here, unless they have
+// been written or deleted here since.
+func Shard(app *application.Application) gin.HandlerFunc {
+	sharder, mode, err := app.Sharder()
+	if err != nil {
+		return func(c *gin.Context) {}
+	}
+
+	proxies := &proxies{}
+
+	return func(c *gin.Context) {
+		keys, ok := requestKeys(c)
+		if !ok {
+			// invalid, the handler answers it
+			return
+		}
+
+		read := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+		namespace := c.Param("ns")
+		if namespace == "" {
+			namespace = application.DefaultNamespace
+		}
+
+		if c.GetHeader(sharding.ForwardedHeader) == "" {
+			owner, err := sharder.Owner(keys...)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+				return
+			}
+
+			if owner.Name != sharder.Self() {
+				if mode == application.ShardModeRedirect {
+					c.Redirect(http.StatusTemporaryRedirect, owner.URL+c.Request.URL.RequestURI())
+					c.Abort()
+				} else {
+					proxies.forward(c, sharder.Self(), owner)
+				}
+				return
+			}
+		}
+
+		if !read {
+			sharder.Touch(namespace, keys...)
+			return
+		}
+
+		former, ok := sharder.Fallback(namespace, keys[0])
+		if !ok {
+			return
+		}
+
+		_, err := dbFromContext(c).Get(c.Request.Context(), keys[0])
+		if errors.Is(err, storage.ErrNotFound) {
+			proxies.forward(c, sharder.Self(), former)
+		}
+	}
+}
+
+// requestKeys returns the keys a kv request reads or writes, from the path or the json body.
+func requestKeys(c *gin.Context) ([]string, bool) {
+	if key := c.Param("key"); key != "" {
+		return []string{key}, true
+	}
+
+	if c.Request.Method != http.MethodPost || c.Request.Body == nil {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxRawBodySize))
+	if err != nil {
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		Key string `json:"key"`
+		Ops []struct {
+			Key string `json:"key"`
+		} `json:"ops"`
+	}
+
+	if json.Unmarshal(body, &req) != nil {
+		return nil, false
+	}
+
+	keys := make([]string, 0, len(req.Ops)+1)
+	if req.Key != "" {
+		keys = append(keys, req.Key)
+	}
+	for _, op := range req.Ops {
+		keys = append(keys, op.Key)
+	}
+
+	return keys, len(keys) > 0
+}
+
+// proxies holds a reverse proxy per member url.
+type proxies struct {
+	m sync.Map
+}
+
+func (p *proxies) forward(c *gin.Context, self string, to sharding.Member) {
+	proxy, ok := p.m.Load(to.URL)
+	if !ok {
+		target, err := url.Parse(to.URL)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			return
+		}
+
+		rp := httputil.NewSingleHostReverseProxy(target)
+		director := rp.Director
+		rp.Director = func(req *http.Request) {
+			director(req)
+			req.Header.Set(sharding.ForwardedHeader, self)
+			injectTrace(req)
+		}
+		rp.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.Logger.Warn().Err(err).Str("member", to.Name).Msg("forward to shard error")
+
+			data, _ := json.Marshal(NewErrorResponse(CodeInternalError, "shard "+to.Name+": "+err.Error()))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(data)
+		}
+
+		proxy, _ = p.m.LoadOrStore(to.URL, rp)
+	}
+
+	proxy.(*httputil.ReverseProxy).ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+}
+
+// withSharder runs fn with the sharder of the application, 409 if it runs alone.
+func withSharder(app *application.Application, fn func(c *gin.Context, sharder *sharding.Sharder)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sharder, _, err := app.Sharder()
+		if err != nil {
+			c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			return
+		}
+
+		fn(c, sharder)
+	}
+}
+
+// ShardStatus reports the topology and the progress of a rebalance on this member.
+func ShardStatus(app *application.Application) gin.HandlerFunc {
+	return withSharder(app, func(c *gin.Context, sharder *sharding.Sharder) {
+		c.JSON(http.StatusOK, NewSuccessResponse("", sharder.Status()))
+	})
+}
+
+// ShardOwner returns the member owning ?key=.
+func ShardOwner(app *application.Application) gin.HandlerFunc {
+	return withSharder(app, func(c *gin.Context, sharder *sharding.Sharder) {
+		key := c.Query("key")
+		if key == "" {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, "empty key"))
+			return
+		}
+
+		owner, _ := sharder.Owner(key)
+		c.JSON(http.StatusOK, NewSuccessResponse("", owner))
+	})
+}
+
+// UpdateTopology applies a newer topology and sends it to every member, which rebalance their keys.
+func UpdateTopology(app *application.Application) gin.HandlerFunc {
+	return withSharder(app, func(c *gin.Context, sharder *sharding.Sharder) {
+		var req sharding.Update
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		forwarded := c.GetHeader(sharding.ForwardedHeader) != ""
+		if !forwarded {
+			req.Previous = nil
+		}
+
+		update, err := sharder.Update(req)
+		if err != nil {
+			switch {
+			case errors.Is(err, sharding.ErrStaleTopology):
+				c.JSON(http.StatusConflict, NewErrorResponse(CodeConflict, err.Error()))
+			case errors.Is(err, sharding.ErrInvalidTopology):
+				c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			default:
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		if !forwarded {
+			err = sharder.Broadcast(c.Request.Context(), update)
+			if err != nil {
+				// applied here, a newer version can be sent once the members are back
+				c.JSON(http.StatusInternalServerError, Response{Code: CodeInternalError, Message: err.Error(), Data: sharder.Status()})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", sharder.Status()))
+	})
+}
+
+// ReceiveShard imports the jsonl kvs moved here by a former owner into ?ns=.
+func ReceiveShard(app *application.Application) gin.HandlerFunc {
+	return withSharder(app, func(c *gin.Context, sharder *sharding.Sharder) {
+		r, err := transfer.NewReader(transfer.FormatJSONL, c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		n, err := sharder.Receive(c.Request.Context(), c.Query("ns"), r)
+		if err != nil {
+			if errors.Is(err, sharding.ErrUnknownNamespace) {
+				c.JSON(http.StatusNotFound, NewErrorResponse(CodeNotFound, err.Error()))
+			} else {
+				respondDBError(c, err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", ImportResponse{Imported: n}))
+	})
+}
+
+// ShardDone records that a former owner moved its keys.
+func ShardDone(app *application.Application) gin.HandlerFunc {
+	return withSharder(app, func(c *gin.Context, sharder *sharding.Sharder) {
+		var req ShardDoneRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		sharder.Done(req.From, req.Version)
+		c.JSON(http.StatusOK, NewSuccessResponse("", nil))
+	})
+}
@@ -0,0 +1,94 @@
+package rest
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+	"github.com/gin-gonic/gin"
+)
+
+type ImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+// Export streams every kv, optionally only ?prefix=, in ?format=jsonl (default) or csv.
+func Export() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, err := transfer.ParseFormat(c.DefaultQuery("format", string(transfer.FormatJSONL)))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		c.Header("Content-Type", format.ContentType())
+
+		ctx := c.Request.Context()
+		_, err = transfer.Export(format, c.Writer, func(fn func(kv domain.KV) error) error {
+			return dbFromContext(c).Scan(ctx, c.Query("prefix"), fn)
+		})
+		if err == nil {
+			return
+		}
+
+		// once the stream has started, a failure can only cut it
+		if c.Writer.Written() {
+			logger.Logger.Error().Err(err).Msg("export error")
+			c.Abort()
+			return
+		}
+
+		c.Header("Content-Type", "")
+		respondDBError(c, err)
+	}
+}
+
+// Import bulk loads the request body in ?format=, or the format of its Content-Type.
+func Import() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, err := importFormat(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		r, err := transfer.NewReader(format, c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		n, err := dbFromContext(c).Import(c.Request.Context(), r)
+		if err != nil {
+			code, status := CodeInternalError, http.StatusInternalServerError
+			if errors.Is(err, transfer.ErrFormat) {
+				code, status = CodeBadRequest, http.StatusBadRequest
+			} else if errors.Is(err, cluster.ErrNotLeader) {
+				code, status = CodeNotLeader, http.StatusServiceUnavailable
+			}
+
+			// the kvs before the failure stay imported, unless the storage system rolled them back
+			c.JSON(status, Response{Code: code, Message: err.Error(), Data: ImportResponse{Imported: n}})
+			return
+		}
+
+		c.JSON(http.StatusOK, NewSuccessResponse("", ImportResponse{Imported: n}))
+	}
+}
+
+func importFormat(c *gin.Context) (transfer.Format, error) {
+	if f := c.Query("format"); f != "" {
+		return transfer.ParseFormat(f)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType == transfer.FormatCSV.ContentType() {
+		return transfer.FormatCSV, nil
+	}
+
+	return transfer.FormatJSONL, nil
+}
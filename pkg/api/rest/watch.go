@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+	// changeLogHeader is the id of the change log a watch stream follows.
+	changeLogHeader = "X-Kaeya-Change-Log"
+	// sequenceHeader is the first sequence of a watch stream.
+	sequenceHeader = "X-Kaeya-Sequence"
+
+	// keeps idle streams open through proxies and tells followers the newest sequence
+	defaultWatchHeartbeat = 15 * time.Second
+	minWatchHeartbeat     = 100 * time.Millisecond
+)
+
+// HeartbeatResponse is the data of a heartbeat event, Sequence is the newest one committed.
+type HeartbeatResponse struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// streamsStopKey holds a channel in the base context of the server, closed on shutdown
+// so that streams which never end by themselves do not hold it up.
+type streamsStopKey struct{}
+
+func withStreamsStop(ctx context.Context, stop <-chan struct{}) context.Context {
+	return context.WithValue(ctx, streamsStopKey{}, stop)
+}
+
+func streamsStop(c *gin.Context) <-chan struct{} {
+	stop, _ := c.Request.Context().Value(streamsStopKey{}).(<-chan struct{})
+	return stop
+}
+
+// Watch streams the changes of keys starting with ?prefix= as server-sent events, with
+// "<change log id>:<sequence>" as event id. It resumes after the Last-Event-ID header, or
+// starts at ?from=, otherwise only new changes are sent. 410 if the change log no longer
+// holds the start or is not the one of Last-Event-ID or ?log=, sequences restart on every
+// start of the server. Heartbeat events are sent every ?heartbeat=, 15s by default.
+func Watch() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log, from, err := watchStart(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		interval, err := watchHeartbeat(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NewErrorResponse(CodeBadRequest, err.Error()))
+			return
+		}
+
+		db := dbFromContext(c)
+		changes := db.Changes()
+		if log != "" && log != changes.ID {
+			c.JSON(http.StatusGone, NewErrorResponse(CodeGone, fmt.Sprintf("change log %s: %s", log, service.ErrSequenceNotRetained.Error())))
+			return
+		}
+
+		if from == 0 {
+			from = changes.Last + 1
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		events, err := db.Watch(ctx, c.Query("prefix"), from)
+		if err != nil {
+			if errors.Is(err, service.ErrSequenceNotRetained) {
+				c.JSON(http.StatusGone, NewErrorResponse(CodeGone, err.Error()))
+			} else {
+				c.JSON(http.StatusInternalServerError, NewErrorResponse(CodeInternalError, err.Error()))
+			}
+			return
+		}
+
+		// the stream ends when a drop closes the namespace
+		releaseDB(c)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header(changeLogHeader, changes.ID)
+		c.Header(sequenceHeader, strconv.FormatUint(from, 10))
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(interval)
+		defer heartbeat.Stop()
+
+		stop := streamsStop(c)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+
+				err = writeEvent(c, changes.ID, e)
+			case <-heartbeat.C:
+				err = writeSSE(c, "", "heartbeat", HeartbeatResponse{Sequence: db.Changes().Last})
+			case <-stop:
+				return
+			}
+
+			if err != nil {
+				logger.Logger.Debug().Err(err).Msg("watch stream closed")
+				return
+			}
+
+			c.Writer.Flush()
+		}
+	}
+}
+
+// watchStart returns the change log and the sequence to start at, see Watch.
+func watchStart(c *gin.Context) (string, uint64, error) {
+	if id := c.GetHeader(lastEventIDHeader); id != "" {
+		log, last, ok := strings.Cut(id, ":")
+		if !ok || log == "" {
+			return "", 0, fmt.Errorf("invalid %s %s, want <change log id>:<sequence>", lastEventIDHeader, id)
+		}
+
+		seq, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid %s: %w", lastEventIDHeader, err)
+		}
+
+		return log, seq + 1, nil
+	}
+
+	log, from := c.Query("log"), c.Query("from")
+	if from == "" {
+		return log, 0, nil
+	}
+
+	seq, err := strconv.ParseUint(from, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid from: %w", err)
+	}
+
+	return log, seq, nil
+}
+
+func watchHeartbeat(c *gin.Context) (time.Duration, error) {
+	s := c.Query("heartbeat")
+	if s == "" {
+		return defaultWatchHeartbeat, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid heartbeat: %w", err)
+	}
+
+	if d < minWatchHeartbeat {
+		return 0, fmt.Errorf("heartbeat below %s", minWatchHeartbeat)
+	}
+
+	return d, nil
+}
+
+func writeEvent(c *gin.Context, changeLog string, e service.Event) error {
+	return writeSSE(c, changeLog+":"+strconv.FormatUint(e.Sequence, 10), string(e.Type), NewEventResponse(e))
+}
+
+// writeSSE writes a server-sent event, without an id field if id is empty.
+func writeSSE(c *gin.Context, id, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		_, err = fmt.Fprintf(c.Writer, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
@@ -0,0 +1,136 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+// the snapshot is staged under the storage root so it can be hard linked
+const backupStagingPattern = ".backup-*"
+
+var ErrBackupPath = errors.New("invalid backup path")
+
+// Backup writes a consistent snapshot of the default storage and of every namespace
+// into the directory target, with only the files changed since the backup in since
+// unless since is empty. target and since are relative to the backup root of the config.
+// The layout of the backup is the one of the storage root.
+// The key file of an encrypted storage is not part of the backup.
+func (app *Application) Backup(ctx context.Context, target, since string) (*backup.Meta, error) {
+	target, err := app.backupPath(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if since != "" {
+		since, err = app.backupPath(since)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	staging, err := app.checkpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	return backup.WriteDir(staging, target, since)
+}
+
+// BackupTar is like Backup but writes the snapshot as a tar stream into w.
+func (app *Application) BackupTar(ctx context.Context, w io.Writer, since string) (*backup.Meta, error) {
+	var err error
+	if since != "" {
+		since, err = app.backupPath(since)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	staging, err := app.checkpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	return backup.WriteTar(staging, w, since)
+}
+
+// backupPath returns the directory name below the backup root, which name must not leave.
+func (app *Application) backupPath(name string) (string, error) {
+	app.confLock.Lock()
+	root := app.conf.Backup.Root
+	app.confLock.Unlock()
+
+	if root == "" {
+		return "", fmt.Errorf("no backup root configured: %w", ErrBackupPath)
+	}
+
+	if !isBelow(name) {
+		return "", fmt.Errorf("%s is not below the backup root: %w", name, ErrBackupPath)
+	}
+
+	return filepath.Join(root, filepath.Clean(filepath.FromSlash(name))), nil
+}
+
+// checkpoint stages a snapshot of every storage, the caller removes the returned directory.
+func (app *Application) checkpoint(ctx context.Context) (string, error) {
+	staging, err := os.MkdirTemp(app.storageConf.Path, backupStagingPattern)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.DB.Checkpoint(ctx, staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("checkpoint %s error: %w", DefaultNamespace, err)
+	}
+
+	app.nsLock.RLock()
+	defer app.nsLock.RUnlock()
+
+	for name, ns := range app.namespaces {
+		if ns.dropped {
+			continue
+		}
+
+		dir := path.Join(staging, namespaceRootDir, name)
+
+		err = ns.db.Checkpoint(ctx, dir)
+		if err == nil {
+			err = utils.CopyFileN(path.Join(app.namespacePath(name), namespaceConfigFile), path.Join(dir, namespaceConfigFile), -1)
+		}
+
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", fmt.Errorf("checkpoint namespace %s error: %w", name, err)
+		}
+	}
+
+	return staging, nil
+}
+
+// removeBackupStaging removes the snapshots left behind by backups interrupted by a crash.
+func removeBackupStaging(root string) error {
+	dirs, err := filepath.Glob(path.Join(root, backupStagingPattern))
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+)
+
+const raftDir = "raft"
+
+var (
+	ErrClustered    = errors.New("not supported in cluster mode")
+	ErrNotClustered = errors.New("not running in cluster mode")
+)
+
+// join makes the default namespace a member of the raft cluster in conf,
+// namespaces are local to each member and cannot be created.
+func (app *Application) join(conf config.KaeyaConfig) error {
+	if conf.Replication.Leader != "" {
+		return fmt.Errorf("replication leader %s: %w", conf.Replication.Leader, ErrClustered)
+	}
+
+	node, err := cluster.NewNode(conf.Cluster, path.Join(conf.Storage.Path, raftDir), app.DB, conf.Storage,
+		cluster.WithLogLevel(conf.Log.Level))
+	if err != nil {
+		return err
+	}
+
+	app.DB = node
+	app.cluster = node
+
+	logger.Logger.Info().Str("node", conf.Cluster.NodeID).Str("raft_addr", conf.Cluster.RaftAddr).Msg("joined raft cluster")
+
+	return nil
+}
+
+// Cluster returns the raft member of the default namespace, ErrNotClustered if the application runs alone.
+func (app *Application) Cluster() (*cluster.Node, error) {
+	if app.cluster == nil {
+		return nil, ErrNotClustered
+	}
+
+	return app.cluster, nil
+}
@@ -0,0 +1,72 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+var (
+	ErrLeaderless    = errors.New("not supported in leaderless replication mode")
+	ErrNotLeaderless = errors.New("not running in leaderless replication mode")
+)
+
+// replicate makes the default namespace a replica set of the leaderless members in conf,
+// namespaces are local to each member and cannot be created.
+func (app *Application) replicate(conf config.KaeyaConfig) error {
+	switch {
+	case conf.Cluster.NodeID != "":
+		return fmt.Errorf("raft cluster: %w", ErrLeaderless)
+	case conf.Sharding.Self != "":
+		return fmt.Errorf("sharding: %w", ErrLeaderless)
+	case conf.Replication.Leader != "":
+		return fmt.Errorf("replication leader %s: %w", conf.Replication.Leader, ErrLeaderless)
+	case conf.Storage.Codec != "" && codec.CodecType(conf.Storage.Codec) != codec.TypeBinary:
+		// only the binary codec stores the versions
+		return fmt.Errorf("codec %s: %w", conf.Storage.Codec, ErrLeaderless)
+	}
+
+	members := make([]sharding.Member, 0, len(conf.Dynamo.Members))
+	for _, m := range conf.Dynamo.Members {
+		members = append(members, sharding.Member{Name: m.Name, URL: m.URL})
+	}
+
+	options := []dynamo.Option{
+		dynamo.WithReplicas(conf.Dynamo.Replicas, conf.Dynamo.ReadQuorum, conf.Dynamo.WriteQuorum),
+		dynamo.WithVirtualNodes(conf.Dynamo.VirtualNodes),
+	}
+	if conf.Dynamo.AntiEntropyInterval != "" {
+		d, err := utils.ParseDuration(conf.Dynamo.AntiEntropyInterval)
+		if err != nil {
+			return fmt.Errorf("anti-entropy interval: %w", err)
+		}
+		options = append(options, dynamo.WithAntiEntropyInterval(d))
+	}
+
+	node, err := dynamo.NewNode(conf.Dynamo.Self, members, app.DB, options...)
+	if err != nil {
+		return err
+	}
+
+	app.DB = node
+	app.dynamo = node
+
+	logger.Logger.Info().Str("self", conf.Dynamo.Self).Int("replicas", conf.Dynamo.Replicas).Msg("joined leaderless replicas")
+
+	return nil
+}
+
+// Dynamo returns the leaderless replica set of the default namespace, ErrNotLeaderless if the application runs alone.
+func (app *Application) Dynamo() (*dynamo.Node, error) {
+	if app.dynamo == nil {
+		return nil, ErrNotLeaderless
+	}
+
+	return app.dynamo, nil
+}
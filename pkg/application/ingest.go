@@ -0,0 +1,73 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var ErrIngestPath = errors.New("invalid ingest path")
+
+// Ingest adds the segment files built by kaeya-admin build to the namespace, see
+// service.DBService. files are relative to the ingest root of the config.
+func (app *Application) Ingest(ctx context.Context, namespace string, files []string, precedence string) (int, error) {
+	db, release, err := app.Namespace(namespace)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		name, err := app.ingestPath(f)
+		if err != nil {
+			return 0, err
+		}
+
+		paths = append(paths, name)
+	}
+
+	return db.Ingest(ctx, paths, precedence)
+}
+
+// ingestPath returns the file name below the ingest root with the symlinks resolved,
+// neither name nor a symlink must leave the root.
+func (app *Application) ingestPath(name string) (string, error) {
+	app.confLock.Lock()
+	root := app.conf.Ingest.Root
+	app.confLock.Unlock()
+
+	if root == "" {
+		return "", fmt.Errorf("no ingest root configured: %w", ErrIngestPath)
+	}
+
+	if !isBelow(name) {
+		return "", fmt.Errorf("%s is not below the ingest root: %w", name, ErrIngestPath)
+	}
+
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err.Error(), ErrIngestPath)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || !isBelow(rel) {
+		return "", fmt.Errorf("%s is not below the ingest root: %w", name, ErrIngestPath)
+	}
+
+	return resolved, nil
+}
+
+// isBelow reports whether the relative name stays below its directory.
+func isBelow(name string) bool {
+	rel := filepath.Clean(filepath.FromSlash(name))
+
+	return !filepath.IsAbs(rel) && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,52 @@
+package application
+
+import (
+	"fmt"
+
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
+)
+
+// scheduler returns the storage of the namespace if it runs background jobs.
+func (app *Application) scheduler(name string) (storage.Scheduler, error) {
+	repo := app.repo
+	if name != DefaultNamespace {
+		app.nsLock.RLock()
+		ns, ok := app.namespaces[name]
+		app.nsLock.RUnlock()
+
+		if !ok {
+			return nil, ErrNamespaceNotFound
+		}
+		repo = ns.repo
+	}
+
+	s, ok := repo.(storage.Scheduler)
+	if !ok {
+		return nil, fmt.Errorf("namespace %s: %w", name, storage.ErrJobsUnsupported)
+	}
+
+	return s, nil
+}
+
+// RunJob runs a storage job of the namespace now, see storage.Scheduler.
+func (app *Application) RunJob(namespace, job string) (segment.JobStatus, error) {
+	s, err := app.scheduler(namespace)
+	if err != nil {
+		return segment.JobStatus{}, err
+	}
+
+	return s.RunJob(job)
+}
+
+// PauseMerges stops or restarts the background merges of the namespace.
+func (app *Application) PauseMerges(namespace string, paused bool) error {
+	s, err := app.scheduler(namespace)
+	if err != nil {
+		return err
+	}
+
+	s.PauseMerges(paused)
+
+	return nil
+}
@@ -2,14 +2,46 @@ package application
 
 import (
 	"context"
+	"sync"
+	"time"
 
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
 	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
+	"github.com/ForeverSRC/kaeya/pkg/replication"
 	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
 	"github.com/ForeverSRC/kaeya/pkg/storage"
 )
 
 type Application struct {
 	DB service.DBService
+
+	// repo is the storage of the default namespace under the replication layers of DB
+	repo        storage.Repository
+	storageConf config.StorageConfig
+	started     time.Time
+
+	// conf is the config the application runs with, changed by Reload
+	confLock sync.Mutex
+	conf     config.KaeyaConfig
+
+	nsLock     sync.RWMutex
+	namespaces map[string]*Namespace
+
+	// follower is set while the application replicates a leader
+	roleLock sync.RWMutex
+	follower *replication.Follower
+
+	// cluster is set if the default namespace is replicated by raft
+	cluster *cluster.Node
+
+	// sharder is set if the keys are split across shards
+	sharder   *sharding.Sharder
+	shardMode string
+
+	// dynamo is set if the default namespace is replicated without a leader
+	dynamo *dynamo.Node
 }
 
 func NewApplication(conf config.KaeyaConfig) (*Application, error) {
@@ -18,11 +50,49 @@ func NewApplication(conf config.KaeyaConfig) (*Application, error) {
 		return nil, err
 	}
 
-	return &Application{
-		DB: service.NewDefaultDBService(repo),
-	}, nil
+	app := &Application{
+		DB:          service.NewDefaultDBService(repo),
+		repo:        repo,
+		storageConf: conf.Storage,
+		started:     time.Now(),
+		conf:        conf,
+		namespaces:  make(map[string]*Namespace),
+	}
+
+	err = removeBackupStaging(conf.Storage.Path)
+	if err == nil && conf.Cluster.NodeID != "" {
+		err = app.join(conf)
+	}
+	if err == nil && conf.Dynamo.Self != "" {
+		err = app.replicate(conf)
+	}
+	if err == nil {
+		err = app.loadNamespaces(conf.Namespaces)
+	}
+	if err == nil && conf.Sharding.Self != "" {
+		err = app.shard(conf)
+	}
+	if err == nil && conf.Replication.Leader != "" {
+		err = app.follow(conf.Replication)
+	}
+	if err != nil {
+		app.Close(context.Background())
+		return nil, err
+	}
+
+	return app, nil
 }
 
 func (app *Application) Close(ctx context.Context) error {
-	return app.DB.Close(ctx)
+	app.stopReplication()
+	app.stopSharding()
+
+	nsErr := app.closeNamespaces(ctx)
+
+	err := app.DB.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nsErr
 }
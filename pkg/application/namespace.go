@@ -0,0 +1,352 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+const (
+	DefaultNamespace = "default"
+
+	namespaceRootDir    = "namespaces"
+	namespaceConfigFile = "namespace.json"
+
+	fileMode = 0754
+)
+
+var (
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	ErrNamespaceExists   = errors.New("namespace already exists")
+	ErrInvalidNamespace  = errors.New("invalid namespace name")
+
+	namespaceNameExpr = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+type Namespace struct {
+	Name    string               `json:"name"`
+	Storage config.StorageConfig `json:"storage"`
+
+	db   service.DBService
+	repo storage.Repository
+	// users counts the callers of Namespace still using db, a drop waits for them
+	users *sync.WaitGroup
+	// dropped is set once a drop started, the namespace takes no new users
+	dropped bool
+	// closed is set by a drop which failed to remove the data, the storage cannot be closed twice
+	closed bool
+}
+
+func (app *Application) namespacePath(name string) string {
+	return path.Join(app.storageConf.Path, namespaceRootDir, name)
+}
+
+// Namespace returns the DBService of the namespace with the given name and the func
+// to call once done with it, a drop closes the DBService after that.
+func (app *Application) Namespace(name string) (service.DBService, func(), error) {
+	if name == DefaultNamespace {
+		return app.DB, func() {}, nil
+	}
+
+	app.nsLock.RLock()
+	defer app.nsLock.RUnlock()
+
+	ns, ok := app.namespaces[name]
+	if !ok || ns.dropped {
+		return nil, nil, ErrNamespaceNotFound
+	}
+
+	ns.users.Add(1)
+
+	return ns.db, ns.users.Done, nil
+}
+
+func (app *Application) ListNamespaces() []Namespace {
+	app.nsLock.RLock()
+	defer app.nsLock.RUnlock()
+
+	res := make([]Namespace, 0, len(app.namespaces)+1)
+	res = append(res, Namespace{Name: DefaultNamespace, Storage: app.storageConf})
+	for _, ns := range app.namespaces {
+		if !ns.dropped {
+			res = append(res, *ns)
+		}
+	}
+
+	sort.Slice(res[1:], func(i, j int) bool {
+		return res[i+1].Name < res[j+1].Name
+	})
+
+	return res
+}
+
+// CreateNamespace creates a namespace stored under its own directory.
+// Fields left empty in conf are inherited from the root storage config.
+func (app *Application) CreateNamespace(name string, conf config.StorageConfig) (Namespace, error) {
+	if !namespaceNameExpr.MatchString(name) {
+		return Namespace{}, ErrInvalidNamespace
+	}
+
+	if app.cluster != nil {
+		return Namespace{}, fmt.Errorf("create namespace %s: %w", name, ErrClustered)
+	}
+	if app.dynamo != nil {
+		return Namespace{}, fmt.Errorf("create namespace %s: %w", name, ErrLeaderless)
+	}
+
+	app.nsLock.Lock()
+	defer app.nsLock.Unlock()
+
+	if _, ok := app.namespaces[name]; ok || name == DefaultNamespace {
+		return Namespace{}, ErrNamespaceExists
+	}
+
+	conf.Path = ""
+	conf = conf.Inherit(app.storageConf)
+
+	err := config.ValidateStorage(conf)
+	if err != nil {
+		return Namespace{}, fmt.Errorf("invalid storage config: %w", err)
+	}
+
+	nsPath := app.namespacePath(name)
+	if utils.PathExists(nsPath) {
+		return Namespace{}, ErrNamespaceExists
+	}
+
+	err = os.MkdirAll(nsPath, fileMode)
+	if err != nil {
+		return Namespace{}, err
+	}
+
+	err = writeNamespaceConfig(nsPath, conf)
+	if err != nil {
+		os.RemoveAll(nsPath)
+		return Namespace{}, err
+	}
+
+	ns, err := app.openNamespace(name, conf)
+	if err != nil {
+		os.RemoveAll(nsPath)
+		return Namespace{}, err
+	}
+
+	app.namespaces[name] = ns
+
+	return *ns, nil
+}
+
+// DropNamespace closes the namespace and removes all of its data. The namespace is not
+// found from then on, it is closed once its current users are done or ctx is.
+// The namespace is only forgotten once its directory is gone, otherwise it would come
+// back on the next start.
+func (app *Application) DropNamespace(ctx context.Context, name string) error {
+	app.nsLock.Lock()
+	ns, ok := app.namespaces[name]
+	if ok {
+		ns.dropped = true
+	}
+	app.nsLock.Unlock()
+
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+
+	err := ns.drain(ctx)
+	if err != nil {
+		return fmt.Errorf("drop namespace %s error: %w", name, err)
+	}
+
+	app.nsLock.Lock()
+	defer app.nsLock.Unlock()
+
+	if app.namespaces[name] != ns {
+		// dropped by a concurrent drop
+		return ErrNamespaceNotFound
+	}
+
+	if !ns.closed {
+		ns.closed = true
+
+		err := ns.db.Close(ctx)
+		if err != nil {
+			return fmt.Errorf("close namespace %s error: %w", name, err)
+		}
+	}
+
+	err = os.RemoveAll(app.namespacePath(name))
+	if err != nil {
+		return fmt.Errorf("remove namespace %s error: %w", name, err)
+	}
+
+	delete(app.namespaces, name)
+
+	return nil
+}
+
+// drain waits for the users of the dropped namespace.
+func (ns *Namespace) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ns.users.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (app *Application) openNamespace(name string, conf config.StorageConfig) (*Namespace, error) {
+	conf.Path = app.namespacePath(name)
+
+	repo, err := storage.NewStorage(conf)
+	if err != nil {
+		return nil, fmt.Errorf("open namespace %s error: %w", name, err)
+	}
+
+	conf.Path = ""
+
+	return &Namespace{
+		Name:    name,
+		Storage: conf,
+		db:      service.NewDefaultDBService(repo),
+		repo:    repo,
+		users:   &sync.WaitGroup{},
+	}, nil
+}
+
+// loadNamespaces opens every namespace created before the last shutdown,
+// then creates the ones declared in the config file but missing on disk.
+func (app *Application) loadNamespaces(declared map[string]config.StorageConfig) error {
+	entries, err := os.ReadDir(path.Join(app.storageConf.Path, namespaceRootDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		name := e.Name()
+		conf, err := readNamespaceConfig(app.namespacePath(name))
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+
+		ns, err := app.openNamespace(name, conf.Inherit(app.storageConf))
+		if err != nil {
+			return err
+		}
+
+		app.namespaces[name] = ns
+	}
+
+	for name, conf := range declared {
+		if _, ok := app.namespaces[name]; ok {
+			continue
+		}
+
+		_, err = app.CreateNamespace(name, conf)
+		if err != nil {
+			return fmt.Errorf("create namespace %s error: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func writeNamespaceConfig(nsPath string, conf config.StorageConfig) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path.Join(nsPath, namespaceConfigFile), data, fileMode)
+	if err != nil {
+		return fmt.Errorf("write namespace config error: %w", err)
+	}
+
+	return nil
+}
+
+func readNamespaceConfig(nsPath string) (config.StorageConfig, error) {
+	var conf config.StorageConfig
+
+	data, err := os.ReadFile(path.Join(nsPath, namespaceConfigFile))
+	if err != nil {
+		return conf, fmt.Errorf("read config error: %w", err)
+	}
+
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return conf, fmt.Errorf("parse config error: %w", err)
+	}
+
+	return conf, nil
+}
+
+// OfflineNamespaces lists the default namespace and every namespace on disk under
+// the root storage without opening them, for tools working on a stopped server.
+// Unlike ListNamespaces the Path of every storage is set.
+func OfflineNamespaces(root config.StorageConfig) ([]Namespace, error) {
+	res := []Namespace{{Name: DefaultNamespace, Storage: root}}
+
+	nsRoot := path.Join(root.Path, namespaceRootDir)
+	entries, err := os.ReadDir(nsRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		nsPath := path.Join(nsRoot, e.Name())
+		conf, err := readNamespaceConfig(nsPath)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", e.Name(), err)
+		}
+
+		conf = conf.Inherit(root)
+		conf.Path = nsPath
+		res = append(res, Namespace{Name: e.Name(), Storage: conf})
+	}
+
+	return res, nil
+}
+
+func (app *Application) closeNamespaces(ctx context.Context) error {
+	app.nsLock.Lock()
+	defer app.nsLock.Unlock()
+
+	var res error
+	for name, ns := range app.namespaces {
+		if ns.closed {
+			continue
+		}
+
+		err := ns.db.Close(ctx)
+		if err != nil && res == nil {
+			res = fmt.Errorf("close namespace %s error: %w", name, err)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,160 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+)
+
+var ErrRestartRequired = errors.New("config changes need a restart")
+
+// Reload applies conf while serving: the log level, the refresh, flush and merge intervals
+// and the merge floor of the default namespace. The namespaces having the previous value of
+// one of them, like the ones which inherited it, take the new one. Nothing is applied if
+// anything else changed, ErrRestartRequired names the changed sections, or if any of the
+// new values is invalid.
+func (app *Application) Reload(conf config.KaeyaConfig) error {
+	app.confLock.Lock()
+	defer app.confLock.Unlock()
+
+	changed := restartChanges(app.conf, conf)
+	if len(changed) > 0 {
+		return fmt.Errorf("%s: %w", strings.Join(changed, ", "), ErrRestartRequired)
+	}
+
+	err := logger.ValidateLevel(conf.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	if conf.Storage.Segment != app.conf.Storage.Segment {
+		err = app.reconfigureStorage(app.conf.Storage.Segment, conf.Storage)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.Log.Level != app.conf.Log.Level {
+		// logged before the change, which may hide it
+		logger.Logger.Info().Str("from", app.conf.Log.Level).Str("to", conf.Log.Level).Msg("log level changed")
+		err = logger.SetLevel(conf.Log.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.conf = conf
+
+	return nil
+}
+
+type namespaceChange struct {
+	name string
+	ns   *Namespace
+	conf config.StorageConfig
+}
+
+// reconfigureStorage applies the segment settings of conf changed from prev to the default
+// namespace and to the namespaces which have the previous value. All of them are validated
+// and the namespace configs, which store the inherited values for the next start, are
+// rewritten before any repository changes, a failed write restores the ones already written.
+func (app *Application) reconfigureStorage(prev config.SegmentSysConfig, conf config.StorageConfig) error {
+	app.nsLock.Lock()
+	defer app.nsLock.Unlock()
+
+	err := storage.ValidateTunables(conf)
+	if err != nil {
+		return err
+	}
+
+	changes := make([]namespaceChange, 0)
+	for name, ns := range app.namespaces {
+		if ns.closed {
+			continue
+		}
+
+		nsConf := ns.Storage
+		follow(&nsConf.Segment.RefreshInterval, prev.RefreshInterval, conf.Segment.RefreshInterval)
+		follow(&nsConf.Segment.FlushInterval, prev.FlushInterval, conf.Segment.FlushInterval)
+		follow(&nsConf.Segment.MergeInterval, prev.MergeInterval, conf.Segment.MergeInterval)
+		follow(&nsConf.Segment.MergeFloor, prev.MergeFloor, conf.Segment.MergeFloor)
+		if nsConf.Segment == ns.Storage.Segment {
+			continue
+		}
+
+		err = storage.ValidateTunables(nsConf)
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+
+		changes = append(changes, namespaceChange{name: name, ns: ns, conf: nsConf})
+	}
+
+	for i, c := range changes {
+		err = writeNamespaceConfig(app.namespacePath(c.name), c.conf)
+		if err == nil {
+			continue
+		}
+
+		for _, written := range changes[:i] {
+			restoreErr := writeNamespaceConfig(app.namespacePath(written.name), written.ns.Storage)
+			if restoreErr != nil {
+				logger.Logger.Error().Err(restoreErr).Str("namespace", written.name).Msg("restore namespace config error")
+			}
+		}
+
+		return fmt.Errorf("namespace %s: %w", c.name, err)
+	}
+
+	// validated above, the repositories take every value from here
+	err = storage.Reconfigure(conf, app.repo)
+	if err != nil {
+		return err
+	}
+
+	// the namespaces created from now on inherit conf
+	app.storageConf.Segment = conf.Segment
+
+	for _, c := range changes {
+		err = storage.Reconfigure(c.conf, c.ns.repo)
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", c.name, err)
+		}
+
+		c.ns.Storage = c.conf
+	}
+
+	return nil
+}
+
+func follow(value *string, prev, next string) {
+	if *value == prev {
+		*value = next
+	}
+}
+
+// restartChanges returns the config sections changed from prev to next besides the
+// ones Reload applies.
+func restartChanges(prev, next config.KaeyaConfig) []string {
+	// the settings applied live are taken as unchanged
+	next.Log.Level = prev.Log.Level
+	next.Storage.Segment.RefreshInterval = prev.Storage.Segment.RefreshInterval
+	next.Storage.Segment.FlushInterval = prev.Storage.Segment.FlushInterval
+	next.Storage.Segment.MergeInterval = prev.Storage.Segment.MergeInterval
+	next.Storage.Segment.MergeFloor = prev.Storage.Segment.MergeFloor
+
+	var res []string
+	p, n := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := 0; i < p.NumField(); i++ {
+		if !reflect.DeepEqual(p.Field(i).Interface(), n.Field(i).Interface()) {
+			res = append(res, p.Type().Field(i).Tag.Get("mapstructure"))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,171 @@
+package application_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func reloadConfig() config.KaeyaConfig {
+	return config.KaeyaConfig{
+		Log: config.LogConfig{Level: "info"},
+		Storage: config.StorageConfig{
+			Path:   path.Join("testdata", "dynamic", utils.ID()),
+			System: "fs",
+			Codec:  "csv",
+			Segment: config.SegmentSysConfig{
+				RefreshInterval: "1s",
+				FlushInterval:   "1s",
+				MergeInterval:   "1m",
+				MergeFloor:      "2k",
+			},
+		},
+	}
+}
+
+func newApplication(t *testing.T, conf config.KaeyaConfig) *application.Application {
+	app, err := application.NewApplication(conf)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		app.Close(context.Background())
+	})
+
+	return app
+}
+
+func namespaceSegment(t *testing.T, app *application.Application, name string) config.SegmentSysConfig {
+	for _, ns := range app.ListNamespaces() {
+		if ns.Name == name {
+			return ns.Storage.Segment
+		}
+	}
+
+	t.Fatalf("namespace %s not found", name)
+	return config.SegmentSysConfig{}
+}
+
+func savedSegment(t *testing.T, conf config.KaeyaConfig, name string) config.SegmentSysConfig {
+	data, err := os.ReadFile(path.Join(conf.Storage.Path, "namespaces", name, "namespace.json"))
+	assert.NoError(t, err)
+
+	var saved config.StorageConfig
+	assert.NoError(t, json.Unmarshal(data, &saved))
+
+	return saved.Segment
+}
+
+func TestReload(t *testing.T) {
+	conf := reloadConfig()
+	app := newApplication(t, conf)
+
+	_, err := app.CreateNamespace("inherited", config.StorageConfig{})
+	assert.NoError(t, err)
+	_, err = app.CreateNamespace("own", config.StorageConfig{Segment: config.SegmentSysConfig{RefreshInterval: "5s"}})
+	assert.NoError(t, err)
+
+	next := conf
+	next.Storage.Segment.RefreshInterval = "2s"
+	next.Storage.Segment.MergeFloor = "4k"
+	assert.NoError(t, app.Reload(next))
+
+	// only the values equal to the previous ones follow
+	inherited := namespaceSegment(t, app, "inherited")
+	assert.Equal(t, "2s", inherited.RefreshInterval)
+	assert.Equal(t, "4k", inherited.MergeFloor)
+	assert.Equal(t, inherited, savedSegment(t, conf, "inherited"))
+
+	own := namespaceSegment(t, app, "own")
+	assert.Equal(t, "5s", own.RefreshInterval)
+	assert.Equal(t, "4k", own.MergeFloor)
+	assert.Equal(t, own, savedSegment(t, conf, "own"))
+
+	// the namespaces created later inherit the new values
+	_, err = app.CreateNamespace("later", config.StorageConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2s", namespaceSegment(t, app, "later").RefreshInterval)
+}
+
+func TestReloadRestartRequired(t *testing.T) {
+	conf := reloadConfig()
+	app := newApplication(t, conf)
+
+	next := conf
+	next.Storage.Segment.RefreshInterval = "2s"
+	next.Storage.Segment.BufferSize = "1m"
+	next.Server.Addr = ":9999"
+	err := app.Reload(next)
+	assert.True(t, errors.Is(err, application.ErrRestartRequired))
+	assert.Contains(t, err.Error(), "server, storage")
+
+	// nothing of it applied, the live settings alone are accepted afterwards
+	_, err = app.CreateNamespace("ns", config.StorageConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1s", namespaceSegment(t, app, "ns").RefreshInterval)
+
+	next = conf
+	next.Log.Level = "warn"
+	next.Storage.Segment.FlushInterval = "3s"
+	assert.NoError(t, app.Reload(next))
+	assert.Equal(t, "3s", namespaceSegment(t, app, "ns").FlushInterval)
+	assert.NoError(t, app.Reload(conf))
+}
+
+func TestReloadInvalid(t *testing.T) {
+	conf := reloadConfig()
+	app := newApplication(t, conf)
+
+	_, err := app.CreateNamespace("ns", config.StorageConfig{})
+	assert.NoError(t, err)
+
+	// an invalid value anywhere leaves the valid ones unapplied
+	next := conf
+	next.Storage.Segment.RefreshInterval = "2s"
+	next.Log.Level = "loud"
+	assert.Error(t, app.Reload(next))
+
+	next = conf
+	next.Storage.Segment.RefreshInterval = "2s"
+	next.Storage.Segment.FlushInterval = "0s"
+	assert.Error(t, app.Reload(next))
+
+	assert.Equal(t, conf.Storage.Segment, namespaceSegment(t, app, "ns"))
+	assert.Equal(t, conf.Storage.Segment, savedSegment(t, conf, "ns"))
+}
+
+func TestReloadWriteFailed(t *testing.T) {
+	conf := reloadConfig()
+	app := newApplication(t, conf)
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := app.CreateNamespace(name, config.StorageConfig{})
+		assert.NoError(t, err)
+	}
+
+	// the config of b cannot be rewritten
+	file := path.Join(conf.Storage.Path, "namespaces", "b", "namespace.json")
+	assert.NoError(t, os.Remove(file))
+	assert.NoError(t, os.Mkdir(file, 0755))
+
+	next := conf
+	next.Storage.Segment.RefreshInterval = "2s"
+	assert.Error(t, app.Reload(next))
+
+	for _, name := range []string{"a", "c"} {
+		assert.Equal(t, conf.Storage.Segment, namespaceSegment(t, app, name))
+		assert.Equal(t, conf.Storage.Segment, savedSegment(t, conf, name))
+	}
+
+	// the change is applied once the config can be written
+	assert.NoError(t, os.Remove(file))
+	assert.NoError(t, app.Reload(next))
+	assert.Equal(t, "2s", namespaceSegment(t, app, "b").RefreshInterval)
+	assert.Equal(t, "2s", savedSegment(t, conf, "b").RefreshInterval)
+}
@@ -0,0 +1,139 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/replication"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+
+	listLeaderNamespacesTimeout = 10 * time.Second
+)
+
+var (
+	ErrReadOnly    = errors.New("read-only follower")
+	ErrNotFollower = errors.New("not a follower")
+)
+
+type ReplicationStatus struct {
+	Role    string                     `json:"role"`
+	Leader  string                     `json:"leader,omitempty"`
+	Streams []replication.StreamStatus `json:"streams,omitempty"`
+}
+
+// follow makes the application a read-only follower of the leader in conf. Every local
+// namespace is replicated, the ones of the leader missing locally are created first.
+// Namespaces created on the leader later are replicated after a restart.
+func (app *Application) follow(conf config.ReplicationConfig) error {
+	options := make([]replication.Option, 0)
+	if conf.RetryInterval != "" {
+		d, err := utils.ParseDuration(conf.RetryInterval)
+		if err != nil {
+			return err
+		}
+		options = append(options, replication.WithRetryInterval(d))
+	}
+
+	follower := replication.NewFollower(conf.Leader, options...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), listLeaderNamespacesTimeout)
+	defer cancel()
+
+	leaderNamespaces, err := follower.Namespaces(ctx)
+	if err != nil {
+		logger.Logger.Warn().Err(err).Msg("list namespaces of leader error, replicating the local ones")
+	}
+
+	for _, ns := range leaderNamespaces {
+		if ns.Name == DefaultNamespace {
+			continue
+		}
+
+		if _, release, err := app.Namespace(ns.Name); err == nil {
+			release()
+			continue
+		}
+
+		_, err = app.CreateNamespace(ns.Name, ns.Storage)
+		if err != nil {
+			logger.Logger.Error().Err(err).Str("namespace", ns.Name).Msg("create namespace of leader error")
+		}
+	}
+
+	app.roleLock.Lock()
+	defer app.roleLock.Unlock()
+
+	follower.Replicate(DefaultNamespace, "", app.DB)
+	for _, ns := range app.ListNamespaces()[1:] {
+		follower.Replicate(ns.Name, "/ns/"+ns.Name, ns.db)
+	}
+
+	app.follower = follower
+
+	return nil
+}
+
+// ReadOnly is true for a follower, which only changes by the replication of its leader.
+func (app *Application) ReadOnly() bool {
+	app.roleLock.RLock()
+	defer app.roleLock.RUnlock()
+
+	return app.follower != nil
+}
+
+// Promote stops following the leader and accepts writes from then on,
+// changes of the leader not yet replicated are lost.
+func (app *Application) Promote() (ReplicationStatus, error) {
+	app.roleLock.Lock()
+	defer app.roleLock.Unlock()
+
+	if app.follower == nil {
+		return ReplicationStatus{}, ErrNotFollower
+	}
+
+	app.follower.Stop()
+
+	res := ReplicationStatus{
+		Role:    RoleLeader,
+		Leader:  app.follower.Leader(),
+		Streams: app.follower.Status(),
+	}
+	app.follower = nil
+
+	logger.Logger.Info().Str("leader", res.Leader).Msg("promoted to leader")
+
+	return res, nil
+}
+
+func (app *Application) ReplicationStatus() ReplicationStatus {
+	app.roleLock.RLock()
+	defer app.roleLock.RUnlock()
+
+	if app.follower == nil {
+		return ReplicationStatus{Role: RoleLeader}
+	}
+
+	return ReplicationStatus{
+		Role:    RoleFollower,
+		Leader:  app.follower.Leader(),
+		Streams: app.follower.Status(),
+	}
+}
+
+func (app *Application) stopReplication() {
+	app.roleLock.Lock()
+	defer app.roleLock.Unlock()
+
+	if app.follower != nil {
+		app.follower.Stop()
+		app.follower = nil
+	}
+}
@@ -0,0 +1,73 @@
+package application
+
+import (
+	"errors"
+	"path"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+)
+
+const (
+	ShardModeForward  = "forward"
+	ShardModeRedirect = "redirect"
+
+	shardingStateFile = "sharding.json"
+)
+
+var ErrNotSharded = errors.New("not running in sharding mode")
+
+// shard makes the application a member of the shards in conf, the topology
+// updates are kept in the storage path.
+func (app *Application) shard(conf config.KaeyaConfig) error {
+	topology := sharding.Topology{Members: make([]sharding.Member, 0, len(conf.Sharding.Members))}
+	for _, m := range conf.Sharding.Members {
+		topology.Members = append(topology.Members, sharding.Member{Name: m.Name, URL: m.URL})
+	}
+
+	sharder, err := sharding.NewSharder(conf.Sharding.Self, topology, app.databases,
+		sharding.WithVirtualNodes(conf.Sharding.VirtualNodes),
+		sharding.WithStateFile(path.Join(conf.Storage.Path, shardingStateFile)))
+	if err != nil {
+		return err
+	}
+
+	app.sharder = sharder
+	app.shardMode = conf.Sharding.Mode
+	if app.shardMode == "" {
+		app.shardMode = ShardModeForward
+	}
+
+	return nil
+}
+
+func (app *Application) databases() map[string]service.DBService {
+	app.nsLock.RLock()
+	defer app.nsLock.RUnlock()
+
+	res := make(map[string]service.DBService, len(app.namespaces)+1)
+	res[DefaultNamespace] = app.DB
+	for name, ns := range app.namespaces {
+		if !ns.dropped {
+			res[name] = ns.db
+		}
+	}
+
+	return res
+}
+
+// Sharder returns the sharder and the mode of serving keys of other members, ErrNotSharded if the application runs alone.
+func (app *Application) Sharder() (*sharding.Sharder, string, error) {
+	if app.sharder == nil {
+		return nil, "", ErrNotSharded
+	}
+
+	return app.sharder, app.shardMode, nil
+}
+
+func (app *Application) stopSharding() {
+	if app.sharder != nil {
+		app.sharder.Close()
+	}
+}
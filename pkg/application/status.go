@@ -0,0 +1,39 @@
+package application
+
+import (
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+)
+
+// Status is the state of the storage engines for the on-call.
+type Status struct {
+	Started    time.Time                 `json:"started"`
+	Uptime     string                    `json:"uptime"`
+	Storage    storage.Status            `json:"storage"`
+	Namespaces map[string]storage.Status `json:"namespaces,omitempty"`
+}
+
+func (app *Application) Status() Status {
+	// a reload changes the storage config under the lock
+	app.nsLock.RLock()
+	defer app.nsLock.RUnlock()
+
+	status := Status{
+		Started: app.started,
+		Uptime:  time.Since(app.started).Round(time.Second).String(),
+		Storage: storage.StatusOf(app.storageConf, app.repo),
+	}
+
+	if len(app.namespaces) > 0 {
+		status.Namespaces = make(map[string]storage.Status, len(app.namespaces))
+	}
+
+	for name, ns := range app.namespaces {
+		conf := ns.Storage
+		conf.Path = app.namespacePath(name)
+		status.Namespaces[name] = storage.StatusOf(conf, ns.repo)
+	}
+
+	return status
+}
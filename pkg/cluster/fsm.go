@@ -0,0 +1,154 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+	"github.com/hashicorp/raft"
+)
+
+// command is the payload of a raft log entry, a single write is a batch of one op.
+type command struct {
+	Ops []service.Op `json:"ops"`
+}
+
+// fsm applies the committed commands to the local db. Snapshots are checkpoints of the
+// storage streamed as backup tars, restoring one replaces the content of the local db.
+type fsm struct {
+	db          service.DBService
+	storageConf config.StorageConfig
+	tmpDir      string
+}
+
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	var cmd command
+	err := json.Unmarshal(entry.Data, &cmd)
+	if err != nil {
+		return fmt.Errorf("decode raft log %d error: %w", entry.Index, err)
+	}
+
+	return f.db.Batch(context.Background(), cmd.Ops)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	dir, err := os.MkdirTemp(f.tmpDir, "snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.db.Checkpoint(context.Background(), dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("checkpoint for snapshot error: %w", err)
+	}
+
+	return &fsmSnapshot{dir: dir}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	dir := path.Join(f.tmpDir, "restore")
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = backup.RestoreTar(rc, dir, "")
+	if err != nil {
+		return fmt.Errorf("extract snapshot error: %w", err)
+	}
+
+	conf := f.storageConf
+	conf.Path = dir
+
+	repo, err := storage.NewStorage(conf)
+	if err != nil {
+		return fmt.Errorf("open snapshot error: %w", err)
+	}
+
+	snapshot := service.NewDefaultDBService(repo)
+	defer snapshot.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n, err := service.Replace(ctx, f.db, newScanReader(ctx, snapshot))
+	if err != nil {
+		return fmt.Errorf("restore snapshot error: %w", err)
+	}
+
+	logger.Logger.Info().Int("keys", n).Msg("restored raft snapshot")
+
+	return nil
+}
+
+type fsmSnapshot struct {
+	dir string
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := backup.WriteTar(s.dir, sink, "")
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	os.RemoveAll(s.dir)
+}
+
+// scanReader reads the kvs of a db scan, the scan runs until ctx is done or every kv is read.
+type scanReader struct {
+	ch  chan domain.KV
+	err error
+}
+
+func newScanReader(ctx context.Context, db service.DBService) *scanReader {
+	r := &scanReader{
+		ch: make(chan domain.KV),
+	}
+
+	go func() {
+		defer close(r.ch)
+
+		r.err = db.Scan(ctx, "", func(kv domain.KV) error {
+			select {
+			case r.ch <- kv:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	return r
+}
+
+func (r *scanReader) Read() (domain.KV, error) {
+	kv, ok := <-r.ch
+	if ok {
+		return kv, nil
+	}
+
+	// the scan has ended, err is set before ch was closed
+	if r.err != nil {
+		return domain.KV{}, r.err
+	}
+
+	return domain.KV{}, io.EOF
+}
@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+)
+
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+type Status struct {
+	ID           string   `json:"id"`
+	State        string   `json:"state"`
+	Leader       string   `json:"leader"`
+	Term         uint64   `json:"term"`
+	LastIndex    uint64   `json:"last_index"`
+	AppliedIndex uint64   `json:"applied_index"`
+	Members      []Member `json:"members"`
+}
+
+func (n *Node) Status() (Status, error) {
+	future := n.raft.GetConfiguration()
+	err := future.Error()
+	if err != nil {
+		return Status{}, err
+	}
+
+	leader, _ := n.Leader()
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	res := Status{
+		ID:           n.id,
+		State:        n.raft.State().String(),
+		Leader:       leader,
+		Term:         term,
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+		Members:      make([]Member, 0, len(future.Configuration().Servers)),
+	}
+
+	for _, server := range future.Configuration().Servers {
+		res.Members = append(res.Members, Member{
+			ID:      string(server.ID),
+			Address: string(server.Address),
+			Voter:   server.Suffrage == raft.Voter,
+			Leader:  string(server.ID) == leader,
+		})
+	}
+
+	return res, nil
+}
+
+// AddMember adds the node id listening on the raft address addr, a non-voter receives the
+// log but takes no part in elections. Adding an existing id updates its address.
+func (n *Node) AddMember(id, addr string, voter bool) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+
+	var future raft.IndexFuture
+	if voter {
+		future = n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, n.applyTimeout)
+	} else {
+		future = n.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, n.applyTimeout)
+	}
+
+	err := future.Error()
+	if err != nil {
+		return fmt.Errorf("add member %s error: %w", id, n.raftError(err))
+	}
+
+	return nil
+}
+
+// RemoveMember removes the node id from the cluster, removing the leader itself makes it step down.
+func (n *Node) RemoveMember(id string) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+
+	err := n.raft.RemoveServer(raft.ServerID(id), 0, n.applyTimeout).Error()
+	if err != nil {
+		return fmt.Errorf("remove member %s error: %w", id, n.raftError(err))
+	}
+
+	return nil
+}
+
+// Snapshot takes a raft snapshot now and compacts the log, members far behind install it.
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
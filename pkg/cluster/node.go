@@ -0,0 +1,473 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	defaultApplyTimeout = 10 * time.Second
+
+	transportMaxPool = 3
+	transportTimeout = 10 * time.Second
+	retainSnapshots  = 2
+
+	// ops of an Import per raft log entry
+	importBatchSize = 1000
+)
+
+var (
+	ErrNotLeader = errors.New("not the raft leader")
+	ErrNoNodeID  = errors.New("cluster node id is empty")
+)
+
+type Option func(n *Node)
+
+// WithTransport replaces the tcp transport on the raft address, like a raft.InmemTransport in tests.
+func WithTransport(transport raft.Transport) Option {
+	return func(n *Node) {
+		n.transport = transport
+	}
+}
+
+// WithStores replaces the bolt log store and the file snapshot store in the raft dir.
+func WithStores(logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore) Option {
+	return func(n *Node) {
+		n.logs = logs
+		n.stable = stable
+		n.snapshots = snapshots
+	}
+}
+
+// WithRaftConfig changes the raft config before the node starts, like the timeouts.
+func WithRaftConfig(fn func(c *raft.Config)) Option {
+	return func(n *Node) {
+		n.configure = fn
+	}
+}
+
+// WithLogLevel sets the level of the raft logs, info by default.
+func WithLogLevel(level string) Option {
+	return func(n *Node) {
+		n.logLevel = level
+	}
+}
+
+// WithApplyTimeout sets how long a write or a read waits for the raft log.
+func WithApplyTimeout(timeout time.Duration) Option {
+	return func(n *Node) {
+		n.applyTimeout = timeout
+	}
+}
+
+// Node is a DBService replicated by raft. Writes are appended to the raft log on the leader
+// and applied to the local db of every member once committed. Reads are served by the leader
+// only after it confirmed its leadership and refreshed the local db, so they see every write
+// acknowledged before.
+type Node struct {
+	id    string
+	local service.DBService
+	raft  *raft.Raft
+
+	transport raft.Transport
+	logs      raft.LogStore
+	stable    raft.StableStore
+	snapshots raft.SnapshotStore
+	closers   []io.Closer
+
+	configure    func(c *raft.Config)
+	logLevel     string
+	applyTimeout time.Duration
+
+	// ready is closed once the leader applied the entries of the earlier terms,
+	// it is replaced when the leadership is lost
+	readyLock sync.Mutex
+	ready     chan struct{}
+
+	notify chan bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewNode starts the raft member conf.NodeID on top of local, the raft state lives in dir.
+// storageConf opens the checkpoints of raft snapshots.
+func NewNode(conf config.ClusterConfig, dir string, local service.DBService, storageConf config.StorageConfig, options ...Option) (*Node, error) {
+	if conf.NodeID == "" {
+		return nil, ErrNoNodeID
+	}
+
+	n := &Node{
+		id:           conf.NodeID,
+		local:        local,
+		logLevel:     "info",
+		applyTimeout: defaultApplyTimeout,
+		ready:        make(chan struct{}),
+		notify:       make(chan bool, 1),
+		stop:         make(chan struct{}),
+	}
+
+	for _, op := range options {
+		op(n)
+	}
+
+	err := n.start(conf, dir, storageConf)
+	if err != nil {
+		n.closeStores()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *Node) start(conf config.ClusterConfig, dir string, storageConf config.StorageConfig) error {
+	tmpDir := path.Join(dir, "tmp")
+	err := os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	raftLogger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.LevelFromString(n.logLevel),
+		Output: os.Stderr,
+	})
+
+	if n.transport == nil {
+		transport, err := raft.NewTCPTransportWithLogger(conf.RaftAddr, nil, transportMaxPool, transportTimeout, raftLogger)
+		if err != nil {
+			return fmt.Errorf("raft transport on %s error: %w", conf.RaftAddr, err)
+		}
+		n.transport = transport
+	}
+	if closer, ok := n.transport.(io.Closer); ok {
+		n.closers = append(n.closers, closer)
+	}
+
+	if n.logs == nil {
+		store, err := raftboltdb.NewBoltStore(path.Join(dir, "raft.db"))
+		if err != nil {
+			return fmt.Errorf("open raft log error: %w", err)
+		}
+		n.logs, n.stable = store, store
+		n.closers = append(n.closers, store)
+
+		n.snapshots, err = raft.NewFileSnapshotStoreWithLogger(dir, retainSnapshots, raftLogger)
+		if err != nil {
+			return fmt.Errorf("open raft snapshots error: %w", err)
+		}
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(conf.NodeID)
+	rc.Logger = raftLogger
+	rc.NotifyCh = n.notify
+	if n.configure != nil {
+		n.configure(rc)
+	}
+
+	f := &fsm{db: n.local, storageConf: storageConf, tmpDir: tmpDir}
+
+	if conf.Bootstrap {
+		exists, err := raft.HasExistingState(n.logs, n.stable, n.snapshots)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			err = raft.BootstrapCluster(rc, n.logs, n.stable, n.snapshots, n.transport, raft.Configuration{
+				Servers: []raft.Server{{
+					Suffrage: raft.Voter,
+					ID:       rc.LocalID,
+					Address:  n.transport.LocalAddr(),
+				}},
+			})
+			if err != nil {
+				return fmt.Errorf("bootstrap cluster error: %w", err)
+			}
+			logger.Logger.Info().Str("node", conf.NodeID).Msg("bootstrapped raft cluster")
+		}
+	}
+
+	n.raft, err = raft.NewRaft(rc, f, n.logs, n.stable, n.snapshots, n.transport)
+	if err != nil {
+		return fmt.Errorf("start raft error: %w", err)
+	}
+
+	n.wg.Add(1)
+	go n.watchLeadership()
+
+	return nil
+}
+
+// watchLeadership applies a barrier when the node becomes the leader, the reads wait for it.
+func (n *Node) watchLeadership() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case leader := <-n.notify:
+			if !leader {
+				n.setReady(false)
+				continue
+			}
+
+			err := n.raft.Barrier(n.applyTimeout).Error()
+			if err != nil {
+				logger.Logger.Warn().Err(err).Msg("raft barrier of new leader error")
+				continue
+			}
+
+			n.setReady(true)
+			logger.Logger.Info().Str("node", n.id).Msg("became raft leader")
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *Node) setReady(ready bool) {
+	n.readyLock.Lock()
+	defer n.readyLock.Unlock()
+
+	select {
+	case <-n.ready:
+		if !ready {
+			n.ready = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(n.ready)
+		}
+	}
+}
+
+func (n *Node) readyCh() chan struct{} {
+	n.readyLock.Lock()
+	defer n.readyLock.Unlock()
+
+	return n.ready
+}
+
+// Leader returns the id and the raft address of the current leader, empty if unknown.
+func (n *Node) Leader() (string, string) {
+	addr, id := n.raft.LeaderWithID()
+	return string(id), string(addr)
+}
+
+func (n *Node) notLeader() error {
+	id, addr := n.Leader()
+	if id == "" {
+		return fmt.Errorf("no leader elected: %w", ErrNotLeader)
+	}
+
+	return fmt.Errorf("leader is %s at %s: %w", id, addr, ErrNotLeader)
+}
+
+// raftError maps the errors of a raft future, the write may still be committed
+// by a later leader if the leadership was lost after appending it.
+func (n *Node) raftError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return n.notLeader()
+	}
+
+	return err
+}
+
+func (n *Node) apply(ops []service.Op) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+
+	data, err := json.Marshal(command{Ops: ops})
+	if err != nil {
+		return err
+	}
+
+	future := n.raft.Apply(data, n.applyTimeout)
+	err = future.Error()
+	if err != nil {
+		return n.raftError(err)
+	}
+
+	if err, ok := future.Response().(error); ok && err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// linearizable waits until the node may serve a read: it is the leader, has applied
+// the entries of earlier terms and is still acknowledged by a quorum, and the applied
+// writes are visible in the local db.
+func (n *Node) linearizable(ctx context.Context) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+
+	timer := time.NewTimer(n.applyTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-n.readyCh():
+	case <-timer.C:
+		return n.notLeader()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	err := n.raftError(n.raft.VerifyLeader().Error())
+	if err != nil {
+		return err
+	}
+
+	// the applied writes may still be buffered by the local storage, like by the segment system
+	if r, ok := n.local.(storage.Refresher); ok {
+		return r.Refresh(ctx)
+	}
+
+	return nil
+}
+
+func (n *Node) Set(ctx context.Context, kv domain.KV) error {
+	return n.apply([]service.Op{{Type: service.EventPut, KV: kv}})
+}
+
+func (n *Node) Get(ctx context.Context, key string) (domain.KV, error) {
+	err := n.linearizable(ctx)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	return n.local.Get(ctx, key)
+}
+
+func (n *Node) Delete(ctx context.Context, key string) error {
+	return n.apply([]service.Op{{Type: service.EventDelete, KV: domain.KV{Key: key}}})
+}
+
+func (n *Node) Batch(ctx context.Context, ops []service.Op) error {
+	return n.apply(ops)
+}
+
+func (n *Node) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) error {
+	err := n.linearizable(ctx)
+	if err != nil {
+		return err
+	}
+
+	return n.local.Scan(ctx, prefix, fn)
+}
+
+// Import appends the kvs to the raft log in batches, a failed import may be applied partly.
+func (n *Node) Import(ctx context.Context, r common.KVReader) (int, error) {
+	count := 0
+	ops := make([]service.Op, 0, importBatchSize)
+
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+
+		err := n.apply(ops)
+		if err != nil {
+			return err
+		}
+
+		count += len(ops)
+		ops = ops[:0]
+
+		return nil
+	}
+
+	for {
+		kv, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		ops = append(ops, service.Op{Type: service.EventPut, KV: kv})
+		if len(ops) == importBatchSize {
+			err = flush()
+			if err != nil {
+				return count, err
+			}
+		}
+
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+	}
+
+	err := flush()
+
+	return count, err
+}
+
+// Ingest is not supported, segment files are local to a member.
+func (n *Node) Ingest(ctx context.Context, files []string, precedence string) (int, error) {
+	return 0, fmt.Errorf("raft cluster: %w", storage.ErrIngestUnsupported)
+}
+
+// Checkpoint snapshots the local db, it holds the writes applied by this member.
+func (n *Node) Checkpoint(ctx context.Context, dir string) error {
+	return n.local.Checkpoint(ctx, dir)
+}
+
+// Watch streams the writes applied by this member.
+func (n *Node) Watch(ctx context.Context, prefix string, fromSequence uint64) (<-chan service.Event, error) {
+	return n.local.Watch(ctx, prefix, fromSequence)
+}
+
+func (n *Node) Changes() service.ChangeLogStatus {
+	return n.local.Changes()
+}
+
+// Close stops the raft member, it stays in the cluster configuration until removed, then closes the local db.
+func (n *Node) Close(ctx context.Context) error {
+	err := n.raft.Shutdown().Error()
+
+	close(n.stop)
+	n.wg.Wait()
+
+	n.closeStores()
+
+	if localErr := n.local.Close(ctx); localErr != nil && err == nil {
+		err = localErr
+	}
+
+	return err
+}
+
+func (n *Node) closeStores() {
+	for _, closer := range n.closers {
+		if err := closer.Close(); err != nil {
+			logger.Logger.Warn().Err(err).Msg("close raft store error")
+		}
+	}
+	n.closers = nil
+}
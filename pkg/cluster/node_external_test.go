@@ -0,0 +1,203 @@
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/cluster"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+const waitTimeout = 10 * time.Second
+
+type member struct {
+	node      *cluster.Node
+	local     service.DBService
+	transport *raft.InmemTransport
+}
+
+type testCluster struct {
+	t       *testing.T
+	system  string
+	members map[string]*member
+}
+
+func newTestCluster(t *testing.T, system string) *testCluster {
+	c := &testCluster{t: t, system: system, members: make(map[string]*member)}
+	t.Cleanup(func() {
+		for _, m := range c.members {
+			m.node.Close(context.Background())
+		}
+	})
+
+	return c
+}
+
+func (c *testCluster) start(id string, bootstrap bool) *member {
+	dir := path.Join("testdata", "dynamic", utils.ID())
+	conf := config.StorageConfig{Path: path.Join(dir, "db"), System: c.system, Codec: "binary"}
+
+	repo, err := storage.NewStorage(conf)
+	assert.NoError(c.t, err)
+	local := service.NewDefaultDBService(repo)
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	for _, m := range c.members {
+		m.transport.Connect(transport.LocalAddr(), transport)
+		transport.Connect(m.transport.LocalAddr(), m.transport)
+	}
+
+	snapshots := raft.NewInmemSnapshotStore()
+	node, err := cluster.NewNode(
+		config.ClusterConfig{NodeID: id, RaftAddr: id, Bootstrap: bootstrap},
+		path.Join(dir, "raft"), local, conf,
+		cluster.WithTransport(transport),
+		cluster.WithStores(raft.NewInmemStore(), raft.NewInmemStore(), snapshots),
+		cluster.WithLogLevel("error"),
+		cluster.WithRaftConfig(func(rc *raft.Config) {
+			rc.HeartbeatTimeout = 50 * time.Millisecond
+			rc.ElectionTimeout = 50 * time.Millisecond
+			rc.LeaderLeaseTimeout = 50 * time.Millisecond
+			rc.CommitTimeout = 5 * time.Millisecond
+			rc.TrailingLogs = 1
+			rc.SnapshotThreshold = 1 << 20
+		}),
+	)
+	assert.NoError(c.t, err)
+
+	m := &member{node: node, local: local, transport: transport}
+	c.members[id] = m
+
+	return m
+}
+
+func (c *testCluster) stop(id string) {
+	m := c.members[id]
+	delete(c.members, id)
+
+	assert.NoError(c.t, m.node.Close(context.Background()))
+	for _, other := range c.members {
+		other.transport.Disconnect(m.transport.LocalAddr())
+	}
+}
+
+func (c *testCluster) leader() *member {
+	var res *member
+	assert.Eventually(c.t, func() bool {
+		for _, m := range c.members {
+			status, err := m.node.Status()
+			if err == nil && status.State == raft.Leader.String() {
+				res = m
+				return true
+			}
+		}
+		return false
+	}, waitTimeout, 10*time.Millisecond)
+
+	return res
+}
+
+// replicated waits until the local db of every member has the value of key.
+func (c *testCluster) replicated(key, value string) {
+	assert.Eventually(c.t, func() bool {
+		for _, m := range c.members {
+			kv, err := m.local.Get(context.Background(), key)
+			if err != nil || string(kv.Value) != value {
+				return false
+			}
+		}
+		return true
+	}, waitTimeout, 10*time.Millisecond, key)
+}
+
+func TestCluster(t *testing.T) {
+	// the segment system shows a write only after a refresh, the leader must not serve stale reads
+	for _, system := range []string{"fs", "segment"} {
+		t.Run(system, func(t *testing.T) {
+			runCluster(t, system)
+		})
+	}
+}
+
+func runCluster(t *testing.T, system string) {
+	ctx := context.Background()
+	c := newTestCluster(t, system)
+
+	c.start("node-1", true)
+	leader := c.leader()
+	for i := 2; i <= 3; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		c.start(id, false)
+		assert.NoError(t, leader.node.AddMember(id, id, true))
+	}
+
+	status, err := leader.node.Status()
+	assert.NoError(t, err)
+	assert.Len(t, status.Members, 3)
+	assert.Equal(t, "node-1", status.Leader)
+
+	assert.NoError(t, leader.node.Set(ctx, domain.KV{Key: "a", Value: []byte("1")}))
+	assert.NoError(t, leader.node.Batch(ctx, []service.Op{
+		{Type: service.EventPut, KV: domain.KV{Key: "b", Value: []byte("2")}},
+		{Type: service.EventDelete, KV: domain.KV{Key: "a"}},
+		{Type: service.EventPut, KV: domain.KV{Key: "c", Value: []byte("3")}},
+	}))
+
+	_, err = leader.node.Get(ctx, "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	kv, err := leader.node.Get(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), kv.Value)
+
+	c.replicated("c", "3")
+	_, err = c.members["node-2"].local.Get(ctx, "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// the followers redirect to the leader
+	follower := c.members["node-2"].node
+	assert.ErrorIs(t, follower.Set(ctx, domain.KV{Key: "x", Value: []byte("x")}), cluster.ErrNotLeader)
+	_, err = follower.Get(ctx, "b")
+	assert.ErrorIs(t, err, cluster.ErrNotLeader)
+	id, _ := follower.Leader()
+	assert.Equal(t, "node-1", id)
+
+	// a new member far behind the compacted log installs the snapshot
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, leader.node.Set(ctx, domain.KV{Key: fmt.Sprintf("k%d", i), Value: []byte(fmt.Sprint(i))}))
+	}
+	assert.NoError(t, leader.node.Snapshot())
+
+	c.start("node-4", false)
+	assert.NoError(t, leader.node.AddMember("node-4", "node-4", true))
+	c.replicated("k9", "9")
+	c.replicated("b", "2")
+	_, err = c.members["node-4"].local.Get(ctx, "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// the leader fails, the others elect a new one
+	c.stop("node-1")
+	leader = c.leader()
+	status, err = leader.node.Status()
+	assert.NoError(t, err)
+	assert.NotEqual(t, "node-1", status.Leader)
+
+	assert.NoError(t, leader.node.Set(ctx, domain.KV{Key: "d", Value: []byte("4")}))
+	kv, err = leader.node.Get(ctx, "c")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), kv.Value)
+	c.replicated("d", "4")
+
+	assert.NoError(t, leader.node.RemoveMember("node-1"))
+	status, err = leader.node.Status()
+	assert.NoError(t, err)
+	assert.Len(t, status.Members, 3)
+}
@@ -2,61 +2,223 @@ package config
 
 import (
 	"os"
-
-	"github.com/go-playground/validator/v10"
-	"github.com/mcuadros/go-defaults"
-	"github.com/spf13/viper"
 )
 
 type KaeyaConfig struct {
-	Log     LogConfig     `mapstructure:"log" validate:"required"`
-	Storage StorageConfig `mapstructure:"storage" validate:"required"`
+	Log         LogConfig                `mapstructure:"log" validate:"required"`
+	Server      ServerConfig             `mapstructure:"server"`
+	Storage     StorageConfig            `mapstructure:"storage" validate:"required"`
+	Namespaces  map[string]StorageConfig `mapstructure:"namespaces"`
+	Replication ReplicationConfig        `mapstructure:"replication"`
+	Cluster     ClusterConfig            `mapstructure:"cluster"`
+	Sharding    ShardingConfig           `mapstructure:"sharding"`
+	Dynamo      DynamoConfig             `mapstructure:"dynamo"`
+	Tracing     TracingConfig            `mapstructure:"tracing"`
+	Backup      BackupConfig             `mapstructure:"backup"`
+	Ingest      IngestConfig             `mapstructure:"ingest"`
+}
+
+// ClusterConfig makes the server a member of a raft cluster if NodeID is set,
+// the default namespace is replicated by the raft log.
+type ClusterConfig struct {
+	NodeID string `mapstructure:"node_id"`
+	// RaftAddr is the address of the raft transport, like 10.0.0.1:7000, the other members connect to it.
+	RaftAddr string `mapstructure:"raft_addr" validate:"required_with=NodeID"`
+	// Bootstrap starts a new cluster with this node as the only member, on the first start of the first node.
+	// Further members are added by the admin api of the leader.
+	Bootstrap bool `mapstructure:"bootstrap"`
+}
+
+// ShardingConfig splits the keys across the members by consistent hashing if Self is set,
+// every member has the same members and virtual nodes.
+type ShardingConfig struct {
+	// Self is the name of this server among the members.
+	Self         string `mapstructure:"self"`
+	VirtualNodes int    `mapstructure:"virtual_nodes" default:"128" validate:"min=1"`
+	// Mode is how a request for a key of another member is served, "forward" proxies it
+	// and "redirect" answers 307 with the url of the owner.
+	Mode    string              `mapstructure:"mode" default:"forward" validate:"oneof=forward redirect"`
+	Members []ShardMemberConfig `mapstructure:"members" validate:"required_with=Self,dive"`
+}
+
+// DynamoConfig replicates every key to the Replicas members following it on the ring if Self
+// is set, without a leader. Every member has the same members, replicas and virtual nodes.
+type DynamoConfig struct {
+	// Self is the name of this server among the members.
+	Self     string `mapstructure:"self"`
+	Replicas int    `mapstructure:"replicas" default:"3" validate:"min=1"`
+	// ReadQuorum and WriteQuorum are the replicas which must answer a read or a write,
+	// a request can set its own with the r and w query params.
+	ReadQuorum   int `mapstructure:"read_quorum" default:"2" validate:"min=1,ltefield=Replicas"`
+	WriteQuorum  int `mapstructure:"write_quorum" default:"2" validate:"min=1,ltefield=Replicas"`
+	VirtualNodes int `mapstructure:"virtual_nodes" default:"128" validate:"min=1"`
+	// AntiEntropyInterval is how often the replicas are compared with the other members, "0" disables it.
+	AntiEntropyInterval string              `mapstructure:"anti_entropy_interval" default:"1m" validate:"omitempty,duration"`
+	Members             []ShardMemberConfig `mapstructure:"members" validate:"required_with=Self,dive"`
+}
+
+type ShardMemberConfig struct {
+	Name string `mapstructure:"name" validate:"required"`
+	// URL of the rest api, like http://10.0.0.1:6666.
+	URL string `mapstructure:"url" validate:"required,url"`
+}
+
+// TracingConfig exports the spans of the requests over OTLP/HTTP if Endpoint is set.
+type TracingConfig struct {
+	// Endpoint is the host and port of the collector, like localhost:4318.
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure sends the spans over plain http.
+	Insecure    bool   `mapstructure:"insecure"`
+	ServiceName string `mapstructure:"service_name" default:"kaeya"`
+	// SampleRatio is the part of the traces started here which are recorded, the ones
+	// continued from a caller follow its decision.
+	SampleRatio float64 `mapstructure:"sample_ratio" default:"1" validate:"min=0,max=1"`
+}
+
+// BackupConfig allows backups into directories on the server if Root is set,
+// a backup streamed as tar works without it.
+type BackupConfig struct {
+	// Root holds the backup directories, the target of a backup and the backup
+	// it is based on are named relative to it.
+	Root string `mapstructure:"root"`
+}
+
+// IngestConfig allows ingesting segment files on the server if Root is set.
+type IngestConfig struct {
+	// Root holds the segment files to ingest, they are named relative to it.
+	Root string `mapstructure:"root"`
+}
+
+type ServerConfig struct {
+	Addr string `mapstructure:"addr" default:":6666"`
+	// RequestTimeout bounds the kv reads and writes, ScanTimeout the exports and imports,
+	// "0" disables them. A request past its timeout fails with a timeout error.
+	RequestTimeout string `mapstructure:"request_timeout" default:"30s" validate:"omitempty,duration"`
+	ScanTimeout    string `mapstructure:"scan_timeout" default:"0" validate:"omitempty,duration"`
+	// ShutdownDelay is the wait between failing the readiness probe and closing the
+	// listener on shutdown, for the orchestrator to stop routing requests here.
+	ShutdownDelay string `mapstructure:"shutdown_delay" default:"0s" validate:"omitempty,duration"`
+}
+
+// ReplicationConfig makes the server a read-only follower of Leader if set.
+type ReplicationConfig struct {
+	// Leader is the base url of the leader, like http://10.0.0.1:6666
+	Leader string `mapstructure:"leader" validate:"omitempty,url"`
+	// RetryInterval is the wait before reconnecting to the leader, 1s by default.
+	RetryInterval string `mapstructure:"retry_interval" validate:"omitempty,duration"`
 }
 
 type StorageConfig struct {
-	Path    string           `mapstructure:"path"`
-	System  string           `mapstructure:"system" default:"segment" validate:"oneof=fs segment"`
-	Codec   string           `mapstructure:"codec" default:"csv" validate:"required"`
-	Segment SegmentSysConfig `mapstructure:"segment"`
+	Path   string `mapstructure:"path" json:"path,omitempty"`
+	System string `mapstructure:"system" json:"system,omitempty" default:"segment" validate:"oneof=fs segment"`
+	// Codec is csv by default, binary keeps content types and values with any bytes.
+	// The binary codec also reads the data written by csv.
+	Codec   string           `mapstructure:"codec" json:"codec,omitempty" default:"csv" validate:"oneof=csv binary"`
+	Segment SegmentSysConfig `mapstructure:"segment" json:"segment"`
+
+	Encryption EncryptionConfig `mapstructure:"encryption" json:"encryption"`
+}
+
+// EncryptionConfig enables encryption at rest if KeyFile or KEKEnv is set.
+// KeyFile holds one "<id>:<base64 key>" per line, the largest id seals new data,
+// keys sealed by the key encryption key in KEKEnv are unwrapped on load.
+type EncryptionConfig struct {
+	KeyFile string `mapstructure:"key_file" json:"key_file,omitempty"`
+	KEKEnv  string `mapstructure:"kek_env" json:"kek_env,omitempty"`
+}
+
+func (ec EncryptionConfig) Enabled() bool {
+	return ec.KeyFile != "" || ec.KEKEnv != ""
 }
 
 type LogConfig struct {
 	Level string `mapstructure:"level" default:"info" validate:"oneof=debug info warn error"`
 }
 type SegmentSysConfig struct {
-	BufferSize      string `mapstructure:"buffer_size"`
-	RefreshInterval string `mapstructure:"refresh_interval"`
-	FlushInterval   string `mapstructure:"flush_interval"`
-	MergeInterval   string `mapstructure:"merge_interval"`
-	MergeFloor      string `mapstructure:"merge_floor"`
+	BufferSize      string `mapstructure:"buffer_size" json:"buffer_size,omitempty" validate:"omitempty,size"`
+	RefreshInterval string `mapstructure:"refresh_interval" json:"refresh_interval,omitempty" validate:"omitempty,duration"`
+	FlushInterval   string `mapstructure:"flush_interval" json:"flush_interval,omitempty" validate:"omitempty,duration"`
+	MergeInterval   string `mapstructure:"merge_interval" json:"merge_interval,omitempty" validate:"omitempty,duration"`
+	MergeFloor      string `mapstructure:"merge_floor" json:"merge_floor,omitempty" validate:"omitempty,size"`
+	Compression     string `mapstructure:"compression" json:"compression,omitempty" validate:"omitempty,oneof=none snappy zstd"`
+
+	// values larger than ValueLogThreshold are kept in a separate value log, disabled if empty
+	ValueLogThreshold  string `mapstructure:"value_log_threshold" json:"value_log_threshold,omitempty" validate:"omitempty,size"`
+	ValueLogFileSize   string `mapstructure:"value_log_file_size" json:"value_log_file_size,omitempty" validate:"omitempty,size"`
+	ValueLogGCInterval string `mapstructure:"value_log_gc_interval" json:"value_log_gc_interval,omitempty" validate:"omitempty,duration"`
+
+	// rewrite segment files in a legacy format on startup
+	UpgradeLegacy bool `mapstructure:"upgrade_legacy" json:"upgrade_legacy,omitempty"`
+
+	// whether ingested segment files win over the existing data, newest by default
+	IngestPrecedence string `mapstructure:"ingest_precedence" json:"ingest_precedence,omitempty" validate:"omitempty,oneof=newest oldest"`
 }
 
-func ProvideConfig() (KaeyaConfig, error) {
-	sourceConfig := viper.New()
-	sourceConfig.AddConfigPath("config")
+// Inherit fills every empty field of sc with the value from parent.
+// A namespace without its own storage settings behaves like the root storage.
+func (sc StorageConfig) Inherit(parent StorageConfig) StorageConfig {
+	if sc.System == "" {
+		sc.System = parent.System
+	}
+
+	if sc.Codec == "" {
+		sc.Codec = parent.Codec
+	}
 
-	err := sourceConfig.MergeInConfig()
-	if err != nil {
-		return KaeyaConfig{}, err
+	seg, p := &sc.Segment, parent.Segment
+	if seg.BufferSize == "" {
+		seg.BufferSize = p.BufferSize
 	}
 
-	var conf KaeyaConfig
-	defaults.SetDefaults(&conf)
+	if seg.RefreshInterval == "" {
+		seg.RefreshInterval = p.RefreshInterval
+	}
 
-	err = sourceConfig.Unmarshal(&conf)
+	if seg.FlushInterval == "" {
+		seg.FlushInterval = p.FlushInterval
+	}
 
-	validate := validator.New()
-	err = validate.Struct(&conf)
-	if err != nil {
-		return KaeyaConfig{}, err
+	if seg.MergeInterval == "" {
+		seg.MergeInterval = p.MergeInterval
+	}
+
+	if seg.MergeFloor == "" {
+		seg.MergeFloor = p.MergeFloor
+	}
+
+	if seg.Compression == "" {
+		seg.Compression = p.Compression
+	}
+
+	if seg.ValueLogThreshold == "" {
+		seg.ValueLogThreshold = p.ValueLogThreshold
+	}
+
+	if seg.ValueLogFileSize == "" {
+		seg.ValueLogFileSize = p.ValueLogFileSize
+	}
+
+	if seg.ValueLogGCInterval == "" {
+		seg.ValueLogGCInterval = p.ValueLogGCInterval
+	}
+
+	if !seg.UpgradeLegacy {
+		seg.UpgradeLegacy = p.UpgradeLegacy
 	}
 
-	if conf.Storage.Path == "" {
-		conf.Storage.Path = setDefaultPath()
+	if seg.IngestPrecedence == "" {
+		seg.IngestPrecedence = p.IngestPrecedence
 	}
 
-	return conf, nil
+	if !sc.Encryption.Enabled() {
+		sc.Encryption = parent.Encryption
+	}
+
+	return sc
+}
 
+func ValidateStorage(conf StorageConfig) error {
+	return newValidator().Struct(&conf)
 }
 
 func setDefaultPath() string {
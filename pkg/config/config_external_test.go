@@ -0,0 +1,69 @@
+package config_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	file := path.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+
+	return file
+}
+
+func TestProvideConfig(t *testing.T) {
+	file := writeConfig(t, `
+server:
+  addr: ":7000"
+storage:
+  path: /data/kaeya
+  segment:
+    merge_floor: 1m
+`)
+	t.Setenv("KAEYA_SERVER_ADDR", ":8000")
+	t.Setenv("KAEYA_LOG_LEVEL", "debug")
+	t.Setenv("KAEYA_STORAGE_SEGMENT_FLUSH_INTERVAL", "5s")
+
+	conf, err := config.ProvideConfig(
+		config.WithFile(file),
+		config.WithOverrides(map[string]string{"log.level": "warn"}),
+	)
+	assert.NoError(t, err)
+
+	// the environment wins over the file, the overrides over both
+	assert.Equal(t, ":8000", conf.Server.Addr)
+	assert.Equal(t, "warn", conf.Log.Level)
+	assert.Equal(t, "5s", conf.Storage.Segment.FlushInterval)
+	assert.Equal(t, "1m", conf.Storage.Segment.MergeFloor)
+	assert.Equal(t, "/data/kaeya", conf.Storage.Path)
+	assert.Equal(t, "segment", conf.Storage.System)
+
+	out, err := config.Marshal(conf)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "merge_floor: 1m")
+
+	_, err = config.ProvideConfig(config.WithFile(path.Join(t.TempDir(), "missing.yaml")))
+	assert.Error(t, err)
+}
+
+func TestProvideConfigInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown key": "server:\n  adr: \":7000\"\n",
+		"duration":    "server:\n  request_timeout: 30\n",
+		"size":        "storage:\n  segment:\n    buffer_size: lots\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.ProvideConfig(config.WithFile(writeConfig(t, content)))
+			assert.Error(t, err)
+		})
+	}
+
+	t.Setenv("KAEYA_STORAGE_SEGMENT_MERGE_INTERVAL", "soon")
+	_, err := config.ProvideConfig(config.WithFile(writeConfig(t, "")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-playground/validator/v10"
+	"github.com/mcuadros/go-defaults"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix prefixes the environment variables overriding the config keys,
+	// like KAEYA_STORAGE_PATH for storage.path.
+	EnvPrefix = "KAEYA"
+	// FileEnv names the config file if no file is given explicitly.
+	FileEnv = EnvPrefix + "_CONFIG"
+)
+
+type sourceOptions struct {
+	file      string
+	overrides map[string]string
+}
+
+type Option func(o *sourceOptions)
+
+// WithFile reads the config from file instead of the config directory of the working directory.
+func WithFile(file string) Option {
+	return func(o *sourceOptions) {
+		o.file = file
+	}
+}
+
+// WithOverrides sets config keys like storage.path, they win over the file and the environment.
+func WithOverrides(values map[string]string) Option {
+	return func(o *sourceOptions) {
+		for k, v := range values {
+			o.overrides[k] = v
+		}
+	}
+}
+
+// ProvideConfig merges from the lowest precedence: the defaults, the config file, the
+// KAEYA_* environment variables and the overrides. Without an explicit file, a missing
+// config file is no error. Unknown keys, durations and sizes are rejected.
+func ProvideConfig(options ...Option) (KaeyaConfig, error) {
+	sourceConfig, explicit := newSource(options...)
+
+	err := sourceConfig.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if err != nil && (explicit || !errors.As(err, &notFound)) {
+		return KaeyaConfig{}, err
+	}
+
+	return load(sourceConfig)
+}
+
+// WatchConfig calls fn with the config loaded again whenever the config file changes,
+// err if the new one is invalid. Editors may write a file in several steps, fn must
+// accept the same config more than once.
+func WatchConfig(fn func(conf KaeyaConfig, err error), options ...Option) error {
+	sourceConfig, _ := newSource(options...)
+
+	err := sourceConfig.ReadInConfig()
+	if err != nil {
+		return err
+	}
+
+	sourceConfig.OnConfigChange(func(fsnotify.Event) {
+		fn(load(sourceConfig))
+	})
+	sourceConfig.WatchConfig()
+
+	return nil
+}
+
+// Marshal writes conf in the yaml of the config file.
+func Marshal(conf KaeyaConfig) ([]byte, error) {
+	return yaml.Marshal(toValues(reflect.ValueOf(conf)))
+}
+
+// toValues turns the structs in v into maps keyed by their mapstructure tags, also
+// the ones in maps and lists.
+func toValues(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		values := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			values[v.Type().Field(i).Tag.Get("mapstructure")] = toValues(v.Field(i))
+		}
+		return values
+	case reflect.Map:
+		values := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			values[iter.Key().String()] = toValues(iter.Value())
+		}
+		return values
+	case reflect.Slice:
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = toValues(v.Index(i))
+		}
+		return values
+	default:
+		return v.Interface()
+	}
+}
+
+// newSource also reports whether the config file has been given explicitly.
+func newSource(options ...Option) (*viper.Viper, bool) {
+	opts := &sourceOptions{
+		file:      os.Getenv(FileEnv),
+		overrides: make(map[string]string),
+	}
+	for _, op := range options {
+		op(opts)
+	}
+
+	sourceConfig := viper.New()
+	if opts.file != "" {
+		sourceConfig.SetConfigFile(opts.file)
+	} else {
+		sourceConfig.AddConfigPath("config")
+	}
+
+	sourceConfig.SetEnvPrefix(EnvPrefix)
+	sourceConfig.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnvs(sourceConfig, reflect.TypeOf(KaeyaConfig{}), "")
+
+	for k, v := range opts.overrides {
+		sourceConfig.Set(k, v)
+	}
+
+	return sourceConfig, opts.file != ""
+}
+
+// bindEnvs binds a variable to every key of t, viper only looks up the environment for
+// the keys it knows. The members of maps and lists are set by the config file only.
+func bindEnvs(sourceConfig *viper.Viper, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			bindEnvs(sourceConfig, f.Type, key+".")
+		case reflect.Map, reflect.Slice:
+		default:
+			_ = sourceConfig.BindEnv(key)
+		}
+	}
+}
+
+func load(sourceConfig *viper.Viper) (KaeyaConfig, error) {
+	var conf KaeyaConfig
+	defaults.SetDefaults(&conf)
+
+	err := sourceConfig.UnmarshalExact(&conf)
+	if err != nil {
+		return KaeyaConfig{}, err
+	}
+
+	err = newValidator().Struct(&conf)
+	if err != nil {
+		return KaeyaConfig{}, err
+	}
+
+	if conf.Storage.Path == "" {
+		conf.Storage.Path = setDefaultPath()
+	}
+
+	return conf, nil
+}
+
+// newValidator knows the duration and size tags of the config, like "1s" and "64k".
+func newValidator() *validator.Validate {
+	validate := validator.New()
+
+	_ = validate.RegisterValidation("duration", func(fl validator.FieldLevel) bool {
+		_, err := utils.ParseDuration(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("size", func(fl validator.FieldLevel) bool {
+		_, err := utils.ToBytes(fl.Field().String())
+		return err == nil
+	})
+
+	return validate
+}
@@ -1,6 +1,31 @@
 package domain
 
+// FlagsReserved are the bits of KV.Flags used by the storage engine itself,
+// clients may only set the lower 24 bits.
+const FlagsReserved uint32 = 0xFF000000
+
+// FlagTombstone marks a deleted key, the record shadows every older version of it.
+const FlagTombstone uint32 = 1 << 25
+
+// FlagSiblings marks a record holding the concurrent versions of a key, see dynamo.
+const FlagSiblings uint32 = 1 << 26
+
 type KV struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Flags       uint32 `json:"flags,omitempty"`
+	// Version is the version vector of the value, set by the leaderless replication.
+	Version VersionVector `json:"version,omitempty"`
+	// Siblings are the concurrent values of a key read by the leaderless replication, Value is empty then.
+	Siblings []KV `json:"siblings,omitempty"`
+}
+
+// Tombstone returns the record which deletes key.
+func Tombstone(key string) KV {
+	return KV{Key: key, Flags: FlagTombstone}
+}
+
+func (kv KV) IsTombstone() bool {
+	return kv.Flags&FlagTombstone != 0
 }
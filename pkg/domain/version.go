@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrVersionFormat = errors.New("invalid version vector")
+
+// Order is how two version vectors relate.
+type Order int
+
+const (
+	VersionEqual Order = iota
+	VersionBefore
+	VersionAfter
+	VersionConcurrent
+)
+
+// VersionVector counts the writes coordinated by every node which wrote a value or one of its ancestors.
+type VersionVector map[string]uint64
+
+// ParseVersion reads the form of String, the empty string is the empty vector.
+func ParseVersion(s string) (VersionVector, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	res := make(VersionVector)
+	for _, entry := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(entry, ':')
+		if i <= 0 {
+			return nil, ErrVersionFormat
+		}
+
+		counter, err := strconv.ParseUint(entry[i+1:], 10, 64)
+		if err != nil {
+			return nil, ErrVersionFormat
+		}
+		res[entry[:i]] = counter
+	}
+
+	return res, nil
+}
+
+// String is like a:3,b:1 ordered by node.
+func (v VersionVector) String() string {
+	nodes := make([]string, 0, len(v))
+	for node := range v {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var b strings.Builder
+	for i, node := range nodes {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(node)
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatUint(v[node], 10))
+	}
+
+	return b.String()
+}
+
+func (v VersionVector) Clone() VersionVector {
+	res := make(VersionVector, len(v)+1)
+	for node, counter := range v {
+		res[node] = counter
+	}
+
+	return res
+}
+
+// Increment returns a copy of v with the counter of node incremented.
+func (v VersionVector) Increment(node string) VersionVector {
+	res := v.Clone()
+	res[node]++
+
+	return res
+}
+
+// Merge returns the smallest vector descending from both v and other.
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	res := v.Clone()
+	for node, counter := range other {
+		if counter > res[node] {
+			res[node] = counter
+		}
+	}
+
+	return res
+}
+
+// Compare tells whether v happened before, after or concurrently with other.
+func (v VersionVector) Compare(other VersionVector) Order {
+	less, greater := false, false
+	for node, counter := range v {
+		if c := other[node]; counter > c {
+			greater = true
+		} else if counter < c {
+			less = true
+		}
+	}
+	for node, counter := range other {
+		if _, ok := v[node]; !ok && counter > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return VersionConcurrent
+	case less:
+		return VersionBefore
+	case greater:
+		return VersionAfter
+	default:
+		return VersionEqual
+	}
+}
+
+// Descends is true if v is equal to or after other.
+func (v VersionVector) Descends(other VersionVector) bool {
+	order := v.Compare(other)
+	return order == VersionEqual || order == VersionAfter
+}
@@ -0,0 +1,191 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+func (n *Node) antiEntropy() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			err := n.Sync(context.Background())
+			if err != nil {
+				logger.Logger.Warn().Err(err).Msg("anti-entropy error")
+			}
+		}
+	}
+}
+
+func (n *Node) member(name string) (sharding.Member, error) {
+	for _, m := range n.members {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+
+	return sharding.Member{}, fmt.Errorf("unknown member %s: %w", name, ErrMember)
+}
+
+// shared reports whether both this member and peer replicate key.
+func (n *Node) shared(key string, peer string) bool {
+	self, other := false, false
+	for _, m := range n.Replicas(key) {
+		self = self || m.Name == n.self
+		other = other || m.Name == peer
+	}
+
+	return self && other
+}
+
+// Tree returns the merkle tree of the replicas this member shares with peer.
+func (n *Node) Tree(ctx context.Context, peer string) (Tree, error) {
+	if _, err := n.member(peer); err != nil {
+		return nil, err
+	}
+
+	t := newTree()
+	err := n.local.Scan(ctx, "", func(kv domain.KV) error {
+		if n.shared(kv.Key, peer) {
+			t.add(kv.Key, kv.Version.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.build()
+
+	return t, nil
+}
+
+// Buckets returns the replicas this member shares with peer in the buckets of a tree.
+func (n *Node) Buckets(ctx context.Context, peer string, buckets []int) ([]domain.KV, error) {
+	if _, err := n.member(peer); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[int]struct{}, len(buckets))
+	for _, b := range buckets {
+		wanted[b] = struct{}{}
+	}
+
+	var res []domain.KV
+	err := n.local.Scan(ctx, "", func(kv domain.KV) error {
+		if _, ok := wanted[bucket(kv.Key)]; ok && n.shared(kv.Key, peer) {
+			res = append(res, kv)
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+// Sync compares the replicas with every other member and exchanges the ones in differing buckets.
+func (n *Node) Sync(ctx context.Context) error {
+	var failed []string
+	for _, m := range n.members {
+		if m.Name == n.self {
+			continue
+		}
+
+		err := n.syncWith(ctx, m)
+		if err != nil {
+			logger.Logger.Warn().Err(err).Str("member", m.Name).Msg("anti-entropy sync error")
+			failed = append(failed, err.Error())
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.status.LastSync = time.Now()
+	n.status.Error = strings.Join(failed, "; ")
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s: %w", n.status.Error, ErrMember)
+	}
+
+	return nil
+}
+
+func (n *Node) syncWith(ctx context.Context, m sharding.Member) error {
+	var remote Tree
+	err := n.do(ctx, http.MethodGet, m, TreePath+"?peer="+url.QueryEscape(n.self), "", nil, &remote)
+	if err != nil {
+		return err
+	}
+
+	local, err := n.Tree(ctx, m.Name)
+	if err != nil {
+		return err
+	}
+
+	buckets := local.diff(remote)
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		ids = append(ids, strconv.Itoa(b))
+	}
+
+	var theirs []domain.KV
+	err = n.do(ctx, http.MethodGet, m, BucketsPath+"?peer="+url.QueryEscape(n.self)+"&buckets="+strings.Join(ids, ","), "", nil, &theirs)
+	if err != nil {
+		return err
+	}
+
+	ours, err := n.Buckets(ctx, m.Name, buckets)
+	if err != nil {
+		return err
+	}
+
+	changed, err := n.Store(ctx, common.NewSliceReader(theirs))
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.status.Synced += changed
+	n.mu.Unlock()
+
+	if len(ours) == 0 {
+		return nil
+	}
+
+	return n.push(ctx, m, ours)
+}
+
+// ParseBuckets parses the comma separated buckets of a tree.
+func ParseBuckets(s string) ([]int, error) {
+	parts := strings.Split(s, ",")
+	res := make([]int, 0, len(parts))
+	for _, p := range parts {
+		b, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || b < 0 || b >= leaves {
+			return nil, fmt.Errorf("invalid bucket %q", p)
+		}
+		res = append(res, b)
+	}
+
+	return res, nil
+}
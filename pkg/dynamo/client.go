@@ -0,0 +1,158 @@
+package dynamo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// ContentType is the content type of the replicas exchanged by the members, one json kv per line.
+	ContentType = "application/x-ndjson"
+
+	CoordinatePath = "/admin/dynamo/coordinate"
+	ReplicasPath   = "/admin/dynamo/replicas"
+	TreePath       = "/admin/dynamo/tree"
+	BucketsPath    = "/admin/dynamo/buckets"
+)
+
+// maxLineSize bounds a replica line, siblings hold several values.
+const maxLineSize = 64 << 20
+
+type reader struct {
+	scanner *bufio.Scanner
+}
+
+// NewReader reads the replicas sent by a member, unlike the export format they keep
+// the reserved flags and the versions.
+func NewReader(r io.Reader) common.KVReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	return &reader{scanner: scanner}
+}
+
+func (r *reader) Read() (domain.KV, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var kv domain.KV
+		err := json.Unmarshal(line, &kv)
+		if err != nil {
+			return domain.KV{}, err
+		}
+		if kv.Key == "" {
+			return domain.KV{}, errors.New("replica without key")
+		}
+
+		return kv, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return domain.KV{}, err
+	}
+
+	return domain.KV{}, io.EOF
+}
+
+// WriteReplicas writes kvs in the format of NewReader.
+func WriteReplicas(w io.Writer, kvs []domain.KV) error {
+	enc := json.NewEncoder(w)
+	for _, kv := range kvs {
+		err := enc.Encode(kv)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// push sends replicas to be merged into the ones of m.
+func (n *Node) push(ctx context.Context, m sharding.Member, kvs []domain.KV) error {
+	var buffer bytes.Buffer
+	err := WriteReplicas(&buffer, kvs)
+	if err != nil {
+		return err
+	}
+
+	return n.do(ctx, http.MethodPost, m, ReplicasPath, ContentType, &buffer, nil)
+}
+
+// fetch returns the replica of key stored by m.
+func (n *Node) fetch(ctx context.Context, m sharding.Member, key string) (domain.KV, error) {
+	var kv domain.KV
+	err := n.do(ctx, http.MethodGet, m, ReplicasPath+"?key="+url.QueryEscape(key), "", nil, &kv)
+
+	return kv, err
+}
+
+func (n *Node) coordinateOn(ctx context.Context, m sharding.Member, write Write) error {
+	data, err := json.Marshal(write)
+	if err != nil {
+		return err
+	}
+
+	return n.do(ctx, http.MethodPost, m, CoordinatePath, "application/json", bytes.NewReader(data), nil)
+}
+
+// do sends a request to m and decodes the data of the response into res if not nil.
+// The quorum errors of m are returned as ErrQuorum, a missing replica as storage.ErrNotFound.
+func (n *Node) do(ctx context.Context, method string, m sharding.Member, path, contentType string, body io.Reader, res interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, m.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(sharding.ForwardedHeader, n.self)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", m.Name, err.Error(), ErrMember)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %s: %w", m.Name, err.Error(), ErrMember)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound:
+		return storage.ErrNotFound
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return fmt.Errorf("%s: %s: %w", m.Name, out.Message, ErrQuorum)
+	default:
+		return fmt.Errorf("%s: %d %s: %w", m.Name, resp.StatusCode, out.Message, ErrMember)
+	}
+
+	if res == nil || len(out.Data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(out.Data, res)
+}
@@ -0,0 +1,80 @@
+package dynamo
+
+import (
+	"hash/fnv"
+)
+
+// leaves of a merkle tree, the keys are spread over them by hash
+const leaves = 1024
+
+// Tree is a merkle tree over the replicas two members share, in heap order: the root at 1
+// and the children of i at 2i and 2i+1, the leaves from leaves on. A leaf combines the
+// keys and versions of its bucket, two members holding the same replicas have the same root.
+type Tree []uint64
+
+func newTree() Tree {
+	return make(Tree, 2*leaves)
+}
+
+func bucket(key string) int {
+	return int(hashString(key) % leaves)
+}
+
+// add accounts for the replica of key at version, the order of the adds does not matter.
+func (t Tree) add(key string, version string) {
+	t[leaves+bucket(key)] ^= hashString(key + "\x00" + version)
+}
+
+// build computes the inner nodes from the leaves.
+func (t Tree) build() {
+	for i := leaves - 1; i >= 1; i-- {
+		t[i] = mix(t[2*i], t[2*i+1])
+	}
+}
+
+// diff returns the buckets whose leaves differ, only descending into the subtrees which differ.
+func (t Tree) diff(other Tree) []int {
+	if len(other) != len(t) {
+		res := make([]int, leaves)
+		for i := range res {
+			res[i] = i
+		}
+		return res
+	}
+
+	var res []int
+	var walk func(i int)
+	walk = func(i int) {
+		if t[i] == other[i] {
+			return
+		}
+
+		if i >= leaves {
+			res = append(res, i-leaves)
+			return
+		}
+
+		walk(2 * i)
+		walk(2*i + 1)
+	}
+	walk(1)
+
+	return res
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	return h.Sum64()
+}
+
+// mix combines two child hashes, unlike xor it tells apart swapped children.
+func mix(a, b uint64) uint64 {
+	x := a*0x9e3779b97f4a7c15 ^ b
+	x ^= x >> 31
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 29
+
+	return x
+}
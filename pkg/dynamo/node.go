@@ -0,0 +1,647 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultReplicas            = 3
+	defaultQuorum              = 2
+	defaultAntiEntropyInterval = time.Minute
+	defaultRequestTimeout      = 5 * time.Second
+
+	// replicas still written or read after the quorum answered are waited for up to this long
+	backgroundTimeout = 10 * time.Second
+)
+
+var (
+	ErrQuorum        = errors.New("quorum not reached")
+	ErrInvalidQuorum = errors.New("invalid quorum")
+	ErrMember        = errors.New("member error")
+)
+
+type quorumKey struct{}
+
+type versionKey struct{}
+
+// WithQuorum sets how many replicas must answer the reads and the writes under ctx, 0 keeps the configured one.
+func WithQuorum(ctx context.Context, r, w int) context.Context {
+	return context.WithValue(ctx, quorumKey{}, [2]int{r, w})
+}
+
+// WithVersion sets the version a Delete under ctx has seen, without it the delete removes
+// every value the coordinator knows.
+func WithVersion(ctx context.Context, version domain.VersionVector) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+type Option func(n *Node)
+
+// WithReplicas sets the replicas of every key n, and the default read and write quorums.
+func WithReplicas(n, r, w int) Option {
+	return func(node *Node) {
+		node.n, node.r, node.w = n, r, w
+	}
+}
+
+// WithVirtualNodes sets the points of every member on the ring, it must be the same on every member.
+func WithVirtualNodes(vnodes int) Option {
+	return func(n *Node) {
+		n.vnodes = vnodes
+	}
+}
+
+// WithAntiEntropyInterval sets how often the replicas are compared with the other members, 0 disables it.
+func WithAntiEntropyInterval(interval time.Duration) Option {
+	return func(n *Node) {
+		n.antiEntropyInterval = interval
+	}
+}
+
+func WithClient(client *http.Client) Option {
+	return func(n *Node) {
+		n.client = client
+	}
+}
+
+// Write is a put or a delete coordinated by a replica of the key. Context is the version the
+// writer has seen, All replaces every value the coordinator knows.
+type Write struct {
+	Key     string               `json:"key"`
+	Value   domain.KV            `json:"value"`
+	Context domain.VersionVector `json:"context,omitempty"`
+	All     bool                 `json:"all,omitempty"`
+	W       int                  `json:"w,omitempty"`
+}
+
+type Status struct {
+	Self        string            `json:"self"`
+	Replicas    int               `json:"replicas"`
+	ReadQuorum  int               `json:"read_quorum"`
+	WriteQuorum int               `json:"write_quorum"`
+	Members     []sharding.Member `json:"members"`
+	// ReadRepairs are the replicas updated after reads, Synced the kvs exchanged by anti-entropy.
+	ReadRepairs int       `json:"read_repairs"`
+	Synced      int       `json:"synced"`
+	LastSync    time.Time `json:"last_sync"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Node is a DBService replicating every key to the n members following it on the ring,
+// without a leader. Writes go through one of the replicas, which orders them by version
+// vectors, and succeed once w replicas stored them. Reads merge the answers of r replicas,
+// concurrent writes are returned as siblings and stale replicas are repaired. The replicas
+// are compared with merkle trees in the background to repair what reads miss.
+type Node struct {
+	self    string
+	members []sharding.Member
+	ring    *sharding.Ring
+	local   service.DBService
+	client  *http.Client
+
+	n, r, w             int
+	vnodes              int
+	antiEntropyInterval time.Duration
+
+	// writeLock serializes the read-modify-write of local replicas
+	writeLock sync.Mutex
+
+	mu     sync.Mutex
+	status Status
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewNode(self string, members []sharding.Member, local service.DBService, options ...Option) (*Node, error) {
+	n := &Node{
+		self:                self,
+		members:             members,
+		local:               local,
+		client:              &http.Client{Timeout: defaultRequestTimeout},
+		n:                   defaultReplicas,
+		r:                   defaultQuorum,
+		w:                   defaultQuorum,
+		antiEntropyInterval: defaultAntiEntropyInterval,
+		stop:                make(chan struct{}),
+	}
+
+	for _, op := range options {
+		op(n)
+	}
+
+	if n.n < 1 || n.n > len(members) || n.r < 1 || n.r > n.n || n.w < 1 || n.w > n.n {
+		return nil, fmt.Errorf("%d replicas of %d members, r %d, w %d: %w", n.n, len(members), n.r, n.w, ErrInvalidQuorum)
+	}
+
+	found := false
+	for _, m := range members {
+		found = found || m.Name == self
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not a member", self)
+	}
+
+	n.ring = sharding.NewRing(members, n.vnodes)
+	n.status = Status{Self: self, Replicas: n.n, ReadQuorum: n.r, WriteQuorum: n.w, Members: members}
+
+	if n.antiEntropyInterval > 0 {
+		n.wg.Add(1)
+		go n.antiEntropy()
+	}
+
+	return n, nil
+}
+
+func (n *Node) quorum(ctx context.Context) (int, int, error) {
+	r, w := n.r, n.w
+	if q, ok := ctx.Value(quorumKey{}).([2]int); ok {
+		if q[0] != 0 {
+			r = q[0]
+		}
+		if q[1] != 0 {
+			w = q[1]
+		}
+	}
+
+	if r < 1 || r > n.n || w < 1 || w > n.n {
+		return 0, 0, fmt.Errorf("r %d, w %d of %d replicas: %w", r, w, n.n, ErrInvalidQuorum)
+	}
+
+	return r, w, nil
+}
+
+// Replicas returns the members holding key, the first one is the preferred coordinator.
+func (n *Node) Replicas(key string) []sharding.Member {
+	return n.ring.Successors(key, n.n)
+}
+
+func (n *Node) isReplica(replicas []sharding.Member) bool {
+	for _, m := range replicas {
+		if m.Name == n.self {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set stores kv, kv.Version is the version the writer has seen. A value written without
+// the version of the current one is kept next to it as a sibling.
+func (n *Node) Set(ctx context.Context, kv domain.KV) error {
+	_, w, err := n.quorum(ctx)
+	if err != nil {
+		return err
+	}
+
+	return n.write(ctx, Write{Key: kv.Key, Value: kv, Context: kv.Version, W: w})
+}
+
+func (n *Node) Delete(ctx context.Context, key string) error {
+	_, w, err := n.quorum(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, _ := ctx.Value(versionKey{}).(domain.VersionVector)
+
+	return n.write(ctx, Write{Key: key, Value: domain.Tombstone(key), Context: version, All: version == nil, W: w})
+}
+
+// write coordinates the write here if this member is a replica of the key, or on the first reachable replica.
+func (n *Node) write(ctx context.Context, write Write) error {
+	replicas := n.Replicas(write.Key)
+	if n.isReplica(replicas) {
+		return n.Coordinate(ctx, write)
+	}
+
+	var err error
+	for _, m := range replicas {
+		err = n.coordinateOn(ctx, m, write)
+		if err == nil || errors.Is(err, ErrQuorum) || errors.Is(err, ErrInvalidQuorum) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("no replica of %s reachable: %s: %w", write.Key, err.Error(), ErrQuorum)
+}
+
+// Coordinate applies write to the local replica and sends the result to the other replicas,
+// it returns once write.W replicas stored it.
+func (n *Node) Coordinate(ctx context.Context, write Write) error {
+	w := write.W
+	if w == 0 {
+		w = n.w
+	}
+	if w < 1 || w > n.n {
+		return fmt.Errorf("w %d of %d replicas: %w", w, n.n, ErrInvalidQuorum)
+	}
+
+	var stored domain.KV
+	_, err := n.update(ctx, write.Key, func(o object) (object, bool) {
+		vc := write.Context
+		if write.All {
+			vc = o.version
+		}
+
+		res := o.write(n.self, vc, write.Value)
+		stored, _ = res.encode()
+		return res, true
+	})
+	if err != nil {
+		return err
+	}
+
+	others := make([]sharding.Member, 0, n.n)
+	for _, m := range n.Replicas(write.Key) {
+		if m.Name != n.self {
+			others = append(others, m)
+		}
+	}
+
+	acks := 1
+	if acks >= w {
+		go n.replicate(others, stored, nil)
+		return nil
+	}
+
+	results := make(chan error, len(others))
+	go n.replicate(others, stored, results)
+
+	for range others {
+		err := <-results
+		if err == nil {
+			acks++
+		} else {
+			logger.Logger.Warn().Err(err).Str("key", write.Key).Msg("replicate write error")
+		}
+
+		if acks >= w {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%d of %d replicas stored %s: %w", acks, w, write.Key, ErrQuorum)
+}
+
+// replicate sends kv to the members, each result is sent to results if not nil.
+func (n *Node) replicate(members []sharding.Member, kv domain.KV, results chan<- error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backgroundTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m sharding.Member) {
+			defer wg.Done()
+
+			err := n.push(ctx, m, []domain.KV{kv})
+			if results != nil {
+				results <- err
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// reply is the answer of a replica to a read.
+type reply struct {
+	member sharding.Member
+	obj    object
+	found  bool
+	err    error
+}
+
+// Get merges the replicas of r members, the ones found stale are repaired in the background.
+func (n *Node) Get(ctx context.Context, key string) (domain.KV, error) {
+	r, _, err := n.quorum(ctx)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	replicas := n.Replicas(key)
+	replies := make(chan reply, len(replicas))
+
+	// the replicas answering after the quorum are still read to repair them
+	readCtx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), backgroundTimeout)
+	for _, m := range replicas {
+		go func(m sharding.Member) {
+			obj, found, err := n.read(readCtx, m, key)
+			replies <- reply{member: m, obj: obj, found: found, err: err}
+		}(m)
+	}
+
+	answered := make([]reply, 0, len(replicas))
+	ok, received := 0, 0
+	for ok < r && received < len(replicas) {
+		select {
+		case rep := <-replies:
+			received++
+			answered = append(answered, rep)
+			if rep.err == nil {
+				ok++
+			} else {
+				logger.Logger.Warn().Err(rep.err).Str("member", rep.member.Name).Msg("read replica error")
+			}
+		case <-ctx.Done():
+			cancel()
+			return domain.KV{}, ctx.Err()
+		}
+	}
+
+	merged, found := mergeReplies(answered)
+
+	go func() {
+		defer cancel()
+
+		for ; received < len(replicas); received++ {
+			answered = append(answered, <-replies)
+		}
+
+		all, _ := mergeReplies(answered)
+		n.repair(readCtx, all, answered)
+	}()
+
+	if ok < r {
+		return domain.KV{}, fmt.Errorf("%d of %d replicas answered: %w", ok, r, ErrQuorum)
+	}
+
+	if !found {
+		return domain.KV{}, storage.ErrNotFound
+	}
+
+	return merged.resolve()
+}
+
+func mergeReplies(replies []reply) (object, bool) {
+	var res object
+	found := false
+	for _, rep := range replies {
+		if rep.err != nil || !rep.found {
+			continue
+		}
+
+		if !found {
+			res, found = rep.obj, true
+		} else {
+			res = merge(res, rep.obj)
+		}
+	}
+
+	return res, found
+}
+
+// repair sends the merged replica to the members which answered with an older or no version.
+func (n *Node) repair(ctx context.Context, merged object, replies []reply) {
+	if merged.version == nil {
+		return
+	}
+
+	kv, err := merged.encode()
+	if err != nil {
+		return
+	}
+
+	for _, rep := range replies {
+		if rep.err != nil || (rep.found && rep.obj.version.Compare(merged.version) == domain.VersionEqual) {
+			continue
+		}
+
+		if rep.member.Name == n.self {
+			_, err = n.store(ctx, kv)
+		} else {
+			err = n.push(ctx, rep.member, []domain.KV{kv})
+		}
+
+		if err != nil {
+			logger.Logger.Warn().Err(err).Str("member", rep.member.Name).Msg("read repair error")
+			continue
+		}
+
+		n.mu.Lock()
+		n.status.ReadRepairs++
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) read(ctx context.Context, m sharding.Member, key string) (object, bool, error) {
+	var kv domain.KV
+	var err error
+	if m.Name == n.self {
+		kv, err = n.Replica(ctx, key)
+	} else {
+		kv, err = n.fetch(ctx, m, key)
+	}
+
+	if errors.Is(err, storage.ErrNotFound) {
+		return object{}, false, nil
+	}
+	if err != nil {
+		return object{}, false, err
+	}
+
+	obj, err := decode(kv)
+	return obj, err == nil, err
+}
+
+// Replica returns the stored replica of key on this member, storage.ErrNotFound if there is none.
+func (n *Node) Replica(ctx context.Context, key string) (domain.KV, error) {
+	err := n.refresh(ctx)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	return n.local.Get(ctx, key)
+}
+
+// refresh makes the buffered local writes readable, a replica must read its own writes.
+func (n *Node) refresh(ctx context.Context) error {
+	if r, ok := n.local.(storage.Refresher); ok {
+		return r.Refresh(ctx)
+	}
+
+	return nil
+}
+
+// Store merges the replicas read from r into the local ones, it returns how many changed.
+func (n *Node) Store(ctx context.Context, r common.KVReader) (int, error) {
+	count := 0
+	for {
+		kv, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		changed, err := n.store(ctx, kv)
+		if err != nil {
+			return count, err
+		}
+		if changed {
+			count++
+		}
+	}
+}
+
+func (n *Node) store(ctx context.Context, kv domain.KV) (bool, error) {
+	incoming, err := decode(kv)
+	if err != nil {
+		return false, err
+	}
+
+	return n.update(ctx, kv.Key, func(o object) (object, bool) {
+		if o.version == nil {
+			return incoming, true
+		}
+
+		res := merge(o, incoming)
+		return res, res.version.Compare(o.version) != domain.VersionEqual
+	})
+}
+
+// update replaces the local replica of key by fn of it, if fn reports a change.
+func (n *Node) update(ctx context.Context, key string, fn func(o object) (object, bool)) (bool, error) {
+	n.writeLock.Lock()
+	defer n.writeLock.Unlock()
+
+	err := n.refresh(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	current := object{key: key}
+	kv, err := n.local.Get(ctx, key)
+	if err == nil {
+		current, err = decode(kv)
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+
+	res, changed := fn(current)
+	if !changed {
+		return false, nil
+	}
+
+	kv, err = res.encode()
+	if err != nil {
+		return false, err
+	}
+
+	return true, n.local.Set(ctx, kv)
+}
+
+// Batch applies the ops one by one, each with the write quorum of ctx. The Version of
+// a delete op is the one it has seen, see WithVersion.
+func (n *Node) Batch(ctx context.Context, ops []service.Op) error {
+	for i, op := range ops {
+		var err error
+		switch op.Type {
+		case service.EventPut:
+			err = n.Set(ctx, op.KV)
+		case service.EventDelete:
+			opCtx := ctx
+			if op.KV.Version != nil {
+				opCtx = WithVersion(ctx, op.KV.Version)
+			}
+			err = n.Delete(opCtx, op.KV.Key)
+		default:
+			err = fmt.Errorf("%s: %w", op.Type, service.ErrUnknownOp)
+		}
+
+		if err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Scan calls fn with the keys replicated by this member as a client reads them.
+func (n *Node) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) error {
+	return n.local.Scan(ctx, prefix, func(kv domain.KV) error {
+		obj, err := decode(kv)
+		if err != nil {
+			return err
+		}
+
+		res, err := obj.resolve()
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(res)
+	})
+}
+
+// Import writes every kv with the write quorum of ctx.
+func (n *Node) Import(ctx context.Context, r common.KVReader) (int, error) {
+	count := 0
+	for {
+		kv, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		err = n.Set(ctx, kv)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// Ingest is not supported, segment files bypass the version vectors.
+func (n *Node) Ingest(ctx context.Context, files []string, precedence string) (int, error) {
+	return 0, fmt.Errorf("leaderless replication: %w", storage.ErrIngestUnsupported)
+}
+
+// Checkpoint snapshots the local replicas.
+func (n *Node) Checkpoint(ctx context.Context, dir string) error {
+	return n.local.Checkpoint(ctx, dir)
+}
+
+// Watch streams the changes of the local replicas as stored.
+func (n *Node) Watch(ctx context.Context, prefix string, fromSequence uint64) (<-chan service.Event, error) {
+	return n.local.Watch(ctx, prefix, fromSequence)
+}
+
+func (n *Node) Changes() service.ChangeLogStatus {
+	return n.local.Changes()
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.status
+}
+
+func (n *Node) Close(ctx context.Context) error {
+	close(n.stop)
+	n.wg.Wait()
+
+	return n.local.Close(ctx)
+}
@@ -0,0 +1,265 @@
+package dynamo_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/api/rest"
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/dynamo"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type replica struct {
+	name   string
+	app    *application.Application
+	server *httptest.Server
+	// down makes the server fail every request
+	down atomic.Bool
+}
+
+func startReplicas(t *testing.T, system string, names []string, replicas int) []*replica {
+	res := make([]*replica, 0, len(names))
+	members := make([]config.ShardMemberConfig, 0, len(names))
+	for _, name := range names {
+		r := &replica{name: name}
+		r.server = httptest.NewUnstartedServer(nil)
+		res = append(res, r)
+		members = append(members, config.ShardMemberConfig{Name: name, URL: "http://" + r.server.Listener.Addr().String()})
+	}
+
+	for _, r := range res {
+		app, err := application.NewApplication(config.KaeyaConfig{
+			Storage: config.StorageConfig{
+				Path:   path.Join("testdata", "dynamic", utils.ID()),
+				System: system,
+				Codec:  "binary",
+			},
+			Dynamo: config.DynamoConfig{
+				Self:                r.name,
+				Replicas:            replicas,
+				ReadQuorum:          2,
+				WriteQuorum:         2,
+				AntiEntropyInterval: "0",
+				Members:             members,
+			},
+		})
+		assert.NoError(t, err)
+
+		r, handler := r, rest.Route(app)
+		r.app = app
+		r.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if r.down.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			handler.ServeHTTP(w, req)
+		})
+		r.server.Start()
+
+		t.Cleanup(func() {
+			r.server.Close()
+			app.Close(context.Background())
+		})
+	}
+
+	return res
+}
+
+func do(t *testing.T, method, url, body string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	return resp, string(data)
+}
+
+func (r *replica) stored(key string) bool {
+	node, _ := r.app.Dynamo()
+	_, err := node.Replica(context.Background(), key)
+
+	return err == nil
+}
+
+func TestQuorum(t *testing.T) {
+	for _, system := range []string{"fs", "segment"} {
+		t.Run(system, func(t *testing.T) {
+			runQuorum(t, system)
+		})
+	}
+}
+
+func runQuorum(t *testing.T, system string) {
+	replicas := startReplicas(t, system, []string{"a", "b", "c"}, 3)
+	a, b, c := replicas[0], replicas[1], replicas[2]
+
+	resp, body := do(t, http.MethodPut, a.server.URL+"/kv/k", "v1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+	resp, body = do(t, http.MethodGet, b.server.URL+"/kv/k?raw=1", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "v1", body)
+	version := resp.Header.Get("X-Kaeya-Version")
+	assert.Equal(t, "a:1", version)
+
+	// two writers replace the same version concurrently
+	resp, body = do(t, http.MethodPut, a.server.URL+"/kv/k", "x", "X-Kaeya-Version", version)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	resp, body = do(t, http.MethodPut, b.server.URL+"/kv/k", "y", "X-Kaeya-Version", version)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+	resp, body = do(t, http.MethodGet, c.server.URL+"/kv/k?raw=1", "")
+	assert.Equal(t, http.StatusMultipleChoices, resp.StatusCode)
+	var res struct {
+		Data rest.KVResponse `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &res))
+	values := make([]string, 0, len(res.Data.Siblings))
+	for _, s := range res.Data.Siblings {
+		values = append(values, s.Value)
+	}
+	assert.ElementsMatch(t, []string{"x", "y"}, values)
+
+	// a write with the merged version resolves them
+	resp, body = do(t, http.MethodPost, c.server.URL+"/kv", `{"key":"k","value":"z","version":"`+res.Data.Version+`"}`,
+		"Content-Type", "application/json")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	resp, body = do(t, http.MethodGet, a.server.URL+"/kv/k?raw=1&r=3", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "z", body)
+
+	resp, _ = do(t, http.MethodDelete, b.server.URL+"/kv/k", "", "X-Kaeya-Version", resp.Header.Get("X-Kaeya-Version"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, http.MethodGet, c.server.URL+"/kv/k", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// a write needs w replicas
+	c.down.Store(true)
+	resp, body = do(t, http.MethodPut, a.server.URL+"/kv/k2?w=3", "v")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, body, fmt.Sprint(rest.CodeQuorum))
+	resp, _ = do(t, http.MethodPut, a.server.URL+"/kv/k3", "v")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, http.MethodPut, a.server.URL+"/kv/k4", "v")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, http.MethodGet, a.server.URL+"/kv/k3?r=4", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	c.down.Store(false)
+
+	// a read repairs the replica c missed
+	assert.False(t, c.stored("k3"))
+	resp, _ = do(t, http.MethodGet, a.server.URL+"/kv/k3?r=3", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		return c.stored("k3")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// anti-entropy repairs the ones no read saw
+	assert.False(t, c.stored("k4"))
+	resp, body = do(t, http.MethodPost, c.server.URL+"/admin/dynamo/sync", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.True(t, c.stored("k4"))
+	assert.True(t, c.stored("k2"))
+
+	node, err := c.app.Dynamo()
+	assert.NoError(t, err)
+	status := node.Status()
+	assert.NotZero(t, status.ReadRepairs+status.Synced)
+
+	for _, r := range replicas {
+		node, _ := r.app.Dynamo()
+		for _, peer := range replicas {
+			if peer != r {
+				local, err := node.Tree(context.Background(), peer.name)
+				assert.NoError(t, err)
+				other, _ := peer.app.Dynamo()
+				remote, err := other.Tree(context.Background(), r.name)
+				assert.NoError(t, err)
+				assert.Equal(t, local, remote)
+			}
+		}
+	}
+}
+
+func TestCoordinate(t *testing.T) {
+	replicas := startReplicas(t, "fs", []string{"a", "b", "c"}, 2)
+
+	// every member serves every key, the ones it does not replicate included
+	for i := 0; i < 20; i++ {
+		resp, body := do(t, http.MethodPut, fmt.Sprintf("%s/kv/key-%d", replicas[i%3].server.URL, i), fmt.Sprint(i))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	}
+
+	a, _ := replicas[0].app.Dynamo()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		assert.Eventually(t, func() bool {
+			count := 0
+			for _, r := range replicas {
+				if r.stored(key) {
+					count++
+				}
+			}
+			return count == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		for _, m := range a.Replicas(key) {
+			for _, r := range replicas {
+				if r.name == m.Name {
+					assert.True(t, r.stored(key))
+				}
+			}
+		}
+
+		kv, err := a.Get(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), string(kv.Value))
+	}
+
+	_, err := a.Get(context.Background(), "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = a.Get(dynamo.WithQuorum(context.Background(), 3, 0), "key-0")
+	assert.ErrorIs(t, err, dynamo.ErrInvalidQuorum)
+}
+
+func TestOverwrite(t *testing.T) {
+	// the segment storage reads the buffered writes after a refresh only
+	replicas := startReplicas(t, "segment", []string{"a", "b", "c"}, 3)
+	a, b := replicas[0], replicas[1]
+
+	// each write replaces the version of the one before
+	resp, body := do(t, http.MethodPut, a.server.URL+"/kv/k", "v1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	for i := 2; i <= 3; i++ {
+		resp, body = do(t, http.MethodPut, a.server.URL+"/kv/k", fmt.Sprint("v", i), "X-Kaeya-Version", fmt.Sprint("a:", i-1))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	}
+
+	resp, body = do(t, http.MethodGet, b.server.URL+"/kv/k?raw=1&r=3", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "v3", body)
+	assert.Equal(t, "a:3", resp.Header.Get("X-Kaeya-Version"))
+}
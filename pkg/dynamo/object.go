@@ -0,0 +1,117 @@
+package dynamo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+)
+
+// object is the replica of a key: the concurrent values written since the last
+// write which saw all of them, and the version vector of the whole set. A deleted
+// value is a sibling with domain.FlagTombstone.
+type object struct {
+	key      string
+	version  domain.VersionVector
+	siblings []domain.KV
+}
+
+// decode reads a stored record, a single live value is stored as a plain kv and
+// anything else as a record with domain.FlagSiblings holding the values as json.
+func decode(kv domain.KV) (object, error) {
+	res := object{key: kv.Key, version: kv.Version}
+
+	if kv.Flags&domain.FlagSiblings == 0 {
+		res.siblings = []domain.KV{{Value: kv.Value, ContentType: kv.ContentType, Flags: kv.Flags}}
+		return res, nil
+	}
+
+	err := json.Unmarshal(kv.Value, &res.siblings)
+	if err != nil {
+		return object{}, fmt.Errorf("siblings of %s: %w", kv.Key, err)
+	}
+
+	return res, nil
+}
+
+func (o object) encode() (domain.KV, error) {
+	if len(o.siblings) == 1 && !o.siblings[0].IsTombstone() {
+		s := o.siblings[0]
+		return domain.KV{Key: o.key, Value: s.Value, ContentType: s.ContentType, Flags: s.Flags, Version: o.version}, nil
+	}
+
+	value, err := json.Marshal(o.siblings)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	return domain.KV{Key: o.key, Value: value, Flags: domain.FlagSiblings, Version: o.version}, nil
+}
+
+// write adds value written by the coordinator node knowing the versions in context:
+// the siblings context has seen are replaced, the others stay next to value.
+func (o object) write(node string, context domain.VersionVector, value domain.KV) object {
+	res := object{key: o.key, version: o.version.Merge(context).Increment(node)}
+
+	value.Key, value.Version = "", nil
+	if !context.Descends(o.version) {
+		res.siblings = append(res.siblings, o.siblings...)
+	}
+	res.siblings = appendSibling(res.siblings, value)
+
+	return res
+}
+
+// merge reconciles two replicas of a key, the newer one wins and concurrent ones keep the values of both.
+func merge(a, b object) object {
+	switch a.version.Compare(b.version) {
+	case domain.VersionEqual, domain.VersionAfter:
+		return a
+	case domain.VersionBefore:
+		return b
+	}
+
+	res := object{key: a.key, version: a.version.Merge(b.version)}
+	res.siblings = append(res.siblings, a.siblings...)
+	for _, s := range b.siblings {
+		res.siblings = appendSibling(res.siblings, s)
+	}
+
+	return res
+}
+
+func appendSibling(siblings []domain.KV, s domain.KV) []domain.KV {
+	for _, other := range siblings {
+		if other.Flags == s.Flags && other.ContentType == s.ContentType && bytes.Equal(other.Value, s.Value) {
+			return siblings
+		}
+	}
+
+	return append(siblings, s)
+}
+
+// resolve is the kv read by a client: the version with the only live value, or with
+// the concurrent live values as siblings. storage.ErrNotFound if every value is deleted.
+func (o object) resolve() (domain.KV, error) {
+	live := make([]domain.KV, 0, len(o.siblings))
+	for _, s := range o.siblings {
+		if !s.IsTombstone() {
+			live = append(live, s)
+		}
+	}
+
+	switch len(live) {
+	case 0:
+		return domain.KV{}, storage.ErrNotFound
+	case 1:
+		s := live[0]
+		return domain.KV{Key: o.key, Value: s.Value, ContentType: s.ContentType, Flags: s.Flags, Version: o.version}, nil
+	default:
+		for i := range live {
+			live[i].Key = o.key
+		}
+		return domain.KV{Key: o.key, Version: o.version, Siblings: live}, nil
+	}
+}
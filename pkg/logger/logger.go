@@ -14,7 +14,25 @@ func InitZerolog(level string) error {
 		return err
 	}
 
+	// the level is only global, so that SetLevel changes it for every logger derived from Logger
+	zerolog.SetGlobalLevel(lv)
+	Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	return nil
+}
+
+// ValidateLevel returns the error SetLevel would return for level, without changing it.
+func ValidateLevel(level string) error {
+	_, err := zerolog.ParseLevel(level)
+	return err
+}
+
+// SetLevel changes the level of Logger while logging.
+func SetLevel(level string) error {
+	lv, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
 	zerolog.SetGlobalLevel(lv)
-	Logger = zerolog.New(os.Stderr).Level(lv).With().Timestamp().Logger()
 	return nil
 }
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kaeya"
+
+// Jobs of a storage reported by ObserveJob.
+const (
+	JobRefresh    = "refresh"
+	JobFlush      = "flush"
+	JobMerge      = "merge"
+	JobCompact    = "compact"
+	JobValueLogGC = "value_log_gc"
+)
+
+var (
+	// Registry holds the metrics of the process, served by Handler.
+	Registry = prometheus.NewRegistry()
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Requests served by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests by handler and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"handler", "method"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "job_duration_seconds",
+		Help:      "Duration of the background refreshes, flushes, merges and value log gcs by storage path.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 12),
+	}, []string{"path", "job"})
+
+	jobErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "job_errors_total",
+		Help:      "Failed background jobs by storage path.",
+	}, []string{"path", "job"})
+
+	mergeReclaimed = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "merge_reclaimed_bytes",
+		Help:      "Disk space freed by each merge by storage path.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"path"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, requestDuration, jobDuration, jobErrors, mergeReclaimed,
+	)
+}
+
+// Handler serves the metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served request, handler is the route like /kv/:key.
+func ObserveRequest(handler, method string, code int, d time.Duration) {
+	requests.WithLabelValues(handler, method, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(handler, method).Observe(d.Seconds())
+}
+
+// ObserveJob records a background job of the storage at path.
+func ObserveJob(path, job string, d time.Duration, err error) {
+	jobDuration.WithLabelValues(path, job).Observe(d.Seconds())
+	if err != nil {
+		jobErrors.WithLabelValues(path, job).Inc()
+	}
+}
+
+// ObserveMergeReclaimed records the bytes freed by a merge of the storage at path.
+func ObserveMergeReclaimed(path string, bytes int64) {
+	mergeReclaimed.WithLabelValues(path).Observe(float64(bytes))
+}
+
+// Gauge is a value of a storage read at every scrape.
+type Gauge struct {
+	Name  string
+	Help  string
+	Value func() float64
+}
+
+// RegisterStorage registers the gauges of the storage at path as kaeya_storage_<name>{path=...},
+// the returned func unregisters them when the storage is closed.
+func RegisterStorage(path string, gauges ...Gauge) func() {
+	registered := make([]prometheus.Collector, 0, len(gauges))
+	for _, g := range gauges {
+		c := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "storage",
+			Name:        g.Name,
+			Help:        g.Help,
+			ConstLabels: prometheus.Labels{"path": path},
+		}, g.Value)
+
+		err := Registry.Register(c)
+		if err != nil {
+			// a storage opened twice at the same path, like a snapshot restore, keeps the first gauges
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				logger.Logger.Warn().Err(err).Str("path", path).Msg("register storage metrics error")
+			}
+			continue
+		}
+		registered = append(registered, c)
+	}
+
+	return func() {
+		for _, c := range registered {
+			Registry.Unregister(c)
+		}
+	}
+}
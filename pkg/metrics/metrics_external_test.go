@@ -0,0 +1,69 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, err := io.ReadAll(w.Body)
+	assert.NoError(t, err)
+
+	return string(data)
+}
+
+func TestStorageMetrics(t *testing.T) {
+	root := path.Join("testdata", "dynamic", utils.ID())
+	repo, err := segment.NewDefaultSegmentFSRepository(codec2.NewBinaryCodec(), root,
+		segment.WithMaxBufferSize(1024),
+		segment.WithRefreshInterval(10*time.Millisecond),
+		segment.WithMergeInterval(20*time.Millisecond),
+		segment.WithMergeFloor(1<<20))
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		err = repo.Save(context.Background(), domain.KV{Key: "key", Value: []byte(fmt.Sprintf("%050d", i))})
+		assert.NoError(t, err)
+	}
+
+	label := fmt.Sprintf(`{path="%s"}`, root)
+	assert.Eventually(t, func() bool {
+		out := scrape(t)
+		return strings.Contains(out, "kaeya_storage_segments"+label+" 1") &&
+			strings.Contains(out, `kaeya_storage_merge_reclaimed_bytes_count`+label)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	out := scrape(t)
+	assert.Contains(t, out, "kaeya_storage_write_buffer_capacity_bytes"+label+" 1024")
+	assert.Contains(t, out, `kaeya_storage_job_duration_seconds_count{job="refresh",path="`+root+`"}`)
+	assert.Contains(t, out, "go_goroutines")
+
+	assert.NoError(t, repo.Close(context.Background()))
+	assert.NotContains(t, scrape(t), "kaeya_storage_segments"+label)
+}
+
+func TestObserveRequest(t *testing.T) {
+	metrics.ObserveRequest("/kv/:key", http.MethodGet, http.StatusNotFound, time.Millisecond)
+
+	out := scrape(t)
+	assert.Contains(t, out, `kaeya_http_requests_total{code="404",handler="/kv/:key",method="GET"} 1`)
+	assert.Contains(t, out, `kaeya_http_request_duration_seconds_count{handler="/kv/:key",method="GET"} 1`)
+}
@@ -0,0 +1,189 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+)
+
+const (
+	defaultRetryInterval = time.Second
+
+	// how often the leader reports its newest sequence, bounds the staleness of the lag
+	heartbeatInterval = time.Second
+)
+
+var (
+	ErrLeader = errors.New("unexpected leader response")
+
+	// errResync means the leader cannot resume the stream, a full copy is needed
+	errResync = errors.New("leader cannot resume the stream")
+)
+
+type Option func(f *Follower)
+
+// WithRetryInterval sets the wait before reconnecting to the leader.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(f *Follower) {
+		f.retryInterval = interval
+	}
+}
+
+func WithClient(client *http.Client) Option {
+	return func(f *Follower) {
+		f.client = client
+	}
+}
+
+// Namespace is a namespace of the leader, as listed by its admin api.
+type Namespace struct {
+	Name    string               `json:"name"`
+	Storage config.StorageConfig `json:"storage"`
+}
+
+// StreamStatus is the replication state of one namespace.
+type StreamStatus struct {
+	Namespace string `json:"namespace"`
+	Connected bool   `json:"connected"`
+	// ChangeLog is the id of the leader change log followed, empty before the first copy.
+	ChangeLog string `json:"change_log,omitempty"`
+	// Applied is the last sequence of the leader applied locally.
+	Applied uint64 `json:"applied"`
+	// LeaderSequence is the newest sequence of the leader known, Lag the difference.
+	LeaderSequence uint64    `json:"leader_sequence"`
+	Lag            uint64    `json:"lag"`
+	LastContact    time.Time `json:"last_contact"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Follower copies the data of a leader into local dbs and applies its watch stream,
+// one stream per namespace. A stream is resumed after a disconnect as long as the leader
+// retains the changes, otherwise the namespace is copied again.
+type Follower struct {
+	leader        string
+	client        *http.Client
+	retryInterval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// NewFollower follows the leader at the base url leader, like http://10.0.0.1:6666.
+func NewFollower(leader string, options ...Option) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &Follower{
+		leader:        leader,
+		client:        &http.Client{},
+		retryInterval: defaultRetryInterval,
+		ctx:           ctx,
+		cancel:        cancel,
+		streams:       make(map[string]*stream),
+	}
+
+	for _, op := range options {
+		op(f)
+	}
+
+	return f
+}
+
+func (f *Follower) Leader() string {
+	return f.leader
+}
+
+// Replicate starts to follow namespace into db, path is the url prefix of the
+// namespace on the leader, empty for the default one.
+func (f *Follower) Replicate(namespace, path string, db service.DBService) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.streams[namespace]; ok || f.ctx.Err() != nil {
+		return
+	}
+
+	s := &stream{
+		f:         f,
+		namespace: namespace,
+		path:      path,
+		db:        db,
+		status:    StreamStatus{Namespace: namespace},
+	}
+	f.streams[namespace] = s
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		s.run(f.ctx)
+	}()
+}
+
+// Namespaces lists the namespaces of the leader.
+func (f *Follower) Namespaces(ctx context.Context) ([]Namespace, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+"/admin/ns", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, leaderError("list namespaces", resp)
+	}
+
+	var res struct {
+		Data []Namespace `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("list namespaces: %s: %w", err.Error(), ErrLeader)
+	}
+
+	return res.Data, nil
+}
+
+// Status reports the streams ordered by namespace.
+func (f *Follower) Status() []StreamStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := make([]StreamStatus, 0, len(f.streams))
+	for _, s := range f.streams {
+		res = append(res, s.snapshot())
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Namespace < res[j].Namespace
+	})
+
+	return res
+}
+
+// Stop disconnects from the leader and waits until no more changes are applied.
+func (f *Follower) Stop() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+func leaderError(op string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return fmt.Errorf("%s: %s %s: %w", op, resp.Status, msg, ErrLeader)
+}
@@ -0,0 +1,104 @@
+package replication_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/api/rest"
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/replication"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/index"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func storageConfig() config.StorageConfig {
+	return config.StorageConfig{
+		Path:   path.Join("testdata", "dynamic", utils.ID()),
+		System: "fs",
+		Codec:  "binary",
+	}
+}
+
+func TestFollower(t *testing.T) {
+	ctx := context.Background()
+
+	leader, err := application.NewApplication(config.KaeyaConfig{Storage: storageConfig()})
+	assert.NoError(t, err)
+	defer leader.Close(ctx)
+
+	server := httptest.NewServer(rest.Route(leader))
+	defer server.Close()
+
+	assert.NoError(t, leader.DB.Set(ctx, domain.KV{Key: "a", Value: []byte("1")}))
+	assert.NoError(t, leader.DB.Set(ctx, domain.KV{Key: "b", Value: []byte("2"), ContentType: "text/plain", Flags: 7}))
+
+	repo, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), storageConfig().Path)
+	assert.NoError(t, err)
+	db := service.NewDefaultDBService(repo)
+	defer db.Close(ctx)
+
+	// left from an earlier life of the follower, gone on the leader
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "stale", Value: []byte("x")}))
+
+	follower := replication.NewFollower(server.URL, replication.WithRetryInterval(10*time.Millisecond))
+	defer follower.Stop()
+	follower.Replicate(application.DefaultNamespace, "", db)
+
+	assert.Eventually(t, func() bool {
+		status := follower.Status()
+		return len(status) == 1 && status[0].Connected
+	}, 5*time.Second, 10*time.Millisecond)
+
+	kv, err := db.Get(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.KV{Key: "b", Value: []byte("2"), ContentType: "text/plain", Flags: 7}, kv)
+
+	_, err = db.Get(ctx, "stale")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.NoError(t, leader.DB.Set(ctx, domain.KV{Key: "c", Value: []byte{0xff, 0x00}}))
+	assert.NoError(t, leader.DB.Delete(ctx, "a"))
+
+	assert.Eventually(t, func() bool {
+		_, err := db.Get(ctx, "a")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	kv, err = db.Get(ctx, "c")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0x00}, kv.Value)
+
+	status := follower.Status()[0]
+	assert.Equal(t, application.DefaultNamespace, status.Namespace)
+	assert.Equal(t, leader.DB.Changes().ID, status.ChangeLog)
+	assert.Equal(t, uint64(4), status.Applied)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.Empty(t, status.Error)
+
+	// a bulk import is not streamed, it makes the follower copy the namespace again
+	changeLog := leader.DB.Changes().ID
+	_, err = leader.DB.Import(ctx, common.NewSliceReader([]domain.KV{{Key: "d", Value: []byte("4")}}))
+	assert.NoError(t, err)
+	assert.NotEqual(t, changeLog, leader.DB.Changes().ID)
+
+	assert.Eventually(t, func() bool {
+		kv, err := db.Get(ctx, "d")
+		return err == nil && string(kv.Value) == "4"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		status := follower.Status()[0]
+		return status.Connected && status.ChangeLog == leader.DB.Changes().ID
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,327 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+)
+
+const (
+	// headers of a watch stream, see rest.Watch
+	changeLogHeader = "X-Kaeya-Change-Log"
+	sequenceHeader  = "X-Kaeya-Sequence"
+
+	eventPut       = "put"
+	eventDelete    = "delete"
+	eventHeartbeat = "heartbeat"
+
+	// a put event holds a value of up to 64MB, base64 encoded if binary
+	maxEventSize = 96 << 20
+)
+
+// message is the data of a watch event, see rest.EventResponse and rest.HeartbeatResponse.
+type message struct {
+	Sequence uint64           `json:"sequence"`
+	Key      string           `json:"key"`
+	KV       *transfer.Record `json:"kv"`
+}
+
+// stream replicates one namespace, the status is guarded by mu.
+type stream struct {
+	f         *Follower
+	namespace string
+	path      string
+	db        service.DBService
+
+	mu     sync.Mutex
+	status StreamStatus
+}
+
+func (s *stream) run(ctx context.Context) {
+	for {
+		err := s.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.disconnected(err)
+		logger.Logger.Warn().Err(err).Str("namespace", s.namespace).Msg("replication stream disconnected")
+
+		select {
+		case <-time.After(s.f.retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow connects to the leader, copies the namespace if the stream cannot be resumed
+// and applies the changes until the stream breaks.
+func (s *stream) follow(ctx context.Context) error {
+	changeLog, applied := s.position()
+
+	resp, err := s.watch(ctx, changeLog, applied)
+	if errors.Is(err, errResync) && changeLog != "" {
+		logger.Logger.Info().Str("namespace", s.namespace).Msg("replication stream cannot be resumed, copying again")
+		changeLog = ""
+		resp, err = s.watch(ctx, "", 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if changeLog == "" {
+		from, err := strconv.ParseUint(resp.Header.Get(sequenceHeader), 10, 64)
+		if err != nil || from == 0 {
+			return fmt.Errorf("watch: invalid %s: %w", sequenceHeader, ErrLeader)
+		}
+
+		// the copy is taken after the stream started, replaying the stream on top of it
+		// in order ends up in the state of the leader
+		n, err := s.copy(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.synced(resp.Header.Get(changeLogHeader), from-1)
+		logger.Logger.Info().Str("namespace", s.namespace).Int("keys", n).Msg("copied namespace from leader")
+	}
+
+	s.connected()
+
+	return s.apply(ctx, resp.Body)
+}
+
+func (s *stream) watch(ctx context.Context, changeLog string, applied uint64) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("heartbeat", heartbeatInterval.String())
+	if changeLog != "" {
+		query.Set("log", changeLog)
+		query.Set("from", strconv.FormatUint(applied+1, 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.f.leader+s.path+"/watch?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusGone:
+		resp.Body.Close()
+		return nil, errResync
+	default:
+		defer resp.Body.Close()
+		return nil, leaderError("watch", resp)
+	}
+}
+
+// copy imports every kv of the leader and deletes the local keys the leader does not have.
+func (s *stream) copy(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.f.leader+s.path+"/export?format="+string(transfer.FormatJSONL), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, leaderError("export", resp)
+	}
+
+	r, err := transfer.NewReader(transfer.FormatJSONL, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := service.Replace(ctx, s.db, r)
+	if err != nil {
+		return 0, fmt.Errorf("copy from leader error: %w", err)
+	}
+
+	return n, nil
+}
+
+// apply reads the server-sent events of the leader, each data is a single line.
+func (s *stream) apply(ctx context.Context, body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxEventSize)
+
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if event != "" {
+				err := s.handle(ctx, event, data)
+				if err != nil {
+					return err
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("watch stream closed by leader: %w", io.ErrUnexpectedEOF)
+}
+
+func (s *stream) handle(ctx context.Context, event, data string) error {
+	var msg message
+	err := json.Unmarshal([]byte(data), &msg)
+	if err != nil {
+		return fmt.Errorf("%s event: %s: %w", event, err.Error(), ErrLeader)
+	}
+
+	if event == eventHeartbeat {
+		s.contact(msg.Sequence)
+		return nil
+	}
+
+	_, applied := s.position()
+	if msg.Sequence <= applied {
+		return nil
+	}
+
+	if msg.Sequence != applied+1 {
+		s.reset()
+		return fmt.Errorf("sequence %d after %d: %w", msg.Sequence, applied, errResync)
+	}
+
+	switch event {
+	case eventPut:
+		if msg.KV == nil {
+			return fmt.Errorf("put event without kv: %w", ErrLeader)
+		}
+
+		kv, err := msg.KV.KV()
+		if err != nil {
+			return err
+		}
+
+		err = s.db.Set(ctx, kv)
+		if err != nil {
+			return err
+		}
+	case eventDelete:
+		err = s.db.Delete(ctx, msg.Key)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown event %s: %w", event, ErrLeader)
+	}
+
+	s.applied(msg.Sequence)
+
+	return nil
+}
+
+func (s *stream) position() (string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status.ChangeLog, s.status.Applied
+}
+
+func (s *stream) synced(changeLog string, applied uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.ChangeLog = changeLog
+	s.status.Applied = applied
+	s.status.LeaderSequence = applied
+}
+
+// reset forgets the position, the next connect copies the namespace again.
+func (s *stream) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.ChangeLog = ""
+}
+
+func (s *stream) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Connected = true
+	s.status.Error = ""
+	s.status.LastContact = time.Now()
+}
+
+func (s *stream) disconnected(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Connected = false
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+}
+
+func (s *stream) contact(leaderSequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.LastContact = time.Now()
+	if leaderSequence > s.status.LeaderSequence {
+		s.status.LeaderSequence = leaderSequence
+	}
+}
+
+func (s *stream) applied(sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Applied = sequence
+	s.status.LastContact = time.Now()
+	if sequence > s.status.LeaderSequence {
+		s.status.LeaderSequence = sequence
+	}
+}
+
+func (s *stream) snapshot() StreamStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := s.status
+	if res.LeaderSequence > res.Applied {
+		res.Lag = res.LeaderSequence - res.Applied
+	}
+
+	return res
+}
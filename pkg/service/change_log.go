@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+const (
+	defaultChangeLogSize = 4096
+
+	// the number of changes copied out of the log at once by a watcher
+	watchBatchSize = 64
+)
+
+var (
+	ErrSequenceNotRetained = errors.New("sequence no longer retained by the change log")
+	ErrWatchClosed         = errors.New("db closed")
+)
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event is a change of a key, sequences are assigned in commit order starting at 1.
+type Event struct {
+	Sequence uint64
+	Type     EventType
+	// KV is the stored kv, only its key for a delete.
+	KV domain.KV
+}
+
+// ChangeLogStatus describes the retained changes. The change log is not persisted, its ID
+// is new on every start and sequences under another ID are unrelated.
+type ChangeLogStatus struct {
+	ID string `json:"id"`
+	// First is the oldest retained sequence, Last the newest one, 0 before the first change.
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// changeLog keeps the latest changes in a ring for watchers to follow and resume from.
+// Sequences start at 1 on every start, the log is not persisted.
+type changeLog struct {
+	id     string
+	mu     sync.Mutex
+	events []Event
+	next   uint64
+	// first is the first sequence after the last reset
+	first  uint64
+	notify chan struct{}
+	closed bool
+}
+
+func newChangeLog(size int) *changeLog {
+	if size <= 0 {
+		size = defaultChangeLogSize
+	}
+
+	return &changeLog{
+		id:     utils.ID(),
+		events: make([]Event, size),
+		next:   1,
+		first:  1,
+		notify: make(chan struct{}),
+	}
+}
+
+// oldest is the smallest sequence still retained, the caller must hold mu.
+func (l *changeLog) oldest() uint64 {
+	size := uint64(len(l.events))
+	if l.next-l.first <= size {
+		return l.first
+	}
+
+	return l.next - size
+}
+
+func (l *changeLog) status() ChangeLogStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ChangeLogStatus{ID: l.id, First: l.oldest(), Last: l.next - 1}
+}
+
+func (l *changeLog) append(typ EventType, kv domain.KV) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	l.events[l.next%uint64(len(l.events))] = Event{Sequence: l.next, Type: typ, KV: kv}
+	l.next++
+
+	// wake up every waiting watcher
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// reset starts the log over under a new id after changes it does not hold, like a bulk
+// import. The watchers are stopped and cannot resume, they have to copy the data again.
+func (l *changeLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	l.id = utils.ID()
+	l.first = l.next
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// start returns the id of the log and the sequence to follow from, the next change if from is 0.
+func (l *changeLog) start(from uint64) (string, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return "", 0, ErrWatchClosed
+	}
+
+	if from == 0 {
+		return l.id, l.next, nil
+	}
+
+	if from < l.oldest() || from > l.next {
+		return "", 0, fmt.Errorf("sequence %d, retained %d to %d: %w", from, l.oldest(), l.next-1, ErrSequenceNotRetained)
+	}
+
+	return l.id, from, nil
+}
+
+// read appends the retained changes from seq on of the log with id to buf. Without any,
+// it returns a channel closed by the next change.
+func (l *changeLog) read(id string, seq uint64, buf []Event) ([]Event, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, nil, ErrWatchClosed
+	}
+
+	if id != l.id || seq < l.oldest() {
+		return nil, nil, ErrSequenceNotRetained
+	}
+
+	for ; seq < l.next && len(buf) < cap(buf); seq++ {
+		buf = append(buf, l.events[seq%uint64(len(l.events))])
+	}
+
+	return buf, l.notify, nil
+}
+
+// follow sends the changes of keys starting with prefix from seq on to ch until ctx is done,
+// the log is closed or the watcher falls behind the retained changes. It closes ch at the end.
+func (l *changeLog) follow(ctx context.Context, id, prefix string, seq uint64, ch chan<- Event) {
+	defer close(ch)
+
+	buf := make([]Event, 0, watchBatchSize)
+	for {
+		events, notify, err := l.read(id, seq, buf[:0])
+		if err != nil {
+			return
+		}
+
+		for _, e := range events {
+			seq = e.Sequence + 1
+			if !strings.HasPrefix(e.KV.Key, prefix) {
+				continue
+			}
+
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *changeLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+}
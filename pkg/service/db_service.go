@@ -3,45 +3,293 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"sync"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
 	"github.com/ForeverSRC/kaeya/pkg/storage"
-	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var ErrUnknownOp = errors.New("unknown batch op")
+
 type DBService interface {
 	Set(ctx context.Context, kv domain.KV) error
+	// Get returns storage.ErrNotFound if the key does not exist or has been deleted.
 	Get(ctx context.Context, key string) (domain.KV, error)
+	// Delete stores a tombstone for key, deleting a missing key is no error.
+	// codec.ErrUnsupported if the storage uses the csv codec.
+	Delete(ctx context.Context, key string) error
+	// Batch applies the ops in order, without other writes in between.
+	Batch(ctx context.Context, ops []Op) error
 	Close(ctx context.Context) error
+	// Checkpoint makes a consistent snapshot of the storage in dir, see storage.Repository.
+	Checkpoint(ctx context.Context, dir string) error
+	// Scan calls fn with every key starting with prefix, see storage.Repository.
+	Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) error
+	Import(ctx context.Context, r common.KVReader) (int, error)
+	// Ingest adds segment files built by storage.BuildSegment, storage.ErrIngestUnsupported
+	// if the storage system has no segments.
+	Ingest(ctx context.Context, files []string, precedence string) (int, error)
+	// Watch streams every Set and Delete of keys starting with prefix in commit order, from
+	// fromSequence on or only new ones if it is 0. ErrSequenceNotRetained if the change log
+	// no longer holds fromSequence. The channel is closed when ctx is done, the db is closed
+	// or the watcher falls behind the change log, resume from the sequence after the last event.
+	// Bulk Import and Ingest are not streamed, they reset the change log and stop the watchers.
+	Watch(ctx context.Context, prefix string, fromSequence uint64) (<-chan Event, error)
+	// Changes reports the changes retained for Watch.
+	Changes() ChangeLogStatus
+}
+
+// FilteredImporter writes the kvs of a reader like single writes, streamed to the watchers,
+// skipping the ones keep rejects. No write of the key comes between keep and the write.
+type FilteredImporter interface {
+	ImportWhere(ctx context.Context, r common.KVReader, keep func(key string) bool) (int, error)
+}
+
+// Op is a put or a delete of a batch, only the key of KV is used by a delete.
+type Op struct {
+	Type EventType `json:"type"`
+	KV   domain.KV `json:"kv"`
+}
+
+type Option func(d *DefaultDBService)
+
+// WithChangeLogSize sets how many of the latest changes are retained for resuming watchers.
+func WithChangeLogSize(size int) Option {
+	return func(d *DefaultDBService) {
+		d.changes = newChangeLog(size)
+	}
 }
 
 type DefaultDBService struct {
 	repo storage.Repository
+
+	// writeLock keeps the sequence of changes in commit order
+	writeLock sync.Mutex
+	changes   *changeLog
 }
 
-func NewDefaultDBService(repo storage.Repository) *DefaultDBService {
-	return &DefaultDBService{
-		repo: repo,
+func NewDefaultDBService(repo storage.Repository, options ...Option) *DefaultDBService {
+	d := &DefaultDBService{
+		repo:    repo,
+		changes: newChangeLog(defaultChangeLogSize),
+	}
+
+	for _, op := range options {
+		op(d)
 	}
+
+	return d
 }
 
-func (d *DefaultDBService) Set(ctx context.Context, kv domain.KV) error {
-	return d.repo.Save(ctx, kv)
+func (d *DefaultDBService) Set(ctx context.Context, kv domain.KV) (err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Set", trace.WithAttributes(attribute.String("kaeya.key", kv.Key)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return d.write(ctx, EventPut, kv)
 }
 
-func (d *DefaultDBService) Get(ctx context.Context, key string) (domain.KV, error) {
-	kv, err := d.repo.Load(ctx, key)
-	if err != nil {
-		if errors.Is(err, fs.ErrNull) {
-			return domain.KV{Key: key}, nil
-		} else {
-			return domain.KV{}, err
+func (d *DefaultDBService) Delete(ctx context.Context, key string) (err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Delete", trace.WithAttributes(attribute.String("kaeya.key", key)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return d.write(ctx, EventDelete, domain.Tombstone(key))
+}
+
+// Batch stops at the first failed op, the ops before stay applied.
+func (d *DefaultDBService) Batch(ctx context.Context, ops []Op) (err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Batch", trace.WithAttributes(attribute.Int("kaeya.ops", len(ops))))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	for i, op := range ops {
+		kv, err := op.record()
+		if err == nil {
+			err = d.doWrite(ctx, op.Type, kv)
+		}
+
+		if err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
 		}
 	}
 
+	return nil
+}
+
+func (d *DefaultDBService) write(ctx context.Context, typ EventType, kv domain.KV) error {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	return d.doWrite(ctx, typ, kv)
+}
+
+func (d *DefaultDBService) doWrite(ctx context.Context, typ EventType, kv domain.KV) error {
+	err := d.repo.Save(ctx, kv)
+	if err != nil {
+		return err
+	}
+
+	d.changes.append(typ, kv)
+
+	return nil
+}
+
+// record is the kv to store for op.
+func (op Op) record() (domain.KV, error) {
+	switch op.Type {
+	case EventPut:
+		return op.KV, nil
+	case EventDelete:
+		return domain.Tombstone(op.KV.Key), nil
+	default:
+		return domain.KV{}, fmt.Errorf("%s: %w", op.Type, ErrUnknownOp)
+	}
+}
+
+func (d *DefaultDBService) Get(ctx context.Context, key string) (kv domain.KV, err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Get", trace.WithAttributes(attribute.String("kaeya.key", key)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	kv, err = d.repo.Load(ctx, key)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	if kv.IsTombstone() {
+		return domain.KV{}, storage.ErrNotFound
+	}
+
 	return kv, nil
 }
 
+func (d *DefaultDBService) Watch(ctx context.Context, prefix string, fromSequence uint64) (<-chan Event, error) {
+	id, seq, err := d.changes.start(fromSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Event)
+	go d.changes.follow(ctx, id, prefix, seq, ch)
+
+	return ch, nil
+}
+
+// Refresh makes every write visible to Get and Scan, on storage systems which show
+// writes after a refresh only, see storage.Refresher.
+func (d *DefaultDBService) Refresh(ctx context.Context) error {
+	r, ok := d.repo.(storage.Refresher)
+	if !ok {
+		return nil
+	}
+
+	return r.Refresh(ctx)
+}
+
+func (d *DefaultDBService) Checkpoint(ctx context.Context, dir string) error {
+	return d.repo.Checkpoint(ctx, dir)
+}
+
+func (d *DefaultDBService) Changes() ChangeLogStatus {
+	return d.changes.status()
+}
+
+func (d *DefaultDBService) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) (err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Scan", trace.WithAttributes(attribute.String("kaeya.prefix", prefix)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return d.repo.Scan(ctx, prefix, func(kv domain.KV) error {
+		if kv.IsTombstone() {
+			return nil
+		}
+
+		return fn(kv)
+	})
+}
+
+func (d *DefaultDBService) Import(ctx context.Context, r common.KVReader) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "DBService.Import")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	// a watcher like a follower must copy the data again, even after a partial import
+	defer d.changes.reset()
+
+	return d.repo.Import(ctx, r)
+}
+
+// ImportWhere writes the kvs of r which keep accepts one by one, see FilteredImporter.
+// Unlike Import the change log is kept.
+func (d *DefaultDBService) ImportWhere(ctx context.Context, r common.KVReader, keep func(key string) bool) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "DBService.ImportWhere")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	for {
+		kv, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		written, err := d.writeIf(ctx, kv, keep)
+		if err != nil {
+			return n, err
+		}
+		if written {
+			n++
+		}
+	}
+}
+
+func (d *DefaultDBService) writeIf(ctx context.Context, kv domain.KV, keep func(key string) bool) (bool, error) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	if !keep(kv.Key) {
+		return false, nil
+	}
+
+	typ := EventPut
+	if kv.IsTombstone() {
+		typ = EventDelete
+	}
+
+	return true, d.doWrite(ctx, typ, kv)
+}
+
+func (d *DefaultDBService) Ingest(ctx context.Context, files []string, precedence string) (int, error) {
+	ingester, ok := d.repo.(storage.Ingester)
+	if !ok {
+		return 0, storage.ErrIngestUnsupported
+	}
+
+	defer d.changes.reset()
+
+	return ingester.Ingest(ctx, files, precedence)
+}
+
 func (d *DefaultDBService) Close(ctx context.Context) error {
+	d.changes.close()
 	return d.repo.Close(ctx)
 }
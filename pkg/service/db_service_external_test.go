@@ -0,0 +1,191 @@
+package service_test
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/index"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDB(t *testing.T, options ...service.Option) *service.DefaultDBService {
+	repo, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), path.Join("testdata", "dynamic", utils.ID()))
+	assert.NoError(t, err)
+
+	return service.NewDefaultDBService(repo, options...)
+}
+
+func receive(t *testing.T, events <-chan service.Event) service.Event {
+	select {
+	case e, ok := <-events:
+		assert.True(t, ok)
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return service.Event{}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	db := newDB(t)
+	defer db.Close(ctx)
+
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "a", Value: []byte("1")}))
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "b", Value: []byte("2")}))
+	assert.NoError(t, db.Delete(ctx, "a"))
+	assert.NoError(t, db.Delete(ctx, "missing"))
+
+	_, err := db.Get(ctx, "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	kv, err := db.Get(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), kv.Value)
+
+	keys := make([]string, 0)
+	err = db.Scan(ctx, "", func(kv domain.KV) error {
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, keys)
+
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "a", Value: []byte("3")}))
+	kv, err = db.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), kv.Value)
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := newDB(t, service.WithChangeLogSize(3))
+
+	events, err := db.Watch(ctx, "a", 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "a1", Value: []byte("1")}))
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "b1", Value: []byte("2")}))
+	assert.NoError(t, db.Delete(ctx, "a1"))
+
+	e := receive(t, events)
+	assert.Equal(t, service.Event{Sequence: 1, Type: service.EventPut, KV: domain.KV{Key: "a1", Value: []byte("1")}}, e)
+
+	e = receive(t, events)
+	assert.Equal(t, uint64(3), e.Sequence)
+	assert.Equal(t, service.EventDelete, e.Type)
+	assert.Equal(t, "a1", e.KV.Key)
+
+	// resume
+	resumed, err := db.Watch(ctx, "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), receive(t, resumed).Sequence)
+	assert.Equal(t, uint64(3), receive(t, resumed).Sequence)
+
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "c1", Value: []byte("4")}))
+	assert.Equal(t, uint64(4), receive(t, resumed).Sequence)
+
+	status := db.Changes()
+	assert.NotEmpty(t, status.ID)
+	assert.Equal(t, uint64(2), status.First)
+	assert.Equal(t, uint64(4), status.Last)
+
+	// the first change has been dropped from the change log
+	_, err = db.Watch(ctx, "", 1)
+	assert.ErrorIs(t, err, service.ErrSequenceNotRetained)
+
+	_, err = db.Watch(ctx, "", 6)
+	assert.ErrorIs(t, err, service.ErrSequenceNotRetained)
+
+	assert.NoError(t, db.Close(ctx))
+
+	_, ok := <-events
+	assert.False(t, ok)
+
+	_, err = db.Watch(ctx, "", 0)
+	assert.ErrorIs(t, err, service.ErrWatchClosed)
+}
+
+func TestImportResetsChanges(t *testing.T) {
+	ctx := context.Background()
+	db := newDB(t)
+	defer db.Close(ctx)
+
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "a", Value: []byte("1")}))
+
+	events, err := db.Watch(ctx, "", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), receive(t, events).Sequence)
+
+	before := db.Changes()
+	_, err = db.Import(ctx, common.NewSliceReader([]domain.KV{{Key: "b", Value: []byte("2")}}))
+	assert.NoError(t, err)
+
+	// the watchers cannot miss the imported kvs silently
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watch not stopped")
+	}
+
+	after := db.Changes()
+	assert.NotEqual(t, before.ID, after.ID)
+	assert.Equal(t, before.Last, after.Last)
+
+	_, err = db.Watch(ctx, "", 1)
+	assert.ErrorIs(t, err, service.ErrSequenceNotRetained)
+
+	events, err = db.Watch(ctx, "", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set(ctx, domain.KV{Key: "c", Value: []byte("3")}))
+	assert.Equal(t, uint64(2), receive(t, events).Sequence)
+}
+
+func TestImportWhere(t *testing.T) {
+	ctx := context.Background()
+	db := newDB(t)
+	defer db.Close(ctx)
+
+	events, err := db.Watch(ctx, "", 0)
+	assert.NoError(t, err)
+	before := db.Changes()
+
+	// a write of a kept key made meanwhile waits for it
+	written := make(chan error)
+	kvs := []domain.KV{{Key: "a", Value: []byte("moved")}, {Key: "b", Value: []byte("moved")}}
+	n, err := db.ImportWhere(ctx, common.NewSliceReader(kvs), func(key string) bool {
+		if key == "a" {
+			go func() {
+				written <- db.Set(ctx, domain.KV{Key: "a", Value: []byte("new")})
+			}()
+		}
+
+		return key == "a"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, <-written)
+
+	kv, err := db.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), kv.Value)
+	_, err = db.Get(ctx, "b")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// the kvs are streamed like writes
+	assert.Equal(t, []byte("moved"), receive(t, events).KV.Value)
+	assert.Equal(t, []byte("new"), receive(t, events).KV.Value)
+	assert.Equal(t, before.ID, db.Changes().ID)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+// Replace makes db hold exactly the kvs of r: they are bulk imported, then every
+// other key is deleted. It returns the number of imported kvs.
+func Replace(ctx context.Context, db DBService, r common.KVReader) (int, error) {
+	seen := &seenReader{r: r, keys: make(map[string]struct{})}
+	n, err := db.Import(ctx, seen)
+	if err != nil {
+		return 0, err
+	}
+
+	stale := make([]string, 0)
+	err = db.Scan(ctx, "", func(kv domain.KV) error {
+		if _, ok := seen.keys[kv.Key]; !ok {
+			stale = append(stale, kv.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range stale {
+		err = db.Delete(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// seenReader records the keys read.
+type seenReader struct {
+	r    common.KVReader
+	keys map[string]struct{}
+}
+
+func (r *seenReader) Read() (domain.KV, error) {
+	kv, err := r.r.Read()
+	if err == nil {
+		r.keys[kv.Key] = struct{}{}
+	}
+
+	return kv, err
+}
@@ -0,0 +1,194 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+)
+
+// rebalance moves the keys owned by other members until it succeeds, then tells the members it is done.
+func (s *Sharder) rebalance(ctx context.Context, version uint64) {
+	defer s.wg.Done()
+
+	for {
+		err := s.migrate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			break
+		}
+
+		s.failed(err)
+		logger.Logger.Error().Err(err).Uint64("version", version).Msg("shard rebalance error")
+
+		select {
+		case <-time.After(s.retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	s.finished()
+	s.notifyDone(ctx, version)
+}
+
+func (s *Sharder) migrate(ctx context.Context) error {
+	dbs := s.dbs()
+
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := s.migrateNamespace(ctx, name, dbs[name])
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateNamespace collects the keys of other members first, the kvs are read again
+// batch by batch so the scan does not run while keys are deleted.
+func (s *Sharder) migrateNamespace(ctx context.Context, namespace string, db service.DBService) error {
+	s.mu.RLock()
+	ring := s.ring
+	s.mu.RUnlock()
+
+	owners := make(map[string]Member)
+	moving := make(map[string][]string)
+	err := db.Scan(ctx, "", func(kv domain.KV) error {
+		owner, ok := ring.Owner(kv.Key)
+		if ok && owner.Name != s.self {
+			owners[owner.Name] = owner
+			moving[owner.Name] = append(moving[owner.Name], kv.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, keys := range moving {
+		for len(keys) > 0 {
+			n := migrateBatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+
+			err = s.moveBatch(ctx, namespace, db, owners[name], keys[:n])
+			if err != nil {
+				return fmt.Errorf("move to %s: %w", name, err)
+			}
+			keys = keys[n:]
+		}
+	}
+
+	return nil
+}
+
+func (s *Sharder) moveBatch(ctx context.Context, namespace string, db service.DBService, owner Member, keys []string) error {
+	var buffer bytes.Buffer
+	w, err := transfer.NewWriter(transfer.FormatJSONL, &buffer)
+	if err != nil {
+		return err
+	}
+
+	moved := make([]string, 0, len(keys))
+	for _, key := range keys {
+		kv, err := db.Get(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = w.Write(kv)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, key)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = s.post(ctx, owner.URL+receivePath+"?ns="+url.QueryEscape(namespace), transfer.FormatJSONL.ContentType(), &buffer)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range moved {
+		err = db.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.moved += len(moved)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Sharder) notifyDone(ctx context.Context, version uint64) {
+	body, _ := json.Marshal(map[string]interface{}{"from": s.self, "version": version})
+
+	for _, m := range s.Topology().Members {
+		if m.Name == s.self {
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := s.post(ctx, m.URL+donePath, "application/json", bytes.NewReader(body))
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+
+			if attempt == notifyAttempts {
+				logger.Logger.Warn().Err(err).Str("member", m.Name).Msg("notify shard rebalance done error")
+				break
+			}
+
+			select {
+			case <-time.After(s.retryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (s *Sharder) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+func (s *Sharder) finished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rebalancing = false
+	s.err = ""
+	logger.Logger.Info().Int("moved", s.moved).Msg("shard rebalance finished")
+}
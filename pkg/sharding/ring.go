@@ -0,0 +1,120 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const DefaultVirtualNodes = 128
+
+type Member struct {
+	Name string `json:"name"`
+	// URL is the http address of the rest api of the member, like http://10.0.0.1:6666.
+	URL string `json:"url"`
+}
+
+// Ring places every member at vnodes points of a hash ring, a key is owned by the member
+// of the first point at or after its hash. Adding a member only moves keys to it.
+type Ring struct {
+	points  []uint64
+	owners  map[uint64]Member
+	members []Member
+}
+
+func NewRing(members []Member, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		points:  make([]uint64, 0, len(members)*vnodes),
+		owners:  make(map[uint64]Member, len(members)*vnodes),
+		members: members,
+	}
+
+	for _, m := range members {
+		for i := 0; i < vnodes; i++ {
+			point := hash(m.Name + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+
+			r.owners[point] = m
+			r.points = append(r.points, point)
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+
+	return r
+}
+
+// Owner returns the member owning key, false if the ring is empty.
+func (r *Ring) Owner(key string) (Member, bool) {
+	if len(r.points) == 0 {
+		return Member{}, false
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]], true
+}
+
+// Successors returns up to n distinct members from the owner of key on along the ring,
+// the replicas of key in the leaderless replication.
+func (r *Ring) Successors(key string, n int) []Member {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+
+	res := make([]Member, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; i < len(r.points) && len(res) < n; i++ {
+		m := r.owners[r.points[(start+i)%len(r.points)]]
+		if _, ok := seen[m.Name]; ok {
+			continue
+		}
+
+		seen[m.Name] = struct{}{}
+		res = append(res, m)
+	}
+
+	return res
+}
+
+func (r *Ring) Members() []Member {
+	return r.members
+}
+
+// hash is fnv-1a finished by the mixer of splitmix64, fnv alone spreads similar short keys poorly.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
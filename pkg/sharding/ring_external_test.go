@@ -0,0 +1,70 @@
+package sharding_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/stretchr/testify/assert"
+)
+
+func members(names ...string) []sharding.Member {
+	res := make([]sharding.Member, 0, len(names))
+	for _, name := range names {
+		res = append(res, sharding.Member{Name: name, URL: "http://" + name})
+	}
+
+	return res
+}
+
+func TestRing(t *testing.T) {
+	_, ok := sharding.NewRing(nil, 0).Owner("a")
+	assert.False(t, ok)
+
+	before := sharding.NewRing(members("a", "b", "c"), 0)
+	after := sharding.NewRing(members("a", "b", "c", "d"), 0)
+
+	const keys = 10000
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		from, ok := before.Owner(key)
+		assert.True(t, ok)
+		to, _ := after.Owner(key)
+		counts[to.Name]++
+
+		// keys only move to the new member
+		if from.Name != to.Name {
+			assert.Equal(t, "d", to.Name)
+			moved++
+		}
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		assert.InDelta(t, keys/4, counts[name], keys/4*0.25, name)
+	}
+	assert.Equal(t, counts["d"], moved)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner, _ := after.Owner(key)
+
+		replicas := after.Successors(key, 3)
+		assert.Len(t, replicas, 3)
+		assert.Equal(t, owner, replicas[0])
+		assert.NotEqual(t, replicas[1], replicas[2])
+		assert.NotEqual(t, replicas[0], replicas[2])
+	}
+	assert.Len(t, before.Successors("a", 5), 3)
+
+	// the owner only depends on the members
+	again := sharding.NewRing(members("d", "c", "b", "a"), 0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		x, _ := after.Owner(key)
+		y, _ := again.Owner(key)
+		assert.Equal(t, x, y)
+	}
+}
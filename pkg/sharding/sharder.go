@@ -0,0 +1,507 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/service"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// ForwardedHeader names the member which forwarded a request, the receiver serves it locally.
+	ForwardedHeader = "X-Kaeya-Forwarded"
+
+	// admin routes of the members, see rest.Route
+	topologyPath = "/admin/shards/topology"
+	receivePath  = "/admin/shards/receive"
+	donePath     = "/admin/shards/done"
+
+	defaultRetryInterval = time.Second
+	// kvs sent to the new owner per request while rebalancing
+	migrateBatchSize = 500
+	notifyAttempts   = 5
+)
+
+var (
+	ErrStaleTopology    = errors.New("topology version is not newer")
+	ErrInvalidTopology  = errors.New("invalid topology")
+	ErrCrossShard       = errors.New("keys are owned by different shards")
+	ErrUnknownNamespace = errors.New("namespace not found")
+	ErrMember           = errors.New("member error")
+)
+
+type Topology struct {
+	Version uint64   `json:"version"`
+	Members []Member `json:"members"`
+}
+
+// Update is a new topology sent to every member, Previous is the topology it replaces
+// on the member where the update started.
+type Update struct {
+	Topology
+	Previous *Topology `json:"previous,omitempty"`
+}
+
+// Databases returns the db of every namespace by name, their keys are sharded alike.
+type Databases func() map[string]service.DBService
+
+type Status struct {
+	Self     string   `json:"self"`
+	Topology Topology `json:"topology"`
+	// Rebalancing is true while this member moves the keys it no longer owns.
+	Rebalancing bool `json:"rebalancing"`
+	Moved       int  `json:"moved"`
+	// Pending are the former owners still moving keys to the others, reads of missing keys
+	// are checked on them until they are done.
+	Pending []string `json:"pending,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type Option func(s *Sharder)
+
+// WithVirtualNodes sets the points of every member on the ring, it must be the same on every member.
+func WithVirtualNodes(vnodes int) Option {
+	return func(s *Sharder) {
+		s.vnodes = vnodes
+	}
+}
+
+// WithStateFile keeps the topology updates in file, a newer one wins over the configured topology on start.
+func WithStateFile(file string) Option {
+	return func(s *Sharder) {
+		s.stateFile = file
+	}
+}
+
+func WithClient(client *http.Client) Option {
+	return func(s *Sharder) {
+		s.client = client
+	}
+}
+
+// WithRetryInterval sets the wait before a failed rebalance is tried again.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(s *Sharder) {
+		s.retryInterval = interval
+	}
+}
+
+// Sharder splits the keyspace of the members by consistent hashing. When the topology
+// changes, every member moves the keys it no longer owns to their new owners, which
+// meanwhile look up the keys they miss on the former owners.
+type Sharder struct {
+	self          string
+	dbs           Databases
+	vnodes        int
+	stateFile     string
+	client        *http.Client
+	retryInterval time.Duration
+
+	mu       sync.RWMutex
+	topology Topology
+	ring     *Ring
+	// previous is the ring before the last update while pending former owners move keys,
+	// touched are the keys written meanwhile, which the moved kvs must not overwrite
+	previous *Ring
+	pending  map[string]bool
+	touched  map[string]struct{}
+
+	rebalancing bool
+	moved       int
+	err         string
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewSharder(self string, topology Topology, dbs Databases, options ...Option) (*Sharder, error) {
+	s := &Sharder{
+		self:          self,
+		dbs:           dbs,
+		vnodes:        DefaultVirtualNodes,
+		client:        http.DefaultClient,
+		retryInterval: defaultRetryInterval,
+	}
+
+	for _, op := range options {
+		op(s)
+	}
+
+	if self == "" {
+		return nil, fmt.Errorf("empty self: %w", ErrInvalidTopology)
+	}
+
+	saved, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if saved != nil && saved.Version >= topology.Version {
+		topology = *saved
+	}
+
+	err = validate(topology)
+	if err != nil {
+		return nil, err
+	}
+
+	s.topology = topology
+	s.ring = NewRing(topology.Members, s.vnodes)
+
+	return s, nil
+}
+
+func validate(topology Topology) error {
+	if len(topology.Members) == 0 {
+		return fmt.Errorf("no members: %w", ErrInvalidTopology)
+	}
+
+	names := make(map[string]struct{}, len(topology.Members))
+	for _, m := range topology.Members {
+		if m.Name == "" || m.URL == "" {
+			return fmt.Errorf("member without name or url: %w", ErrInvalidTopology)
+		}
+
+		if _, ok := names[m.Name]; ok {
+			return fmt.Errorf("duplicate member %s: %w", m.Name, ErrInvalidTopology)
+		}
+		names[m.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+func (s *Sharder) Self() string {
+	return s.self
+}
+
+func (s *Sharder) Topology() Topology {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topology
+}
+
+// Owner returns the member owning every key, ErrCrossShard if they belong to different members.
+func (s *Sharder) Owner(keys ...string) (Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var owner Member
+	for i, key := range keys {
+		m, _ := s.ring.Owner(key)
+		if i > 0 && m.Name != owner.Name {
+			return Member{}, ErrCrossShard
+		}
+		owner = m
+	}
+
+	return owner, nil
+}
+
+// Fallback returns the former owner of key in namespace if it may still hold the key, which
+// has not been moved here yet. A key written here since, deleted as well, is never looked up there.
+func (s *Sharder) Fallback(namespace, key string) (Member, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.previous == nil {
+		return Member{}, false
+	}
+
+	if _, ok := s.touched[namespace+"\x00"+key]; ok {
+		return Member{}, false
+	}
+
+	m, _ := s.previous.Owner(key)
+	if m.Name == s.self || !s.pending[m.Name] {
+		return Member{}, false
+	}
+
+	return m, true
+}
+
+// Touch records the keys of namespace written during a rebalance.
+func (s *Sharder) Touch(namespace string, keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.previous == nil {
+		return
+	}
+
+	for _, key := range keys {
+		s.touched[namespace+"\x00"+key] = struct{}{}
+	}
+}
+
+func (s *Sharder) isTouched(namespace, key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.touched[namespace+"\x00"+key]
+	return ok
+}
+
+// Receive writes the kvs moved here by a former owner, keys written here since the update are kept.
+// A write racing with a kv of the same key wins unless the db is no service.FilteredImporter,
+// such a db imports the kvs.
+func (s *Sharder) Receive(ctx context.Context, namespace string, r common.KVReader) (int, error) {
+	db, ok := s.dbs()[namespace]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", namespace, ErrUnknownNamespace)
+	}
+
+	if importer, ok := db.(service.FilteredImporter); ok {
+		// a write is touched before it is made
+		return importer.ImportWhere(ctx, r, func(key string) bool {
+			return !s.isTouched(namespace, key)
+		})
+	}
+
+	return db.Import(ctx, &untouchedReader{s: s, namespace: namespace, r: r})
+}
+
+// Update applies a newer topology and starts moving the keys this member no longer owns.
+// The returned update holds the previous topology to broadcast to the other members.
+func (s *Sharder) Update(u Update) (Update, error) {
+	err := validate(u.Topology)
+	if err != nil {
+		return Update{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u.Version <= s.topology.Version {
+		return Update{}, fmt.Errorf("version %d, current %d: %w", u.Version, s.topology.Version, ErrStaleTopology)
+	}
+
+	if u.Previous == nil {
+		previous := s.topology
+		u.Previous = &previous
+	}
+
+	err = s.save(u.Topology)
+	if err != nil {
+		return Update{}, err
+	}
+
+	s.topology = u.Topology
+	s.ring = NewRing(u.Members, s.vnodes)
+
+	s.previous = NewRing(u.Previous.Members, s.vnodes)
+	s.pending = make(map[string]bool)
+	s.touched = make(map[string]struct{})
+	for _, m := range u.Previous.Members {
+		if m.Name != s.self {
+			s.pending[m.Name] = true
+		}
+	}
+	if len(s.pending) == 0 {
+		s.previous = nil
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.rebalancing, s.moved, s.err = true, 0, ""
+
+	s.wg.Add(1)
+	go s.rebalance(ctx, u.Version)
+
+	logger.Logger.Info().Uint64("version", u.Version).Int("members", len(u.Members)).Msg("shard topology updated")
+
+	return u, nil
+}
+
+// Broadcast sends the update to every other member of the previous and the new topology.
+func (s *Sharder) Broadcast(ctx context.Context, u Update) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string]Member)
+	for _, m := range append(u.Previous.Members, u.Members...) {
+		if m.Name != s.self {
+			members[m.Name] = m
+		}
+	}
+
+	failed := make([]string, 0)
+	var firstErr error
+	for _, m := range members {
+		err = s.post(ctx, m.URL+topologyPath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			failed = append(failed, m.Name)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		sort.Strings(failed)
+		return fmt.Errorf("send topology to %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+
+	return nil
+}
+
+// Done records that the former owner from moved its keys for the topology version.
+func (s *Sharder) Done(from string, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != s.topology.Version || s.previous == nil {
+		return
+	}
+
+	delete(s.pending, from)
+	if len(s.pending) == 0 {
+		s.previous = nil
+		s.touched = nil
+		logger.Logger.Info().Uint64("version", version).Msg("shard rebalance finished on every member")
+	}
+}
+
+func (s *Sharder) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := Status{
+		Self:        s.self,
+		Topology:    s.topology,
+		Rebalancing: s.rebalancing,
+		Moved:       s.moved,
+		Error:       s.err,
+	}
+
+	if s.previous != nil {
+		for name := range s.pending {
+			res.Pending = append(res.Pending, name)
+		}
+		sort.Strings(res.Pending)
+	}
+
+	return res
+}
+
+// Close stops a running rebalance, it goes on after a restart only by another update.
+func (s *Sharder) Close() {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Sharder) post(ctx context.Context, url, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(ForwardedHeader, s.self)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+
+		return fmt.Errorf("%s: %d %s: %w", url, resp.StatusCode, res.Message, ErrMember)
+	}
+
+	io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
+
+func (s *Sharder) load() (*Topology, error) {
+	if s.stateFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res Topology
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("read %s error: %w", s.stateFile, err)
+	}
+
+	return &res, nil
+}
+
+func (s *Sharder) save(topology Topology) error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(topology)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.stateFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.stateFile)
+}
+
+// untouchedReader skips the kvs of keys written during the rebalance.
+type untouchedReader struct {
+	s         *Sharder
+	namespace string
+	r         common.KVReader
+}
+
+func (u *untouchedReader) Read() (domain.KV, error) {
+	for {
+		kv, err := u.r.Read()
+		if err != nil {
+			return kv, err
+		}
+
+		if !u.s.isTouched(u.namespace, kv.Key) {
+			return kv, nil
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package sharding_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/api/rest"
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/sharding"
+	"github.com/ForeverSRC/kaeya/pkg/storage"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const keys = 200
+
+type shard struct {
+	name   string
+	app    *application.Application
+	server *httptest.Server
+}
+
+// startShards starts a server per name, the first count of them are the initial members.
+func startShards(t *testing.T, names []string, count int) []*shard {
+	shards := make([]*shard, 0, len(names))
+	for _, name := range names {
+		server := httptest.NewUnstartedServer(nil)
+		shards = append(shards, &shard{name: name, server: server})
+	}
+
+	initial := make([]config.ShardMemberConfig, 0, count)
+	for _, s := range shards[:count] {
+		initial = append(initial, config.ShardMemberConfig{Name: s.name, URL: "http://" + s.server.Listener.Addr().String()})
+	}
+
+	for i, s := range shards {
+		members := initial
+		if i >= count {
+			members = []config.ShardMemberConfig{{Name: s.name, URL: "http://" + s.server.Listener.Addr().String()}}
+		}
+
+		app, err := application.NewApplication(config.KaeyaConfig{
+			Storage: config.StorageConfig{
+				Path:   path.Join("testdata", "dynamic", utils.ID()),
+				System: "fs",
+				Codec:  "binary",
+			},
+			Sharding: config.ShardingConfig{Self: s.name, Members: members},
+		})
+		assert.NoError(t, err)
+
+		s.app = app
+		s.server.Config.Handler = rest.Route(app)
+		s.server.Start()
+
+		t.Cleanup(func() {
+			s.server.Close()
+			app.Close(context.Background())
+		})
+	}
+
+	return shards
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	return resp.StatusCode, string(data)
+}
+
+// local counts the keys stored by the shard itself.
+func (s *shard) local(t *testing.T) int {
+	n := 0
+	for i := 0; i < keys; i++ {
+		_, err := s.app.DB.Get(context.Background(), fmt.Sprintf("key-%d", i))
+		if err == nil {
+			n++
+		} else {
+			assert.ErrorIs(t, err, storage.ErrNotFound)
+		}
+	}
+
+	return n
+}
+
+func TestSharding(t *testing.T) {
+	shards := startShards(t, []string{"a", "b", "c"}, 2)
+	a, b, c := shards[0], shards[1], shards[2]
+
+	for i := 0; i < keys; i++ {
+		code, body := do(t, http.MethodPut, fmt.Sprintf("%s/kv/key-%d", a.server.URL, i), fmt.Sprint(i))
+		assert.Equal(t, http.StatusOK, code, body)
+	}
+
+	// every key is stored once and readable from every member
+	assert.Equal(t, keys, a.local(t)+b.local(t))
+	assert.NotZero(t, b.local(t))
+	code, body := do(t, http.MethodGet, b.server.URL+"/kv/key-7?raw=1", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "7", body)
+
+	// a batch is served by a single member
+	sharder, _, _ := a.app.Sharder()
+	first, _ := sharder.Owner("key-0")
+	var other string
+	for i := 1; ; i++ {
+		owner, _ := sharder.Owner(fmt.Sprintf("key-%d", i))
+		if owner.Name != first.Name {
+			other = fmt.Sprintf("key-%d", i)
+			break
+		}
+	}
+	code, _ = do(t, http.MethodPost, b.server.URL+"/kv/_batch", `{"ops":[{"op":"put","key":"key-0","value":"x"},{"op":"delete","key":"`+other+`"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// c joins, a and b move the keys c owns
+	topology := sharding.Topology{Version: 1, Members: append(sharder.Topology().Members, sharding.Member{Name: "c", URL: c.server.URL})}
+	data, err := json.Marshal(topology)
+	assert.NoError(t, err)
+	code, body = do(t, http.MethodPost, a.server.URL+"/admin/shards/topology", string(data))
+	assert.Equal(t, http.StatusOK, code, body)
+
+	assert.Eventually(t, func() bool {
+		for _, s := range shards {
+			sharder, _, _ := s.app.Sharder()
+			status := sharder.Status()
+			if status.Topology.Version != 1 || status.Rebalancing || len(status.Pending) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, keys, a.local(t)+b.local(t)+c.local(t))
+	assert.NotZero(t, c.local(t))
+
+	sharder, _, _ = c.app.Sharder()
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner, err := sharder.Owner(key)
+		assert.NoError(t, err)
+
+		for _, s := range shards {
+			_, err := s.app.DB.Get(context.Background(), key)
+			assert.Equal(t, owner.Name == s.name, err == nil, key)
+		}
+
+		code, body := do(t, http.MethodGet, fmt.Sprintf("%s/kv/%s?raw=1", shards[i%3].server.URL, key), "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, fmt.Sprint(i), body)
+	}
+
+	code, _ = do(t, http.MethodPost, a.server.URL+"/admin/shards/topology", string(data))
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestDeleteDuringRebalance(t *testing.T) {
+	shards := startShards(t, []string{"a", "b", "c"}, 2)
+	a, c := shards[0], shards[2]
+
+	for i := 0; i < keys; i++ {
+		code, body := do(t, http.MethodPut, fmt.Sprintf("%s/kv/key-%d", a.server.URL, i), fmt.Sprint(i))
+		assert.Equal(t, http.StatusOK, code, body)
+	}
+
+	// only c learns about the new topology, a and b never move their keys to it
+	previous := func() sharding.Topology {
+		sharder, _, _ := a.app.Sharder()
+		return sharder.Topology()
+	}()
+	topology := sharding.Topology{Version: 1, Members: append(previous.Members, sharding.Member{Name: "c", URL: c.server.URL})}
+
+	sharder, _, _ := c.app.Sharder()
+	_, err := sharder.Update(sharding.Update{Topology: topology, Previous: &previous})
+	assert.NoError(t, err)
+
+	var moved []string
+	for i := 0; i < keys && len(moved) < 2; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner, _ := sharder.Owner(key); owner.Name == "c" {
+			moved = append(moved, key)
+		}
+	}
+	assert.Len(t, moved, 2)
+
+	// the value is still on the former owner
+	code, _ := do(t, http.MethodGet, c.server.URL+"/kv/"+moved[0], "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, http.MethodDelete, c.server.URL+"/kv/"+moved[0], "")
+	assert.Equal(t, http.StatusOK, code, body)
+	code, _ = do(t, http.MethodGet, c.server.URL+"/kv/"+moved[0], "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// untouched keys are still looked up on the former owner
+	code, _ = do(t, http.MethodGet, c.server.URL+"/kv/"+moved[1], "")
+	assert.Equal(t, http.StatusOK, code)
+}
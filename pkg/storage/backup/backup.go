@@ -0,0 +1,524 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+const (
+	// MetaFileName is written last into a backup directory, a backup without it is incomplete.
+	MetaFileName = "backup.json"
+
+	metaVersion = 1
+	fileMode    = 0754
+)
+
+var (
+	ErrBackupFormat = errors.New("invalid backup")
+	ErrChecksum     = errors.New("checksum mismatch")
+	ErrNotEmpty     = errors.New("restore target is not empty")
+)
+
+// File is a file of the backed up data directory.
+type File struct {
+	// Path is relative to the data directory, with forward slashes.
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+	// InBase is set if the file was not copied since it is unchanged in the base backup.
+	InBase bool `json:"in_base,omitempty"`
+}
+
+// Meta describes a backup.
+type Meta struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Base is the directory of the backup an incremental backup is based on, relative to
+	// the backup directory so both can be moved together. In a tar stream it is only the
+	// name of the base backup directory, see RestoreTar.
+	Base  string `json:"base,omitempty"`
+	Files []File `json:"files"`
+}
+
+// ReadMeta reads the meta of the backup in dir.
+func ReadMeta(dir string) (*Meta, error) {
+	data, err := os.ReadFile(path.Join(dir, MetaFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: no %s: %w", dir, MetaFileName, ErrBackupFormat)
+		}
+
+		return nil, err
+	}
+
+	meta := &Meta{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", dir, err.Error(), ErrBackupFormat)
+	}
+
+	if meta.Version != metaVersion {
+		return nil, fmt.Errorf("%s: version %d: %w", dir, meta.Version, ErrBackupFormat)
+	}
+
+	err = meta.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+
+	return meta, nil
+}
+
+// validate rejects the file paths leading out of the data directory.
+func (meta *Meta) validate() error {
+	for _, f := range meta.Files {
+		if !isLocal(f.Path) || f.Path == MetaFileName {
+			return fmt.Errorf("file %s: %w", f.Path, ErrBackupFormat)
+		}
+	}
+
+	return nil
+}
+
+// isLocal reports whether name is a relative path staying below its directory.
+func isLocal(name string) bool {
+	rel := filepath.Clean(filepath.FromSlash(name))
+
+	return rel != "." && !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// scan builds the meta of the snapshot in staging. Files unchanged in the backup in
+// base are marked InBase, base can be empty for a full backup. Base is set to the
+// absolute path of base.
+func scan(staging, base string) (*Meta, error) {
+	meta := &Meta{Version: metaVersion, Created: time.Now()}
+
+	baseFiles := make(map[File]bool)
+	if base != "" {
+		abs, err := filepath.Abs(base)
+		if err != nil {
+			return nil, err
+		}
+
+		baseMeta, err := ReadMeta(abs)
+		if err != nil {
+			return nil, fmt.Errorf("read base backup error: %w", err)
+		}
+
+		for _, f := range baseMeta.Files {
+			f.InBase = false
+			baseFiles[f] = true
+		}
+
+		meta.Base = abs
+	}
+
+	err := filepath.Walk(staging, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, name)
+		if err != nil {
+			return err
+		}
+
+		sum, err := checksum(name)
+		if err != nil {
+			return err
+		}
+
+		f := File{Path: filepath.ToSlash(rel), Size: info.Size(), CRC32: sum}
+		f.InBase = baseFiles[f]
+		meta.Files = append(meta.Files, f)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(meta.Files, func(i, j int) bool {
+		return meta.Files[i].Path < meta.Files[j].Path
+	})
+
+	return meta, nil
+}
+
+// WriteDir installs the snapshot in staging as a backup in the empty or missing
+// directory target, incremental to the backup in base unless base is empty.
+// Files are hard linked from staging where possible.
+func WriteDir(staging, target, base string) (*Meta, error) {
+	meta, err := scan(staging, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Base != "" {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+
+		meta.Base, err = filepath.Rel(abs, meta.Base)
+		if err != nil {
+			return nil, err
+		}
+		meta.Base = filepath.ToSlash(meta.Base)
+	}
+
+	err = checkEmpty(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// every file can be in the base backup
+	err = os.MkdirAll(target, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range meta.Files {
+		if f.InBase {
+			continue
+		}
+
+		name := filepath.Join(target, filepath.FromSlash(f.Path))
+		err = os.MkdirAll(filepath.Dir(name), fileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		err = utils.LinkOrCopy(filepath.Join(staging, filepath.FromSlash(f.Path)), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path.Join(target, MetaFileName), data, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// WriteTar writes the snapshot in staging as a tar stream into w, starting with the meta.
+// The files marked InBase are left out, see WriteDir.
+func WriteTar(staging string, w io.Writer, base string) (*Meta, error) {
+	meta, err := scan(staging, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Base != "" {
+		meta.Base = filepath.Base(meta.Base)
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    MetaFileName,
+		Mode:    fileMode,
+		Size:    int64(len(data)),
+		ModTime: meta.Created,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range meta.Files {
+		if f.InBase {
+			continue
+		}
+
+		err = writeTarFile(tw, filepath.Join(staging, filepath.FromSlash(f.Path)), f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, f File) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    f.Path,
+		Mode:    fileMode,
+		Size:    f.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, in, f.Size)
+
+	return err
+}
+
+// Verify checks every file of the backup in dir and of its base backups against the meta.
+func Verify(dir string) (*Meta, error) {
+	meta, err := ReadMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range meta.Files {
+		name, err := locate(dir, meta, f)
+		if err != nil {
+			return nil, err
+		}
+
+		err = verifyFile(name, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
+}
+
+// Restore verifies the backup in src and installs it into the empty or missing data directory dst.
+func Restore(src, dst string) (*Meta, error) {
+	err := checkEmpty(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := Verify(src)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range meta.Files {
+		name, err := locate(src, meta, f)
+		if err != nil {
+			return nil, err
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(f.Path))
+		err = os.MkdirAll(filepath.Dir(target), fileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		// the backup must stay intact, never link it into a live data directory
+		err = utils.CopyFileN(name, target, f.Size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
+}
+
+// RestoreTar extracts the tar stream written by WriteTar and installs it into dst, see Restore.
+// The base backup of an incremental stream must be available as the directory base,
+// base is ignored for a full backup.
+func RestoreTar(r io.Reader, dst, base string) (*Meta, error) {
+	err := checkEmpty(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dst)), ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err.Error(), ErrBackupFormat)
+		}
+
+		if !isLocal(hdr.Name) || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %s: %w", hdr.Name, ErrBackupFormat)
+		}
+
+		name := filepath.Join(tmp, filepath.Clean(filepath.FromSlash(hdr.Name)))
+		err = os.MkdirAll(filepath.Dir(name), fileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = rebase(tmp, base)
+	if err != nil {
+		return nil, err
+	}
+
+	return Restore(tmp, dst)
+}
+
+// rebase points the incremental backup extracted into dir to its base backup in base.
+func rebase(dir, base string) error {
+	meta, err := ReadMeta(dir)
+	if err != nil || meta.Base == "" {
+		return err
+	}
+
+	if base == "" {
+		return fmt.Errorf("incremental backup of %s without its base backup: %w", meta.Base, ErrBackupFormat)
+	}
+
+	meta.Base, err = filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(dir, MetaFileName), data, fileMode)
+}
+
+// locate returns the backup file holding f, following the chain of base backups.
+func locate(dir string, meta *Meta, f File) (string, error) {
+	visited := map[string]bool{filepath.Clean(dir): true}
+	for f.InBase {
+		if meta.Base == "" {
+			return "", fmt.Errorf("%s: in base without base backup: %w", f.Path, ErrBackupFormat)
+		}
+
+		// absolute in the backups written before it was made relative, never inside the backup
+		baseDir := filepath.FromSlash(meta.Base)
+		if filepath.Clean(baseDir) != baseDir || !filepath.IsAbs(baseDir) && isLocal(baseDir) {
+			return "", fmt.Errorf("%s: base backup %s: %w", f.Path, meta.Base, ErrBackupFormat)
+		}
+		if !filepath.IsAbs(baseDir) {
+			baseDir = filepath.Join(dir, baseDir)
+		}
+
+		if visited[baseDir] {
+			return "", fmt.Errorf("%s: base backup %s in a cycle: %w", f.Path, baseDir, ErrBackupFormat)
+		}
+		visited[baseDir] = true
+
+		base, err := ReadMeta(baseDir)
+		if err != nil {
+			return "", fmt.Errorf("read base backup error: %w", err)
+		}
+
+		found := false
+		for _, bf := range base.Files {
+			if bf.Path == f.Path && bf.Size == f.Size && bf.CRC32 == f.CRC32 {
+				dir, meta, f, found = baseDir, base, bf, true
+				break
+			}
+		}
+
+		if !found {
+			return "", fmt.Errorf("%s: missing in base backup %s: %w", f.Path, baseDir, ErrBackupFormat)
+		}
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(f.Path)), nil
+}
+
+func verifyFile(name string, f File) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != f.Size {
+		return fmt.Errorf("%s: size %d, expected %d: %w", f.Path, info.Size(), f.Size, ErrChecksum)
+	}
+
+	sum, err := checksum(name)
+	if err != nil {
+		return err
+	}
+
+	if sum != f.CRC32 {
+		return fmt.Errorf("%s: %w", f.Path, ErrChecksum)
+	}
+
+	return nil
+}
+
+func checksum(name string) (uint32, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, in)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
+
+func checkEmpty(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("%s: %w", dir, ErrNotEmpty)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package backup_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/storage/backup"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0754))
+		assert.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0754))
+	}
+}
+
+func assertFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		data, err := os.ReadFile(path.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+}
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	first := map[string]string{
+		"data/segments/1_seg.sgk": "segment 1",
+		"data/segments/MANIFEST":  "1",
+	}
+	writeFiles(t, path.Join(rootPath, "staging1"), first)
+
+	meta, err := backup.WriteDir(path.Join(rootPath, "staging1"), path.Join(rootPath, "full"), "")
+	assert.NoError(t, err)
+	assert.Len(t, meta.Files, 2)
+
+	second := map[string]string{
+		"data/segments/1_seg.sgk":    "segment 1",
+		"data/segments/2_seg.sgk":    "segment 2",
+		"data/segments/MANIFEST":     "1 2",
+		"namespaces/ns/data/data.ky": "fs",
+	}
+	writeFiles(t, path.Join(rootPath, "staging2"), second)
+
+	meta, err = backup.WriteDir(path.Join(rootPath, "staging2"), path.Join(rootPath, "incr"), path.Join(rootPath, "full"))
+	assert.NoError(t, err)
+	assert.Len(t, meta.Files, 4)
+
+	// only the unchanged segment is left to the base backup
+	assert.NoFileExists(t, path.Join(rootPath, "incr", "data", "segments", "1_seg.sgk"))
+	assert.FileExists(t, path.Join(rootPath, "incr", "data", "segments", "2_seg.sgk"))
+	assert.Equal(t, "../full", meta.Base)
+
+	// the backups are moved together
+	moved := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, os.Rename(rootPath, moved))
+	rootPath = moved
+
+	_, err = backup.Restore(path.Join(rootPath, "incr"), path.Join(rootPath, "restored"))
+	assert.NoError(t, err)
+	assertFiles(t, path.Join(rootPath, "restored"), second)
+
+	_, err = backup.Restore(path.Join(rootPath, "incr"), path.Join(rootPath, "restored"))
+	assert.ErrorIs(t, err, backup.ErrNotEmpty)
+
+	// a corrupted file in the base backup fails the restore
+	writeFiles(t, path.Join(rootPath, "full"), map[string]string{"data/segments/1_seg.sgk": "segment X"})
+
+	_, err = backup.Verify(path.Join(rootPath, "incr"))
+	assert.ErrorIs(t, err, backup.ErrChecksum)
+
+	_, err = backup.Restore(path.Join(rootPath, "incr"), path.Join(rootPath, "restored2"))
+	assert.ErrorIs(t, err, backup.ErrChecksum)
+	assert.NoDirExists(t, path.Join(rootPath, "restored2"))
+}
+
+func TestTarBackupAndRestore(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	files := map[string]string{
+		"data/data.ky":                  "line 1\nline 2\n",
+		"namespaces/ns/namespace.json":  "{}",
+		"namespaces/ns/data/segments/1": "segment",
+	}
+	writeFiles(t, path.Join(rootPath, "staging"), files)
+
+	buffer := &bytes.Buffer{}
+	meta, err := backup.WriteTar(path.Join(rootPath, "staging"), buffer, "")
+	assert.NoError(t, err)
+	assert.Len(t, meta.Files, 3)
+
+	_, err = backup.RestoreTar(bytes.NewReader(buffer.Bytes()), path.Join(rootPath, "restored"), "")
+	assert.NoError(t, err)
+	assertFiles(t, path.Join(rootPath, "restored"), files)
+
+	_, err = backup.RestoreTar(bytes.NewReader([]byte("not a tar")), path.Join(rootPath, "restored2"), "")
+	assert.ErrorIs(t, err, backup.ErrBackupFormat)
+}
+
+func TestIncrementalTarRestore(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	first := map[string]string{"data/segments/1_seg.sgk": "segment 1"}
+	writeFiles(t, path.Join(rootPath, "staging1"), first)
+
+	_, err := backup.WriteDir(path.Join(rootPath, "staging1"), path.Join(rootPath, "full"), "")
+	assert.NoError(t, err)
+
+	second := map[string]string{"data/segments/1_seg.sgk": "segment 1", "data/segments/2_seg.sgk": "segment 2"}
+	writeFiles(t, path.Join(rootPath, "staging2"), second)
+
+	buffer := &bytes.Buffer{}
+	meta, err := backup.WriteTar(path.Join(rootPath, "staging2"), buffer, path.Join(rootPath, "full"))
+	assert.NoError(t, err)
+	assert.Equal(t, "full", meta.Base)
+
+	_, err = backup.RestoreTar(bytes.NewReader(buffer.Bytes()), path.Join(rootPath, "restored"), "")
+	assert.ErrorIs(t, err, backup.ErrBackupFormat)
+
+	_, err = backup.RestoreTar(bytes.NewReader(buffer.Bytes()), path.Join(rootPath, "restored"), path.Join(rootPath, "full"))
+	assert.NoError(t, err)
+	assertFiles(t, path.Join(rootPath, "restored"), second)
+}
+
+func TestRestoreCraftedMeta(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	writeFiles(t, path.Join(rootPath, "staging"), map[string]string{"data/data.ky": "data"})
+	_, err := backup.WriteDir(path.Join(rootPath, "staging"), path.Join(rootPath, "full"), "")
+	assert.NoError(t, err)
+
+	// a file of the meta leading out of the data directory
+	writeFiles(t, rootPath, map[string]string{
+		"evil":                "evil",
+		"crafted/backup.json": `{"version":1,"files":[{"path":"../evil","size":4,"crc32":` + fmt.Sprint(crc32.ChecksumIEEE([]byte("evil"))) + `}]}`,
+	})
+
+	_, err = backup.Restore(path.Join(rootPath, "crafted"), path.Join(rootPath, "restored", "data"))
+	assert.ErrorIs(t, err, backup.ErrBackupFormat)
+	assert.NoFileExists(t, path.Join(rootPath, "restored", "evil"))
+
+	// a base inside the backup or the backup itself
+	for _, base := range []string{"sub", ".", "../incr/.", "../incr"} {
+		writeFiles(t, path.Join(rootPath, "incr"), map[string]string{
+			"backup.json": `{"version":1,"base":"` + base + `","files":[{"path":"data/data.ky","size":4,"crc32":1,"in_base":true}]}`,
+		})
+
+		_, err = backup.Restore(path.Join(rootPath, "incr"), path.Join(rootPath, "restored2"))
+		assert.ErrorIs(t, err, backup.ErrBackupFormat, base)
+	}
+
+	// the same in a tar stream
+	buffer := &bytes.Buffer{}
+	tw := tar.NewWriter(buffer)
+	meta := []byte(`{"version":1,"files":[{"path":"/tmp/evil","size":0,"crc32":0}]}`)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: backup.MetaFileName, Mode: 0644, Size: int64(len(meta))}))
+	_, err = tw.Write(meta)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+
+	_, err = backup.RestoreTar(buffer, path.Join(rootPath, "restored3"), "")
+	assert.ErrorIs(t, err, backup.ErrBackupFormat)
+}
@@ -0,0 +1,161 @@
+package codec
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+)
+
+const (
+	binaryRecordMark = 0x00
+	binaryFieldDelim = 0x00
+	escapeChar       = '\\'
+
+	metaContentType = "ct"
+	metaFlags       = "f"
+	metaVersion     = "vv"
+)
+
+// BinaryCodec encodes a record as
+//
+//	0x00 <key> 0x00 <metadata> 0x00 <value>
+//
+// Key and value are escaped so the record never contains a line break or a
+// field delimiter, metadata is url encoded. Records without the leading mark
+// are decoded as legacy csv records, so it can read data written by StringCodec.
+type BinaryCodec struct {
+	legacy *StringCodec
+}
+
+func NewBinaryCodec() *BinaryCodec {
+	return &BinaryCodec{
+		legacy: NewStringCodec(),
+	}
+}
+
+func (b *BinaryCodec) Type() CodecType {
+	return TypeBinary
+}
+
+func (b *BinaryCodec) Encode(value domain.KV) ([]byte, error) {
+	meta := url.Values{}
+	if value.ContentType != "" {
+		meta.Set(metaContentType, value.ContentType)
+	}
+
+	if value.Flags != 0 {
+		meta.Set(metaFlags, strconv.FormatUint(uint64(value.Flags), 10))
+	}
+
+	if len(value.Version) > 0 {
+		meta.Set(metaVersion, value.Version.String())
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(value.Key)+len(value.Value)+8))
+	buffer.WriteByte(binaryRecordMark)
+	escape(buffer, []byte(value.Key))
+	buffer.WriteByte(binaryFieldDelim)
+	buffer.WriteString(meta.Encode())
+	buffer.WriteByte(binaryFieldDelim)
+	escape(buffer, value.Value)
+
+	return buffer.Bytes(), nil
+}
+
+func (b *BinaryCodec) Decode(data []byte) (domain.KV, error) {
+	if len(data) == 0 || data[0] != binaryRecordMark {
+		return b.legacy.Decode(data)
+	}
+
+	var res domain.KV
+
+	fields := bytes.SplitN(data[1:], []byte{binaryFieldDelim}, 3)
+	if len(fields) != 3 {
+		return res, ErrDataFormat
+	}
+
+	key, err := unescape(fields[0])
+	if err != nil {
+		return res, err
+	}
+
+	meta, err := url.ParseQuery(string(fields[1]))
+	if err != nil {
+		return res, ErrDataFormat
+	}
+
+	value, err := unescape(fields[2])
+	if err != nil {
+		return res, err
+	}
+
+	if f := meta.Get(metaFlags); f != "" {
+		flags, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return res, ErrDataFormat
+		}
+		res.Flags = uint32(flags)
+	}
+
+	res.Version, err = domain.ParseVersion(meta.Get(metaVersion))
+	if err != nil {
+		return res, ErrDataFormat
+	}
+
+	res.Key = string(key)
+	res.ContentType = meta.Get(metaContentType)
+	if len(value) > 0 {
+		res.Value = append([]byte(nil), value...)
+	}
+
+	return res, nil
+}
+
+func escape(buffer *bytes.Buffer, data []byte) {
+	for _, c := range data {
+		switch c {
+		case escapeChar:
+			buffer.WriteString(`\\`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case binaryFieldDelim:
+			buffer.WriteString(`\0`)
+		default:
+			buffer.WriteByte(c)
+		}
+	}
+}
+
+func unescape(data []byte) ([]byte, error) {
+	if bytes.IndexByte(data, escapeChar) == -1 {
+		return data, nil
+	}
+
+	res := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != escapeChar {
+			res = append(res, data[i])
+			continue
+		}
+
+		i++
+		if i == len(data) {
+			return nil, ErrDataFormat
+		}
+
+		switch data[i] {
+		case escapeChar:
+			res = append(res, escapeChar)
+		case 'n':
+			res = append(res, '\n')
+		case '0':
+			res = append(res, binaryFieldDelim)
+		default:
+			return nil, ErrDataFormat
+		}
+	}
+
+	return res, nil
+}
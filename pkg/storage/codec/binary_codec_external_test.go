@@ -0,0 +1,96 @@
+package codec_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryCodec(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   domain.KV
+	}{
+		{
+			name: "plain",
+			kv:   domain.KV{Key: "aaa", Value: []byte("1")},
+		},
+		{
+			name: "content type",
+			kv:   domain.KV{Key: "img", Value: []byte("png"), ContentType: "image/png"},
+		},
+		{
+			name: "escaped",
+			kv:   domain.KV{Key: "a,b\\c", Value: []byte("line1\nline2\x00\\n"), ContentType: "text/plain; charset=utf-8"},
+		},
+		{
+			name: "binary with flags",
+			kv:   domain.KV{Key: "blob", Value: []byte{0xff, 0x00, '\n', 0x5c, 0x01}, ContentType: "application/x-protobuf", Flags: 42},
+		},
+		{
+			name: "empty value",
+			kv:   domain.KV{Key: "empty"},
+		},
+		{
+			name: "tombstone",
+			kv:   domain.Tombstone("deleted"),
+		},
+		{
+			name: "version vector",
+			kv:   domain.KV{Key: "v", Value: []byte("1"), Version: domain.VersionVector{"node-a": 3, "b:c": 1}},
+		},
+	}
+
+	cd := codec.NewBinaryCodec()
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := cd.Encode(c.kv)
+			assert.NoError(t, err)
+			assert.Equal(t, -1, bytes.IndexByte(data, '\n'))
+
+			res, err := cd.Decode(data)
+			assert.NoError(t, err)
+			assert.Equal(t, c.kv, res)
+		})
+	}
+}
+
+func TestBinaryCodecDecodeLegacy(t *testing.T) {
+	cd := codec.NewBinaryCodec()
+
+	res, err := cd.Decode([]byte(`ccc,{"a":1,"b":2}`))
+	assert.NoError(t, err)
+	assert.Equal(t, domain.KV{Key: "ccc", Value: []byte(`{"a":1,"b":2}`)}, res)
+
+	_, err = cd.Decode([]byte{0x00, 'a', 0x00})
+	assert.ErrorIs(t, err, codec.ErrDataFormat)
+
+	_, err = cd.Decode([]byte{0x00, 'a', 0x00, 0x00, 'b', '\\'})
+	assert.ErrorIs(t, err, codec.ErrDataFormat)
+}
+
+func TestStringCodecUnsupported(t *testing.T) {
+	cd := codec.NewStringCodec()
+
+	_, err := cd.Encode(domain.KV{Key: "a", Value: []byte("1\n2")})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+
+	_, err = cd.Encode(domain.KV{Key: "a,b", Value: []byte("1")})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+
+	_, err = cd.Encode(domain.KV{Key: "a\nb", Value: []byte("1")})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+
+	_, err = cd.Encode(domain.KV{Key: "a", Value: []byte("1"), Flags: 1})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+
+	_, err = cd.Encode(domain.Tombstone("a"))
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+
+	_, err = cd.Encode(domain.KV{Key: "a", Value: []byte("1"), Version: domain.VersionVector{"a": 1}})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+}
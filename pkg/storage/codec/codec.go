@@ -17,18 +17,22 @@ type Decoder interface {
 type Codec interface {
 	Encoder
 	Decoder
+	Type() CodecType
 }
 
 type CodecType string
 
 const (
-	TypeCSV CodecType = "csv"
+	TypeCSV    CodecType = "csv"
+	TypeBinary CodecType = "binary"
 )
 
 func NewCodec(kind string) (Codec, error) {
 	switch CodecType(kind) {
 	case TypeCSV:
 		return NewStringCodec(), nil
+	case TypeBinary:
+		return NewBinaryCodec(), nil
 	default:
 		return nil, fmt.Errorf("no codec type: %s", kind)
 	}
@@ -14,9 +14,13 @@ const (
 )
 
 var (
-	ErrDataFormat = errors.New("data format error")
+	ErrDataFormat  = errors.New("data format error")
+	ErrUnsupported = errors.New("not supported by codec")
 )
 
+// StringCodec stores a record as "key,value". It can neither hold keys containing
+// a comma or a line break, values containing a line break nor any metadata, use
+// BinaryCodec for those.
 type StringCodec struct {
 	format string
 }
@@ -27,7 +31,23 @@ func NewStringCodec() *StringCodec {
 	}
 }
 
+func (s *StringCodec) Type() CodecType {
+	return TypeCSV
+}
+
 func (s *StringCodec) Encode(value domain.KV) ([]byte, error) {
+	if value.ContentType != "" || value.Flags != 0 || len(value.Version) > 0 {
+		return nil, fmt.Errorf("csv metadata: %w", ErrUnsupported)
+	}
+
+	if strings.ContainsAny(value.Key, ",\n") {
+		return nil, fmt.Errorf("csv key with comma or line break: %w", ErrUnsupported)
+	}
+
+	if bytes.IndexByte(value.Value, '\n') != -1 {
+		return nil, fmt.Errorf("csv value with line break: %w", ErrUnsupported)
+	}
+
 	buffer := bytes.NewBufferString(fmt.Sprintf(s.format, value.Key, value.Value))
 	return buffer.Bytes(), nil
 }
@@ -43,7 +63,9 @@ func (s *StringCodec) Decode(bytes []byte) (domain.KV, error) {
 	}
 
 	res.Key = str[0:idx]
-	res.Value = str[idx+1:]
+	if idx+1 < len(str) {
+		res.Value = []byte(str[idx+1:])
+	}
 
 	return res, nil
 
@@ -0,0 +1,36 @@
+package common
+
+import "fmt"
+
+// CheckReport is the result of an offline consistency check of a data directory.
+type CheckReport struct {
+	// Files is the number of checked data files
+	Files int
+	// Records is the number of readable records, LiveKeys the number of distinct keys among them
+	Records  int
+	LiveKeys int
+
+	Problems []string
+	Repairs  []string
+}
+
+// GarbageRatio is the part of the records which are shadowed by newer versions.
+func (r *CheckReport) GarbageRatio() float64 {
+	if r.Records == 0 {
+		return 0
+	}
+
+	return float64(r.Records-r.LiveKeys) / float64(r.Records)
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) Problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *CheckReport) Repairf(format string, args ...interface{}) {
+	r.Repairs = append(r.Repairs, fmt.Sprintf(format, args...))
+}
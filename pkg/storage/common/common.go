@@ -11,8 +11,15 @@ import (
 var (
 	ErrEnd       = errors.New("offset beyond file size")
 	ErrEmptyLine = errors.New("empty line")
+
+	// ErrNotFound is returned by every storage system when a key does not exist.
+	ErrNotFound = errors.New("not found")
 )
 
+// CancelCheckInterval is the number of records a scan reads between two checks of its context,
+// a done context ends it with the context error.
+const CancelCheckInterval = 256
+
 func ReadLineFromTail(file *os.File, offset int64, delim byte) (line []byte, newOffset int64, err error) {
 	fs, err := file.Stat()
 	if err != nil {
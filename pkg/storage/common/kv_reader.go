@@ -0,0 +1,32 @@
+package common
+
+import (
+	"io"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+)
+
+// KVReader yields the kvs of a bulk import one by one, Read returns io.EOF after the last one.
+type KVReader interface {
+	Read() (domain.KV, error)
+}
+
+// SliceReader is a KVReader over kvs in memory.
+type SliceReader struct {
+	kvs []domain.KV
+}
+
+func NewSliceReader(kvs []domain.KV) *SliceReader {
+	return &SliceReader{kvs: kvs}
+}
+
+func (r *SliceReader) Read() (domain.KV, error) {
+	if len(r.kvs) == 0 {
+		return domain.KV{}, io.EOF
+	}
+
+	kv := r.kvs[0]
+	r.kvs = r.kvs[1:]
+
+	return kv, nil
+}
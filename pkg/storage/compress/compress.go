@@ -0,0 +1,121 @@
+package compress
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Kind string
+
+const (
+	KindNone   Kind = "none"
+	KindSnappy Kind = "snappy"
+	KindZstd   Kind = "zstd"
+)
+
+type Compressor interface {
+	Kind() Kind
+	// Compress appends the compressed src to dst.
+	Compress(dst, src []byte) []byte
+	// Decompress appends the decompressed src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	zstdOnce sync.Once
+	zstdInst *zstdCompressor
+	zstdErr  error
+)
+
+// NewCompressor returns the compressor of kind, compressors are safe for concurrent use
+// and shared by all callers.
+func NewCompressor(kind string) (Compressor, error) {
+	switch Kind(kind) {
+	case KindNone, "":
+		return noneCompressor{}, nil
+	case KindSnappy:
+		return snappyCompressor{}, nil
+	case KindZstd:
+		zstdOnce.Do(func() {
+			zstdInst, zstdErr = newZstdCompressor()
+		})
+		return zstdInst, zstdErr
+	default:
+		return nil, fmt.Errorf("no compression kind: %s", kind)
+	}
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Kind() Kind {
+	return KindNone
+}
+
+func (noneCompressor) Compress(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noneCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Kind() Kind {
+	return KindSnappy
+}
+
+func (snappyCompressor) Compress(dst, src []byte) []byte {
+	return append(dst, snappy.Encode(nil, src)...)
+}
+
+func (snappyCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	data, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decode error: %w", err)
+	}
+
+	return append(dst, data...), nil
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() (*zstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdCompressor{
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func (z *zstdCompressor) Kind() Kind {
+	return KindZstd
+}
+
+func (z *zstdCompressor) Compress(dst, src []byte) []byte {
+	return z.encoder.EncodeAll(src, dst)
+}
+
+func (z *zstdCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	data, err := z.decoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("zstd decode error: %w", err)
+	}
+
+	return data, nil
+}
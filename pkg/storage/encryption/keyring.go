@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	keySize = 32
+)
+
+var (
+	ErrNoKeys     = errors.New("no encryption keys")
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrKeyFormat  = errors.New("encryption key format error")
+)
+
+// Keyring holds the AES-256-GCM keys by their id. New data is always sealed
+// by the key with the largest id, older keys are kept to open existing data.
+type Keyring struct {
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+func NewKeyring(keys map[uint32][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	kr := &Keyring{
+		keys: make(map[uint32]cipher.AEAD, len(keys)),
+	}
+
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+
+		kr.keys[id] = aead
+		if id > kr.current {
+			kr.current = id
+		}
+	}
+
+	return kr, nil
+}
+
+// LoadKeyring reads the keys from keyFile, one "<id>:<base64 key>" per line.
+// If the environment variable kekEnv holds a base64 key encryption key, the keys
+// in keyFile are expected to be sealed by it. Without keyFile the keys are read
+// from kekEnv directly, separated by commas.
+func LoadKeyring(keyFile, kekEnv string) (*Keyring, error) {
+	var kek cipher.AEAD
+	var env string
+
+	if kekEnv != "" {
+		env = os.Getenv(kekEnv)
+	}
+
+	if keyFile == "" {
+		if env == "" {
+			return nil, ErrNoKeys
+		}
+
+		keys, err := parseKeys(strings.NewReader(strings.ReplaceAll(env, ",", "\n")), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewKeyring(keys)
+	}
+
+	if env != "" {
+		key, err := base64.StdEncoding.DecodeString(env)
+		if err != nil {
+			return nil, fmt.Errorf("decode kek: %w", ErrKeyFormat)
+		}
+
+		kek, err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("open key file error: %w", err)
+	}
+	defer file.Close()
+
+	keys, err := parseKeys(file, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeyring(keys)
+}
+
+func parseKeys(r io.Reader, kek cipher.AEAD) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idStr, keyStr, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, ErrKeyFormat
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("key id %s: %w", idStr, ErrKeyFormat)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(keyStr)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, ErrKeyFormat)
+		}
+
+		if kek != nil {
+			key, err = open(kek, key)
+			if err != nil {
+				return nil, fmt.Errorf("unwrap key %d: %w", id, err)
+			}
+		}
+
+		keys[uint32(id)] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes: %w", keySize, ErrKeyFormat)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (kr *Keyring) CurrentKeyID() uint32 {
+	return kr.current
+}
+
+func (kr *Keyring) HasKey(keyID uint32) bool {
+	_, ok := kr.keys[keyID]
+	return ok
+}
+
+// Seal encrypts data by the current key and returns the key id with nonce and ciphertext.
+func (kr *Keyring) Seal(data []byte) (uint32, []byte, error) {
+	aead := kr.keys[kr.current]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return kr.current, aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data sealed by the key with keyID.
+func (kr *Keyring) Open(keyID uint32, data []byte) ([]byte, error) {
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %d: %w", keyID, ErrUnknownKey)
+	}
+
+	return open(aead, data)
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrKeyFormat
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// SealLine is like Seal but returns base64 text which is safe to store in a line.
+func (kr *Keyring) SealLine(data []byte) (uint32, []byte, error) {
+	keyID, sealed, err := kr.Seal(data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+
+	return keyID, line, nil
+}
+
+func (kr *Keyring) OpenLine(keyID uint32, line []byte) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, bytes.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("decode sealed line: %w", ErrKeyFormat)
+	}
+
+	return kr.Open(keyID, sealed[:n])
+}
+
+// Wrap seals key by kek, the result can be written to a key file used with that kek.
+func Wrap(kek, key []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
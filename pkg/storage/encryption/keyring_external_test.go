@@ -0,0 +1,74 @@
+package encryption_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	old, err := encryption.NewKeyring(map[uint32][]byte{1: key1})
+	assert.NoError(t, err)
+
+	keyID, sealed, err := old.Seal([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), keyID)
+
+	kr, err := encryption.NewKeyring(map[uint32][]byte{1: key1, 2: key2})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), kr.CurrentKeyID())
+
+	data, err := kr.Open(keyID, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	_, err = old.Open(2, sealed)
+	assert.ErrorIs(t, err, encryption.ErrUnknownKey)
+
+	keyID, line, err := kr.SealLine([]byte("a\nb"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(line), "\n")
+
+	data, err = kr.OpenLine(keyID, line)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a\nb"), data)
+
+	_, err = encryption.NewKeyring(map[uint32][]byte{1: []byte("short")})
+	assert.ErrorIs(t, err, encryption.ErrKeyFormat)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	kek := bytes.Repeat([]byte{9}, 32)
+
+	wrapped, err := encryption.Wrap(kek, key)
+	assert.NoError(t, err)
+
+	keyFile := path.Join(t.TempDir(), "keys")
+	content := fmt.Sprintf("# rotated keys\n3:%s\n", base64.StdEncoding.EncodeToString(wrapped))
+	assert.NoError(t, os.WriteFile(keyFile, []byte(content), 0600))
+
+	t.Setenv("KAEYA_TEST_KEK", base64.StdEncoding.EncodeToString(kek))
+
+	kr, err := encryption.LoadKeyring(keyFile, "KAEYA_TEST_KEK")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), kr.CurrentKeyID())
+
+	t.Setenv("KAEYA_TEST_KEYS", "1:"+base64.StdEncoding.EncodeToString(key))
+
+	kr, err = encryption.LoadKeyring("", "KAEYA_TEST_KEYS")
+	assert.NoError(t, err)
+	assert.True(t, kr.HasKey(1))
+
+	_, err = encryption.LoadKeyring("", "KAEYA_TEST_MISSING")
+	assert.ErrorIs(t, err, encryption.ErrNoKeys)
+}
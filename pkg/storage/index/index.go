@@ -9,6 +9,8 @@ import (
 type Indexer interface {
 	Index(ctx context.Context, key string, offset int64) error
 	Search(ctx context.Context, key string) (int64, error)
+	// Len returns the number of indexed keys.
+	Len() int
 }
 
 var ErrIndexMiss = errors.New("not found in index")
@@ -44,3 +46,10 @@ func (ir *InMemoryIndexer) Search(ctx context.Context, key string) (int64, error
 
 	return offset, nil
 }
+
+func (ir *InMemoryIndexer) Len() int {
+	ir.mu.RLock()
+	defer ir.mu.RUnlock()
+
+	return len(ir.hash)
+}
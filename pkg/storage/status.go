@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
+)
+
+// Status describes a running storage for the admin status.
+type Status struct {
+	System string `json:"system"`
+	Path   string `json:"path"`
+	// DiskBytes is the size of the data files
+	DiskBytes int64 `json:"disk_bytes"`
+	// Keys are the indexed keys of a fs storage
+	Keys int `json:"keys,omitempty"`
+
+	// Segments are the live segments from the newest, Jobs the last run of every background job
+	Segments            []mananger.SegmentInfo       `json:"segments,omitempty"`
+	WriteBufferBytes    int64                        `json:"write_buffer_bytes,omitempty"`
+	WriteBufferCapacity int64                        `json:"write_buffer_capacity,omitempty"`
+	Jobs                map[string]segment.JobStatus `json:"jobs,omitempty"`
+	MergesPaused        bool                         `json:"merges_paused,omitempty"`
+}
+
+// StatusOf describes repo opened by NewStorage with conf.
+func StatusOf(conf config.StorageConfig, repo Repository) Status {
+	status := Status{
+		System: conf.System,
+		Path:   conf.Path,
+	}
+
+	switch r := repo.(type) {
+	case *fs.FileSystemRepository:
+		stats := r.Stats()
+		status.DiskBytes, status.Keys = stats.FileBytes, stats.Keys
+	case *segment.SegmentFSRepository:
+		stats := r.Stats()
+		status.DiskBytes = stats.DiskBytes
+		status.Segments = r.Segments()
+		status.WriteBufferBytes, status.WriteBufferCapacity = stats.WriteBufferBytes, stats.WriteBufferCapacity
+		status.Jobs = r.Jobs()
+		status.MergesPaused = r.MergesPaused()
+	}
+
+	return status
+}
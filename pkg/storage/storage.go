@@ -2,26 +2,70 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/config"
 	"github.com/ForeverSRC/kaeya/pkg/domain"
 	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/compress"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
 	"github.com/ForeverSRC/kaeya/pkg/storage/index"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
+	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
 	"github.com/ForeverSRC/kaeya/pkg/utils"
 )
 
+var (
+	ErrNotFound = common.ErrNotFound
+
+	ErrIngestUnsupported = errors.New("storage system cannot ingest segment files")
+	ErrJobsUnsupported   = errors.New("storage system has no background jobs")
+)
+
 type Repository interface {
 	Save(ctx context.Context, kv domain.KV) error
+	// Load returns the newest version of key, which is a tombstone if it has been deleted.
 	Load(ctx context.Context, key string) (domain.KV, error)
 	Close(ctx context.Context) error
+	// Checkpoint makes a consistent snapshot of the data files in dir while serving,
+	// dir is laid out like the storage path.
+	Checkpoint(ctx context.Context, dir string) error
+	// Scan calls fn with the newest version of every key starting with prefix,
+	// in no particular order, until fn returns an error. Tombstones of deleted keys are included.
+	Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) error
+	// Import bulk loads the kvs of r faster than saving them one by one, later kvs win.
+	Import(ctx context.Context, r common.KVReader) (int, error)
+}
+
+// Ingester is implemented by the storage systems which can ingest segment files built by BuildSegment.
+type Ingester interface {
+	// Ingest adds the segment files atomically, precedence is "newest" or "oldest",
+	// empty for the configured one. It returns the number of ingested records.
+	Ingest(ctx context.Context, files []string, precedence string) (int, error)
+}
+
+// Refresher is implemented by the storage systems which show writes to Load and Scan only
+// after a refresh, see segment.SegmentFSRepository.
+type Refresher interface {
+	// Refresh makes every write saved before visible.
+	Refresh(ctx context.Context) error
+}
+
+// Scheduler is implemented by the storage systems running background jobs, see segment.SegmentFSRepository.
+type Scheduler interface {
+	// RunJob runs a job now, out of its schedule, and returns its outcome.
+	RunJob(job string) (segment.JobStatus, error)
+	PauseMerges(paused bool)
+	MergesPaused() bool
 }
 
 func NewStorage(conf config.StorageConfig) (Repository, error) {
-	cd, err := codec.NewCodec(conf.Codec)
+	cd, keyring, err := openCodecAndKeyring(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -31,54 +75,245 @@ func NewStorage(conf config.StorageConfig) (Repository, error) {
 	var repo Repository
 	switch system.SystemKind(conf.System) {
 	case system.KindFS:
-		repo, err = fs.NewFileSystemRepository(cd, idxr, conf.Path)
+		repo, err = fs.NewFileSystemRepository(cd, idxr, conf.Path, fsOptions(keyring)...)
 	case system.KindSegment:
-		sf := conf.Segment
-		options := make([]segment.Option, 0)
-
-		if sf.BufferSize != "" {
-			bufSize, err := utils.ToBytes(sf.BufferSize)
-			if err != nil {
-				return nil, err
-			}
-			options = append(options, segment.WithMaxBufferSize(bufSize))
+		var options []segment.Option
+		options, err = segmentOptions(conf, keyring)
+		if err != nil {
+			return nil, err
 		}
 
-		if sf.MergeFloor != "" {
-			mergeFloor, err := utils.ToBytes(sf.MergeFloor)
-			if err != nil {
-				return nil, err
-			}
-			options = append(options, segment.WithMaxBufferSize(mergeFloor))
-		}
+		repo, err = segment.NewDefaultSegmentFSRepository(cd, conf.Path, options...)
+	default:
+		err = fmt.Errorf("no such kind of system: %s", conf.System)
+	}
 
-		if sf.RefreshInterval != "" {
-			d, err := utils.ParseDuration(sf.RefreshInterval)
-			if err != nil {
-				return nil, err
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			options = append(options, segment.WithRefreshInterval(d))
-		}
+	return repo, nil
+
+}
 
-		if sf.FlushInterval != "" {
-			d, err := utils.ParseDuration(sf.FlushInterval)
-			if err != nil {
-				return nil, err
-			}
+// Check validates the data files of the storage offline, the server must be stopped.
+// With repair the problems which can be fixed are repaired, see fs.Check and segment.Check.
+func Check(conf config.StorageConfig, repair bool) (*common.CheckReport, error) {
+	cd, keyring, err := openCodecAndKeyring(conf)
+	if err != nil {
+		return nil, err
+	}
 
-			options = append(options, segment.WithFlushInterval(d))
+	switch system.SystemKind(conf.System) {
+	case system.KindFS:
+		return fs.Check(conf.Path, cd, repair, fsOptions(keyring)...)
+	case system.KindSegment:
+		options, err := segmentOptions(conf, keyring)
+		if err != nil {
+			return nil, err
 		}
 
-		repo, err = segment.NewDefaultSegmentFSRepository(cd, conf.Path, options...)
+		return segment.Check(cd, conf.Path, repair, options...)
 	default:
-		err = fmt.Errorf("no such kind of system: %s", conf.System)
+		return nil, fmt.Errorf("no such kind of system: %s", conf.System)
+	}
+}
+
+// BuildSegment writes the kvs of r into a new segment file, sorted by key, for an ingest into
+// a running server with conf. Codec, compression and encryption are taken from conf.
+func BuildSegment(conf config.StorageConfig, file string, r common.KVReader) (int, error) {
+	if system.SystemKind(conf.System) != system.KindSegment {
+		return 0, fmt.Errorf("storage system %s: %w", conf.System, ErrIngestUnsupported)
 	}
 
+	cd, keyring, err := openCodecAndKeyring(conf)
+	if err != nil {
+		return 0, err
+	}
+
+	options, err := segmentOptions(conf, keyring)
+	if err != nil {
+		return 0, err
+	}
+
+	return segment.BuildSegment(cd, file, r, options...)
+}
+
+// InspectSegments opens the segment files of a stopped segment storage read-only.
+func InspectSegments(conf config.StorageConfig) (*mananger.Inspector, error) {
+	if system.SystemKind(conf.System) != system.KindSegment {
+		return nil, fmt.Errorf("storage system %s has no segments", conf.System)
+	}
+
+	cd, keyring, err := openCodecAndKeyring(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	return repo, nil
+	options, err := segmentOptions(conf, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	return segment.Inspect(cd, conf.Path, options...)
+}
+
+func openCodecAndKeyring(conf config.StorageConfig) (codec.Codec, *encryption.Keyring, error) {
+	cd, err := codec.NewCodec(conf.Codec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !conf.Encryption.Enabled() {
+		return cd, nil, nil
+	}
+
+	keyring, err := encryption.LoadKeyring(conf.Encryption.KeyFile, conf.Encryption.KEKEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load encryption keys error: %w", err)
+	}
+
+	return cd, keyring, nil
+}
+
+func fsOptions(keyring *encryption.Keyring) []fs.Option {
+	options := make([]fs.Option, 0)
+	if keyring != nil {
+		options = append(options, fs.WithKeyring(keyring))
+	}
+
+	return options
+}
+
+func segmentOptions(conf config.StorageConfig, keyring *encryption.Keyring) ([]segment.Option, error) {
+	sf := conf.Segment
+	options := make([]segment.Option, 0)
+
+	if keyring != nil {
+		options = append(options, segment.WithKeyring(keyring))
+	}
+
+	if sf.UpgradeLegacy {
+		options = append(options, segment.WithUpgradeLegacy())
+	}
+
+	if sf.BufferSize != "" {
+		bufSize, err := utils.ToBytes(sf.BufferSize)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, segment.WithMaxBufferSize(bufSize))
+	}
+
+	tunables, err := segmentTunables(sf)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, tunables...)
+
+	if sf.Compression != "" {
+		compressor, err := compress.NewCompressor(sf.Compression)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, segment.WithCompression(compressor))
+	}
+
+	if sf.IngestPrecedence != "" {
+		options = append(options, segment.WithIngestPrecedence(mananger.Precedence(sf.IngestPrecedence)))
+	}
+
+	if sf.ValueLogThreshold != "" {
+		if codec.CodecType(conf.Codec) == codec.TypeCSV {
+			return nil, fmt.Errorf("value log needs metadata in records, not supported by codec %s", conf.Codec)
+		}
+
+		threshold, err := utils.ToBytes(sf.ValueLogThreshold)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, segment.WithValueLogThreshold(threshold))
+	}
+
+	if sf.ValueLogFileSize != "" {
+		fileSize, err := utils.ToBytes(sf.ValueLogFileSize)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, segment.WithValueLogFileSize(fileSize))
+	}
+
+	if sf.ValueLogGCInterval != "" {
+		d, err := utils.ParseDuration(sf.ValueLogGCInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, segment.WithValueLogGCInterval(d))
+	}
+
+	return options, nil
+}
+
+// segmentTunables are the options of a segment storage which Reconfigure changes live.
+func segmentTunables(sf config.SegmentSysConfig) ([]segment.Option, error) {
+	options := make([]segment.Option, 0)
+
+	if sf.MergeFloor != "" {
+		mergeFloor, err := utils.ToBytes(sf.MergeFloor)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, segment.WithMergeFloor(mergeFloor))
+	}
+
+	for _, t := range []struct {
+		name   string
+		value  string
+		option func(time.Duration) segment.Option
+	}{
+		{"refresh_interval", sf.RefreshInterval, segment.WithRefreshInterval},
+		{"flush_interval", sf.FlushInterval, segment.WithFlushInterval},
+		{"merge_interval", sf.MergeInterval, segment.WithMergeInterval},
+	} {
+		if t.value == "" {
+			continue
+		}
+
+		d, err := utils.ParseDuration(t.value)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("%s %s is not positive", t.name, t.value)
+		}
+
+		options = append(options, t.option(d))
+	}
+
+	return options, nil
+}
+
+// ValidateTunables returns the error Reconfigure would return for conf, without applying it.
+func ValidateTunables(conf config.StorageConfig) error {
+	_, err := segmentTunables(conf.Segment)
+	return err
+}
+
+// Reconfigure applies the intervals and the merge floor of conf to repo opened by NewStorage,
+// the storage systems without them ignore it.
+func Reconfigure(conf config.StorageConfig, repo Repository) error {
+	r, ok := repo.(*segment.SegmentFSRepository)
+	if !ok {
+		return nil
+	}
+
+	options, err := segmentTunables(conf.Segment)
+	if err != nil {
+		return err
+	}
+
+	r.Reconfigure(options...)
 
+	return nil
 }
@@ -0,0 +1,180 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+)
+
+const bulkBufferSize = 1 << 20
+
+// Scan calls fn with the newest version of every key starting with prefix, in the order of
+// their last write. Writes made after the scan started are not seen.
+func (fr *FileSystemRepository) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) (err error) {
+	ctx, span := tracing.Start(ctx, "FileSystemRepository.Scan")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	fr.writeLock.Lock()
+	stat, err := fr.file.Stat()
+	fr.writeLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fr.file.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the first pass finds the last line of every key, the second one reads them
+	last := make(map[string]int64)
+	err = fr.scanLines(ctx, f, stat.Size(), func(offset int64, kv domain.KV) error {
+		if strings.HasPrefix(kv.Key, prefix) {
+			last[kv.Key] = offset
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return fr.scanLines(ctx, f, stat.Size(), func(offset int64, kv domain.KV) error {
+		if o, ok := last[kv.Key]; !ok || o != offset {
+			return nil
+		}
+
+		return fn(kv)
+	})
+}
+
+// scanLines calls fn with every decodable line of f before size and its offset.
+func (fr *FileSystemRepository) scanLines(ctx context.Context, f *os.File, size int64, fn func(offset int64, kv domain.KV) error) error {
+	scanner := bufio.NewScanner(io.NewSectionReader(f, 0, size))
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+
+	var offset int64 = 0
+	for lines := 1; scanner.Scan(); lines++ {
+		if lines%common.CancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		data := scanner.Bytes()
+
+		kv, err := fr.decodeLine(data)
+		if err == nil {
+			err = fn(offset, kv)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += int64(len(data)) + lineDelimLen
+	}
+
+	return scanner.Err()
+}
+
+// Import bulk loads the kvs of r with a single sync at the end instead of one per kv,
+// later kvs of r win over earlier ones. It returns the number of imported kvs. A failure
+// before the sync cuts the data file back to where the import started, nothing of r is
+// imported then.
+func (fr *FileSystemRepository) Import(ctx context.Context, r common.KVReader) (int, error) {
+	fr.writeLock.Lock()
+	defer fr.writeLock.Unlock()
+
+	stat, err := fr.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	start := stat.Size()
+	offsets, count, err := fr.appendAll(r, start)
+	if err != nil {
+		// the lines written so far are not indexed and would be read as the newest values
+		truncErr := fr.truncate(start)
+		if truncErr != nil {
+			return 0, fmt.Errorf("%w, truncate error: %v", err, truncErr)
+		}
+
+		return 0, err
+	}
+
+	for key, offset := range offsets {
+		err = fr.indexer.Index(ctx, key, offset)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// appendAll writes the kvs of r to the data file ending at offset and syncs it, it returns
+// the offset of the last line of every key and the number of kvs written.
+func (fr *FileSystemRepository) appendAll(r common.KVReader, offset int64) (map[string]int64, int, error) {
+	w := bufio.NewWriterSize(fr.file, bulkBufferSize)
+	offsets := make(map[string]int64)
+	count := 0
+
+	for {
+		kv, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		data, err := fr.encodeLine(kv)
+		if err != nil {
+			return nil, 0, fmt.Errorf("encode error: %w", err)
+		}
+
+		data = append(data, lineDelim)
+
+		_, err = w.Write(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("write to file error: %w", err)
+		}
+
+		offsets[kv.Key] = offset
+		offset += int64(len(data))
+		count++
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return nil, 0, fmt.Errorf("write to file error: %w", err)
+	}
+
+	err = fr.file.Sync()
+	if err != nil {
+		return nil, 0, fmt.Errorf("sync to fs error: %w", err)
+	}
+
+	return offsets, count, nil
+}
+
+// truncate cuts the data file back to size, the file is opened for appending so the
+// next write goes to size.
+func (fr *FileSystemRepository) truncate(size int64) error {
+	err := fr.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	return fr.file.Sync()
+}
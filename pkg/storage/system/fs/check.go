@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path"
+
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+const (
+	quarantineExtension = ".bad"
+
+	// at most this many undecodable lines are reported one by one
+	maxReportedLines = 10
+)
+
+// Check validates every line of the data file under rootPath without changing it.
+// With repair, a torn tail is truncated; if lines in the middle are undecodable the
+// file is rewritten without them and the original is kept with the .bad extension.
+func Check(rootPath string, cd codec2.Codec, repair bool, options ...Option) (*common.CheckReport, error) {
+	fr := &FileSystemRepository{codec: cd}
+	for _, op := range options {
+		op(fr)
+	}
+
+	fileName := path.Join(rootPath, "data", storageFileName+storageFileNameExtension)
+	report := &common.CheckReport{}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+
+		return nil, err
+	}
+	report.Files = 1
+
+	good := make([][]byte, 0)
+	seen := make(map[string]bool)
+	bad := 0
+
+	// tornAt is the offset of the first line of the undecodable tail
+	var offset, tornAt int64 = 0, -1
+
+	lines := bytes.Split(data, []byte{lineDelim})
+	for i, line := range lines {
+		start := offset
+		offset += int64(len(line)) + lineDelimLen
+
+		// the last line is complete only if it is empty, the file ends with a delimiter
+		if i == len(lines)-1 {
+			if len(line) != 0 && tornAt < 0 {
+				tornAt = start
+			}
+			break
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		kv, err := fr.decodeLine(line)
+		if err != nil {
+			if tornAt < 0 {
+				tornAt = start
+			}
+
+			bad++
+			if bad <= maxReportedLines {
+				report.Problemf("line %d: %v", i+1, err)
+			}
+			continue
+		}
+
+		if tornAt >= 0 {
+			// a readable line after an undecodable one, the file is corrupted in the middle
+			tornAt = -2
+		}
+
+		good = append(good, line)
+		seen[kv.Key] = true
+	}
+
+	if bad > maxReportedLines {
+		report.Problemf("%d more undecodable lines", bad-maxReportedLines)
+	}
+
+	if tornAt >= 0 {
+		report.Problemf("torn tail after offset %d", tornAt)
+	}
+
+	report.Records = len(good)
+	report.LiveKeys = len(seen)
+
+	if !repair || report.OK() {
+		return report, nil
+	}
+
+	if tornAt >= 0 {
+		err = os.Truncate(fileName, tornAt)
+		if err != nil {
+			return nil, err
+		}
+		report.Repairf("truncated to %d bytes", tornAt)
+	} else {
+		err = os.Rename(fileName, fileName+quarantineExtension)
+		if err != nil {
+			return nil, err
+		}
+
+		content := make([]byte, 0, len(data))
+		for _, line := range good {
+			content = append(content, line...)
+			content = append(content, lineDelim)
+		}
+
+		err = os.WriteFile(fileName, content, 0754)
+		if err != nil {
+			return nil, err
+		}
+		report.Repairf("rewrote %d readable lines, original kept as %s", len(good), fileName+quarantineExtension)
+	}
+
+	report.Problems = nil
+
+	return report, nil
+}
@@ -2,17 +2,25 @@ package fs
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
 	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
 	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
 	"github.com/ForeverSRC/kaeya/pkg/storage/index"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -21,25 +29,57 @@ const (
 
 	lineDelim    = '\n'
 	lineDelimLen = 1
+	maxLineSize  = 64 << 20
+
+	// sealedLinePrefix starts a line sealed by a key, followed by "<key id>:<base64 record>"
+	sealedLinePrefix = 0x01
 )
 
 var (
 	errIndexNotFound = errors.New("not found by index")
-	ErrNull          = errors.New("null value")
+	ErrNull          = common.ErrNotFound
 )
 
 type FileSystemRepository struct {
-	file    *os.File
-	codec   codec2.Codec
-	indexer index.Indexer
+	// writeLock serializes appends with checkpoints
+	writeLock sync.Mutex
+	file      *os.File
+	codec     codec2.Codec
+	indexer   index.Indexer
+
+	// nil for records in plain text
+	keyring *encryption.Keyring
+
+	unregisterMetrics func()
+}
+
+type Stats struct {
+	// FileBytes is the size of the data file
+	FileBytes int64
+	// Keys are the keys in the index
+	Keys int
 }
 
-func NewFileSystemRepository(codec codec2.Codec, indexer index.Indexer, rootPath string) (*FileSystemRepository, error) {
+type Option func(fr *FileSystemRepository)
+
+// WithKeyring seals new records by the current key of keyring,
+// records in plain text and sealed by older keys are still readable.
+func WithKeyring(keyring *encryption.Keyring) Option {
+	return func(fr *FileSystemRepository) {
+		fr.keyring = keyring
+	}
+}
+
+func NewFileSystemRepository(codec codec2.Codec, indexer index.Indexer, rootPath string, options ...Option) (*FileSystemRepository, error) {
 	fs := &FileSystemRepository{
 		codec:   codec,
 		indexer: indexer,
 	}
 
+	for _, op := range options {
+		op(fs)
+	}
+
 	f, err := fs.initFile(rootPath)
 	if err != nil {
 		return nil, fmt.Errorf("fs inti error: %w", err)
@@ -49,6 +89,15 @@ func NewFileSystemRepository(codec codec2.Codec, indexer index.Indexer, rootPath
 
 	fs.initIndex()
 
+	fs.unregisterMetrics = metrics.RegisterStorage(rootPath,
+		metrics.Gauge{Name: "file_bytes", Help: "Size of the data file.", Value: func() float64 {
+			return float64(fs.Stats().FileBytes)
+		}},
+		metrics.Gauge{Name: "index_keys", Help: "Keys in the index.", Value: func() float64 {
+			return float64(fs.Stats().Keys)
+		}},
+	)
+
 	return fs, nil
 
 }
@@ -95,11 +144,12 @@ func (fr *FileSystemRepository) initIndex() {
 	ctx := context.Background()
 
 	scanner := bufio.NewScanner(fr.file)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
 
 	var offset int64 = 0
 	for scanner.Scan() {
 		data := scanner.Bytes()
-		kv, err := fr.codec.Decode(data)
+		kv, err := fr.decodeLine(data)
 		if err == nil {
 			_ = fr.indexer.Index(ctx, kv.Key, offset)
 		}
@@ -108,13 +158,22 @@ func (fr *FileSystemRepository) initIndex() {
 	}
 }
 
-func (fr *FileSystemRepository) Save(ctx context.Context, kv domain.KV) error {
-	data, err := fr.codec.Encode(kv)
+func (fr *FileSystemRepository) Save(ctx context.Context, kv domain.KV) (err error) {
+	ctx, span := tracing.Start(ctx, "FileSystemRepository.Save")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	data, err := fr.encodeLine(kv)
 	if err != nil {
 		return fmt.Errorf("encode error: %w", err)
 	}
 
 	data = append(data, lineDelim)
+
+	fr.writeLock.Lock()
+	defer fr.writeLock.Unlock()
+
 	n, err := fr.file.Write(data)
 
 	if err != nil {
@@ -140,8 +199,14 @@ func (fr *FileSystemRepository) Save(ctx context.Context, kv domain.KV) error {
 
 }
 
-func (fr *FileSystemRepository) Load(ctx context.Context, key string) (domain.KV, error) {
-	kv, err := fr.loadByIndex(ctx, key)
+func (fr *FileSystemRepository) Load(ctx context.Context, key string) (kv domain.KV, err error) {
+	ctx, span := tracing.Start(ctx, "FileSystemRepository.Load")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	kv, err = fr.loadByIndex(ctx, key)
+	span.SetAttributes(attribute.Bool("kaeya.index_hit", err == nil))
 	if err != nil {
 		if errors.Is(err, errIndexNotFound) {
 			return fr.loadFromFile(ctx, key)
@@ -181,7 +246,7 @@ func (fr *FileSystemRepository) loadByIndex(ctx context.Context, key string) (do
 		return res, err
 	}
 
-	kv, err := fr.codec.Decode(data[:len(data)-1])
+	kv, err := fr.decodeLine(data[:len(data)-1])
 	if err != nil {
 		return res, err
 	}
@@ -201,7 +266,13 @@ func (fr *FileSystemRepository) loadFromFile(ctx context.Context, key string) (d
 
 	var offset int64 = -1
 
-	for {
+	for lines := 1; ; lines++ {
+		if lines%common.CancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+		}
+
 		data, newOffset, err := common.ReadLineFromTail(fr.file, offset, lineDelim)
 		if err != nil {
 			switch {
@@ -215,7 +286,7 @@ func (fr *FileSystemRepository) loadFromFile(ctx context.Context, key string) (d
 			}
 		}
 
-		kv, err := fr.codec.Decode(data)
+		kv, err := fr.decodeLine(data)
 		if err != nil {
 			return res, err
 		}
@@ -228,6 +299,82 @@ func (fr *FileSystemRepository) loadFromFile(ctx context.Context, key string) (d
 	}
 }
 
+func (fr *FileSystemRepository) encodeLine(kv domain.KV) ([]byte, error) {
+	data, err := fr.codec.Encode(kv)
+	if err != nil || fr.keyring == nil {
+		return data, err
+	}
+
+	keyID, sealed, err := fr.keyring.SealLine(data)
+	if err != nil {
+		return nil, err
+	}
+
+	line := []byte{sealedLinePrefix}
+	line = strconv.AppendUint(line, uint64(keyID), 10)
+	line = append(line, ':')
+
+	return append(line, sealed...), nil
+}
+
+func (fr *FileSystemRepository) decodeLine(data []byte) (domain.KV, error) {
+	if len(data) == 0 || data[0] != sealedLinePrefix {
+		return fr.codec.Decode(data)
+	}
+
+	idStr, sealed, ok := bytes.Cut(data[1:], []byte{':'})
+	if !ok {
+		return domain.KV{}, codec2.ErrDataFormat
+	}
+
+	keyID, err := strconv.ParseUint(string(idStr), 10, 32)
+	if err != nil {
+		return domain.KV{}, codec2.ErrDataFormat
+	}
+
+	if fr.keyring == nil {
+		return domain.KV{}, fmt.Errorf("record sealed by key %d: %w", keyID, encryption.ErrUnknownKey)
+	}
+
+	data, err = fr.keyring.OpenLine(uint32(keyID), sealed)
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	return fr.codec.Decode(data)
+}
+
+// Checkpoint copies the data file up to the last complete record into dir, laid out like rootPath.
+func (fr *FileSystemRepository) Checkpoint(ctx context.Context, dir string) error {
+	fr.writeLock.Lock()
+	stat, err := fr.file.Stat()
+	fr.writeLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	dataDir := path.Join(dir, "data")
+	err = os.MkdirAll(dataDir, 0754)
+	if err != nil {
+		return err
+	}
+
+	// the file is append only, the first size bytes do not change anymore
+	return utils.CopyFileN(fr.file.Name(), path.Join(dataDir, storageFileName+storageFileNameExtension), stat.Size())
+}
+
+// Stats reports the size of the data file and the indexed keys.
+func (fr *FileSystemRepository) Stats() Stats {
+	stats := Stats{Keys: fr.indexer.Len()}
+	if stat, err := fr.file.Stat(); err == nil {
+		stats.FileBytes = stat.Size()
+	}
+
+	return stats
+}
+
 func (fr *FileSystemRepository) Close(ctx context.Context) error {
+	fr.unregisterMetrics()
 	return fr.file.Close()
 }
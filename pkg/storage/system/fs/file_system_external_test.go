@@ -1,14 +1,20 @@
 package fs_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
 	"github.com/ForeverSRC/kaeya/pkg/storage/index"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
 	"github.com/ForeverSRC/kaeya/pkg/utils"
@@ -35,16 +41,16 @@ func TestNormal(t *testing.T) {
 		{
 			name: "normal",
 			kvs: []domain.KV{
-				{Key: "aaa", Value: "1"},
-				{Key: "bbb", Value: "2"},
-				{Key: "ccc", Value: `{"a":1,"b":2}`},
-				{Key: "aaa", Value: "10"},
-				{Key: "bbb", Value: "hhh"},
+				{Key: "aaa", Value: []byte("1")},
+				{Key: "bbb", Value: []byte("2")},
+				{Key: "ccc", Value: []byte(`{"a":1,"b":2}`)},
+				{Key: "aaa", Value: []byte("10")},
+				{Key: "bbb", Value: []byte("hhh")},
 			},
 			expected: []domain.KV{
-				{Key: "aaa", Value: "10"},
-				{Key: "bbb", Value: "hhh"},
-				{Key: "ccc", Value: `{"a":1,"b":2}`},
+				{Key: "aaa", Value: []byte("10")},
+				{Key: "bbb", Value: []byte("hhh")},
+				{Key: "ccc", Value: []byte(`{"a":1,"b":2}`)},
 				{Key: "hhh"},
 			},
 		},
@@ -91,11 +97,11 @@ func TestSaveAndLoad(t *testing.T) {
 		{
 			name: "s-l",
 			data: []domain.KV{
-				{Key: "aa", Value: "1"},
-				{Key: "bc", Value: "aaa-sss-bd"},
-				{Key: "123c", Value: "100"},
-				{Key: "aa", Value: "100"},
-				{Key: "123c", Value: "90"},
+				{Key: "aa", Value: []byte("1")},
+				{Key: "bc", Value: []byte("aaa-sss-bd")},
+				{Key: "123c", Value: []byte("100")},
+				{Key: "aa", Value: []byte("100")},
+				{Key: "123c", Value: []byte("90")},
 			},
 		},
 	}
@@ -132,11 +138,11 @@ func TestSaveAndLoad(t *testing.T) {
 func TestConcurrentReadWrite(t *testing.T) {
 
 	data := []domain.KV{
-		{Key: "aa", Value: "1"},
-		{Key: "bc", Value: "aaa-sss-bd"},
-		{Key: "123c", Value: "100"},
-		{Key: "aa", Value: "100"},
-		{Key: "123c", Value: "90"},
+		{Key: "aa", Value: []byte("1")},
+		{Key: "bc", Value: []byte("aaa-sss-bd")},
+		{Key: "123c", Value: []byte("100")},
+		{Key: "aa", Value: []byte("100")},
+		{Key: "123c", Value: []byte("90")},
 	}
 
 	rootPath := path.Join(testDynamicRoot, utils.ID())
@@ -180,7 +186,7 @@ func TestConcurrentReadWrite(t *testing.T) {
 			}
 
 			assert.Equal(t, data[i].Key, kv.Key)
-			println(kv.Key, ":", kv.Value)
+			println(kv.Key, ":", string(kv.Value))
 			time.Sleep(300 * time.Millisecond)
 		}
 	}()
@@ -193,7 +199,7 @@ func TestConcurrentReadWrite(t *testing.T) {
 		if !errors.Is(err, fs.ErrNull) {
 			assert.NoError(t, err)
 		}
-		println(kv.Key, ":", kv.Value)
+		println(kv.Key, ":", string(kv.Value))
 	}
 
 	fr.Close(context.Background())
@@ -203,26 +209,229 @@ func TestConcurrentReadWrite(t *testing.T) {
 func TestInitIndex(t *testing.T) {
 	rootPath := path.Join(testStaticRoot, "init-index")
 
-	cd := codec.NewStringCodec()
-	indexer := index.NewInMemoryIndexer()
+	existing := []domain.KV{
+		{Key: "aaa", Value: []byte("10")},
+		{Key: "bbb", Value: []byte("hhh")},
+		{Key: "ccc", Value: []byte(`{"a":1,"b":2}`)},
+	}
 
-	fr, err := fs.NewFileSystemRepository(cd, indexer, rootPath)
+	ctx := context.Background()
+
+	// the binary codec reads the records written by csv
+	for _, cd := range []codec.Codec{codec.NewStringCodec(), codec.NewBinaryCodec()} {
+		fr, err := fs.NewFileSystemRepository(cd, index.NewInMemoryIndexer(), rootPath)
+		assert.NoError(t, err)
+
+		for _, kv := range existing {
+			res, err := fr.Load(ctx, kv.Key)
+			if !errors.Is(err, fs.ErrNull) {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, kv.Value, res.Value)
+		}
+
+		assert.NoError(t, fr.Close(ctx))
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	rootPath := path.Join(testDynamicRoot, utils.ID())
+	ctx := context.Background()
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	open := func(keys map[uint32][]byte) *fs.FileSystemRepository {
+		keyring, err := encryption.NewKeyring(keys)
+		assert.NoError(t, err)
+
+		fr, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), rootPath, fs.WithKeyring(keyring))
+		assert.NoError(t, err)
+
+		return fr
+	}
+
+	fr := open(map[uint32][]byte{1: key1})
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "aaa", Value: []byte("secret-1")}))
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "bbb", Value: []byte("secret-2")}))
+	assert.NoError(t, fr.Close(ctx))
+
+	content, err := os.ReadFile(path.Join(rootPath, "data", "data.ky"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "secret")
+
+	// after rotation records sealed by the old key are still readable
+	fr = open(map[uint32][]byte{1: key1, 2: key2})
+	defer fr.Close(ctx)
+
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "aaa", Value: []byte("secret-3")}))
+
+	kv, err := fr.Load(ctx, "aaa")
 	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret-3"), kv.Value)
 
+	kv, err = fr.Load(ctx, "bbb")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret-2"), kv.Value)
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	rootPath := path.Join(testDynamicRoot, utils.ID())
 	ctx := context.Background()
 
-	existing := []domain.KV{
-		{"aaa", "10"},
-		{"bbb", "hhh"},
-		{"ccc", `{"a":1,"b":2}`},
+	fr, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), rootPath)
+	assert.NoError(t, err)
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "aaa", Value: []byte("1")}))
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "aaa", Value: []byte("2")}))
+	assert.NoError(t, fr.Save(ctx, domain.KV{Key: "bbb", Value: []byte("3")}))
+	assert.NoError(t, fr.Close(ctx))
+
+	report, err := fs.Check(rootPath, codec.NewBinaryCodec(), false)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 2, report.LiveKeys)
+
+	// a record torn by a crash
+	f, err := os.OpenFile(path.Join(rootPath, "data", "data.ky"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString("\x00ccc\x00")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	report, err = fs.Check(rootPath, codec.NewBinaryCodec(), false)
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+
+	report, err = fs.Check(rootPath, codec.NewBinaryCodec(), true)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Len(t, report.Repairs, 1)
+
+	report, err = fs.Check(rootPath, codec.NewBinaryCodec(), false)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Records)
+}
+
+func TestScanAndImport(t *testing.T) {
+	rootPath := path.Join(testDynamicRoot, utils.ID())
+
+	repo, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), rootPath)
+	assert.NoError(t, err)
+	defer repo.Close(context.Background())
+
+	ctx := context.Background()
+	assert.NoError(t, repo.Save(ctx, domain.KV{Key: "user:1", Value: []byte("old")}))
+
+	n, err := repo.Import(ctx, common.NewSliceReader([]domain.KV{
+		{Key: "user:1", Value: []byte("alice")},
+		{Key: "user:2", Value: []byte("bob"), Flags: 1},
+		{Key: "item:1", Value: []byte{0xff, 0x00}},
+		{Key: "user:2", Value: []byte("carol")},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	kv, err := repo.Load(ctx, "user:2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("carol"), kv.Value)
+
+	scanned := make(map[string]string)
+	assert.NoError(t, repo.Scan(ctx, "user:", func(kv domain.KV) error {
+		scanned[kv.Key] = string(kv.Value)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"user:1": "alice", "user:2": "carol"}, scanned)
+
+	stop := errors.New("stop")
+	assert.ErrorIs(t, repo.Scan(ctx, "", func(kv domain.KV) error {
+		return stop
+	}), stop)
+}
+
+// failingReader returns the kvs of SliceReader, then err instead of io.EOF.
+type failingReader struct {
+	*common.SliceReader
+	err error
+}
+
+func (r failingReader) Read() (domain.KV, error) {
+	kv, err := r.SliceReader.Read()
+	if err == io.EOF {
+		return kv, r.err
 	}
 
-	for _, kv := range existing {
-		res, err := fr.Load(ctx, kv.Key)
-		if !errors.Is(err, fs.ErrNull) {
-			assert.NoError(t, err)
-		}
-		assert.Equal(t, kv.Value, res.Value)
+	return kv, err
+}
+
+func TestImportFailed(t *testing.T) {
+	rootPath := path.Join(testDynamicRoot, utils.ID())
+	ctx := context.Background()
+
+	repo, err := fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), rootPath)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Save(ctx, domain.KV{Key: "a", Value: []byte("old")}))
+
+	dataFile := path.Join(rootPath, "data", "data.ky")
+	before, err := os.Stat(dataFile)
+	assert.NoError(t, err)
+
+	// more than the write buffer, so that a part reaches the file before the failure
+	kvs := make([]domain.KV, 0)
+	for i := 0; i < 20; i++ {
+		kvs = append(kvs, domain.KV{Key: "a", Value: bytes.Repeat([]byte{'x'}, 64<<10)})
+	}
+	broken := errors.New("broken")
+	n, err := repo.Import(ctx, failingReader{SliceReader: common.NewSliceReader(kvs), err: broken})
+	assert.ErrorIs(t, err, broken)
+	assert.Equal(t, 0, n)
+
+	after, err := os.Stat(dataFile)
+	assert.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+
+	// nothing of the failed import resurfaces after a restart
+	assert.NoError(t, repo.Close(ctx))
+	repo, err = fs.NewFileSystemRepository(codec.NewBinaryCodec(), index.NewInMemoryIndexer(), rootPath)
+	assert.NoError(t, err)
+	defer repo.Close(ctx)
+
+	kv, err := repo.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), kv.Value)
+
+	n, err = repo.Import(ctx, common.NewSliceReader([]domain.KV{{Key: "a", Value: []byte("new")}}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	kv, err = repo.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), kv.Value)
+}
+
+func TestCanceled(t *testing.T) {
+	repo, err := fs.NewFileSystemRepository(codec.NewStringCodec(), index.NewInMemoryIndexer(), path.Join(testDynamicRoot, utils.ID()))
+	assert.NoError(t, err)
+	defer repo.Close(context.Background())
+
+	const total = 2000
+	for i := 0; i < total; i++ {
+		assert.NoError(t, repo.Save(context.Background(), domain.KV{Key: fmt.Sprintf("key-%04d", i), Value: []byte("v")}))
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a missing key is searched in the whole file
+	_, err = repo.Load(ctx, "missing")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = repo.Load(context.Background(), "missing")
+	assert.ErrorIs(t, err, common.ErrNotFound)
+
+	err = repo.Scan(ctx, "", func(kv domain.KV) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
 }
@@ -0,0 +1,252 @@
+package mananger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// importSegmentSize is the minimum size of the segments built by Import
+const importSegmentSize = 4 << 20
+
+// Scan calls fn with the newest version of every key starting with prefix, in no particular order.
+// The segments are opened again when the scan starts, so merges do not disturb it and
+// later writes are not seen.
+func (sm *DefaultManager) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) (err error) {
+	ctx, span := tracing.Start(ctx, "DefaultManager.Scan", trace.WithAttributes(attribute.String("kaeya.prefix", prefix)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	segments, err := sm.snapshot()
+	if err != nil {
+		return err
+	}
+
+	defer discardSnapshot(segments)
+
+	seen := make(map[string]bool)
+	var bytesRead int64
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("kaeya.segments_scanned", len(segments)),
+			attribute.Int64("kaeya.bytes_read", bytesRead),
+			attribute.Int("kaeya.keys", len(seen)),
+		)
+	}()
+
+	records := 0
+	for _, s := range segments {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var fnErr error
+
+		err = s.scanRecords(func(data []byte) bool {
+			records++
+			if records%common.CancelCheckInterval == 0 {
+				if fnErr = ctx.Err(); fnErr != nil {
+					return false
+				}
+			}
+
+			bytesRead += int64(len(data))
+
+			var kv domain.KV
+			kv, fnErr = sm.codec.Decode(data)
+			if fnErr != nil {
+				return false
+			}
+
+			if !strings.HasPrefix(kv.Key, prefix) || seen[kv.Key] {
+				return true
+			}
+			seen[kv.Key] = true
+
+			kv, fnErr = sm.scanValue(ctx, kv)
+			if fnErr == nil {
+				fnErr = fn(kv)
+			}
+
+			return fnErr == nil
+		})
+		if err == nil {
+			err = fnErr
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshot refreshes the write buffer and opens the live segments from the newest,
+// the caller closes them.
+func (sm *DefaultManager) snapshot() ([]*segmentFile, error) {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*segmentFile, 0, sm.linkList.count())
+
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		s, err := openSegmentFile(iter.next().Name(), sm.keyring)
+		if err != nil {
+			discardSnapshot(res)
+			return nil, err
+		}
+
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+// discardSnapshot closes the segments opened by snapshot, the files stay.
+func discardSnapshot(segments []*segmentFile) {
+	for _, s := range segments {
+		s.Close()
+	}
+}
+
+func (sm *DefaultManager) scanValue(ctx context.Context, kv domain.KV) (domain.KV, error) {
+	res, err := sm.resolveValue(kv)
+	if err == nil || !errors.Is(err, ErrValuePointer) {
+		return res, err
+	}
+
+	// the value log file has been collected meanwhile, the value was moved
+	return sm.Read(ctx, kv.Key)
+}
+
+// Import bulk loads the kvs of r bypassing the write buffer: they are encoded straight
+// into segments of at least importSegmentSize, each one added on top of the existing
+// segments, later kvs of r win over earlier ones. It returns the number of imported kvs.
+func (sm *DefaultManager) Import(r common.KVReader) (int, error) {
+	size := int64(sm.writeBuffer.Cap())
+	if size < importSegmentSize {
+		size = importSegmentSize
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, size))
+	meta := segmentMeta{codec: sm.codec.Type()}
+	count := 0
+
+	for {
+		kv, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		data, err := sm.importRecord(kv)
+		if err != nil {
+			return count, err
+		}
+
+		buffer.Write(data)
+		meta.add(kv.Key)
+		count++
+
+		if int64(buffer.Len()) >= size {
+			err = sm.addImported(meta, buffer.Bytes())
+			if err != nil {
+				return count, err
+			}
+
+			buffer.Reset()
+			meta = segmentMeta{codec: sm.codec.Type()}
+		}
+	}
+
+	if buffer.Len() > 0 {
+		err := sm.addImported(meta, buffer.Bytes())
+		if err != nil {
+			return count, err
+		}
+	}
+
+	logger.Logger.Debug().Msgf("imported %d records into %s", count, sm.segmentPath)
+
+	return count, nil
+}
+
+func (sm *DefaultManager) importRecord(kv domain.KV) ([]byte, error) {
+	if sm.valueLog != nil && sm.valueLog.needSeparate(kv.Value) {
+		sm.writeLock.Lock()
+		vp, err := sm.valueLog.append(kv.Key, kv.Value)
+		sm.writeLock.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		kv.Value = vp.encode()
+		kv.Flags |= flagValuePointer
+	}
+
+	data, err := sm.codec.Encode(kv)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{segmentFileDataDelim}, data...), nil
+}
+
+// addImported makes data a new segment on top of the others. The write buffer is
+// refreshed first, writes made before a part of the import do not win over it.
+func (sm *DefaultManager) addImported(meta segmentMeta, data []byte) error {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	if sm.valueLog != nil {
+		// pointers must not become durable before their values
+		err := sm.valueLog.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	seg, err := newSegmentFile(sm.segmentFileFullPath(), sm.linkList.maxID()+1, meta, data, sm.compressor, sm.keyring)
+	if err != nil {
+		return err
+	}
+
+	err = sm.manifest.apply(versionEdit{Add: []manifestEntry{manifestEntryOf(seg)}})
+	if err != nil {
+		discardSegments(seg)
+		return err
+	}
+
+	sm.addSegment(seg)
+
+	return nil
+}
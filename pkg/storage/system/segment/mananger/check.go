@@ -0,0 +1,387 @@
+package mananger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+const (
+	quarantineDir       = "quarantine"
+	quarantineExtension = ".bad"
+
+	repairBufferSize = 1 << 20
+)
+
+// segmentCheck is the result of checking a single segment file.
+type segmentCheck struct {
+	name string
+	seg  *segmentFile
+	// keys of the readable records from the newest to the oldest
+	keys []string
+	// the data after tornAt is incomplete and can be truncated, -1 if the tail is fine
+	tornAt int64
+	err    error
+}
+
+// Check validates the segment files under segmentPath without changing them: headers,
+// decodability of every record, duplicate segmentIDs and the manifest.
+// With repair, torn tails are truncated, unreadable and orphan segments are moved
+// into the quarantine directory and the remaining segments are rewritten into one,
+// options are used to open the segments for that rewrite.
+func Check(segmentPath string, cd codec2.Codec, repair bool, options ...Option) (*common.CheckReport, error) {
+	opened := &DefaultManager{}
+	for _, op := range options {
+		op(opened)
+	}
+
+	files, err := listSegmentFiles(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &common.CheckReport{}
+
+	m, exists, err := readManifest(segmentPath)
+	if err != nil {
+		report.Problemf("manifest unreadable: %v", err)
+		m, exists = &manifest{live: make(map[string]int)}, false
+	}
+
+	checks := make([]segmentCheck, 0, len(files))
+	orphans := make([]string, 0)
+	found := make(map[string]bool, len(files))
+
+	for _, f := range files {
+		name := filepath.Base(f)
+		found[name] = true
+
+		if _, ok := m.live[name]; exists && !ok {
+			report.Problemf("%s: orphan segment file, not in the manifest", name)
+			orphans = append(orphans, f)
+			continue
+		}
+
+		c := checkSegmentFile(f, cd, opened)
+		checks = append(checks, c)
+
+		report.Files++
+		if c.tornAt >= 0 {
+			report.Problemf("%s: torn tail after offset %d", name, c.tornAt)
+		}
+		if c.err != nil && c.tornAt < 0 {
+			report.Problemf("%s: %v", name, c.err)
+		}
+		if c.seg != nil && exists && m.live[name] != c.seg.segmentID {
+			report.Problemf("%s: segment id %d, manifest %d", name, c.seg.segmentID, m.live[name])
+		}
+	}
+
+	if exists {
+		for _, e := range m.entries() {
+			if !found[e.File] {
+				report.Problemf("%s: live segment file missing", e.File)
+			}
+		}
+	}
+
+	readable := make([]segmentCheck, 0, len(checks))
+	for _, c := range checks {
+		if c.seg != nil {
+			readable = append(readable, c)
+		}
+	}
+
+	// from the newest, a segment written later wins on a duplicate segmentID
+	sort.Slice(readable, func(i, j int) bool {
+		if readable[i].seg.segmentID != readable[j].seg.segmentID {
+			return readable[i].seg.segmentID > readable[j].seg.segmentID
+		}
+
+		return filepath.Base(readable[i].name) > filepath.Base(readable[j].name)
+	})
+
+	duplicates := make([]string, 0)
+	seen := make(map[string]bool)
+	for i, c := range readable {
+		if i > 0 && readable[i-1].seg.segmentID == c.seg.segmentID {
+			report.Problemf("%s: duplicate segment id %d", filepath.Base(c.name), c.seg.segmentID)
+			duplicates = append(duplicates, c.name)
+			continue
+		}
+
+		report.Records += len(c.keys)
+		for _, key := range c.keys {
+			seen[key] = true
+		}
+	}
+	report.LiveKeys = len(seen)
+
+	for _, c := range readable {
+		c.seg.Close()
+	}
+
+	if !repair || report.OK() {
+		return report, nil
+	}
+
+	repairs, err := repairSegments(segmentPath, cd, checks, append(orphans, duplicates...), options)
+	if err != nil {
+		return report, err
+	}
+
+	// report the repaired segments
+	report, err = Check(segmentPath, cd, false, options...)
+	if err != nil {
+		return nil, err
+	}
+	report.Repairs = repairs.Repairs
+
+	return report, nil
+}
+
+func repairSegments(segmentPath string, cd codec2.Codec, checks []segmentCheck, stale []string, options []Option) (*common.CheckReport, error) {
+	res := &common.CheckReport{}
+
+	opened := &DefaultManager{}
+	for _, op := range options {
+		op(opened)
+	}
+
+	for _, c := range checks {
+		name := filepath.Base(c.name)
+
+		if c.tornAt >= 0 {
+			err := os.Truncate(c.name, c.tornAt)
+			if err != nil {
+				return nil, err
+			}
+			res.Repairf("%s: truncated to %d bytes", name, c.tornAt)
+
+			c = checkSegmentFile(c.name, cd, opened)
+			if c.seg != nil {
+				c.seg.Close()
+			}
+		}
+
+		if c.err == nil && c.tornAt < 0 {
+			continue
+		}
+
+		err := quarantine(segmentPath, c.name)
+		if err != nil {
+			return nil, err
+		}
+		res.Repairf("%s: unreadable, moved to %s", name, quarantineDir)
+	}
+
+	for _, f := range stale {
+		err := quarantine(segmentPath, f)
+		if err != nil {
+			return nil, err
+		}
+		res.Repairf("%s: stale, moved to %s", filepath.Base(f), quarantineDir)
+	}
+
+	// the remaining segments are the live set of a new manifest
+	err := os.Remove(path.Join(segmentPath, manifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sm, err := NewSegmentManager(segmentPath, repairBufferSize, 0, cd, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := sm.linkList.count()
+	err = sm.Compact()
+	if err != nil {
+		sm.Close()
+		return nil, err
+	}
+	res.Repairf("rewrote %d segments into one", segments)
+
+	return res, sm.Close()
+}
+
+func quarantine(segmentPath, file string) error {
+	dir := path.Join(segmentPath, quarantineDir)
+
+	err := os.MkdirAll(dir, fileMode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file, path.Join(dir, filepath.Base(file)+quarantineExtension))
+}
+
+// checkSegmentFile opens and reads the whole segment, the caller closes the returned segment.
+func checkSegmentFile(name string, cd codec2.Codec, opened *DefaultManager) segmentCheck {
+	file, err := os.OpenFile(name, os.O_RDONLY, fileMode)
+	if err != nil {
+		return segmentCheck{name: name, tornAt: -1, err: fmt.Errorf("open file %s error: %w", name, err)}
+	}
+
+	res := checkSegment(file, cd, opened)
+	if res.seg == nil {
+		file.Close()
+	}
+
+	return res
+}
+
+// checkSegment reads the whole segment in file, which is left open.
+func checkSegment(file *os.File, cd codec2.Codec, opened *DefaultManager) segmentCheck {
+	res := segmentCheck{name: file.Name(), tornAt: -1}
+
+	sg, err := readSegmentHeader(file, opened.keyring)
+	if err != nil {
+		var torn *tornTailError
+		if errors.As(err, &torn) {
+			res.tornAt = torn.offset
+		}
+		res.err = fmt.Errorf("read header of %s error: %w", file.Name(), err)
+
+		return res
+	}
+
+	err = sg.validate(cd.Type())
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	if sg.compressor == nil {
+		res.keys, res.tornAt, err = checkPlainRecords(sg, cd)
+	} else {
+		var decodeErr error
+		err = sg.scanRecords(func(data []byte) bool {
+			var kv domain.KV
+			kv, decodeErr = cd.Decode(data)
+			if decodeErr != nil {
+				return false
+			}
+
+			res.keys = append(res.keys, kv.Key)
+			return true
+		})
+		if err == nil {
+			err = decodeErr
+		}
+	}
+
+	if err == nil && !sg.meta.legacy() && res.tornAt < 0 {
+		err = checkSegmentMeta(sg.meta, res.keys)
+	}
+
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	res.seg = sg
+
+	return res
+}
+
+func checkSegmentMeta(meta segmentMeta, keys []string) error {
+	actual := segmentMeta{}
+	for _, key := range keys {
+		actual.add(key)
+	}
+
+	if actual.count != meta.count {
+		return fmt.Errorf("%d records, header has %d: %w", actual.count, meta.count, ErrSegmentFormat)
+	}
+
+	if actual.minKey != meta.minKey || actual.maxKey != meta.maxKey {
+		return fmt.Errorf("key range [%s, %s], header has [%s, %s]: %w",
+			actual.minKey, actual.maxKey, meta.minKey, meta.maxKey, ErrSegmentFormat)
+	}
+
+	return nil
+}
+
+// checkPlainRecords reads the records of an uncompressed segment from the oldest,
+// undecodable records at the end are a torn tail, in the middle the segment is corrupted.
+func checkPlainRecords(sg *segmentFile, cd codec2.Codec) (keys []string, tornAt int64, err error) {
+	stat, err := sg.Stat()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	data := make([]byte, stat.Size()-sg.dataOffset)
+	_, err = sg.ReadAt(data, sg.dataOffset)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	tornAt = -1
+	var badErr error
+
+	offset := sg.dataOffset
+	lastStart := offset
+	for i, record := range bytes.Split(data, []byte{segmentFileDataDelim}) {
+		if i == 0 {
+			if len(record) != 0 {
+				return nil, -1, fmt.Errorf("no empty line after header: %w", ErrSegmentFormat)
+			}
+			continue
+		}
+
+		// position of the delimiter in front of the record
+		start := offset
+		offset += int64(len(record)) + 1
+		lastStart = start
+
+		if sg.keyring != nil {
+			record, err = sg.keyring.OpenLine(sg.keyID, record)
+		}
+
+		var kv domain.KV
+		if err == nil {
+			kv, err = cd.Decode(record)
+		}
+
+		if err != nil {
+			if tornAt < 0 {
+				tornAt, badErr = start, err
+			}
+			err = nil
+			continue
+		}
+
+		if tornAt >= 0 {
+			return nil, -1, fmt.Errorf("record at offset %d: %w", tornAt, badErr)
+		}
+
+		keys = append(keys, kv.Key)
+	}
+
+	// a record cut in the middle can still be decodable, the header knows the size.
+	// The size is the one of the plain records, a sealed record cut in the middle does not open.
+	if !sg.meta.legacy() && sg.keyring == nil && tornAt < 0 && int64(len(data)) != sg.rawSize {
+		if int64(len(data)) > sg.rawSize {
+			tornAt = sg.dataOffset + sg.rawSize
+		} else if len(keys) > 0 {
+			tornAt = lastStart
+			keys = keys[:len(keys)-1]
+		}
+	}
+
+	// newest first
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+
+	return keys, tornAt, nil
+}
@@ -0,0 +1,288 @@
+package mananger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+// Precedence decides whether ingested segments win over the existing data or not.
+type Precedence string
+
+const (
+	// PrecedenceNewest puts ingested segments on top, they win over every existing version.
+	PrecedenceNewest Precedence = "newest"
+	// PrecedenceOldest puts ingested segments at the bottom, existing versions win over them.
+	PrecedenceOldest Precedence = "oldest"
+
+	// the segmentID of a built segment, the real one is assigned on ingest
+	buildSegmentID = 0
+)
+
+var (
+	ErrIngest     = errors.New("segment cannot be ingested")
+	ErrPrecedence = errors.New("unknown ingest precedence")
+)
+
+func ParsePrecedence(s string) (Precedence, error) {
+	switch Precedence(s) {
+	case PrecedenceNewest, PrecedenceOldest:
+		return Precedence(s), nil
+	default:
+		return "", fmt.Errorf("%s: %w", s, ErrPrecedence)
+	}
+}
+
+// BuildSegment writes the kvs of r sorted by key into a new segment file, for an ingest
+// into a running server by Ingest. Later kvs of r win over earlier ones with the same key.
+// Compression and encryption are taken from options and must match the ones of the
+// server, values are always kept inline. It returns the number of records.
+func BuildSegment(file string, cd codec2.Codec, r common.KVReader, options ...Option) (int, error) {
+	sm := &DefaultManager{codec: cd}
+	for _, op := range options {
+		op(sm)
+	}
+
+	kvs := make([]domain.KV, 0)
+	index := make(map[string]int)
+
+	for {
+		kv, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if kv.Flags&domain.FlagsReserved != 0 {
+			return 0, fmt.Errorf("key %s: reserved flags set: %w", kv.Key, ErrIngest)
+		}
+
+		if i, ok := index[kv.Key]; ok {
+			kvs[i] = kv
+			continue
+		}
+
+		index[kv.Key] = len(kvs)
+		kvs = append(kvs, kv)
+	}
+
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+
+	data := make([]byte, 0)
+	meta := segmentMeta{codec: cd.Type()}
+	for _, kv := range kvs {
+		record, err := cd.Encode(kv)
+		if err != nil {
+			return 0, fmt.Errorf("encode key [%s] error: %w", kv.Key, err)
+		}
+
+		data = append(data, segmentFileDataDelim)
+		data = append(data, record...)
+		meta.add(kv.Key)
+	}
+
+	content, err := encodeSegment(buildSegmentID, meta, data, sm.compressor, sm.keyring)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fileMode)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(file)
+		return 0, err
+	}
+
+	return len(kvs), f.Close()
+}
+
+// Ingest adds the segment files to the live segments by one manifest edit, with segmentIDs
+// above or below the existing ones according to precedence. Among files, a later one wins
+// over an earlier one. The files are checked first and copied, writes wait for the copy.
+// It returns the number of ingested records.
+// Tombstones are dropped by a rewrite of the oldest segment unless WithKeepTombstones,
+// a key deleted before may come back from files ingested with PrecedenceOldest then.
+func (sm *DefaultManager) Ingest(files []string, precedence Precedence) (int, error) {
+	if _, err := ParsePrecedence(string(precedence)); err != nil {
+		return 0, err
+	}
+
+	if len(files) == 0 {
+		return 0, nil
+	}
+
+	// each file is opened once, a file replaced after its check is not copied
+	ingested := make([]*segmentFile, 0, len(files))
+	defer func() {
+		discardSnapshot(ingested)
+	}()
+
+	records := 0
+	for _, f := range files {
+		seg, n, err := sm.checkIngested(f)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", f, err)
+		}
+
+		ingested = append(ingested, seg)
+		records += n
+	}
+
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if precedence == PrecedenceNewest && sm.writeBuffer.Len() > 0 {
+		// writes made before the ingest must not win over it
+		err := sm.doRefresh()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// ingested files are numbered next to the existing segments, the last file the newest
+	ids := make([]int, len(files))
+	for i := range files {
+		if precedence == PrecedenceOldest && sm.linkList.count() > 0 {
+			ids[len(files)-1-i] = sm.linkList.minID() - 1 - i
+		} else {
+			ids[i] = sm.linkList.maxID() + 1 + i
+		}
+	}
+
+	newSegments := make([]*segmentFile, 0, sm.linkList.count()+len(files))
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		newSegments = append(newSegments, iter.next())
+	}
+
+	added := make([]*segmentFile, 0, len(files))
+	for i, f := range files {
+		seg, err := sm.copyIngested(ingested[i], ids[i])
+		if err != nil {
+			discardSegments(added...)
+			return 0, fmt.Errorf("%s: %w", f, err)
+		}
+
+		added = append(added, seg)
+	}
+
+	err := sm.replaceSegments(append(newSegments, added...), added, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return records, nil
+}
+
+// checkIngested opens and validates a segment file to ingest, it returns the segment
+// to copy and its number of records.
+func (sm *DefaultManager) checkIngested(file string) (*segmentFile, int, error) {
+	c := checkSegmentFile(file, sm.codec, sm)
+	if c.err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", c.err.Error(), ErrIngest)
+	}
+	if c.tornAt >= 0 {
+		c.seg.Close()
+		return nil, 0, fmt.Errorf("torn tail after offset %d: %w", c.tornAt, ErrIngest)
+	}
+
+	if c.seg.meta.legacy() {
+		c.seg.Close()
+		return nil, 0, fmt.Errorf("legacy segment: %w", ErrIngest)
+	}
+
+	var pointerErr error
+	err := c.seg.scanRecords(func(data []byte) bool {
+		kv, err := sm.codec.Decode(data)
+		if err == nil && kv.Flags&flagValuePointer != 0 {
+			pointerErr = fmt.Errorf("key %s points into a value log: %w", kv.Key, ErrIngest)
+		}
+
+		return pointerErr == nil
+	})
+	if err == nil {
+		err = pointerErr
+	}
+	if err != nil {
+		c.seg.Close()
+		return nil, 0, err
+	}
+
+	return c.seg, len(c.keys), nil
+}
+
+// copyIngested copies the checked segment into the segment path with segmentID in its header.
+func (sm *DefaultManager) copyIngested(in *segmentFile, segmentID int) (*segmentFile, error) {
+	stat, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(in, 0, stat.Size()))
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read header error: %w", err)
+	}
+
+	magic, rest, _ := strings.Cut(strings.TrimSuffix(header, "\n"), headerAttrDelim)
+	version, attrStr, _ := strings.Cut(rest, headerAttrDelim)
+	attrs, err := url.ParseQuery(attrStr)
+	if err != nil || magic != segmentMagic {
+		return nil, ErrSegmentFormat
+	}
+	attrs.Set(headerAttrID, strconv.Itoa(segmentID))
+
+	name := sm.segmentFileFullPath()
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(out, "%s%s%s%s%s\n", segmentMagic, headerAttrDelim, version, headerAttrDelim, attrs.Encode())
+	if err == nil {
+		_, err = io.Copy(out, reader)
+	}
+
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+
+	seg, err := openSegmentFile(name, sm.keyring)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	seg.flushed = false
+
+	return seg, nil
+}
@@ -0,0 +1,207 @@
+package mananger
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+)
+
+// SegmentInfo describes a segment file for inspection.
+type SegmentInfo struct {
+	File        string    `json:"file"`
+	ID          int       `json:"id"`
+	Version     int       `json:"version"`
+	Size        int64     `json:"size"`
+	Records     int       `json:"records"`
+	MinKey      string    `json:"min_key"`
+	MaxKey      string    `json:"max_key"`
+	Codec       string    `json:"codec,omitempty"`
+	Compression string    `json:"compression,omitempty"`
+	KeyID       uint32    `json:"key_id,omitempty"`
+	Created     time.Time `json:"created,omitempty"`
+}
+
+// segmentInfo describes s from its header, the records of a legacy segment are unknown.
+func segmentInfo(s *segmentFile) (SegmentInfo, error) {
+	stat, err := s.Stat()
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	info := SegmentInfo{
+		File:    filepath.Base(s.Name()),
+		ID:      s.segmentID,
+		Version: s.meta.version,
+		Size:    stat.Size(),
+		Records: s.meta.count,
+		MinKey:  s.meta.minKey,
+		MaxKey:  s.meta.maxKey,
+		Codec:   string(s.meta.codec),
+		Created: s.meta.created,
+	}
+
+	if s.compressor != nil {
+		info.Compression = string(s.compressor.Kind())
+	}
+
+	if s.keyring != nil {
+		info.KeyID = s.keyID
+	}
+
+	return info, nil
+}
+
+// Inspector reads the segments of a stopped storage without changing them.
+type Inspector struct {
+	sm *DefaultManager
+}
+
+// Inspect opens the live segments under segmentPath read-only, in the search order of Read.
+func Inspect(segmentPath string, cd codec2.Codec, options ...Option) (*Inspector, error) {
+	sm := &DefaultManager{
+		segmentPath: segmentPath,
+		codec:       cd,
+	}
+
+	for _, op := range options {
+		op(sm)
+	}
+
+	files, err := listSegmentFiles(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	m, exists, err := readManifest(segmentPath)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest error: %w", err)
+	}
+
+	if exists {
+		files = files[:0]
+		for _, e := range m.entries() {
+			files = append(files, filepath.Join(segmentPath, e.File))
+		}
+	}
+
+	if len(files) == 0 {
+		sm.linkList = newLinkListFromSlice(0, 0, nil)
+	} else {
+		sm.linkList, err = openSegmentFiles(files, sm.keyring, cd.Type())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Inspector{sm: sm}, nil
+}
+
+// List returns the segments from the newest to the oldest.
+func (in *Inspector) List() ([]SegmentInfo, error) {
+	res := make([]SegmentInfo, 0, in.sm.linkList.count())
+
+	iter := in.sm.linkList.iterator()
+	for iter.hasNext() {
+		info, err := in.info(iter.next())
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, info)
+	}
+
+	return res, nil
+}
+
+func (in *Inspector) info(s *segmentFile) (SegmentInfo, error) {
+	info, err := segmentInfo(s)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+
+	// a legacy header knows nothing about the records
+	if s.meta.legacy() {
+		meta := segmentMeta{}
+		err = in.scan(s, func(kv domain.KV) error {
+			meta.add(kv.Key)
+			return nil
+		})
+		if err != nil {
+			return SegmentInfo{}, err
+		}
+
+		info.Records, info.MinKey, info.MaxKey = meta.count, meta.minKey, meta.maxKey
+	}
+
+	return info, nil
+}
+
+// Dump calls fn with every record of the segment with the given id or file name,
+// from the newest to the oldest. Values kept in the value log are not resolved.
+func (in *Inspector) Dump(segment string, fn func(kv domain.KV) error) error {
+	iter := in.sm.linkList.iterator()
+	for iter.hasNext() {
+		s := iter.next()
+		if filepath.Base(s.Name()) != segment && fmt.Sprint(s.segmentID) != segment {
+			continue
+		}
+
+		return in.scan(s, fn)
+	}
+
+	return fmt.Errorf("segment %s: %w", segment, ErrNull)
+}
+
+func (in *Inspector) scan(s *segmentFile, fn func(kv domain.KV) error) error {
+	var fnErr error
+
+	err := s.scanRecords(func(data []byte) bool {
+		var kv domain.KV
+		kv, fnErr = in.sm.codec.Decode(data)
+		if fnErr == nil {
+			fnErr = fn(kv)
+		}
+
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// Locate returns the segment holding the winning version of key, searching like Read.
+func (in *Inspector) Locate(key string) (SegmentInfo, domain.KV, error) {
+	iter := in.sm.linkList.iterator()
+	for iter.hasNext() {
+		s := iter.next()
+		kv, _, err := in.sm.loadFromSegment(context.Background(), s, key)
+		if err != nil {
+			continue
+		}
+
+		info, err := in.info(s)
+		return info, kv, err
+	}
+
+	return SegmentInfo{}, domain.KV{Key: key}, ErrNull
+}
+
+// InValueLog reports whether the value of kv is a pointer into the value log.
+func InValueLog(kv domain.KV) bool {
+	return kv.Flags&flagValuePointer != 0
+}
+
+func (in *Inspector) Close() error {
+	iter := in.sm.linkList.iterator()
+	for iter.hasNext() {
+		iter.next().Close()
+	}
+
+	return nil
+}
@@ -1,8 +1,8 @@
 package mananger
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -10,16 +10,20 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
 	"github.com/ForeverSRC/kaeya/pkg/logger"
 	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
 	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/compress"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
 	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -30,27 +34,52 @@ const (
 	segmentFileDataDelim    = '\n'
 
 	fileMode = 0754
+
+	// a read is repeated on the segments swapped by a merge during it
+	readAttempts = 3
 )
 
 var (
-	ErrNull = errors.New("null value")
+	ErrNull = common.ErrNotFound
 )
 
-type segmentFile struct {
-	*os.File
-	segmentID int
-	flushed   bool
-	next      *segmentFile
-	prev      *segmentFile
-}
-
 type Manager interface {
 	Refresh() error
 	Close() error
 	Write(kv domain.KV) error
-	Read(key string) (domain.KV, error)
+	Read(ctx context.Context, key string) (domain.KV, error)
 	Flush() error
 	Merge() error
+	Compact() error
+	SetMergeFloor(size int64)
+	ValueLogGC() error
+	Stats() Stats
+	Segments() []SegmentInfo
+	Checkpoint(segmentDir, valueLogDir string) error
+	Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) error
+	Import(r common.KVReader) (int, error)
+	Ingest(files []string, precedence Precedence) (int, error)
+}
+
+type Stats struct {
+	Segments int
+	// DiskBytes is the size of all segment files
+	DiskBytes int64
+	// RawBytes is the size of their records before compression
+	RawBytes int64
+	// WriteBufferBytes are the bytes written since the last refresh, of WriteBufferCapacity
+	WriteBufferBytes    int64
+	WriteBufferCapacity int64
+	// ReclaimedBytes is the disk space freed by merges and compactions since the start
+	ReclaimedBytes int64
+}
+
+func (s Stats) CompressionRatio() float64 {
+	if s.DiskBytes == 0 {
+		return 1
+	}
+
+	return float64(s.RawBytes) / float64(s.DiskBytes)
 }
 
 type DefaultManager struct {
@@ -61,26 +90,116 @@ type DefaultManager struct {
 
 	writeLock   sync.Mutex
 	writeBuffer *bytes.Buffer
+	writeMeta   segmentMeta
 	mergeBuffer *bytes.Buffer
 
+	// bufferedBytes mirrors writeBuffer.Len() for Stats, which does not wait for the write lock
+	bufferedBytes   int64
+	writeBufferSize int64
+	reclaimedBytes  int64
+
 	linkList *segmentLinkList
+	// listLock guards linkList for the readers without the write lock, which changes it
+	// under both locks
+	listLock sync.RWMutex
+	manifest *manifest
+
+	compressor compress.Compressor
+	keyring    *encryption.Keyring
+
+	valueLogPath        string
+	valueLogThreshold   int64
+	valueLogMaxFileSize int64
+	valueLog            *valueLog
+
+	upgradeLegacy bool
+	// keepTombstones keeps the tombstones in a rewrite of the oldest segment
+	keepTombstones bool
+}
+
+type Option func(sm *DefaultManager)
+
+// WithValueLog stores values larger than threshold in a separate value log
+// under path, segments only keep pointers to them.
+func WithValueLog(path string, threshold, maxFileSize int64) Option {
+	return func(sm *DefaultManager) {
+		sm.valueLogPath = path
+		sm.valueLogThreshold = threshold
+		sm.valueLogMaxFileSize = maxFileSize
+	}
 }
 
-func NewSegmentManager(segmentPath string, writeBufferSize int64, mergeFloor int64, codec codec2.Codec) (*DefaultManager, error) {
+// WithCompression compresses new and merged segments by compressor,
+// segments written with another compression stay readable.
+func WithCompression(compressor compress.Compressor) Option {
+	return func(sm *DefaultManager) {
+		sm.compressor = compressor
+	}
+}
+
+// WithKeyring encrypts new segments and the value log by the current key of keyring,
+// Merge rewrites the segments sealed by older keys.
+func WithKeyring(keyring *encryption.Keyring) Option {
+	return func(sm *DefaultManager) {
+		sm.keyring = keyring
+	}
+}
+
+// WithUpgradeLegacy rewrites the segments in a legacy format into the current format on startup.
+func WithUpgradeLegacy() Option {
+	return func(sm *DefaultManager) {
+		sm.upgradeLegacy = true
+	}
+}
+
+// WithKeepTombstones keeps the tombstones when the oldest segment is rewritten, for
+// segments ingested below the existing ones, which would bring a deleted key back.
+func WithKeepTombstones() Option {
+	return func(sm *DefaultManager) {
+		sm.keepTombstones = true
+	}
+}
+
+func NewSegmentManager(segmentPath string, writeBufferSize int64, mergeFloor int64, codec codec2.Codec, options ...Option) (manager *DefaultManager, err error) {
 	sm := &DefaultManager{
 		segmentPath: segmentPath,
 		codec:       codec,
 		mergeFloor:  mergeFloor,
 	}
 
-	err := sm.initSegmentFiles()
-	if err != nil {
-		return nil, err
+	for _, op := range options {
+		op(sm)
 	}
 
+	sm.writeBufferSize = writeBufferSize
 	sm.writeBuffer = bytes.NewBuffer(make([]byte, 0, writeBufferSize))
 	sm.mergeBuffer = bytes.NewBuffer(make([]byte, 0, writeBufferSize))
 
+	defer func() {
+		if err != nil {
+			sm.closeFiles()
+		}
+	}()
+
+	err = sm.initSegmentFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if sm.upgradeLegacy {
+		_, err = sm.Upgrade()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade legacy segments error: %w", err)
+		}
+	}
+
+	if sm.valueLogPath != "" {
+		sm.valueLog, err = openValueLog(sm.valueLogPath, sm.valueLogThreshold, sm.valueLogMaxFileSize, sm.keyring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return sm, nil
 }
 
@@ -101,10 +220,10 @@ func (sm *DefaultManager) initSegmentFiles() error {
 
 }
 
-func (sm *DefaultManager) getAllSegmentFiles() error {
+func listSegmentFiles(segmentPath string) ([]string, error) {
 	files := make([]string, 0)
 
-	err := filepath.WalkDir(sm.segmentPath, func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(segmentPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -113,10 +232,7 @@ func (sm *DefaultManager) getAllSegmentFiles() error {
 			return nil
 		}
 
-		name := d.Name()
-		strs := strings.Split(name, "_")
-
-		if strs[1] != (segmentFileNamePrefix + segmentFileNameExtension) {
+		if !strings.HasSuffix(d.Name(), segmentFileNameNumDelim+segmentFileNamePrefix+segmentFileNameExtension) {
 			return nil
 		}
 
@@ -127,23 +243,106 @@ func (sm *DefaultManager) getAllSegmentFiles() error {
 	})
 
 	if err != nil {
-		return fmt.Errorf("walk for segemnt error: %w", err)
+		return nil, fmt.Errorf("walk for segemnt error: %w", err)
+	}
+
+	return files, nil
+}
+
+func (sm *DefaultManager) getAllSegmentFiles() error {
+	files, err := listSegmentFiles(sm.segmentPath)
+	if err != nil {
+		return err
+	}
+
+	m, exists, err := openManifest(sm.segmentPath)
+	if err != nil {
+		return fmt.Errorf("open manifest error: %w", err)
 	}
+	sm.manifest = m
+
+	if exists {
+		files, err = sm.liveSegmentFiles(files)
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(files) == 0 {
 		sm.linkList = newLinkListFromSlice(0, 0, nil)
 	} else {
-		linkList, err := openSegmentFiles(files)
+		linkList, err := openSegmentFiles(files, sm.keyring, sm.codec.Type())
 		if err != nil {
 			return err
 		}
 		sm.linkList = linkList
 	}
 
+	if exists {
+		return sm.checkManifest()
+	}
+
+	// a segment path written before the manifest, every segment file is live
+	edit := versionEdit{}
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		edit.Add = append(edit.Add, manifestEntryOf(iter.next()))
+	}
+
+	return sm.manifest.apply(edit)
+}
+
+// liveSegmentFiles returns the files recorded as live by the manifest and removes
+// the orphans, which are left by a refresh or merge interrupted by a crash.
+func (sm *DefaultManager) liveSegmentFiles(files []string) ([]string, error) {
+	found := make(map[string]bool, len(files))
+	for _, f := range files {
+		name := filepath.Base(f)
+		found[name] = true
+
+		if _, ok := sm.manifest.live[name]; ok {
+			continue
+		}
+
+		logger.Logger.Warn().Msgf("remove orphan segment file %s", f)
+		err := os.Remove(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	live := make([]string, 0, len(sm.manifest.live))
+	for _, e := range sm.manifest.entries() {
+		if !found[e.File] {
+			return nil, fmt.Errorf("live segment file %s missing: %w", e.File, ErrManifest)
+		}
+
+		live = append(live, path.Join(sm.segmentPath, e.File))
+	}
+
+	return live, nil
+}
+
+// checkManifest verifies the segmentIDs in the headers against the manifest.
+func (sm *DefaultManager) checkManifest() error {
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		curr := iter.next()
+		name := filepath.Base(curr.Name())
+
+		if id := sm.manifest.live[name]; id != curr.segmentID {
+			return fmt.Errorf("segment file %s has id %d, manifest %d: %w", name, curr.segmentID, id, ErrManifest)
+		}
+	}
+
 	return nil
+}
 
+func manifestEntryOf(s *segmentFile) manifestEntry {
+	return manifestEntry{File: filepath.Base(s.Name()), ID: s.segmentID}
 }
 
-func openSegmentFiles(files []string) (linkList *segmentLinkList, err error) {
+func openSegmentFiles(files []string, keyring *encryption.Keyring, codecType codec2.CodecType) (linkList *segmentLinkList, err error) {
 	sgs := make([]*segmentFile, 0, len(files))
 
 	defer func() {
@@ -155,34 +354,18 @@ func openSegmentFiles(files []string) (linkList *segmentLinkList, err error) {
 	}()
 
 	for _, fName := range files {
-
-		file, err := os.OpenFile(fName, os.O_RDONLY, fileMode)
+		sg, err := openSegmentFile(fName, keyring)
 		if err != nil {
-			file.Close()
-			return nil, fmt.Errorf("open file %s error: %w", fName, err)
+			return nil, err
 		}
 
-		reader := bufio.NewReader(file)
-		l, _, err := reader.ReadLine()
-		if err != nil {
-			file.Close()
-			return nil, fmt.Errorf("read segmentID error: %w", err)
-		}
+		sgs = append(sgs, sg)
 
-		id, err := strconv.Atoi(string(l))
+		err = sg.validate(codecType)
 		if err != nil {
-			file.Close()
-			return nil, fmt.Errorf("convert segmentID error: %w", err)
-		}
-
-		sg := &segmentFile{
-			segmentID: id,
-			File:      file,
-			flushed:   true,
+			return nil, fmt.Errorf("segment %s: %w", fName, err)
 		}
 
-		sgs = append(sgs, sg)
-
 	}
 
 	sort.Slice(sgs, func(i, j int) bool {
@@ -203,6 +386,20 @@ func (sm *DefaultManager) Write(kv domain.KV) error {
 	sm.writeLock.Lock()
 	defer sm.writeLock.Unlock()
 
+	if sm.valueLog != nil && sm.valueLog.needSeparate(kv.Value) {
+		vp, err := sm.valueLog.append(kv.Key, kv.Value)
+		if err != nil {
+			return err
+		}
+
+		kv.Value = vp.encode()
+		kv.Flags |= flagValuePointer
+	}
+
+	return sm.doWrite(kv)
+}
+
+func (sm *DefaultManager) doWrite(kv domain.KV) error {
 	data, err := sm.codec.Encode(kv)
 	if err != nil {
 		return err
@@ -219,21 +416,40 @@ func (sm *DefaultManager) Write(kv domain.KV) error {
 	}
 
 	_, err = sm.writeBuffer.Write(data)
-	return err
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&sm.bufferedBytes, int64(sm.writeBuffer.Len()))
+
+	sm.writeMeta.add(kv.Key)
+
+	return nil
 }
 
 func (sm *DefaultManager) Close() error {
 	sm.Refresh()
 	sm.Flush()
+	sm.closeFiles()
 
-	iter := sm.linkList.iterator()
+	return nil
+}
 
-	for iter.hasNext() {
-		curr := iter.next()
-		curr.Close()
+// closeFiles closes the files opened so far, also by a NewSegmentManager which failed.
+func (sm *DefaultManager) closeFiles() {
+	if sm.linkList != nil {
+		iter := sm.linkList.iterator()
+		for iter.hasNext() {
+			iter.next().Close()
+		}
 	}
 
-	return nil
+	if sm.valueLog != nil {
+		sm.valueLog.close()
+	}
+
+	if sm.manifest != nil {
+		sm.manifest.close()
+	}
 }
 
 func (sm *DefaultManager) Refresh() error {
@@ -247,67 +463,157 @@ func (sm *DefaultManager) Refresh() error {
 	return sm.doRefresh()
 }
 
+// doRefresh writes the write buffer into a new segment, which newSegmentFile makes durable
+// before the manifest refers to it.
 func (sm *DefaultManager) doRefresh() error {
 	newSegID := sm.linkList.maxID() + 1
 
-	newSeg, err := newSegmentFile(sm.segmentFileFullPath(), newSegID, sm.writeBuffer.Bytes())
+	meta := sm.writeMeta
+	meta.codec = sm.codec.Type()
+
+	if sm.valueLog != nil {
+		// pointers must not become durable before their values
+		err := sm.valueLog.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	newSeg, err := newSegmentFile(sm.segmentFileFullPath(), newSegID, meta, sm.writeBuffer.Bytes(), sm.compressor, sm.keyring)
+	if err != nil {
+		return err
+	}
+
+	if newSeg.compressor != nil {
+		if stat, err := newSeg.Stat(); err == nil {
+			logger.Logger.Debug().Msgf("segment %d: %d bytes compressed to %d bytes", newSegID, newSeg.rawSize, stat.Size())
+		}
+	}
+
+	err = sm.manifest.apply(versionEdit{Add: []manifestEntry{manifestEntryOf(newSeg)}})
 	if err != nil {
+		discardSegments(newSeg)
 		return err
 	}
 
 	sm.writeBuffer.Reset()
+	sm.writeMeta = segmentMeta{}
+	atomic.StoreInt64(&sm.bufferedBytes, 0)
 
-	sm.linkList.addToHead(newSeg)
+	sm.addSegment(newSeg)
 
 	return nil
 }
 
+// addSegment makes seg the newest segment, under the write lock.
+func (sm *DefaultManager) addSegment(seg *segmentFile) {
+	sm.listLock.Lock()
+	defer sm.listLock.Unlock()
+
+	sm.linkList.addToHead(seg)
+}
+
+// liveSegments returns the segments from the newest. A merge may close some of them
+// meanwhile, their reads fail with os.ErrClosed.
+func (sm *DefaultManager) liveSegments() []*segmentFile {
+	sm.listLock.RLock()
+	defer sm.listLock.RUnlock()
+
+	res := make([]*segmentFile, 0, sm.linkList.count())
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		res = append(res, iter.next())
+	}
+
+	return res
+}
+
 func (sm *DefaultManager) segmentFileFullPath() string {
 	return path.Join(sm.segmentPath, getSegmentFileName())
 }
 
-func newSegmentFile(filePath string, segmentID int, data []byte) (*segmentFile, error) {
-	newFile, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, fileMode)
+func (sm *DefaultManager) Read(ctx context.Context, key string) (kv domain.KV, err error) {
+	_, span := tracing.Start(ctx, "DefaultManager.Read")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	kv, stats, err := sm.readRaw(ctx, key)
+	span.SetAttributes(
+		attribute.Int("kaeya.segments_scanned", stats.segments),
+		attribute.Int64("kaeya.bytes_read", stats.bytes),
+	)
 	if err != nil {
-		return nil, err
+		return kv, err
 	}
 
-	metadata := []byte(fmt.Sprintf("%d\n", segmentID))
-	content := append(metadata, data...)
+	if kv.Flags&flagValuePointer != 0 {
+		span.SetAttributes(attribute.Bool("kaeya.value_log", true))
+	}
 
-	_, err = newFile.Write(content)
-	if err != nil {
-		return nil, err
+	return sm.resolveValue(kv)
+}
+
+// resolveValue replaces a pointer into the value log by the value it points to.
+func (sm *DefaultManager) resolveValue(kv domain.KV) (domain.KV, error) {
+	if kv.Flags&flagValuePointer == 0 {
+		return kv, nil
 	}
 
-	err = newFile.Close()
-	if err != nil {
-		return nil, err
+	key := kv.Key
+
+	vp, err := decodeValuePointer(kv.Value)
+	if err != nil || sm.valueLog == nil {
+		return domain.KV{Key: key}, fmt.Errorf("resolve value of %s: %w", key, ErrValuePointer)
 	}
 
-	// read only
-	newFile, err = os.Open(newFile.Name())
+	kv.Value, err = sm.valueLog.read(key, vp)
 	if err != nil {
-		return nil, fmt.Errorf("open new segment file error: %w", err)
+		return domain.KV{Key: key}, err
 	}
 
-	newSeg := &segmentFile{
-		File:      newFile,
-		segmentID: segmentID,
-		flushed:   false,
-	}
+	kv.Flags &^= flagValuePointer
 
-	return newSeg, nil
+	return kv, nil
+}
 
+// readStats is the work done by a read, the segments searched and the record bytes decoded.
+type readStats struct {
+	segments int
+	bytes    int64
 }
 
-func (sm *DefaultManager) Read(key string) (domain.KV, error) {
-	iter := sm.linkList.iterator()
+// readRaw returns the newest record of key as stored in the segments,
+// without resolving value pointers.
+func (sm *DefaultManager) readRaw(ctx context.Context, key string) (domain.KV, readStats, error) {
+	var stats readStats
+
+	for i := 1; ; i++ {
+		kv, err := sm.readSegments(ctx, key, &stats)
+		// a segment replaced by a merge, the merged one has the key. Closed for good
+		// once the manager is.
+		if !errors.Is(err, os.ErrClosed) || i == readAttempts {
+			return kv, stats, err
+		}
+	}
+}
 
-	for iter.hasNext() {
-		curr := iter.next()
-		kv, err := sm.loadFromFile(curr.File, key)
+func (sm *DefaultManager) readSegments(ctx context.Context, key string, stats *readStats) (domain.KV, error) {
+	for _, curr := range sm.liveSegments() {
+		if err := ctx.Err(); err != nil {
+			return domain.KV{Key: key}, err
+		}
+
+		kv, n, err := sm.loadFromSegment(ctx, curr, key)
+		stats.segments++
+		stats.bytes += n
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return domain.KV{Key: key}, ctxErr
+			}
+			if errors.Is(err, os.ErrClosed) {
+				return domain.KV{Key: key}, err
+			}
 			continue
 		}
 
@@ -317,67 +623,193 @@ func (sm *DefaultManager) Read(key string) (domain.KV, error) {
 	return domain.KV{Key: key}, ErrNull
 }
 
-func (sm *DefaultManager) loadFromFile(file *os.File, key string) (domain.KV, error) {
+// loadFromSegment returns the record of key in segment and the record bytes scanned for it.
+func (sm *DefaultManager) loadFromSegment(ctx context.Context, segment *segmentFile, key string) (domain.KV, int64, error) {
 	res := domain.KV{
 		Key: key,
 	}
 
-	var offset int64 = -1
+	var found bool
+	var decodeErr error
+	var n int64
+	records := 0
 
-	for {
-		data, newOffset, err := common.ReadLineFromTail(file, offset, segmentFileDataDelim)
-		if err != nil {
-			switch {
-			case errors.Is(err, common.ErrEnd):
-				return res, ErrNull
-			case errors.Is(err, common.ErrEmptyLine):
-				offset = newOffset
-				continue
-			default:
-				return res, err
+	err := segment.scanRecords(func(data []byte) bool {
+		records++
+		if records%common.CancelCheckInterval == 0 {
+			if decodeErr = ctx.Err(); decodeErr != nil {
+				return false
 			}
 		}
 
+		n += int64(len(data))
 		kv, err := sm.codec.Decode(data)
 		if err != nil {
-			return res, err
+			decodeErr = err
+			return false
 		}
 
 		if kv.Key == key {
-			return kv, nil
+			res, found = kv, true
+			return false
 		}
 
-		offset = newOffset
+		return true
+	})
+
+	switch {
+	case err != nil:
+		return res, n, err
+	case decodeErr != nil:
+		return res, n, decodeErr
+	case !found:
+		return res, n, ErrNull
+	default:
+		return res, n, nil
 	}
 }
 
 func (sm *DefaultManager) Flush() error {
-	iter := sm.linkList.iterator()
+	if sm.valueLog != nil {
+		err := sm.valueLog.sync()
+		if err != nil {
+			return err
+		}
+	}
 
-	for iter.hasNext() {
-		curr := iter.next()
+	for _, curr := range sm.liveSegments() {
 		err := curr.Sync()
+		// a segment replaced by a merge meanwhile, the merged one is synced
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type valueLogEntry struct {
+	kv domain.KV
+	vp valuePointer
+}
+
+// ValueLogGC collects the oldest sealed value log file of which enough is garbage:
+// values still referenced by the segments are appended to the active file again
+// and the old file is removed. The files with too many live values are skipped.
+func (sm *DefaultManager) ValueLogGC() error {
+	if sm.valueLog == nil {
+		return nil
+	}
+
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	files := sm.valueLog.sealed()
+	if len(files) == 0 {
+		return nil
+	}
+
+	// all newer versions must be visible to readRaw
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
 		if err != nil {
 			return err
+		}
+	}
 
+	for _, file := range files {
+		live, liveSize, err := sm.liveValues(file)
+		if err != nil {
+			return err
+		}
+
+		if file.size > 0 && float64(liveSize)/float64(file.size) > 1-valueLogGCRatio {
+			continue
 		}
+
+		return sm.collectValueLog(file, live, liveSize)
 	}
 
 	return nil
 }
 
+// liveValues returns the entries of file which the segments still point to, with their values opened.
+func (sm *DefaultManager) liveValues(file *valueLogFile) ([]valueLogEntry, int64, error) {
+	live := make([]valueLogEntry, 0)
+	var liveSize int64
+
+	err := sm.valueLog.iterate(file, func(key string, vp valuePointer) error {
+		kv, _, err := sm.readRaw(context.Background(), key)
+		if err != nil || kv.Flags&flagValuePointer == 0 {
+			return nil
+		}
+
+		curr, err := decodeValuePointer(kv.Value)
+		if err != nil || curr.fileID != vp.fileID || curr.offset != vp.offset {
+			return nil
+		}
+
+		value, err := sm.valueLog.read(key, curr)
+		if err != nil {
+			return err
+		}
+
+		kv.Value = value
+		live = append(live, valueLogEntry{kv: kv, vp: vp})
+		liveSize += vp.length
+
+		return nil
+	})
+
+	return live, liveSize, err
+}
+
+// collectValueLog relocates the live entries of file and removes it.
+func (sm *DefaultManager) collectValueLog(file *valueLogFile, live []valueLogEntry, liveSize int64) error {
+	for _, e := range live {
+		vp, err := sm.valueLog.append(e.kv.Key, e.kv.Value)
+		if err != nil {
+			return err
+		}
+
+		e.kv.Value = vp.encode()
+		err = sm.doWrite(e.kv)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	// relocated values and pointers must be durable before the old file is gone
+	err := sm.Flush()
+	if err != nil {
+		return err
+	}
+
+	logger.Logger.Debug().Msgf("value log gc: relocated %d values, reclaimed %d bytes", len(live), file.size-liveSize)
+
+	return sm.valueLog.remove(file.id)
+}
+
 func (sm *DefaultManager) Merge() error {
 	sm.writeLock.Lock()
 	defer sm.writeLock.Unlock()
 
 	count := sm.linkList.count()
-	if count <= 1 {
+	if count == 0 {
 		return nil
 	}
 
 	states := make([]bool, 0, count)
 	segs := make([]segmentFile, 0, count)
 	canDoMerge := false
+	needReseal := false
 
 	iter := sm.linkList.iterator()
 	for iter.hasNext() {
@@ -391,17 +823,19 @@ func (sm *DefaultManager) Merge() error {
 			canMerge = stat.Size() <= sm.mergeFloor
 		}
 
-		canDoMerge = canDoMerge || canMerge
+		canDoMerge = canDoMerge || (canMerge && count > 1)
+		needReseal = needReseal || sm.needReseal(s)
 		states = append(states, canMerge)
 		segs = append(segs, *s)
 	}
 
-	if !canDoMerge {
-		return nil
+	if !canDoMerge && !needReseal {
+		return sm.resealValueLog()
 	}
 
 	newSegments := make([]*segmentFile, 0, count/2)
 	needDeleted := make([]segmentFile, 0, count/2)
+	added := make([]*segmentFile, 0, count/2)
 
 	for i := 0; i < count; {
 		if i == count-1 {
@@ -411,10 +845,12 @@ func (sm *DefaultManager) Merge() error {
 
 		if states[i] {
 			if states[i+1] {
-				merged, err := sm.doMerge(segs[i], segs[i+1])
+				merged, err := sm.doMerge(segs[i], segs[i+1], i+1 == count-1)
 				if err != nil {
+					discardSegments(added...)
 					return err
 				}
+				added = append(added, merged)
 				newSegments = append(newSegments, merged)
 				needDeleted = append(needDeleted, segs[i], segs[i+1])
 			} else {
@@ -427,13 +863,254 @@ func (sm *DefaultManager) Merge() error {
 		}
 	}
 
+	// re-encryption pass, segments not merged above are rewritten under the current key
+	for i, s := range newSegments {
+		if !sm.needReseal(s) {
+			continue
+		}
+
+		rewritten, err := sm.rewrite(s.segmentID, i == len(newSegments)-1, *s)
+		if err != nil {
+			discardSegments(added...)
+			return err
+		}
+
+		added = append(added, rewritten)
+		newSegments[i] = rewritten
+		needDeleted = append(needDeleted, *s)
+	}
+
+	err := sm.replaceSegments(newSegments, added, needDeleted)
+	if err != nil {
+		return err
+	}
+
+	return sm.resealValueLog()
+}
+
+// resealValueLog rewrites the live values of the value log files with entries not sealed
+// by the current key, so a retired key is not needed anymore once the merge is done.
+func (sm *DefaultManager) resealValueLog() error {
+	if sm.valueLog == nil || sm.keyring == nil {
+		return nil
+	}
+
+	files, err := sm.valueLog.staleFiles()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	// all newer versions must be visible to readRaw
+	if sm.writeBuffer.Len() > 0 {
+		err = sm.doRefresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		live, liveSize, err := sm.liveValues(file)
+		if err != nil {
+			return err
+		}
+
+		err = sm.collectValueLog(file, live, liveSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetMergeFloor changes the size under which segments are merged, from the next merge on.
+func (sm *DefaultManager) SetMergeFloor(size int64) {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	sm.mergeFloor = size
+}
+
+// Checkpoint makes a consistent snapshot in segmentDir and valueLogDir while writes wait:
+// the write buffer is refreshed into a segment, the immutable segment files are hard linked
+// next to a manifest of them, and the value log is linked up to its current size.
+func (sm *DefaultManager) Checkpoint(segmentDir, valueLogDir string) error {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := sm.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(segmentDir, fileMode)
+	if err != nil {
+		return err
+	}
+
+	edit := versionEdit{}
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		curr := iter.next()
+		entry := manifestEntryOf(curr)
+
+		err = utils.LinkOrCopy(curr.Name(), path.Join(segmentDir, entry.File))
+		if err != nil {
+			return fmt.Errorf("checkpoint segment %s error: %w", entry.File, err)
+		}
+
+		edit.Add = append(edit.Add, entry)
+	}
+
+	line, err := encodeVersionEdit(edit)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path.Join(segmentDir, manifestFileName), line, fileMode)
+	if err != nil {
+		return err
+	}
+
+	if sm.valueLog == nil {
+		return nil
+	}
+
+	return sm.valueLog.checkpoint(valueLogDir)
+}
+
+// Compact rewrites all segments, the write buffer included, into a single one holding
+// the newest version of every key. Tombstones are dropped unless WithKeepTombstones.
+func (sm *DefaultManager) Compact() error {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if sm.writeBuffer.Len() > 0 {
+		err := sm.doRefresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	if sm.linkList.count() == 0 {
+		return nil
+	}
+
+	segs := make([]segmentFile, 0, sm.linkList.count())
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		segs = append(segs, *iter.next())
+	}
+
+	compacted, err := sm.rewrite(sm.linkList.maxID(), true, segs...)
+	if err != nil {
+		return err
+	}
+
+	return sm.replaceSegments([]*segmentFile{compacted}, []*segmentFile{compacted}, segs)
+}
+
+// Upgrade rewrites every segment in a legacy format into the current format
+// and returns the number of rewritten segments.
+func (sm *DefaultManager) Upgrade() (int, error) {
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	count := sm.linkList.count()
+	if count == 0 {
+		return 0, nil
+	}
+
+	newSegments := make([]*segmentFile, 0, count)
+	needDeleted := make([]segmentFile, 0)
+	added := make([]*segmentFile, 0)
+
+	iter := sm.linkList.iterator()
+	for iter.hasNext() {
+		s := iter.next()
+		if !s.meta.legacy() {
+			newSegments = append(newSegments, s)
+			continue
+		}
+
+		upgraded, err := sm.rewrite(s.segmentID, false, *s)
+		if err != nil {
+			discardSegments(added...)
+			return 0, err
+		}
+
+		added = append(added, upgraded)
+		newSegments = append(newSegments, upgraded)
+		needDeleted = append(needDeleted, *s)
+	}
+
+	if len(needDeleted) == 0 {
+		return 0, nil
+	}
+
+	err := sm.replaceSegments(newSegments, added, needDeleted)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Logger.Info().Msgf("upgraded %d legacy segments in %s", len(needDeleted), sm.segmentPath)
+
+	return len(needDeleted), nil
+}
+
+// replaceSegments makes newSegments the segments of sm and removes the files of needDeleted.
+// The added segments are synced and swapped with needDeleted in the manifest by one
+// edit, a crash at any point leaves either the old or the new segment set.
+func (sm *DefaultManager) replaceSegments(newSegments, added []*segmentFile, needDeleted []segmentFile) error {
+	edit := versionEdit{}
+	for _, s := range added {
+		err := s.Sync()
+		if err != nil {
+			discardSegments(added...)
+			return err
+		}
+		s.flushed = true
+
+		edit.Add = append(edit.Add, manifestEntryOf(s))
+	}
+
+	var reclaimed int64
+	for _, s := range needDeleted {
+		edit.Delete = append(edit.Delete, filepath.Base(s.Name()))
+		if stat, err := s.Stat(); err == nil {
+			reclaimed += stat.Size()
+		}
+	}
+	for _, s := range added {
+		if stat, err := s.Stat(); err == nil {
+			reclaimed -= stat.Size()
+		}
+	}
+
+	err := sm.manifest.apply(edit)
+	if err != nil {
+		discardSegments(added...)
+		return err
+	}
+
 	sort.Slice(newSegments, func(i, j int) bool {
 		return newSegments[i].segmentID > newSegments[j].segmentID
 	})
 
-	newList := newLinkListFromSlice(newSegments[0].segmentID, newSegments[len(newSegments)-1].segmentID, newSegments)
+	sm.listLock.Lock()
+	sm.linkList = newLinkListFromSlice(newSegments[0].segmentID, newSegments[len(newSegments)-1].segmentID, newSegments)
+	sm.listLock.Unlock()
 
-	sm.linkList = newList
+	if reclaimed > 0 {
+		atomic.AddInt64(&sm.reclaimedBytes, reclaimed)
+	}
 
 	// remove segments
 	for _, s := range needDeleted {
@@ -448,34 +1125,67 @@ func (sm *DefaultManager) Merge() error {
 	}
 
 	return nil
+}
 
+// discardSegments closes and removes segments which never got into the manifest.
+func discardSegments(segments ...*segmentFile) {
+	for _, s := range segments {
+		s.Close()
+
+		err := os.Remove(s.Name())
+		if err != nil {
+			logger.Logger.Warn().Err(err).Msgf("remove file %s failed", s.Name())
+		}
+	}
 }
 
-func (sm *DefaultManager) doMerge(prev, next segmentFile) (*segmentFile, error) {
-	prevData, err := sm.readAllData(prev)
-	if err != nil {
-		return nil, err
+// needReseal reports whether s is not sealed by the current key.
+func (sm *DefaultManager) needReseal(s *segmentFile) bool {
+	if sm.keyring == nil {
+		return false
 	}
 
-	nextData, err := sm.readAllData(next)
-	if err != nil {
-		return nil, err
+	return s.keyring == nil || s.keyID != sm.keyring.CurrentKeyID()
+}
+
+func (sm *DefaultManager) doMerge(prev, next segmentFile, oldest bool) (*segmentFile, error) {
+	return sm.rewrite(next.segmentID, oldest, prev, next)
+}
+
+// rewrite writes the newest version of every key in segments, ordered from
+// the newest to the oldest, into a new segment with segmentID. Nothing older
+// is left to shadow if oldest is set, the tombstones are dropped then.
+func (sm *DefaultManager) rewrite(segmentID int, oldest bool, segments ...segmentFile) (*segmentFile, error) {
+	tmpMerged := make([]domain.KV, 0)
+	for _, s := range segments {
+		data, err := sm.readAllData(s)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpMerged = append(tmpMerged, data...)
 	}
 
-	tmpMerged := append(prevData, nextData...)
-	res := make([]domain.KV, 0, len(prevData)+len(nextData))
-	hash := make(map[string]bool, len(prevData)+len(nextData))
+	res := make([]domain.KV, 0, len(tmpMerged))
+	hash := make(map[string]bool, len(tmpMerged))
 
+	dropTombstones := oldest && !sm.keepTombstones
 	for _, kv := range tmpMerged {
-		if !hash[kv.Key] {
+		if hash[kv.Key] {
+			continue
+		}
+
+		hash[kv.Key] = true
+		if !dropTombstones || !kv.IsTombstone() {
 			res = append(res, kv)
-			hash[kv.Key] = true
 		}
 	}
 
 	// guarantee empty
 	sm.mergeBuffer.Reset()
 
+	meta := segmentMeta{codec: sm.codec.Type()}
+
 	for i := len(res) - 1; i >= 0; i-- {
 		data, err := sm.codec.Encode(res[i])
 		if err != nil {
@@ -485,9 +1195,10 @@ func (sm *DefaultManager) doMerge(prev, next segmentFile) (*segmentFile, error)
 
 		data = append([]byte{segmentFileDataDelim}, data...)
 		sm.mergeBuffer.Write(data)
+		meta.add(res[i].Key)
 	}
 
-	seg, err := newSegmentFile(sm.segmentFileFullPath(), next.segmentID, sm.mergeBuffer.Bytes())
+	seg, err := newSegmentFile(sm.segmentFileFullPath(), segmentID, meta, sm.mergeBuffer.Bytes(), sm.compressor, sm.keyring)
 	// guarantee empty
 	sm.mergeBuffer.Reset()
 
@@ -501,28 +1212,58 @@ func (sm *DefaultManager) doMerge(prev, next segmentFile) (*segmentFile, error)
 
 func (sm *DefaultManager) readAllData(segment segmentFile) ([]domain.KV, error) {
 	res := make([]domain.KV, 0, 10)
-	var offset int64 = -1
-
-	for {
-		data, newOffset, err := common.ReadLineFromTail(segment.File, offset, segmentFileDataDelim)
-		if err != nil {
-			switch {
-			case errors.Is(err, common.ErrEnd):
-				return res, nil
-			case errors.Is(err, common.ErrEmptyLine):
-				return res, nil
-			default:
-				return nil, err
-			}
-		}
 
+	err := segment.scanRecords(func(data []byte) bool {
 		kv, err := sm.codec.Decode(data)
 		if err != nil {
 			logger.Logger.Error().Err(err).Msg("decode error, discard")
-			continue
+			return true
 		}
 		res = append(res, kv)
 
-		offset = newOffset
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (sm *DefaultManager) Stats() Stats {
+	stats := Stats{
+		WriteBufferBytes:    atomic.LoadInt64(&sm.bufferedBytes),
+		WriteBufferCapacity: sm.writeBufferSize,
+		ReclaimedBytes:      atomic.LoadInt64(&sm.reclaimedBytes),
 	}
+
+	for _, curr := range sm.liveSegments() {
+		stat, err := curr.Stat()
+		if err != nil {
+			continue
+		}
+
+		stats.Segments++
+		stats.DiskBytes += stat.Size()
+		stats.RawBytes += curr.rawSize + curr.dataOffset
+	}
+
+	return stats
+}
+
+// Segments describes the live segments of a running manager from the newest to the oldest,
+// the records of legacy segments are not counted.
+func (sm *DefaultManager) Segments() []SegmentInfo {
+	res := make([]SegmentInfo, 0)
+
+	for _, curr := range sm.liveSegments() {
+		info, err := segmentInfo(curr)
+		if err != nil {
+			continue
+		}
+
+		res = append(res, info)
+	}
+
+	return res
 }
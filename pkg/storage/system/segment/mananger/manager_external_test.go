@@ -1,11 +1,19 @@
 package mananger_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
 	"path"
+	"path/filepath"
 	"testing"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
 	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/compress"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
 	"github.com/ForeverSRC/kaeya/pkg/utils"
 	"github.com/stretchr/testify/assert"
@@ -19,9 +27,9 @@ func TestSegmentNormal(t *testing.T) {
 		{
 			name: "normal",
 			values: []domain.KV{
-				{"aaa", "1"},
-				{"bb", "abdgeg"},
-				{"ccccc", "100"},
+				{Key: "aaa", Value: []byte("1")},
+				{Key: "bb", Value: []byte("abdgeg")},
+				{Key: "ccccc", Value: []byte("100")},
 			},
 		},
 	}
@@ -42,7 +50,7 @@ func TestSegmentNormal(t *testing.T) {
 			assert.NoError(t, err)
 
 			for _, kv := range c.values {
-				res, err := manager.Read(kv.Key)
+				res, err := manager.Read(context.Background(), kv.Key)
 				assert.NoError(t, err)
 				assert.Equal(t, kv, res)
 			}
@@ -59,32 +67,863 @@ func TestReadFromMultiSegment(t *testing.T) {
 		err error
 	}{
 		{
-			kv:  domain.KV{"aaa", "1"},
+			kv:  domain.KV{Key: "aaa", Value: []byte("1")},
 			err: nil,
 		},
 		{
-			kv:  domain.KV{"bb", "abdgeg"},
+			kv:  domain.KV{Key: "bb", Value: []byte("abdgeg")},
 			err: nil,
 		},
 		{
-			kv:  domain.KV{"ccccc", "100"},
+			kv:  domain.KV{Key: "ccccc", Value: []byte("100")},
 			err: nil,
 		},
 		{
-			kv:  domain.KV{"not-exist", ""},
+			kv:  domain.KV{Key: "not-exist"},
 			err: mananger.ErrNull,
 		},
 	}
 
-	rootPath := path.Join("testdata", "static", "segments")
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
 	manager, err := mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewStringCodec())
 	assert.NoError(t, err)
 	defer manager.Close()
 
 	for _, c := range cases {
-		res, err := manager.Read(c.kv.Key)
+		res, err := manager.Read(context.Background(), c.kv.Key)
 		assert.Equal(t, c.err, err)
 		assert.Equal(t, c.kv, res)
 	}
 
 }
+
+func TestOpenFailedClosesFiles(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files not listed")
+	}
+
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
+	// a value log path which is a file cannot be opened
+	vlogPath := path.Join(rootPath, "vlog")
+	assert.NoError(t, os.WriteFile(vlogPath, nil, 0644))
+
+	_, err = mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewStringCodec(), mananger.WithValueLog(vlogPath, 16, 600))
+	assert.Error(t, err)
+
+	// the manifest and the segments opened before are closed
+	after, err := os.ReadDir("/proc/self/fd")
+	assert.NoError(t, err)
+	assert.Equal(t, len(fds), len(after))
+}
+
+func TestValueLog(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	vlogPath := path.Join(rootPath, "vlog")
+
+	manager, err := mananger.NewSegmentManager(
+		path.Join(rootPath, "segments"), 1024, 1024, codec.NewBinaryCodec(),
+		mananger.WithValueLog(vlogPath, 16, 600),
+	)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	large := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 200)
+	}
+
+	values := []domain.KV{
+		{Key: "a", Value: large('1'), ContentType: "text/plain"},
+		{Key: "b", Value: large('2'), Flags: 3},
+		{Key: "a", Value: large('3')},
+		{Key: "small", Value: []byte("inline")},
+		// the first value log file is full, this goes to the second one
+		{Key: "a", Value: large('4')},
+	}
+
+	for _, kv := range values {
+		assert.NoError(t, manager.Write(kv))
+	}
+	assert.NoError(t, manager.Refresh())
+
+	expected := []domain.KV{values[1], values[3], values[4]}
+	for _, kv := range expected {
+		res, err := manager.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv, res)
+	}
+
+	files, err := os.ReadDir(vlogPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// only "b" is alive in the first file, it is moved and the file removed
+	assert.NoError(t, manager.ValueLogGC())
+
+	files, err = os.ReadDir(vlogPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	for _, kv := range expected {
+		res, err := manager.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv, res)
+	}
+}
+
+func TestValueLogGCSkipsLiveFiles(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	vlogPath := path.Join(rootPath, "vlog")
+
+	manager, err := mananger.NewSegmentManager(
+		path.Join(rootPath, "segments"), 1024, 1024, codec.NewBinaryCodec(),
+		mananger.WithValueLog(vlogPath, 16, 600),
+	)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	large := bytes.Repeat([]byte{'x'}, 200)
+
+	// three entries fill a file: the first one stays alive, the second one is garbage
+	for _, key := range []string{"b", "c", "d", "a", "a", "a", "a"} {
+		assert.NoError(t, manager.Write(domain.KV{Key: key, Value: large}))
+		assert.NoError(t, manager.Refresh())
+	}
+
+	assert.NoError(t, manager.ValueLogGC())
+
+	files, err := filepath.Glob(path.Join(vlogPath, "*.vlog"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(vlogPath, "1.vlog"), path.Join(vlogPath, "3.vlog")}, files)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, large, kv.Value)
+	}
+}
+
+func TestValueLogTornTail(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	segmentPath, vlogPath := path.Join(rootPath, "segments"), path.Join(rootPath, "vlog")
+
+	open := func() *mananger.DefaultManager {
+		manager, err := mananger.NewSegmentManager(segmentPath, 1024, 1024, codec.NewBinaryCodec(), mananger.WithValueLog(vlogPath, 16, 300))
+		assert.NoError(t, err)
+		return manager
+	}
+
+	large := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 200)
+	}
+
+	manager := open()
+	assert.NoError(t, manager.Write(domain.KV{Key: "a", Value: large('1')}))
+	assert.NoError(t, manager.Refresh())
+	assert.NoError(t, manager.Close())
+
+	// a crash in the middle of an append
+	f, err := os.OpenFile(path.Join(vlogPath, "1.vlog"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 1, 0, 0, 0, 200, 'b', '2'})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	manager = open()
+	defer manager.Close()
+
+	// b is appended to the first file, the new a to the second one
+	assert.NoError(t, manager.Write(domain.KV{Key: "b", Value: large('3')}))
+	assert.NoError(t, manager.Write(domain.KV{Key: "a", Value: large('4')}))
+	assert.NoError(t, manager.Refresh())
+
+	// the gc iterates the entries of the first file
+	assert.NoError(t, manager.ValueLogGC())
+	assert.NoFileExists(t, path.Join(vlogPath, "1.vlog"))
+
+	for key, value := range map[string][]byte{"a": large('4'), "b": large('3')} {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, value, kv.Value)
+	}
+}
+
+func TestCompressedSegments(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	kinds := []compress.Kind{compress.KindNone, compress.KindSnappy, compress.KindZstd}
+	expected := make(map[string]domain.KV)
+
+	// every manager writes segments with another compression into the same path
+	for i, kind := range kinds {
+		compressor, err := compress.NewCompressor(string(kind))
+		assert.NoError(t, err)
+
+		manager, err := mananger.NewSegmentManager(rootPath, 16<<10, 64<<10, codec.NewBinaryCodec(), mananger.WithCompression(compressor))
+		assert.NoError(t, err)
+
+		for j := 0; j < 500; j++ {
+			kv := domain.KV{
+				Key:   fmt.Sprintf("key-%d", j%200),
+				Value: bytes.Repeat([]byte(fmt.Sprintf("%d-%d", i, j)), 8),
+			}
+			assert.NoError(t, manager.Write(kv))
+			expected[kv.Key] = kv
+		}
+		assert.NoError(t, manager.Refresh())
+
+		for _, kv := range expected {
+			res, err := manager.Read(context.Background(), kv.Key)
+			assert.NoError(t, err)
+			assert.Equal(t, kv, res)
+		}
+
+		stats := manager.Stats()
+		if kind != compress.KindNone {
+			assert.Greater(t, stats.CompressionRatio(), 1.0)
+		}
+
+		assert.NoError(t, manager.Close())
+	}
+
+	compressor, err := compress.NewCompressor(string(compress.KindZstd))
+	assert.NoError(t, err)
+
+	manager, err := mananger.NewSegmentManager(rootPath, 16<<10, 1<<20, codec.NewBinaryCodec(), mananger.WithCompression(compressor))
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	before := manager.Stats().Segments
+	assert.NoError(t, manager.Merge())
+	assert.Less(t, manager.Stats().Segments, before)
+
+	for _, kv := range expected {
+		res, err := manager.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv, res)
+	}
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	vlogPath := path.Join(rootPath, "vlog")
+	segPath := path.Join(rootPath, "segments")
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	write := func(keys map[uint32][]byte, round int, expected map[string]domain.KV) {
+		keyring, err := encryption.NewKeyring(keys)
+		assert.NoError(t, err)
+
+		manager, err := mananger.NewSegmentManager(segPath, 4<<10, 1<<20, codec.NewBinaryCodec(),
+			mananger.WithKeyring(keyring), mananger.WithValueLog(vlogPath, 128, 1<<20))
+		assert.NoError(t, err)
+		defer manager.Close()
+
+		// the second round leaves the keys below 20 alone, their large values stay in the value log
+		for j := 0; j < 100; j++ {
+			kv := domain.KV{
+				Key:   fmt.Sprintf("key-%d", (round-1)*20+j%(40/round)),
+				Value: bytes.Repeat([]byte(fmt.Sprintf("%d-%d", round, j)), 1+j%60),
+			}
+			assert.NoError(t, manager.Write(kv))
+			expected[kv.Key] = kv
+		}
+		assert.NoError(t, manager.Refresh())
+		assert.NoError(t, manager.Flush())
+	}
+
+	expected := make(map[string]domain.KV)
+	write(map[uint32][]byte{1: key1}, 1, expected)
+
+	// nothing is stored in plain text
+	files, err := filepath.Glob(path.Join(segPath, "*.sgk"))
+	assert.NoError(t, err)
+	vlogs, err := filepath.Glob(path.Join(vlogPath, "*.vlog"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, vlogs)
+	for _, f := range append(files, vlogs...) {
+		content, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		// neither a record nor the min and max keys in the header
+		assert.NotContains(t, string(content), "key-")
+	}
+
+	// without the key the segments can not be opened
+	_, err = mananger.NewSegmentManager(segPath, 4<<10, 1<<20, codec.NewBinaryCodec())
+	assert.ErrorIs(t, err, encryption.ErrUnknownKey)
+
+	// rotate to key 2, older data stays readable and is re-encrypted by Merge
+	write(map[uint32][]byte{1: key1, 2: key2}, 2, expected)
+
+	keyring, err := encryption.NewKeyring(map[uint32][]byte{1: key1, 2: key2})
+	assert.NoError(t, err)
+
+	manager, err := mananger.NewSegmentManager(segPath, 4<<10, 1<<20, codec.NewBinaryCodec(),
+		mananger.WithKeyring(keyring), mananger.WithValueLog(vlogPath, 128, 1<<20))
+	assert.NoError(t, err)
+
+	assert.NoError(t, manager.Merge())
+	assert.NoError(t, manager.Close())
+
+	// all segments are sealed by key 2 now
+	files, err = filepath.Glob(path.Join(segPath, "*.sgk"))
+	assert.NoError(t, err)
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		header, _, _ := bytes.Cut(content, []byte{'\n'})
+		assert.Contains(t, string(header), "key=2")
+	}
+
+	// key 1 is retired, the value log has been re-encrypted as well
+	keyring, err = encryption.NewKeyring(map[uint32][]byte{2: key2})
+	assert.NoError(t, err)
+
+	manager, err = mananger.NewSegmentManager(segPath, 4<<10, 1<<20, codec.NewBinaryCodec(),
+		mananger.WithKeyring(keyring), mananger.WithValueLog(vlogPath, 128, 1<<20))
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	// the sealed key range is opened with the header
+	for _, s := range manager.Segments() {
+		assert.NotEmpty(t, s.MinKey)
+		assert.LessOrEqual(t, s.MinKey, s.MaxKey)
+	}
+
+	for _, kv := range expected {
+		res, err := manager.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv, res)
+	}
+}
+
+func TestUpgradeLegacySegments(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
+	keys := []string{"aaa", "bb", "ccccc"}
+
+	manager, err := mananger.NewSegmentManager(rootPath, 128, 1024, codec.NewStringCodec())
+	assert.NoError(t, err)
+
+	expected := make([]domain.KV, 0, len(keys))
+	for _, key := range keys {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		expected = append(expected, kv)
+	}
+	assert.NoError(t, manager.Close())
+
+	manager, err = mananger.NewSegmentManager(rootPath, 128, 1024, codec.NewStringCodec(), mananger.WithUpgradeLegacy())
+	assert.NoError(t, err)
+
+	for i, key := range keys {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected[i], kv)
+	}
+	assert.NoError(t, manager.Close())
+
+	files, err := filepath.Glob(path.Join(rootPath, "*.sgk"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(content, []byte("KAEYASEG 1 ")))
+		assert.Contains(t, string(content), "codec=csv")
+	}
+
+	// a csv storage switches to the binary codec, which reads its records
+	manager, err = mananger.NewSegmentManager(rootPath, 128, 1024, codec.NewBinaryCodec())
+	assert.NoError(t, err)
+
+	for i, key := range keys {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected[i], kv)
+	}
+
+	assert.NoError(t, manager.Write(domain.KV{Key: "d", Value: []byte("1\n2"), ContentType: "text/plain"}))
+	assert.NoError(t, manager.Refresh())
+	assert.NoError(t, manager.Close())
+
+	// but segments written by the binary codec are rejected by csv
+	_, err = mananger.NewSegmentManager(rootPath, 128, 1024, codec.NewStringCodec())
+	assert.ErrorIs(t, err, mananger.ErrSegmentCodec)
+}
+
+func TestManifestRecovery(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	manager, err := mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewBinaryCodec())
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, manager.Write(domain.KV{Key: fmt.Sprintf("key-%d", i%5), Value: []byte(fmt.Sprint(i))}))
+	}
+	assert.NoError(t, manager.Refresh())
+	assert.NoError(t, manager.Merge())
+	assert.NoError(t, manager.Close())
+
+	live, err := filepath.Glob(path.Join(rootPath, "*.sgk"))
+	assert.NoError(t, err)
+
+	// a merged segment written before a crash, it never got into the manifest
+	content, err := os.ReadFile(live[0])
+	assert.NoError(t, err)
+	orphan := path.Join(rootPath, "1_seg.sgk")
+	assert.NoError(t, os.WriteFile(orphan, content, 0644))
+
+	// an edit torn by the crash
+	f, err := os.OpenFile(path.Join(rootPath, "MANIFEST"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`0badc0de {"add":[{"file":"1_seg`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	manager, err = mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewBinaryCodec())
+	assert.NoError(t, err)
+
+	assert.NoFileExists(t, orphan)
+	assert.Equal(t, len(live), manager.Stats().Segments)
+
+	for i := 15; i < 20; i++ {
+		kv, err := manager.Read(context.Background(), fmt.Sprintf("key-%d", i%5))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprint(i)), kv.Value)
+	}
+
+	// the torn edit is cut off, the next one survives the following restarts
+	assert.NoError(t, manager.Write(domain.KV{Key: "key-new", Value: []byte("new")}))
+	assert.NoError(t, manager.Refresh())
+	assert.NoError(t, manager.Close())
+
+	for i := 0; i < 2; i++ {
+		manager, err = mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewBinaryCodec())
+		assert.NoError(t, err)
+
+		kv, err := manager.Read(context.Background(), "key-new")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), kv.Value)
+		assert.NoError(t, manager.Close())
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
+	// legacy segments without a manifest are fine
+	report, err := mananger.Check(rootPath, codec.NewStringCodec(), false)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 3, report.Files)
+	assert.Equal(t, 3, report.LiveKeys)
+	assert.Greater(t, report.GarbageRatio(), 0.0)
+
+	manager, err := mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewStringCodec())
+	assert.NoError(t, err)
+	assert.NoError(t, manager.Write(domain.KV{Key: "ddd", Value: []byte("4")}))
+	assert.NoError(t, manager.Close())
+
+	live, err := filepath.Glob(path.Join(rootPath, "*.sgk"))
+	assert.NoError(t, err)
+
+	// a torn write at the end of the newest segment and an orphan left by a merge
+	f, err := os.OpenFile(live[len(live)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString("\nbroken")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, os.WriteFile(path.Join(rootPath, "5_seg.sgk"), []byte("5\n\neee,5"), 0644))
+
+	report, err = mananger.Check(rootPath, codec.NewStringCodec(), false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Problems, 2)
+
+	report, err = mananger.Check(rootPath, codec.NewStringCodec(), true)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.NotEmpty(t, report.Repairs)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, 4, report.LiveKeys)
+	assert.Equal(t, 0.0, report.GarbageRatio())
+
+	manager, err = mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewStringCodec())
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	for key, value := range map[string]string{"aaa": "1", "bb": "abdgeg", "ddd": "4"} {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(value), kv.Value)
+	}
+
+	_, err = manager.Read(context.Background(), "eee")
+	assert.ErrorIs(t, err, mananger.ErrNull)
+}
+
+func TestCheckAndRepairEncrypted(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	keyring, err := encryption.NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	assert.NoError(t, err)
+
+	manager, err := mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewBinaryCodec(), mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, manager.Write(domain.KV{Key: fmt.Sprintf("key-%d", i), Value: []byte(fmt.Sprintf("%d", i))}))
+	}
+	assert.NoError(t, manager.Close())
+
+	// sealed records are longer than the plain ones counted by the header
+	report, err := mananger.Check(rootPath, codec.NewBinaryCodec(), false, mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 10, report.LiveKeys)
+
+	live, err := filepath.Glob(path.Join(rootPath, "*.sgk"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, live)
+
+	f, err := os.OpenFile(live[len(live)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString("\nbroken")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	report, err = mananger.Check(rootPath, codec.NewBinaryCodec(), true, mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.NotEmpty(t, report.Repairs)
+	assert.Equal(t, 10, report.LiveKeys)
+
+	manager, err = mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewBinaryCodec(), mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	for i := 0; i < 10; i++ {
+		kv, err := manager.Read(context.Background(), fmt.Sprintf("key-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%d", i)), kv.Value)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
+	manager, err := mananger.NewSegmentManager(rootPath, 64, 1024, codec.NewStringCodec())
+	assert.NoError(t, err)
+	assert.NoError(t, manager.Write(domain.KV{Key: "bb", Value: []byte("new")}))
+	assert.NoError(t, manager.Write(domain.KV{Key: "ddd", Value: []byte("4")}))
+	assert.NoError(t, manager.Close())
+
+	inspector, err := mananger.Inspect(rootPath, codec.NewStringCodec())
+	assert.NoError(t, err)
+	defer inspector.Close()
+
+	segments, err := inspector.List()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 4)
+
+	newest := segments[0]
+	assert.Equal(t, 4, newest.ID)
+	assert.Equal(t, 1, newest.Version)
+	assert.Equal(t, 2, newest.Records)
+	assert.Equal(t, "bb", newest.MinKey)
+	assert.Equal(t, "ddd", newest.MaxKey)
+
+	// legacy segments are counted by reading them
+	assert.Equal(t, 0, segments[3].Version)
+	assert.Equal(t, 4, segments[3].Records)
+	assert.Equal(t, "aaa", segments[3].MinKey)
+
+	dumped := make([]string, 0)
+	assert.NoError(t, inspector.Dump("4", func(kv domain.KV) error {
+		dumped = append(dumped, kv.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"ddd", "bb"}, dumped)
+
+	info, kv, err := inspector.Locate("bb")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, info.ID)
+	assert.Equal(t, []byte("new"), kv.Value)
+
+	info, kv, err = inspector.Locate("ccccc")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, info.ID)
+	assert.Equal(t, []byte("100"), kv.Value)
+
+	_, _, err = inspector.Locate("not-exist")
+	assert.ErrorIs(t, err, mananger.ErrNull)
+}
+
+func TestCheckpoint(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	checkpointPath := path.Join("testdata", "dynamic", utils.ID())
+
+	manager, err := mananger.NewSegmentManager(
+		path.Join(rootPath, "segments"), 1024, 1024, codec.NewBinaryCodec(),
+		mananger.WithValueLog(path.Join(rootPath, "vlog"), 16, 600),
+	)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	values := []domain.KV{
+		{Key: "a", Value: bytes.Repeat([]byte{'1'}, 200)},
+		{Key: "b", Value: []byte("inline")},
+	}
+	for _, kv := range values {
+		assert.NoError(t, manager.Write(kv))
+	}
+
+	// the write buffer is part of the checkpoint
+	assert.NoError(t, manager.Checkpoint(path.Join(checkpointPath, "segments"), path.Join(checkpointPath, "vlog")))
+
+	// later writes are not
+	assert.NoError(t, manager.Write(domain.KV{Key: "c", Value: []byte("later")}))
+	assert.NoError(t, manager.Refresh())
+
+	snapshot, err := mananger.NewSegmentManager(
+		path.Join(checkpointPath, "segments"), 1024, 1024, codec.NewBinaryCodec(),
+		mananger.WithValueLog(path.Join(checkpointPath, "vlog"), 16, 600),
+	)
+	assert.NoError(t, err)
+	defer snapshot.Close()
+
+	for _, kv := range values {
+		res, err := snapshot.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv, res)
+	}
+
+	_, err = snapshot.Read(context.Background(), "c")
+	assert.ErrorIs(t, err, mananger.ErrNull)
+}
+
+func TestScanAndImport(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	manager, err := mananger.NewSegmentManager(
+		path.Join(rootPath, "segments"), 64, 1024, codec.NewBinaryCodec(),
+		mananger.WithValueLog(path.Join(rootPath, "vlog"), 16, 1024),
+	)
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	large := bytes.Repeat([]byte{'x'}, 100)
+
+	assert.NoError(t, manager.Write(domain.KV{Key: "user:1", Value: []byte("old")}))
+	assert.NoError(t, manager.Write(domain.KV{Key: "user:3", Value: []byte("kept")}))
+
+	n, err := manager.Import(common.NewSliceReader([]domain.KV{
+		{Key: "user:1", Value: []byte("alice")},
+		{Key: "user:2", Value: large, ContentType: "text/plain"},
+		{Key: "item:1", Value: []byte("1")},
+		{Key: "item:1", Value: []byte("2")},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// the write buffer was refreshed below the imported segment
+	stats := manager.Stats()
+	assert.Equal(t, 2, stats.Segments)
+
+	kv, err := manager.Read(context.Background(), "item:1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), kv.Value)
+
+	scanned := make(map[string]domain.KV)
+	assert.NoError(t, manager.Scan(context.Background(), "user:", func(kv domain.KV) error {
+		scanned[kv.Key] = kv
+		return nil
+	}))
+
+	assert.Len(t, scanned, 3)
+	assert.Equal(t, []byte("alice"), scanned["user:1"].Value)
+	assert.Equal(t, domain.KV{Key: "user:2", Value: large, ContentType: "text/plain"}, scanned["user:2"])
+	assert.Equal(t, []byte("kept"), scanned["user:3"].Value)
+}
+
+func TestBuildAndIngest(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	segmentPath := path.Join(rootPath, "segments")
+	assert.NoError(t, os.MkdirAll(rootPath, 0754))
+
+	snappy, err := compress.NewCompressor(string(compress.KindSnappy))
+	assert.NoError(t, err)
+
+	build := func(name string, kvs ...domain.KV) string {
+		file := path.Join(rootPath, name)
+		n, err := mananger.BuildSegment(file, codec.NewBinaryCodec(), common.NewSliceReader(kvs), mananger.WithCompression(snappy))
+		assert.NoError(t, err)
+		assert.Equal(t, len(kvs), n)
+		return file
+	}
+
+	top := build("top.sgk", domain.KV{Key: "b", Value: []byte("top")}, domain.KV{Key: "a", Value: []byte("top")})
+	bottom := build("bottom.sgk", domain.KV{Key: "a", Value: []byte("bottom")}, domain.KV{Key: "z", Value: []byte("bottom")})
+
+	manager, err := mananger.NewSegmentManager(segmentPath, 64, 1024, codec.NewBinaryCodec())
+	assert.NoError(t, err)
+
+	assert.NoError(t, manager.Write(domain.KV{Key: "a", Value: []byte("existing")}))
+	assert.NoError(t, manager.Write(domain.KV{Key: "b", Value: []byte("existing")}))
+	assert.NoError(t, manager.Refresh())
+
+	n, err := manager.Ingest([]string{top}, mananger.PrecedenceNewest)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = manager.Ingest([]string{bottom}, mananger.PrecedenceOldest)
+	assert.NoError(t, err)
+
+	_, err = manager.Ingest([]string{bottom}, "middle")
+	assert.ErrorIs(t, err, mananger.ErrPrecedence)
+
+	// the binary codec reads a segment built by csv
+	other := path.Join(rootPath, "other.sgk")
+	_, err = mananger.BuildSegment(other, codec.NewStringCodec(), common.NewSliceReader([]domain.KV{{Key: "x", Value: []byte("1")}}))
+	assert.NoError(t, err)
+	_, err = manager.Ingest([]string{other}, mananger.PrecedenceNewest)
+	assert.NoError(t, err)
+
+	// the ingested files are copies
+	assert.FileExists(t, top)
+	assert.NoError(t, manager.Close())
+
+	manager, err = mananger.NewSegmentManager(segmentPath, 64, 1024, codec.NewBinaryCodec())
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	expected := map[string]string{"a": "top", "b": "top", "z": "bottom", "x": "1"}
+	for key, value := range expected {
+		kv, err := manager.Read(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, value, string(kv.Value), key)
+	}
+
+	assert.Equal(t, 4, manager.Stats().Segments)
+}
+
+func TestBuildAndIngestEncrypted(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	segmentPath := path.Join(rootPath, "segments")
+	assert.NoError(t, os.MkdirAll(rootPath, 0754))
+
+	keyring, err := encryption.NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	assert.NoError(t, err)
+
+	file := path.Join(rootPath, "built.sgk")
+	kvs := []domain.KV{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}, {Key: "c", Value: []byte("3")}}
+	_, err = mananger.BuildSegment(file, codec.NewBinaryCodec(), common.NewSliceReader(kvs), mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+
+	manager, err := mananger.NewSegmentManager(segmentPath, 64, 1024, codec.NewBinaryCodec(), mananger.WithKeyring(keyring))
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	n, err := manager.Ingest([]string{file}, mananger.PrecedenceNewest)
+	assert.NoError(t, err)
+	assert.Equal(t, len(kvs), n)
+
+	for _, kv := range kvs {
+		res, err := manager.Read(context.Background(), kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv.Value, res.Value)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, os.MkdirAll(rootPath, 0754))
+
+	bottom := path.Join(rootPath, "bottom.sgk")
+	_, err := mananger.BuildSegment(bottom, codec.NewBinaryCodec(), common.NewSliceReader([]domain.KV{{Key: "a", Value: []byte("bottom")}}))
+	assert.NoError(t, err)
+
+	for _, keep := range []bool{false, true} {
+		var options []mananger.Option
+		if keep {
+			options = append(options, mananger.WithKeepTombstones())
+		}
+
+		manager, err := mananger.NewSegmentManager(path.Join(rootPath, fmt.Sprint(keep)), 64, 1024, codec.NewBinaryCodec(), options...)
+		assert.NoError(t, err)
+
+		assert.NoError(t, manager.Write(domain.KV{Key: "a", Value: []byte("1")}))
+		assert.NoError(t, manager.Refresh())
+		assert.NoError(t, manager.Write(domain.Tombstone("a")))
+		assert.NoError(t, manager.Refresh())
+
+		// the merge rewrites the oldest segment, nothing is left for the tombstone to shadow
+		assert.NoError(t, manager.Merge())
+		assert.Equal(t, 1, manager.Stats().Segments)
+
+		kv, err := manager.Read(context.Background(), "a")
+		if keep {
+			assert.NoError(t, err)
+			assert.True(t, kv.IsTombstone())
+		} else {
+			assert.ErrorIs(t, err, mananger.ErrNull)
+		}
+
+		// an older version ingested below comes back without the tombstone
+		_, err = manager.Ingest([]string{bottom}, mananger.PrecedenceOldest)
+		assert.NoError(t, err)
+
+		kv, err = manager.Read(context.Background(), "a")
+		assert.NoError(t, err)
+		assert.Equal(t, keep, kv.IsTombstone())
+
+		assert.NoError(t, manager.Close())
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+
+	manager, err := mananger.NewSegmentManager(rootPath, 1<<20, 1<<20, codec.NewStringCodec())
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	const total = 2000
+	for i := 0; i < total; i++ {
+		assert.NoError(t, manager.Write(domain.KV{Key: fmt.Sprintf("key-%04d", i), Value: []byte("v")}))
+	}
+	assert.NoError(t, manager.Refresh())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = manager.Read(ctx, "missing")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = manager.Read(context.Background(), "missing")
+	assert.ErrorIs(t, err, mananger.ErrNull)
+
+	// a scan stops soon after its context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	count := 0
+	err = manager.Scan(ctx, "", func(kv domain.KV) error {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, count, total)
+}
@@ -1,14 +1,19 @@
 package mananger
 
 import (
+	"path"
 	"testing"
 
 	"github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestInitSegments(t *testing.T) {
-	manager, err := NewSegmentManager("testdata/static/segments", 128, 1024, codec.NewStringCodec())
+	rootPath := path.Join("testdata", "dynamic", utils.ID())
+	assert.NoError(t, utils.CopyDir(path.Join("testdata", "static", "segments"), rootPath))
+
+	manager, err := NewSegmentManager(rootPath, 128, 1024, codec.NewStringCodec())
 	assert.NoError(t, err)
 
 	assert.Equal(t, 3, manager.linkList.maxID())
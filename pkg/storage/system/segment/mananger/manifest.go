@@ -0,0 +1,314 @@
+package mananger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestFileName    = "MANIFEST"
+	manifestTmpFileName = "MANIFEST.tmp"
+
+	// the manifest is rewritten as a single snapshot edit after this many edits
+	manifestCompactEdits = 1000
+)
+
+var (
+	ErrManifest = errors.New("manifest error")
+)
+
+type manifestEntry struct {
+	File string `json:"file"`
+	ID   int    `json:"id"`
+}
+
+// versionEdit changes the live segment set atomically, files are relative to the segment path.
+type versionEdit struct {
+	Add    []manifestEntry `json:"add,omitempty"`
+	Delete []string        `json:"del,omitempty"`
+}
+
+// manifest is the source of truth of the live segment files. It is an append only
+// log of version edits, one per line:
+//
+//	<crc32 of edit in hex> <edit in json>
+//
+// A torn or corrupted last line is an edit which never happened, it is cut off
+// before the next edit is appended.
+type manifest struct {
+	dir   string
+	file  *os.File
+	live  map[string]int
+	edits int
+	// end of the last complete edit
+	size int64
+}
+
+// openManifest replays the manifest in dir, exists is false if there is none yet.
+func openManifest(dir string) (m *manifest, exists bool, err error) {
+	// a leftover of an interrupted compaction
+	err = os.Remove(path.Join(dir, manifestTmpFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	m, exists, err = readManifest(dir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	name := path.Join(dir, manifestFileName)
+	m.file, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileMode)
+	if err != nil {
+		return nil, false, fmt.Errorf("open manifest error: %w", err)
+	}
+
+	// the next edit must not follow a torn one
+	stat, err := m.file.Stat()
+	if err == nil && stat.Size() != m.size {
+		err = m.truncate()
+	}
+	if err != nil {
+		m.file.Close()
+		return nil, false, err
+	}
+
+	return m, exists, nil
+}
+
+// readManifest replays the manifest in dir without changing anything.
+func readManifest(dir string) (m *manifest, exists bool, err error) {
+	m = &manifest{
+		dir:  dir,
+		live: make(map[string]int),
+	}
+
+	exists, err = m.load()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return m, exists, nil
+}
+
+func (m *manifest) load() (bool, error) {
+	f, err := os.Open(path.Join(m.dir, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+	defer f.Close()
+
+	return true, m.replay(f)
+}
+
+func (m *manifest) replay(f *os.File) error {
+	r := bufio.NewReaderSize(f, 64<<10)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(line) == 0 {
+			return nil
+		}
+
+		// an edit is complete with its line end
+		edit, decodeErr := decodeVersionEdit(bytes.TrimSuffix(line, []byte{'\n'}))
+		if decodeErr == nil && err != nil {
+			decodeErr = fmt.Errorf("no line end: %w", ErrManifest)
+		}
+		if decodeErr != nil {
+			// only the last edit may be torn by a crash
+			if _, peekErr := r.Peek(1); peekErr == nil {
+				return fmt.Errorf("edit %d: %w", m.edits+1, decodeErr)
+			}
+
+			return nil
+		}
+
+		m.applyLive(edit)
+		m.edits++
+		m.size += int64(len(line))
+	}
+}
+
+// truncate cuts the manifest after the last complete edit.
+func (m *manifest) truncate() error {
+	err := m.file.Truncate(m.size)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("truncate manifest error: %w", err)
+	}
+
+	return nil
+}
+
+func encodeVersionEdit(edit versionEdit) ([]byte, error) {
+	data, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+
+	line := []byte(fmt.Sprintf("%08x ", crc32.ChecksumIEEE(data)))
+	line = append(line, data...)
+
+	return append(line, '\n'), nil
+}
+
+func decodeVersionEdit(line []byte) (versionEdit, error) {
+	var edit versionEdit
+
+	sumStr, data, ok := strings.Cut(string(line), " ")
+	if !ok {
+		return edit, ErrManifest
+	}
+
+	sum, err := strconv.ParseUint(sumStr, 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(data)) {
+		return edit, fmt.Errorf("checksum mismatch: %w", ErrManifest)
+	}
+
+	err = json.Unmarshal([]byte(data), &edit)
+	if err != nil {
+		return edit, fmt.Errorf("%s: %w", err.Error(), ErrManifest)
+	}
+
+	return edit, nil
+}
+
+func (m *manifest) applyLive(edit versionEdit) {
+	for _, name := range edit.Delete {
+		delete(m.live, name)
+	}
+
+	for _, e := range edit.Add {
+		m.live[e.File] = e.ID
+	}
+}
+
+// apply makes edit durable before it is applied to the live set.
+func (m *manifest) apply(edit versionEdit) error {
+	line, err := encodeVersionEdit(edit)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.file.Write(line)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		// the part written would precede the next edit
+		truncErr := m.truncate()
+		if truncErr != nil {
+			return fmt.Errorf("write manifest error: %v, %w", err, truncErr)
+		}
+
+		return fmt.Errorf("write manifest error: %w", err)
+	}
+
+	m.applyLive(edit)
+	m.edits++
+	m.size += int64(len(line))
+
+	if m.edits >= manifestCompactEdits {
+		return m.compact()
+	}
+
+	return nil
+}
+
+// entries returns the live segment files ordered by segmentID from the newest.
+func (m *manifest) entries() []manifestEntry {
+	res := make([]manifestEntry, 0, len(m.live))
+	for name, id := range m.live {
+		res = append(res, manifestEntry{File: name, ID: id})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID > res[j].ID
+	})
+
+	return res
+}
+
+// compact replaces the manifest by a single edit adding the live segment files.
+func (m *manifest) compact() error {
+	line, err := encodeVersionEdit(versionEdit{Add: m.entries()})
+	if err != nil {
+		return err
+	}
+
+	tmpName := path.Join(m.dir, manifestTmpFileName)
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileMode)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(line)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write manifest snapshot error: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	name := path.Join(m.dir, manifestFileName)
+	err = os.Rename(tmpName, name)
+	if err != nil {
+		return err
+	}
+
+	err = syncDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	m.file.Close()
+	m.file, err = os.OpenFile(name, os.O_APPEND|os.O_WRONLY, fileMode)
+	if err != nil {
+		return fmt.Errorf("open manifest error: %w", err)
+	}
+
+	m.edits = 1
+	m.size = int64(len(line))
+
+	return nil
+}
+
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
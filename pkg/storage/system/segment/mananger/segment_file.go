@@ -0,0 +1,554 @@
+package mananger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/compress"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
+)
+
+const (
+	// raw size of records put into one compressed block
+	segmentBlockSize = 4 << 10
+
+	segmentMagic = "KAEYASEG"
+
+	// segmentFormatVersion is written into every new segment, version 0 is a legacy
+	// segment whose header starts with the segmentID and has no magic
+	segmentFormatVersion = 1
+
+	headerAttrDelim       = " "
+	headerAttrID          = "id"
+	headerAttrCodec       = "codec"
+	headerAttrCreated     = "created"
+	headerAttrMinKey      = "min"
+	headerAttrMaxKey      = "max"
+	headerAttrCount       = "count"
+	headerAttrCompression = "compression"
+	headerAttrRawSize     = "raw"
+	headerAttrKeyID       = "key"
+	// headerAttrRange holds the min and max keys of an encrypted segment, sealed
+	headerAttrRange = "range"
+)
+
+var (
+	ErrSegmentFormat  = errors.New("segment format error")
+	ErrSegmentVersion = errors.New("unsupported segment format version")
+	ErrSegmentCodec   = errors.New("segment written by another codec")
+)
+
+// segmentMeta describes the records of a segment, it is kept in the header.
+type segmentMeta struct {
+	version int
+	codec   codec2.CodecType
+	created time.Time
+	minKey  string
+	maxKey  string
+	count   int
+}
+
+func (m *segmentMeta) add(key string) {
+	if m.count == 0 || key < m.minKey {
+		m.minKey = key
+	}
+
+	if m.count == 0 || key > m.maxKey {
+		m.maxKey = key
+	}
+
+	m.count++
+}
+
+func (m segmentMeta) legacy() bool {
+	return m.version < segmentFormatVersion
+}
+
+// tornTailError reports a segment whose data after offset is incomplete,
+// usually left by a crash while the file was written.
+type tornTailError struct {
+	offset int64
+}
+
+func (e *tornTailError) Error() string {
+	return fmt.Sprintf("torn tail after offset %d", e.offset)
+}
+
+func (e *tornTailError) Unwrap() error {
+	return ErrSegmentFormat
+}
+
+type blockHandle struct {
+	offset int64
+	length int64
+}
+
+// segmentFile is an immutable file of records, each prefixed by segmentFileDataDelim.
+// The first line is the header with the url encoded attributes:
+//
+//	KAEYASEG <version> codec=<codec>&compression=<kind>&count=<records>&created=<unix nano>&id=<segmentID>&key=<key id>&max=<key>&min=<key>&raw=<size>
+//
+// Legacy segments start with the segmentID, optionally followed by the attributes.
+//
+// Records of a compressed segment are grouped into blocks, every block is
+// stored as its uvarint length followed by the compressed records.
+// If the segment is encrypted, every block is sealed after compression, and
+// without compression every record is sealed on its own and stored as base64.
+type segmentFile struct {
+	*os.File
+	segmentID int
+	meta      segmentMeta
+	flushed   bool
+	next      *segmentFile
+	prev      *segmentFile
+
+	// nil for a plain segment
+	compressor compress.Compressor
+	dataOffset int64
+	rawSize    int64
+	blocks     []blockHandle
+
+	// nil for a segment in plain text
+	keyring *encryption.Keyring
+	keyID   uint32
+}
+
+func newSegmentFile(filePath string, segmentID int, meta segmentMeta, data []byte, compressor compress.Compressor, keyring *encryption.Keyring) (*segmentFile, error) {
+	if compressor != nil && compressor.Kind() == compress.KindNone {
+		compressor = nil
+	}
+
+	content, err := encodeSegment(segmentID, meta, data, compressor, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	newFile, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = newFile.Write(content)
+	if err == nil {
+		err = newFile.Sync()
+	}
+	if err != nil {
+		newFile.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	err = newFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// the file and its directory entry must be durable before the manifest refers to it
+	err = syncDir(path.Dir(filePath))
+	if err != nil {
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	// read only
+	newSeg, err := openSegmentFile(newFile.Name(), keyring)
+	if err != nil {
+		return nil, fmt.Errorf("open new segment file error: %w", err)
+	}
+
+	return newSeg, nil
+}
+
+func encodeSegment(segmentID int, meta segmentMeta, data []byte, compressor compress.Compressor, keyring *encryption.Keyring) ([]byte, error) {
+	if meta.created.IsZero() {
+		meta.created = time.Now()
+	}
+
+	attrs := url.Values{}
+	attrs.Set(headerAttrID, strconv.Itoa(segmentID))
+	attrs.Set(headerAttrCodec, string(meta.codec))
+	attrs.Set(headerAttrCreated, strconv.FormatInt(meta.created.UnixNano(), 10))
+	attrs.Set(headerAttrCount, strconv.Itoa(meta.count))
+	if meta.count > 0 && keyring == nil {
+		attrs.Set(headerAttrMinKey, meta.minKey)
+		attrs.Set(headerAttrMaxKey, meta.maxKey)
+	}
+	if meta.count > 0 && keyring != nil {
+		keyRange := url.Values{}
+		keyRange.Set(headerAttrMinKey, meta.minKey)
+		keyRange.Set(headerAttrMaxKey, meta.maxKey)
+
+		_, sealed, err := keyring.SealLine([]byte(keyRange.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		attrs.Set(headerAttrRange, string(sealed))
+	}
+	attrs.Set(headerAttrRawSize, strconv.Itoa(len(data)))
+	if compressor != nil {
+		attrs.Set(headerAttrCompression, string(compressor.Kind()))
+	}
+	if keyring != nil {
+		attrs.Set(headerAttrKeyID, strconv.FormatUint(uint64(keyring.CurrentKeyID()), 10))
+	}
+
+	content := []byte(fmt.Sprintf("%s%s%d%s%s\n", segmentMagic, headerAttrDelim, segmentFormatVersion, headerAttrDelim, attrs.Encode()))
+
+	if compressor == nil && keyring == nil {
+		return append(content, data...), nil
+	}
+
+	if compressor == nil {
+		for _, record := range bytes.Split(data, []byte{segmentFileDataDelim}) {
+			if len(record) == 0 {
+				continue
+			}
+
+			_, line, err := keyring.SealLine(record)
+			if err != nil {
+				return nil, err
+			}
+
+			content = append(content, segmentFileDataDelim)
+			content = append(content, line...)
+		}
+
+		return content, nil
+	}
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	block := make([]byte, 0, segmentBlockSize)
+
+	for start := 0; start < len(data); {
+		end := start + segmentBlockSize
+		if end >= len(data) {
+			end = len(data)
+		} else {
+			// cut at the start of the next record
+			idx := bytes.IndexByte(data[end:], segmentFileDataDelim)
+			if idx == -1 {
+				end = len(data)
+			} else {
+				end += idx
+			}
+		}
+
+		block = compressor.Compress(block[:0], data[start:end])
+		if keyring != nil {
+			_, sealed, err := keyring.Seal(block)
+			if err != nil {
+				return nil, err
+			}
+			block = sealed
+		}
+
+		n := binary.PutUvarint(lenBuf, uint64(len(block)))
+		content = append(content, lenBuf[:n]...)
+		content = append(content, block...)
+
+		start = end
+	}
+
+	return content, nil
+}
+
+func openSegmentFile(fName string, keyring *encryption.Keyring) (*segmentFile, error) {
+	file, err := os.OpenFile(fName, os.O_RDONLY, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open file %s error: %w", fName, err)
+	}
+
+	sg, err := readSegmentHeader(file, keyring)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read header of %s error: %w", fName, err)
+	}
+
+	return sg, nil
+}
+
+func readSegmentHeader(file *os.File, keyring *encryption.Keyring) (*segmentFile, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, stat.Size()))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read segmentID error: %w", err)
+	}
+
+	sg := &segmentFile{
+		File:       file,
+		flushed:    true,
+		dataOffset: int64(len(line)),
+	}
+
+	attrs, err := parseSegmentHeader(sg, strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	sg.rawSize = stat.Size() - sg.dataOffset
+	if raw := attrs.Get(headerAttrRawSize); raw != "" {
+		sg.rawSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, ErrSegmentFormat
+		}
+	}
+
+	if keyID := attrs.Get(headerAttrKeyID); keyID != "" {
+		id, err := strconv.ParseUint(keyID, 10, 32)
+		if err != nil {
+			return nil, ErrSegmentFormat
+		}
+
+		if keyring == nil || !keyring.HasKey(uint32(id)) {
+			return nil, fmt.Errorf("segment sealed by key %d: %w", id, encryption.ErrUnknownKey)
+		}
+
+		sg.keyring = keyring
+		sg.keyID = uint32(id)
+
+		err = sg.openKeyRange(attrs.Get(headerAttrRange))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kind := attrs.Get(headerAttrCompression)
+	if kind == "" || compress.Kind(kind) == compress.KindNone {
+		return sg, nil
+	}
+
+	sg.compressor, err = compress.NewCompressor(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	sg.blocks, err = readBlockHandles(reader, sg.dataOffset, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return sg, nil
+}
+
+func parseSegmentHeader(sg *segmentFile, line string) (url.Values, error) {
+	magic, rest, _ := strings.Cut(line, headerAttrDelim)
+	if magic != segmentMagic {
+		// legacy: <segmentID>[ attributes]
+		attrs, err := url.ParseQuery(rest)
+		if err != nil {
+			return nil, ErrSegmentFormat
+		}
+
+		sg.segmentID, err = strconv.Atoi(magic)
+		if err != nil {
+			return nil, fmt.Errorf("convert segmentID error: %w", err)
+		}
+
+		return attrs, nil
+	}
+
+	versionStr, attrStr, _ := strings.Cut(rest, headerAttrDelim)
+
+	var err error
+	sg.meta.version, err = strconv.Atoi(versionStr)
+	if err != nil {
+		return nil, ErrSegmentFormat
+	}
+
+	if sg.meta.version > segmentFormatVersion {
+		return nil, fmt.Errorf("version %d: %w", sg.meta.version, ErrSegmentVersion)
+	}
+
+	attrs, err := url.ParseQuery(attrStr)
+	if err != nil {
+		return nil, ErrSegmentFormat
+	}
+
+	sg.segmentID, err = strconv.Atoi(attrs.Get(headerAttrID))
+	if err != nil {
+		return nil, fmt.Errorf("convert segmentID error: %w", err)
+	}
+
+	created, err := strconv.ParseInt(attrs.Get(headerAttrCreated), 10, 64)
+	if err != nil {
+		return nil, ErrSegmentFormat
+	}
+
+	sg.meta.count, err = strconv.Atoi(attrs.Get(headerAttrCount))
+	if err != nil || sg.meta.count < 0 {
+		return nil, ErrSegmentFormat
+	}
+
+	sg.meta.codec = codec2.CodecType(attrs.Get(headerAttrCodec))
+	sg.meta.created = time.Unix(0, created)
+	sg.meta.minKey = attrs.Get(headerAttrMinKey)
+	sg.meta.maxKey = attrs.Get(headerAttrMaxKey)
+
+	if sg.meta.minKey > sg.meta.maxKey {
+		return nil, fmt.Errorf("min key after max key: %w", ErrSegmentFormat)
+	}
+
+	return attrs, nil
+}
+
+// openKeyRange sets the min and max keys of an encrypted segment from the sealed range attribute.
+func (sg *segmentFile) openKeyRange(sealed string) error {
+	if sealed == "" {
+		return nil
+	}
+
+	data, err := sg.keyring.OpenLine(sg.keyID, []byte(sealed))
+	if err != nil {
+		return fmt.Errorf("open key range error: %w", err)
+	}
+
+	keyRange, err := url.ParseQuery(string(data))
+	if err != nil {
+		return ErrSegmentFormat
+	}
+
+	sg.meta.minKey, sg.meta.maxKey = keyRange.Get(headerAttrMinKey), keyRange.Get(headerAttrMaxKey)
+	if sg.meta.minKey > sg.meta.maxKey {
+		return fmt.Errorf("min key after max key: %w", ErrSegmentFormat)
+	}
+
+	return nil
+}
+
+// validate checks the header of sg against the codec used to decode its records.
+// The binary codec also reads csv records, a csv storage can switch to it.
+func (sg *segmentFile) validate(codecType codec2.CodecType) error {
+	if sg.meta.legacy() {
+		return nil
+	}
+
+	if sg.meta.codec == codec2.TypeCSV && codecType == codec2.TypeBinary {
+		return nil
+	}
+
+	if sg.meta.codec != codecType {
+		return fmt.Errorf("%s, expected %s: %w", sg.meta.codec, codecType, ErrSegmentCodec)
+	}
+
+	return nil
+}
+
+func readBlockHandles(reader *bufio.Reader, offset, size int64) ([]blockHandle, error) {
+	blocks := make([]blockHandle, 0)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+
+	for offset < size {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, &tornTailError{offset: offset}
+		}
+
+		start := offset
+		offset += int64(binary.PutUvarint(lenBuf, length))
+		if offset+int64(length) > size {
+			return nil, &tornTailError{offset: start}
+		}
+
+		blocks = append(blocks, blockHandle{offset: offset, length: int64(length)})
+
+		_, err = reader.Discard(int(length))
+		if err != nil {
+			return nil, err
+		}
+
+		offset += int64(length)
+	}
+
+	return blocks, nil
+}
+
+// scanRecords calls fn with every record of the segment from the newest to the oldest
+// until fn returns false.
+func (sg *segmentFile) scanRecords(fn func(data []byte) bool) error {
+	if sg.compressor == nil {
+		return sg.scanPlainRecords(fn)
+	}
+
+	var raw []byte
+	for i := len(sg.blocks) - 1; i >= 0; i-- {
+		b := sg.blocks[i]
+
+		block := make([]byte, b.length)
+		_, err := sg.ReadAt(block, b.offset)
+		if err != nil {
+			return fmt.Errorf("read block error: %w", err)
+		}
+
+		if sg.keyring != nil {
+			block, err = sg.keyring.Open(sg.keyID, block)
+			if err != nil {
+				return fmt.Errorf("open block error: %w", err)
+			}
+		}
+
+		raw, err = sg.compressor.Decompress(raw[:0], block)
+		if err != nil {
+			return err
+		}
+
+		records := bytes.Split(raw, []byte{segmentFileDataDelim})
+		for j := len(records) - 1; j >= 0; j-- {
+			if len(records[j]) == 0 {
+				continue
+			}
+
+			if !fn(records[j]) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (sg *segmentFile) scanPlainRecords(fn func(data []byte) bool) error {
+	var offset int64 = -1
+
+	for {
+		data, newOffset, err := common.ReadLineFromTail(sg.File, offset, segmentFileDataDelim)
+		if err != nil {
+			switch {
+			// the empty line separates the records from the segmentID
+			case errors.Is(err, common.ErrEnd), errors.Is(err, common.ErrEmptyLine):
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if sg.keyring != nil {
+			data, err = sg.keyring.OpenLine(sg.keyID, data)
+			if err != nil {
+				return fmt.Errorf("open record error: %w", err)
+			}
+		}
+
+		if !fn(data) {
+			return nil
+		}
+
+		offset = newOffset
+	}
+}
@@ -0,0 +1,577 @@
+package mananger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+)
+
+const (
+	valueLogFileExtension  = ".vlog"
+	valueLogEntryHeaderLen = 8
+
+	// entryKeySealed is set in the key length of an entry whose key is sealed together with
+	// its value, the key part is then the id of the sealing key
+	entryKeySealed uint32 = 1 << 31
+	sealedKeyLen          = 4
+
+	// a sealed value log file is collected once at least this part of it is garbage
+	valueLogGCRatio = 0.5
+
+	// flagValuePointer marks a record whose value is a pointer into the value log
+	flagValuePointer uint32 = 1 << 24
+)
+
+var (
+	ErrValuePointer = errors.New("invalid value pointer")
+)
+
+type valuePointer struct {
+	fileID int
+	offset int64
+	length int64
+
+	// the value is sealed by the key with keyID
+	sealed bool
+	keyID  uint32
+}
+
+func (vp valuePointer) encode() []byte {
+	if vp.sealed {
+		return []byte(fmt.Sprintf("%d:%d:%d:%d", vp.fileID, vp.offset, vp.length, vp.keyID))
+	}
+
+	return []byte(fmt.Sprintf("%d:%d:%d", vp.fileID, vp.offset, vp.length))
+}
+
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	var vp valuePointer
+
+	strs := strings.Split(string(data), ":")
+	if len(strs) != 3 && len(strs) != 4 {
+		return vp, ErrValuePointer
+	}
+
+	if len(strs) == 4 {
+		keyID, err := strconv.ParseUint(strs[3], 10, 32)
+		if err != nil {
+			return vp, ErrValuePointer
+		}
+		vp.sealed, vp.keyID = true, uint32(keyID)
+	}
+
+	id, err := strconv.Atoi(strs[0])
+	if err != nil {
+		return vp, ErrValuePointer
+	}
+
+	offset, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil {
+		return vp, ErrValuePointer
+	}
+
+	length, err := strconv.ParseInt(strs[2], 10, 64)
+	if err != nil {
+		return vp, ErrValuePointer
+	}
+
+	vp.fileID, vp.offset, vp.length = id, offset, length
+
+	return vp, nil
+}
+
+type valueLogFile struct {
+	*os.File
+	id   int
+	size int64
+
+	// stale is set if an entry is not sealed by the current key, see reseal
+	stale bool
+}
+
+// valueLog is an append only log holding values larger than threshold,
+// segments only keep a valuePointer to them. Each entry is
+//
+//	<key length uint32> <value length uint32> <key> <value>
+//
+// With a keyring the key is sealed together with the value, the entry is
+//
+//	<4 | entryKeySealed uint32> <sealed length uint32> <key id uint32> <sealed <key length uint32> <key> <value>>
+//
+// and the key id is kept in the valuePointer as well. Entries written before only
+// sealed the value and are rewritten by reseal.
+type valueLog struct {
+	dir         string
+	threshold   int64
+	maxFileSize int64
+	keyring     *encryption.Keyring
+
+	mu     sync.RWMutex
+	files  map[int]*valueLogFile
+	active *valueLogFile
+}
+
+func openValueLog(dir string, threshold, maxFileSize int64, keyring *encryption.Keyring) (vl *valueLog, err error) {
+	err = os.MkdirAll(dir, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	vl = &valueLog{
+		dir:         dir,
+		threshold:   threshold,
+		maxFileSize: maxFileSize,
+		keyring:     keyring,
+		files:       make(map[int]*valueLogFile),
+	}
+
+	defer func() {
+		if err != nil {
+			vl.close()
+		}
+	}()
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, valueLogFileExtension) {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSuffix(name, valueLogFileExtension))
+		if err != nil {
+			continue
+		}
+
+		f, err := vl.openFile(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if vl.active == nil || id > vl.active.id {
+			vl.active = f
+		}
+	}
+
+	if vl.active == nil {
+		vl.active, err = vl.openFile(1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the older files have been synced when the next one became active
+	err = vl.scanFile(vl.active, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range vl.files {
+		if f != vl.active {
+			err = vl.scanFile(f, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return vl, nil
+}
+
+// scanFile walks the entry headers of f to find the entries not sealed by the current key.
+// With truncate an entry which a crash left incomplete is cut, later entries would be
+// appended after it and could never be read.
+func (vl *valueLog) scanFile(f *valueLogFile, truncate bool) error {
+	header := make([]byte, valueLogEntryHeaderLen+sealedKeyLen)
+
+	var offset int64
+	for offset+valueLogEntryHeaderLen <= f.size {
+		n, err := f.ReadAt(header, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && n >= valueLogEntryHeaderLen) {
+			return fmt.Errorf("read value log %s error: %w", f.Name(), err)
+		}
+
+		keyLen, valueLen, keySealed := parseEntryHeader(header)
+		length := valueLogEntryHeaderLen + keyLen + valueLen
+		if offset+length > f.size {
+			break
+		}
+
+		if vl.keyring != nil && (!keySealed || binary.BigEndian.Uint32(header[valueLogEntryHeaderLen:]) != vl.keyring.CurrentKeyID()) {
+			f.stale = true
+		}
+
+		offset += length
+	}
+
+	if offset == f.size || !truncate {
+		return nil
+	}
+
+	logger.Logger.Warn().Msgf("value log %s: truncate torn tail after offset %d", f.Name(), offset)
+
+	err := f.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("truncate value log %s error: %w", f.Name(), err)
+	}
+	f.size = offset
+
+	return f.Sync()
+}
+
+func (vl *valueLog) openFile(id int) (*valueLogFile, error) {
+	name := path.Join(vl.dir, fmt.Sprintf("%d%s", id, valueLogFileExtension))
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_RDWR, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open value log %s error: %w", name, err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &valueLogFile{
+		File: file,
+		id:   id,
+		size: stat.Size(),
+	}
+	vl.files[id] = f
+
+	return f, nil
+}
+
+func (vl *valueLog) needSeparate(value []byte) bool {
+	return int64(len(value)) > vl.threshold
+}
+
+func (vl *valueLog) append(key string, value []byte) (valuePointer, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if vl.active.size >= vl.maxFileSize {
+		err := vl.rotate()
+		if err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	entry, keyID, err := vl.encodeEntry(key, value)
+	if err != nil {
+		return valuePointer{}, err
+	}
+
+	_, err = vl.active.Write(entry)
+	if err != nil {
+		return valuePointer{}, fmt.Errorf("write value log error: %w", err)
+	}
+
+	vp := valuePointer{
+		fileID: vl.active.id,
+		offset: vl.active.size,
+		length: int64(len(entry)),
+		sealed: vl.keyring != nil,
+		keyID:  keyID,
+	}
+	vl.active.size += vp.length
+
+	return vp, nil
+}
+
+// rotate syncs the active file and starts the next one, the caller holds mu.
+func (vl *valueLog) rotate() error {
+	err := vl.active.Sync()
+	if err != nil {
+		return err
+	}
+
+	f, err := vl.openFile(vl.active.id + 1)
+	if err != nil {
+		return err
+	}
+	vl.active = f
+
+	return nil
+}
+
+func (vl *valueLog) encodeEntry(key string, value []byte) ([]byte, uint32, error) {
+	if vl.keyring == nil {
+		entry := make([]byte, valueLogEntryHeaderLen, valueLogEntryHeaderLen+len(key)+len(value))
+		binary.BigEndian.PutUint32(entry[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(entry[4:8], uint32(len(value)))
+		entry = append(entry, key...)
+		return append(entry, value...), 0, nil
+	}
+
+	plain := make([]byte, 4, 4+len(key)+len(value))
+	binary.BigEndian.PutUint32(plain, uint32(len(key)))
+	plain = append(plain, key...)
+	plain = append(plain, value...)
+
+	keyID, sealed, err := vl.keyring.Seal(plain)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entry := make([]byte, valueLogEntryHeaderLen+sealedKeyLen, valueLogEntryHeaderLen+sealedKeyLen+len(sealed))
+	binary.BigEndian.PutUint32(entry[0:4], entryKeySealed|sealedKeyLen)
+	binary.BigEndian.PutUint32(entry[4:8], uint32(len(sealed)))
+	binary.BigEndian.PutUint32(entry[8:12], keyID)
+
+	return append(entry, sealed...), keyID, nil
+}
+
+func (vl *valueLog) read(key string, vp valuePointer) ([]byte, error) {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	f, ok := vl.files[vp.fileID]
+	if !ok || vp.length < valueLogEntryHeaderLen {
+		return nil, ErrValuePointer
+	}
+
+	entry := make([]byte, vp.length)
+	_, err := f.ReadAt(entry, vp.offset)
+	if err != nil {
+		return nil, fmt.Errorf("read value log error: %w", err)
+	}
+
+	k, v, err := vl.decodeEntry(entry, vp)
+	if err != nil {
+		return nil, err
+	}
+
+	if k != key {
+		return nil, ErrValuePointer
+	}
+
+	return v, nil
+}
+
+// decodeEntry returns the key and the opened value of entry. Only the entries sealing the
+// value alone need vp to know whether it is sealed.
+func (vl *valueLog) decodeEntry(entry []byte, vp valuePointer) (string, []byte, error) {
+	keyLen, valueLen, keySealed := parseEntryHeader(entry)
+	if valueLogEntryHeaderLen+keyLen+valueLen != int64(len(entry)) {
+		return "", nil, ErrValuePointer
+	}
+
+	body := entry[valueLogEntryHeaderLen:]
+	if !keySealed {
+		value, err := vl.open(vp, body[keyLen:])
+		return string(body[:keyLen]), value, err
+	}
+
+	if keyLen != sealedKeyLen {
+		return "", nil, ErrValuePointer
+	}
+
+	keyID := binary.BigEndian.Uint32(body)
+	if vl.keyring == nil {
+		return "", nil, fmt.Errorf("value sealed by key %d: %w", keyID, encryption.ErrUnknownKey)
+	}
+
+	plain, err := vl.keyring.Open(keyID, body[sealedKeyLen:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(plain) < 4 || int64(len(plain)-4) < int64(binary.BigEndian.Uint32(plain)) {
+		return "", nil, ErrValuePointer
+	}
+
+	plainKeyLen := 4 + binary.BigEndian.Uint32(plain)
+
+	return string(plain[4:plainKeyLen]), plain[plainKeyLen:], nil
+}
+
+// open decrypts value if it is sealed according to vp.
+func (vl *valueLog) open(vp valuePointer, value []byte) ([]byte, error) {
+	if !vp.sealed {
+		return value, nil
+	}
+
+	if vl.keyring == nil {
+		return nil, fmt.Errorf("value sealed by key %d: %w", vp.keyID, encryption.ErrUnknownKey)
+	}
+
+	return vl.keyring.Open(vp.keyID, value)
+}
+
+func parseEntryHeader(header []byte) (keyLen, valueLen int64, keySealed bool) {
+	rawKeyLen := binary.BigEndian.Uint32(header[0:4])
+
+	return int64(rawKeyLen &^ entryKeySealed), int64(binary.BigEndian.Uint32(header[4:8])), rawKeyLen&entryKeySealed != 0
+}
+
+// sealed returns the files which are not written anymore, oldest first.
+func (vl *valueLog) sealed() []*valueLogFile {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	ids := make([]int, 0, len(vl.files))
+	for id := range vl.files {
+		if id != vl.active.id {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Ints(ids)
+
+	res := make([]*valueLogFile, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, vl.files[id])
+	}
+
+	return res
+}
+
+// iterate calls fn with the key and the location of every entry of f in the order they were written.
+func (vl *valueLog) iterate(f *valueLogFile, fn func(key string, vp valuePointer) error) error {
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, f.size))
+	header := make([]byte, valueLogEntryHeaderLen)
+
+	var offset int64
+	for offset < f.size {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return fmt.Errorf("read value log %s error: %w", f.Name(), err)
+		}
+
+		keyLen, valueLen, _ := parseEntryHeader(header)
+
+		entry := make([]byte, valueLogEntryHeaderLen+keyLen+valueLen)
+		copy(entry, header)
+		_, err = io.ReadFull(reader, entry[valueLogEntryHeaderLen:])
+		if err != nil {
+			return fmt.Errorf("read value log %s error: %w", f.Name(), err)
+		}
+
+		vp := valuePointer{
+			fileID: f.id,
+			offset: offset,
+			length: int64(len(entry)),
+		}
+
+		// the value of an entry sealing the value alone is not opened without its pointer,
+		// which does not matter for its key
+		key, _, err := vl.decodeEntry(entry, vp)
+		if err != nil {
+			return fmt.Errorf("read value log %s error: %w", f.Name(), err)
+		}
+
+		err = fn(key, vp)
+		if err != nil {
+			return err
+		}
+
+		offset += vp.length
+	}
+
+	return nil
+}
+
+// staleFiles returns the files with entries not sealed by the current key, oldest first.
+// An active stale file is sealed to be rewritten as well.
+func (vl *valueLog) staleFiles() ([]*valueLogFile, error) {
+	vl.mu.Lock()
+	if vl.active.stale {
+		err := vl.rotate()
+		if err != nil {
+			vl.mu.Unlock()
+			return nil, err
+		}
+	}
+	vl.mu.Unlock()
+
+	res := make([]*valueLogFile, 0)
+	for _, f := range vl.sealed() {
+		if f.stale {
+			res = append(res, f)
+		}
+	}
+
+	return res, nil
+}
+
+// checkpoint links the sealed files into dir and copies the active one up to its current size.
+func (vl *valueLog) checkpoint(dir string) error {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	err := os.MkdirAll(dir, fileMode)
+	if err != nil {
+		return err
+	}
+
+	for id, f := range vl.files {
+		target := path.Join(dir, path.Base(f.Name()))
+
+		if id == vl.active.id {
+			err = utils.CopyFileN(f.Name(), target, f.size)
+		} else {
+			err = utils.LinkOrCopy(f.Name(), target)
+		}
+
+		if err != nil {
+			return fmt.Errorf("checkpoint value log %d error: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (vl *valueLog) remove(id int) error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	f, ok := vl.files[id]
+	if !ok || f == vl.active {
+		return nil
+	}
+
+	delete(vl.files, id)
+
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(f.Name())
+}
+
+func (vl *valueLog) sync() error {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	return vl.active.Sync()
+}
+
+func (vl *valueLog) close() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	for _, f := range vl.files {
+		f.Close()
+	}
+
+	return nil
+}
@@ -2,13 +2,23 @@ package segment
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
 	"github.com/ForeverSRC/kaeya/pkg/logger"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
 	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+	"github.com/ForeverSRC/kaeya/pkg/storage/compress"
+	"github.com/ForeverSRC/kaeya/pkg/storage/encryption"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment/mananger"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -17,14 +27,31 @@ const (
 	defaultRefreshInterval   = 1 * time.Second
 	defaultFlushInterval     = 15 * time.Second
 	defaultMergeInterval     = 30 * time.Second
+
+	defaultValueLogFileSize   = 64 << 20
+	defaultValueLogGCInterval = 10 * time.Minute
 )
 
+// ErrUnknownJob is returned by RunJob for a job the storage does not run.
+var ErrUnknownJob = errors.New("unknown storage job")
+
 type FSOpts struct {
 	refreshInterval time.Duration
 	flushInterval   time.Duration
 	mergeInterval   time.Duration
 	writeBufferSize int64
 	mergeFloor      int64
+
+	valueLogThreshold  int64
+	valueLogFileSize   int64
+	valueLogGCInterval time.Duration
+
+	compressor compress.Compressor
+	keyring    *encryption.Keyring
+
+	upgradeLegacy bool
+
+	ingestPrecedence mananger.Precedence
 }
 
 type Option func(opts *FSOpts)
@@ -59,15 +86,75 @@ func WithMergeFloor(size int64) Option {
 	}
 }
 
+// WithValueLogThreshold enables the value log for values larger than size.
+func WithValueLogThreshold(size int64) Option {
+	return func(opts *FSOpts) {
+		opts.valueLogThreshold = size
+	}
+}
+
+func WithValueLogFileSize(size int64) Option {
+	return func(opts *FSOpts) {
+		opts.valueLogFileSize = size
+	}
+}
+
+func WithValueLogGCInterval(interval time.Duration) Option {
+	return func(opts *FSOpts) {
+		opts.valueLogGCInterval = interval
+	}
+}
+
+// WithCompression compresses the blocks of new segment files by compressor.
+func WithCompression(compressor compress.Compressor) Option {
+	return func(opts *FSOpts) {
+		opts.compressor = compressor
+	}
+}
+
+// WithKeyring encrypts new segment files and the value log by the current key of keyring.
+func WithKeyring(keyring *encryption.Keyring) Option {
+	return func(opts *FSOpts) {
+		opts.keyring = keyring
+	}
+}
+
+// WithUpgradeLegacy rewrites the segment files in a legacy format on startup.
+func WithUpgradeLegacy() Option {
+	return func(opts *FSOpts) {
+		opts.upgradeLegacy = true
+	}
+}
+
+// WithIngestPrecedence sets whether ingested segment files win over the existing data
+// when the ingest does not say so. With PrecedenceOldest the tombstones are never dropped,
+// they must keep shadowing the ingested data.
+func WithIngestPrecedence(precedence mananger.Precedence) Option {
+	return func(opts *FSOpts) {
+		opts.ingestPrecedence = precedence
+	}
+}
+
 type SegmentFSRepository struct {
 	*FSOpts
 
 	segmentManager  mananger.Manager
 	segmentRootPath string
+	rootPath        string
+
+	unregisterMetrics func()
+
+	// reconfigureLock serializes the changes of the tunable options
+	reconfigureLock sync.Mutex
+
+	jobsLock     sync.Mutex
+	jobs         map[string]JobStatus
+	mergesPaused atomic.Bool
 
 	refreshTicker *time.Ticker
 	flushTicker   *time.Ticker
 	mergeTicker   *time.Ticker
+	gcTicker      *time.Ticker
 	stopCh        chan struct{}
 }
 
@@ -78,14 +165,21 @@ func NewDefaultSegmentFSRepository(codec codec2.Codec, rootPath string, options
 		mergeInterval:   defaultMergeInterval,
 		writeBufferSize: defaultSegmentBufferSize,
 		mergeFloor:      defaultMergeFloor,
+
+		valueLogFileSize:   defaultValueLogFileSize,
+		valueLogGCInterval: defaultValueLogGCInterval,
+
+		ingestPrecedence: mananger.PrecedenceNewest,
 	}
 
 	for _, op := range options {
 		op(opts)
 	}
 
-	segPath := path.Join(rootPath, "data", "segments")
-	segManager, err := mananger.NewSegmentManager(segPath, opts.writeBufferSize, opts.mergeFloor, codec)
+	managerOptions := opts.managerOptions(rootPath)
+
+	segPath := segmentPath(rootPath)
+	segManager, err := mananger.NewSegmentManager(segPath, opts.writeBufferSize, opts.mergeFloor, codec, managerOptions...)
 	if err != nil {
 		return nil, err
 	}
@@ -94,19 +188,129 @@ func NewDefaultSegmentFSRepository(codec codec2.Codec, rootPath string, options
 		FSOpts:          opts,
 		segmentManager:  segManager,
 		segmentRootPath: segPath,
+		rootPath:        rootPath,
 		refreshTicker:   time.NewTicker(opts.refreshInterval),
 		flushTicker:     time.NewTicker(opts.flushInterval),
 		mergeTicker:     time.NewTicker(opts.mergeInterval),
+		gcTicker:        time.NewTicker(opts.valueLogGCInterval),
 		stopCh:          make(chan struct{}),
+		jobs:            make(map[string]JobStatus),
+	}
+
+	if opts.valueLogThreshold <= 0 {
+		repo.gcTicker.Stop()
 	}
 
+	repo.unregisterMetrics = metrics.RegisterStorage(rootPath,
+		metrics.Gauge{Name: "segments", Help: "Live segment files.", Value: func() float64 {
+			return float64(repo.Stats().Segments)
+		}},
+		metrics.Gauge{Name: "disk_bytes", Help: "Size of the live segment files.", Value: func() float64 {
+			return float64(repo.Stats().DiskBytes)
+		}},
+		metrics.Gauge{Name: "write_buffer_bytes", Help: "Bytes written since the last refresh.", Value: func() float64 {
+			return float64(repo.Stats().WriteBufferBytes)
+		}},
+		metrics.Gauge{Name: "write_buffer_capacity_bytes", Help: "Size of the write buffer.", Value: func() float64 {
+			return float64(repo.Stats().WriteBufferCapacity)
+		}},
+	)
+
 	go repo.backgroundWorker()
 
 	return repo, nil
 }
 
-func (sr *SegmentFSRepository) Save(ctx context.Context, kv domain.KV) error {
-	err := sr.segmentManager.Write(kv)
+func segmentPath(rootPath string) string {
+	return path.Join(rootPath, "data", "segments")
+}
+
+func valueLogPath(rootPath string) string {
+	return path.Join(rootPath, "data", "vlog")
+}
+
+func (opts *FSOpts) managerOptions(rootPath string) []mananger.Option {
+	managerOptions := make([]mananger.Option, 0)
+	if opts.compressor != nil {
+		managerOptions = append(managerOptions, mananger.WithCompression(opts.compressor))
+	}
+
+	if opts.keyring != nil {
+		managerOptions = append(managerOptions, mananger.WithKeyring(opts.keyring))
+	}
+
+	if opts.upgradeLegacy {
+		managerOptions = append(managerOptions, mananger.WithUpgradeLegacy())
+	}
+
+	if opts.ingestPrecedence == mananger.PrecedenceOldest {
+		managerOptions = append(managerOptions, mananger.WithKeepTombstones())
+	}
+
+	if opts.valueLogThreshold > 0 {
+		managerOptions = append(managerOptions, mananger.WithValueLog(valueLogPath(rootPath), opts.valueLogThreshold, opts.valueLogFileSize))
+	}
+
+	return managerOptions
+}
+
+// Check validates the segment files under rootPath offline, see mananger.Check.
+func Check(codec codec2.Codec, rootPath string, repair bool, options ...Option) (*common.CheckReport, error) {
+	opts := &FSOpts{}
+	for _, op := range options {
+		op(opts)
+	}
+
+	return mananger.Check(segmentPath(rootPath), codec, repair, opts.managerOptions(rootPath)...)
+}
+
+// Inspect opens the segment files under rootPath read-only, see mananger.Inspect.
+func Inspect(codec codec2.Codec, rootPath string, options ...Option) (*mananger.Inspector, error) {
+	opts := &FSOpts{}
+	for _, op := range options {
+		op(opts)
+	}
+
+	return mananger.Inspect(segmentPath(rootPath), codec, opts.managerOptions(rootPath)...)
+}
+
+// BuildSegment writes the kvs of r into a segment file for Ingest, see mananger.BuildSegment.
+func BuildSegment(codec codec2.Codec, file string, r common.KVReader, options ...Option) (int, error) {
+	opts := &FSOpts{}
+	for _, op := range options {
+		op(opts)
+	}
+
+	return mananger.BuildSegment(file, codec, r, opts.managerOptions("")...)
+}
+
+// Ingest adds segment files built by BuildSegment, with the configured precedence
+// if precedence is empty, see mananger.DefaultManager.Ingest.
+func (sr *SegmentFSRepository) Ingest(ctx context.Context, files []string, precedence string) (int, error) {
+	p := sr.ingestPrecedence
+	if precedence != "" {
+		var err error
+		p, err = mananger.ParsePrecedence(precedence)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return sr.segmentManager.Ingest(files, p)
+}
+
+// Checkpoint makes a consistent snapshot of the data files in dir, laid out like rootPath.
+func (sr *SegmentFSRepository) Checkpoint(ctx context.Context, dir string) error {
+	return sr.segmentManager.Checkpoint(segmentPath(dir), valueLogPath(dir))
+}
+
+func (sr *SegmentFSRepository) Save(ctx context.Context, kv domain.KV) (err error) {
+	_, span := tracing.Start(ctx, "SegmentFSRepository.Save")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	err = sr.segmentManager.Write(kv)
 	if err != nil {
 		return err
 	}
@@ -114,25 +318,60 @@ func (sr *SegmentFSRepository) Save(ctx context.Context, kv domain.KV) error {
 	return nil
 }
 
+// Scan calls fn with the newest version of every key starting with prefix, see mananger.DefaultManager.Scan.
+func (sr *SegmentFSRepository) Scan(ctx context.Context, prefix string, fn func(kv domain.KV) error) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentFSRepository.Scan")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return sr.segmentManager.Scan(ctx, prefix, fn)
+}
+
+// Refresh writes the buffered writes into a segment now, they are not visible before.
+func (sr *SegmentFSRepository) Refresh(ctx context.Context) error {
+	return sr.segmentManager.Refresh()
+}
+
+// Import bulk loads the kvs of r into new segments, see mananger.DefaultManager.Import.
+func (sr *SegmentFSRepository) Import(ctx context.Context, r common.KVReader) (n int, err error) {
+	_, span := tracing.Start(ctx, "SegmentFSRepository.Import")
+	defer func() {
+		span.SetAttributes(attribute.Int("kaeya.imported", n))
+		tracing.End(span, err)
+	}()
+
+	return sr.segmentManager.Import(r)
+}
+
 func (sr *SegmentFSRepository) backgroundWorker() {
 	for {
 		select {
 		case <-sr.refreshTicker.C:
-			err := sr.segmentManager.Refresh()
+			_, err := sr.runJob(metrics.JobRefresh)
 			if err != nil {
 				logger.Logger.Error().Err(err).Msg("background refresh error")
 			}
 
 		case <-sr.flushTicker.C:
-			err := sr.segmentManager.Flush()
+			_, err := sr.runJob(metrics.JobFlush)
 			if err != nil {
 				logger.Logger.Error().Err(err).Msg("background flush error")
 			}
 		case <-sr.mergeTicker.C:
-			err := sr.segmentManager.Merge()
+			if sr.mergesPaused.Load() {
+				continue
+			}
+
+			_, err := sr.runJob(metrics.JobMerge)
 			if err != nil {
 				logger.Logger.Error().Err(err).Msg("background merge error")
 			}
+		case <-sr.gcTicker.C:
+			_, err := sr.runJob(metrics.JobValueLogGC)
+			if err != nil {
+				logger.Logger.Error().Err(err).Msg("background value log gc error")
+			}
 
 		case <-sr.stopCh:
 			return
@@ -140,11 +379,160 @@ func (sr *SegmentFSRepository) backgroundWorker() {
 	}
 }
 
-func (sr *SegmentFSRepository) Load(ctx context.Context, key string) (domain.KV, error) {
-	return sr.segmentManager.Read(key)
+// JobStatus is the outcome of a run of a background job, merges and compactions
+// report the segments left and the disk space freed.
+type JobStatus struct {
+	Job            string    `json:"job"`
+	Last           time.Time `json:"last"`
+	Duration       string    `json:"duration"`
+	Segments       int       `json:"segments,omitempty"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// RunJob runs a background job now, even while the merges are paused. The job is a
+// metrics job name, or metrics.JobCompact to rewrite all segments into one.
+func (sr *SegmentFSRepository) RunJob(job string) (JobStatus, error) {
+	return sr.runJob(job)
+}
+
+// runJob runs a job and records its duration and result.
+func (sr *SegmentFSRepository) runJob(job string) (JobStatus, error) {
+	var fn func() error
+	switch job {
+	case metrics.JobRefresh:
+		fn = sr.segmentManager.Refresh
+	case metrics.JobFlush:
+		fn = sr.segmentManager.Flush
+	case metrics.JobMerge:
+		fn = sr.segmentManager.Merge
+	case metrics.JobCompact:
+		fn = sr.segmentManager.Compact
+	case metrics.JobValueLogGC:
+		fn = sr.segmentManager.ValueLogGC
+	default:
+		return JobStatus{}, fmt.Errorf("%s: %w", job, ErrUnknownJob)
+	}
+
+	rewrites := job == metrics.JobMerge || job == metrics.JobCompact
+
+	var reclaimed int64
+	if rewrites {
+		reclaimed = sr.segmentManager.Stats().ReclaimedBytes
+	}
+
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+	metrics.ObserveJob(sr.rootPath, job, d, err)
+
+	status := JobStatus{Job: job, Last: start, Duration: d.String()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	if rewrites {
+		stats := sr.segmentManager.Stats()
+		status.Segments, status.ReclaimedBytes = stats.Segments, stats.ReclaimedBytes-reclaimed
+		if err == nil && status.ReclaimedBytes > 0 {
+			metrics.ObserveMergeReclaimed(sr.rootPath, status.ReclaimedBytes)
+		}
+	}
+
+	sr.jobsLock.Lock()
+	sr.jobs[job] = status
+	sr.jobsLock.Unlock()
+
+	return status, err
+}
+
+// Reconfigure applies the refresh, flush and merge intervals and the merge floor of options
+// live, the ones left out get their defaults back. Other options need a new repository.
+func (sr *SegmentFSRepository) Reconfigure(options ...Option) {
+	sr.reconfigureLock.Lock()
+	defer sr.reconfigureLock.Unlock()
+
+	opts := &FSOpts{
+		refreshInterval: defaultRefreshInterval,
+		flushInterval:   defaultFlushInterval,
+		mergeInterval:   defaultMergeInterval,
+		mergeFloor:      defaultMergeFloor,
+	}
+	for _, op := range options {
+		op(opts)
+	}
+
+	for _, t := range []struct {
+		name    string
+		ticker  *time.Ticker
+		current *time.Duration
+		next    time.Duration
+	}{
+		{"refresh", sr.refreshTicker, &sr.refreshInterval, opts.refreshInterval},
+		{"flush", sr.flushTicker, &sr.flushInterval, opts.flushInterval},
+		{"merge", sr.mergeTicker, &sr.mergeInterval, opts.mergeInterval},
+	} {
+		if *t.current == t.next {
+			continue
+		}
+
+		t.ticker.Reset(t.next)
+		logger.Logger.Info().Str("path", sr.rootPath).Str("from", t.current.String()).Str("to", t.next.String()).
+			Msgf("%s interval changed", t.name)
+		*t.current = t.next
+	}
+
+	if sr.mergeFloor != opts.mergeFloor {
+		sr.segmentManager.SetMergeFloor(opts.mergeFloor)
+		logger.Logger.Info().Str("path", sr.rootPath).Int64("from", sr.mergeFloor).Int64("to", opts.mergeFloor).
+			Msg("merge floor changed")
+		sr.mergeFloor = opts.mergeFloor
+	}
+}
+
+// PauseMerges stops or restarts the background merges, a merge in progress completes.
+func (sr *SegmentFSRepository) PauseMerges(paused bool) {
+	sr.mergesPaused.Store(paused)
+}
+
+func (sr *SegmentFSRepository) MergesPaused() bool {
+	return sr.mergesPaused.Load()
+}
+
+// Jobs returns the last run of every background job which has run, by metrics job name.
+func (sr *SegmentFSRepository) Jobs() map[string]JobStatus {
+	sr.jobsLock.Lock()
+	defer sr.jobsLock.Unlock()
+
+	res := make(map[string]JobStatus, len(sr.jobs))
+	for job, status := range sr.jobs {
+		res[job] = status
+	}
+
+	return res
+}
+
+// Segments describes the live segments from the newest to the oldest.
+func (sr *SegmentFSRepository) Segments() []mananger.SegmentInfo {
+	return sr.segmentManager.Segments()
+}
+
+func (sr *SegmentFSRepository) Load(ctx context.Context, key string) (kv domain.KV, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentFSRepository.Load")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	return sr.segmentManager.Read(ctx, key)
+}
+
+// Stats reports the segments of the repository, including the achieved compression ratio.
+func (sr *SegmentFSRepository) Stats() mananger.Stats {
+	return sr.segmentManager.Stats()
 }
 
 func (sr *SegmentFSRepository) Close(ctx context.Context) error {
 	sr.stopCh <- struct{}{}
+	sr.unregisterMetrics()
 	return sr.segmentManager.Close()
 }
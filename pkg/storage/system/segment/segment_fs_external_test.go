@@ -2,12 +2,15 @@ package segment_test
 
 import (
 	"context"
+	"fmt"
 	"path"
 	"testing"
 	"time"
 
 	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/metrics"
 	codec2 "github.com/ForeverSRC/kaeya/pkg/storage/codec"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/fs"
 	"github.com/ForeverSRC/kaeya/pkg/storage/system/segment"
 	"github.com/ForeverSRC/kaeya/pkg/utils"
@@ -47,22 +50,22 @@ func TestSegmentFile(t *testing.T) {
 	commands := []command{
 		{
 			op:        opGet,
-			kv:        domain.KV{"aaa", "1"},
-			expect:    domain.KV{"aaa", ""},
+			kv:        domain.KV{Key: "aaa", Value: []byte("1")},
+			expect:    domain.KV{Key: "aaa"},
 			expectErr: fs.ErrNull,
 		},
 		{
 			op: opSet,
-			kv: domain.KV{"aaa", "1"},
+			kv: domain.KV{Key: "aaa", Value: []byte("1")},
 		},
 		{
 			op: opSet,
-			kv: domain.KV{"bb", "100"},
+			kv: domain.KV{Key: "bb", Value: []byte("100")},
 		},
 		{
 			op:        opGet,
-			kv:        domain.KV{"aaa", "1"},
-			expect:    domain.KV{"aaa", ""},
+			kv:        domain.KV{Key: "aaa", Value: []byte("1")},
+			expect:    domain.KV{Key: "aaa"},
 			expectErr: fs.ErrNull,
 		},
 		{
@@ -71,17 +74,17 @@ func TestSegmentFile(t *testing.T) {
 		},
 		{
 			op:     opGet,
-			kv:     domain.KV{"aaa", "1"},
-			expect: domain.KV{"aaa", "1"},
+			kv:     domain.KV{Key: "aaa", Value: []byte("1")},
+			expect: domain.KV{Key: "aaa", Value: []byte("1")},
 		},
 		{
 			op: opSet,
-			kv: domain.KV{"aaa", "2"},
+			kv: domain.KV{Key: "aaa", Value: []byte("2")},
 		},
 		{
 			op:     opGet,
-			kv:     domain.KV{"aaa", "1"},
-			expect: domain.KV{"aaa", "1"},
+			kv:     domain.KV{Key: "aaa", Value: []byte("1")},
+			expect: domain.KV{Key: "aaa", Value: []byte("1")},
 		},
 		{
 			op:       opSleep,
@@ -89,13 +92,13 @@ func TestSegmentFile(t *testing.T) {
 		},
 		{
 			op:     opGet,
-			kv:     domain.KV{"aaa", "2"},
-			expect: domain.KV{"aaa", "2"},
+			kv:     domain.KV{Key: "aaa", Value: []byte("2")},
+			expect: domain.KV{Key: "aaa", Value: []byte("2")},
 		},
 		{
 			op:     opGet,
-			kv:     domain.KV{"bb", "100"},
-			expect: domain.KV{"bb", "100"},
+			kv:     domain.KV{Key: "bb", Value: []byte("100")},
+			expect: domain.KV{Key: "bb", Value: []byte("100")},
 		},
 	}
 
@@ -120,3 +123,124 @@ func TestSegmentFile(t *testing.T) {
 	segmentFS.Close(ctx)
 
 }
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+
+	segmentFS, err := segment.NewDefaultSegmentFSRepository(
+		codec2.NewStringCodec(),
+		path.Join("testdata", "dynamic", "segment-test", utils.ID()),
+		segment.WithRefreshInterval(20*time.Millisecond),
+		segment.WithFlushInterval(20*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	defer segmentFS.Close(ctx)
+
+	assert.Empty(t, segmentFS.Segments())
+
+	assert.NoError(t, segmentFS.Save(ctx, domain.KV{Key: "aaa", Value: []byte("1")}))
+	assert.Eventually(t, func() bool {
+		jobs := segmentFS.Jobs()
+		return len(segmentFS.Segments()) == 1 && !jobs[metrics.JobRefresh].Last.IsZero() && !jobs[metrics.JobFlush].Last.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s := segmentFS.Segments()[0]
+	assert.NotZero(t, s.Size)
+	assert.Equal(t, 1, s.Records)
+	assert.Equal(t, "aaa", s.MinKey)
+
+	jobs := segmentFS.Jobs()
+	assert.Empty(t, jobs[metrics.JobRefresh].Error)
+	assert.NotEmpty(t, jobs[metrics.JobRefresh].Duration)
+	_, merged := jobs[metrics.JobMerge]
+	assert.False(t, merged)
+}
+
+func TestRunJob(t *testing.T) {
+	ctx := context.Background()
+
+	segmentFS, err := segment.NewDefaultSegmentFSRepository(
+		codec2.NewBinaryCodec(),
+		path.Join("testdata", "dynamic", "segment-test", utils.ID()),
+		segment.WithRefreshInterval(time.Hour),
+		segment.WithMergeInterval(10*time.Millisecond),
+		segment.WithMergeFloor(1<<20),
+	)
+	assert.NoError(t, err)
+	defer segmentFS.Close(ctx)
+
+	segmentFS.PauseMerges(true)
+	assert.True(t, segmentFS.MergesPaused())
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, segmentFS.Save(ctx, domain.KV{Key: "aaa", Value: []byte(fmt.Sprint(i))}))
+		assert.NoError(t, segmentFS.Save(ctx, domain.KV{Key: fmt.Sprintf("k%d", i), Value: []byte("v")}))
+
+		status, err := segmentFS.RunJob(metrics.JobRefresh)
+		assert.NoError(t, err)
+		assert.Equal(t, metrics.JobRefresh, status.Job)
+		assert.NotEmpty(t, status.Duration)
+	}
+	assert.NoError(t, segmentFS.Save(ctx, domain.Tombstone("k0")))
+
+	// paused merges leave the segments alone
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, segmentFS.Segments(), 3)
+
+	status, err := segmentFS.RunJob(metrics.JobCompact)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, status.Segments)
+	assert.Positive(t, status.ReclaimedBytes)
+	assert.Len(t, segmentFS.Segments(), 1)
+
+	kv, err := segmentFS.Load(ctx, "aaa")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(kv.Value))
+
+	// nothing older is left for the tombstone to shadow
+	_, err = segmentFS.Load(ctx, "k0")
+	assert.ErrorIs(t, err, common.ErrNotFound)
+
+	_, err = segmentFS.RunJob("vacuum")
+	assert.ErrorIs(t, err, segment.ErrUnknownJob)
+
+	assert.Contains(t, segmentFS.Jobs(), metrics.JobCompact)
+	_, merged := segmentFS.Jobs()[metrics.JobMerge]
+	assert.False(t, merged)
+}
+
+func TestReconfigure(t *testing.T) {
+	ctx := context.Background()
+
+	segmentFS, err := segment.NewDefaultSegmentFSRepository(
+		codec2.NewBinaryCodec(),
+		path.Join("testdata", "dynamic", "segment-test", utils.ID()),
+		segment.WithRefreshInterval(time.Hour),
+		segment.WithMergeInterval(10*time.Millisecond),
+		segment.WithMergeFloor(1),
+	)
+	assert.NoError(t, err)
+	defer segmentFS.Close(ctx)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, segmentFS.Save(ctx, domain.KV{Key: fmt.Sprintf("k%d", i), Value: []byte("v")}))
+		_, err := segmentFS.RunJob(metrics.JobRefresh)
+		assert.NoError(t, err)
+	}
+
+	// every segment is above the merge floor
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, segmentFS.Segments(), 3)
+
+	segmentFS.Reconfigure(segment.WithMergeInterval(10*time.Millisecond), segment.WithMergeFloor(1<<20))
+	assert.Eventually(t, func() bool {
+		return len(segmentFS.Segments()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the refresh interval left out is back to its default of a second
+	assert.NoError(t, segmentFS.Save(ctx, domain.KV{Key: "k3", Value: []byte("v")}))
+	assert.Eventually(t, func() bool {
+		_, err := segmentFS.Load(ctx, "k3")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,305 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/common"
+)
+
+type Format string
+
+const (
+	// FormatJSONL is one json object per line.
+	FormatJSONL Format = "jsonl"
+	// FormatCSV has a header line followed by one line per kv.
+	FormatCSV Format = "csv"
+
+	EncodingBase64 = "base64"
+
+	maxLineSize = 64 << 20
+)
+
+var (
+	ErrFormat        = errors.New("invalid export data")
+	ErrUnknownFormat = errors.New("unknown export format")
+
+	csvHeader = []string{"key", "value", "encoding", "content_type", "flags"}
+)
+
+// Record is the exported form of a kv. Values which are not valid utf-8 are base64 encoded.
+type Record struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Flags       uint32 `json:"flags,omitempty"`
+}
+
+func NewRecord(kv domain.KV) Record {
+	res := Record{
+		Key:         kv.Key,
+		ContentType: kv.ContentType,
+		Flags:       kv.Flags,
+	}
+
+	if utf8.Valid(kv.Value) {
+		res.Value = string(kv.Value)
+	} else {
+		res.Value = base64.StdEncoding.EncodeToString(kv.Value)
+		res.Encoding = EncodingBase64
+	}
+
+	return res
+}
+
+// KV converts the record back, only user flags are accepted.
+func (r Record) KV() (domain.KV, error) {
+	kv := domain.KV{
+		Key:         r.Key,
+		Value:       []byte(r.Value),
+		ContentType: r.ContentType,
+		Flags:       r.Flags,
+	}
+
+	if kv.Key == "" {
+		return kv, fmt.Errorf("empty key: %w", ErrFormat)
+	}
+
+	if kv.Flags&domain.FlagsReserved != 0 {
+		return kv, fmt.Errorf("key %s: reserved flags set: %w", kv.Key, ErrFormat)
+	}
+
+	switch r.Encoding {
+	case "":
+	case EncodingBase64:
+		value, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return kv, fmt.Errorf("key %s: %s: %w", kv.Key, err.Error(), ErrFormat)
+		}
+		kv.Value = value
+	default:
+		return kv, fmt.Errorf("key %s: unknown encoding %s: %w", kv.Key, r.Encoding, ErrFormat)
+	}
+
+	return kv, nil
+}
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatJSONL, FormatCSV:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("%s: %w", s, ErrUnknownFormat)
+	}
+}
+
+// ContentType is the http content type of the format.
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv"
+	}
+
+	return "application/x-ndjson"
+}
+
+// Writer writes kvs in an export format, Flush must be called after the last one.
+type Writer interface {
+	Write(kv domain.KV) error
+	Flush() error
+}
+
+func NewWriter(format Format, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", format, ErrUnknownFormat)
+	}
+}
+
+// NewReader reads kvs written in format, for a bulk import.
+func NewReader(format Format, r io.Reader) (common.KVReader, error) {
+	switch format {
+	case FormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+		return &jsonlReader{scanner: scanner}, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		return &csvReader{r: cr}, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", format, ErrUnknownFormat)
+	}
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(kv domain.KV) error {
+	return w.enc.Encode(NewRecord(kv))
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *jsonlReader) Read() (domain.KV, error) {
+	for r.scanner.Scan() {
+		r.line++
+
+		data := r.scanner.Bytes()
+		if len(data) == 0 {
+			continue
+		}
+
+		var rec Record
+		err := json.Unmarshal(data, &rec)
+		if err != nil {
+			return domain.KV{}, fmt.Errorf("line %d: %s: %w", r.line, err.Error(), ErrFormat)
+		}
+
+		kv, err := rec.KV()
+		if err != nil {
+			return kv, fmt.Errorf("line %d: %w", r.line, err)
+		}
+
+		return kv, nil
+	}
+
+	err := r.scanner.Err()
+	if err != nil {
+		return domain.KV{}, err
+	}
+
+	return domain.KV{}, io.EOF
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (w *csvWriter) Write(kv domain.KV) error {
+	if !w.wroteHeader {
+		err := w.w.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	rec := NewRecord(kv)
+
+	flags := ""
+	if rec.Flags != 0 {
+		flags = strconv.FormatUint(uint64(rec.Flags), 10)
+	}
+
+	return w.w.Write([]string{rec.Key, rec.Value, rec.Encoding, rec.ContentType, flags})
+}
+
+func (w *csvWriter) Flush() error {
+	if !w.wroteHeader {
+		err := w.w.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+type csvReader struct {
+	r          *csv.Reader
+	readHeader bool
+}
+
+func (r *csvReader) Read() (domain.KV, error) {
+	for {
+		fields, err := r.r.Read()
+		if err == io.EOF {
+			return domain.KV{}, io.EOF
+		}
+		if err != nil {
+			return domain.KV{}, fmt.Errorf("%s: %w", err.Error(), ErrFormat)
+		}
+
+		line, _ := r.r.FieldPos(0)
+
+		if !r.readHeader {
+			r.readHeader = true
+			if len(fields) > 0 && fields[0] == csvHeader[0] {
+				continue
+			}
+		}
+
+		if len(fields) < 2 || len(fields) > len(csvHeader) {
+			return domain.KV{}, fmt.Errorf("line %d: %d fields: %w", line, len(fields), ErrFormat)
+		}
+
+		rec := Record{Key: fields[0], Value: fields[1]}
+		if len(fields) > 2 {
+			rec.Encoding = fields[2]
+		}
+		if len(fields) > 3 {
+			rec.ContentType = fields[3]
+		}
+		if len(fields) > 4 && fields[4] != "" {
+			flags, err := strconv.ParseUint(fields[4], 10, 32)
+			if err != nil {
+				return domain.KV{}, fmt.Errorf("line %d: invalid flags: %w", line, ErrFormat)
+			}
+			rec.Flags = uint32(flags)
+		}
+
+		kv, err := rec.KV()
+		if err != nil {
+			return kv, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		return kv, nil
+	}
+}
+
+// Export writes every kv yielded by scan in format into w and returns their number.
+func Export(format Format, w io.Writer, scan func(fn func(kv domain.KV) error) error) (int, error) {
+	ew, err := NewWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = scan(func(kv domain.KV) error {
+		count++
+		return ew.Write(kv)
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, ew.Flush()
+}
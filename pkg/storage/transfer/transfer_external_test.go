@@ -0,0 +1,80 @@
+package transfer_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ForeverSRC/kaeya/pkg/domain"
+	"github.com/ForeverSRC/kaeya/pkg/storage/transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	kvs := []domain.KV{
+		{Key: "a", Value: []byte("plain, with \"quotes\"\nand lines")},
+		{Key: "b", Value: []byte{0xff, 0x00, 0x01}, ContentType: "application/octet-stream"},
+		{Key: "c", Value: []byte{}, Flags: 7},
+	}
+
+	for _, format := range []transfer.Format{transfer.FormatJSONL, transfer.FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+
+			n, err := transfer.Export(format, buffer, func(fn func(kv domain.KV) error) error {
+				for _, kv := range kvs {
+					if err := fn(kv); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, len(kvs), n)
+
+			r, err := transfer.NewReader(format, buffer)
+			assert.NoError(t, err)
+
+			for _, expected := range kvs {
+				kv, err := r.Read()
+				assert.NoError(t, err)
+				assert.Equal(t, expected.Key, kv.Key)
+				assert.Equal(t, string(expected.Value), string(kv.Value))
+				assert.Equal(t, expected.ContentType, kv.ContentType)
+				assert.Equal(t, expected.Flags, kv.Flags)
+			}
+
+			_, err = r.Read()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+	cases := []struct {
+		name   string
+		format transfer.Format
+		input  string
+	}{
+		{name: "jsonl syntax", format: transfer.FormatJSONL, input: `{"key":`},
+		{name: "jsonl empty key", format: transfer.FormatJSONL, input: `{"value":"1"}`},
+		{name: "jsonl reserved flags", format: transfer.FormatJSONL, input: `{"key":"a","value":"1","flags":16777216}`},
+		{name: "jsonl encoding", format: transfer.FormatJSONL, input: `{"key":"a","value":"!","encoding":"base64"}`},
+		{name: "csv flags", format: transfer.FormatCSV, input: "key,value,encoding,content_type,flags\na,1,,,x\n"},
+		{name: "csv fields", format: transfer.FormatCSV, input: "a,1,,,,extra\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := transfer.NewReader(c.format, strings.NewReader(c.input))
+			assert.NoError(t, err)
+
+			_, err = r.Read()
+			assert.ErrorIs(t, err, transfer.ErrFormat)
+		})
+	}
+
+	_, err := transfer.ParseFormat("xml")
+	assert.ErrorIs(t, err, transfer.ErrUnknownFormat)
+}
@@ -0,0 +1,86 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForeverSRC/kaeya/pkg/api/rest"
+	"github.com/ForeverSRC/kaeya/pkg/application"
+	"github.com/ForeverSRC/kaeya/pkg/config"
+	"github.com/ForeverSRC/kaeya/pkg/tracing"
+	"github.com/ForeverSRC/kaeya/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestTracing(t *testing.T) {
+	shutdown, err := tracing.Setup(config.TracingConfig{})
+	assert.NoError(t, err)
+	defer shutdown(context.Background())
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	app, err := application.NewApplication(config.KaeyaConfig{
+		Storage: config.StorageConfig{
+			Path:    path.Join("testdata", "dynamic", utils.ID()),
+			System:  "segment",
+			Codec:   "binary",
+			Segment: config.SegmentSysConfig{RefreshInterval: "10ms"},
+		},
+	})
+	assert.NoError(t, err)
+	defer app.Close(context.Background())
+
+	router := rest.Route(app)
+	serve := func(method, url, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/kv/a", "1"))
+	assert.Eventually(t, func() bool {
+		return serve(http.MethodGet, "/kv/a", "") == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		// the last one of a name, the get which found the key
+		spans[s.Name()] = s
+	}
+
+	chain := []string{"GET /kv/:key", "DBService.Get", "SegmentFSRepository.Load", "DefaultManager.Read"}
+	for i, name := range chain {
+		s, ok := spans[name]
+		if !assert.True(t, ok, name) {
+			return
+		}
+
+		assert.Equal(t, traceID, s.SpanContext().TraceID().String())
+		if i > 0 {
+			assert.Equal(t, spans[chain[i-1]].SpanContext().SpanID(), s.Parent().SpanID(), name)
+		}
+	}
+
+	attributes := make(map[string]int64)
+	for _, a := range spans["DefaultManager.Read"].Attributes() {
+		attributes[string(a.Key)] = a.Value.AsInt64()
+	}
+	assert.Equal(t, int64(1), attributes["kaeya.segments_scanned"])
+	assert.NotZero(t, attributes["kaeya.bytes_read"])
+
+	_, ok := spans["SegmentFSRepository.Save"]
+	assert.True(t, ok)
+}
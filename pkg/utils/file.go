@@ -1,6 +1,11 @@
 package utils
 
-import "os"
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
 
 func PathExists(path string) bool {
 	_, err := os.Stat(path)
@@ -10,3 +15,68 @@ func PathExists(path string) bool {
 	return true
 }
 
+// CopyDir copies the regular files under src into dst, keeping their relative paths.
+func CopyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0754)
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	return CopyFileN(src, dst, -1)
+}
+
+// CopyFileN copies the first n bytes of src into dst, the whole file if n is negative.
+func CopyFileN(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0754)
+	if err != nil {
+		return err
+	}
+
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// LinkOrCopy hard links src to dst, or copies it if they are on different file systems.
+func LinkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst)
+}